@@ -0,0 +1,69 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnstest builds DNS responses for tests.  Names must be fully
+// qualified, and invalid input panics.
+package dnstest
+
+import (
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Response returns a DNS response to an A query for `name`, with the specified
+// answers.
+func Response(name string, answers ...dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers:   answers,
+	}
+	for i := range msg.Answers {
+		msg.Answers[i].Header.Class = dnsmessage.ClassINET
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// A returns an answer that resolves `name` to the IPv4 address `ip`.
+func A(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a dnsmessage.AResource
+	copy(a.A[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), TTL: ttl},
+		Body:   &a,
+	}
+}
+
+// AAAA returns an answer that resolves `name` to the IPv6 address `ip`.
+func AAAA(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var aaaa dnsmessage.AAAAResource
+	copy(aaaa.AAAA[:], net.ParseIP(ip))
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), TTL: ttl},
+		Body:   &aaaa,
+	}
+}
+
+// CNAME returns an answer that aliases `name` to `target`.
+func CNAME(name string, ttl uint32, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), TTL: ttl},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
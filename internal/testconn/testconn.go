@@ -0,0 +1,67 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testconn provides fake go-tun2socks connections for testing handlers
+// without a TUN device.
+package testconn
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// TCPConn is a core.TCPConn backed by one end of a net.Pipe.
+type TCPConn struct {
+	core.TCPConn
+	Conn  net.Conn
+	Local *net.TCPAddr
+}
+
+func (c *TCPConn) LocalAddr() net.Addr                { return c.Local }
+func (c *TCPConn) Read(b []byte) (int, error)         { return c.Conn.Read(b) }
+func (c *TCPConn) Write(b []byte) (int, error)        { return c.Conn.Write(b) }
+func (c *TCPConn) Close() error                       { return c.Conn.Close() }
+func (c *TCPConn) CloseRead() error                   { return nil }
+func (c *TCPConn) CloseWrite() error                  { return c.Conn.Close() }
+func (c *TCPConn) Abort()                             { c.Conn.Close() }
+func (c *TCPConn) SetDeadline(t time.Time) error      { return c.Conn.SetDeadline(t) }
+func (c *TCPConn) SetReadDeadline(t time.Time) error  { return c.Conn.SetReadDeadline(t) }
+func (c *TCPConn) SetWriteDeadline(t time.Time) error { return c.Conn.SetWriteDeadline(t) }
+
+// UDPConn is a core.UDPConn that records the packets written to the TUN device
+// in Packets.  If Packets is nil, the packets are discarded.
+type UDPConn struct {
+	core.UDPConn
+	Local   *net.UDPAddr
+	Packets chan []byte
+	closed  int32 // Accessed atomically, because handlers close sockets on their own goroutines.
+}
+
+func (c *UDPConn) LocalAddr() *net.UDPAddr { return c.Local }
+func (c *UDPConn) WriteFrom(b []byte, addr *net.UDPAddr) (int, error) {
+	if c.Packets != nil {
+		c.Packets <- append([]byte{}, b...)
+	}
+	return len(b), nil
+}
+func (c *UDPConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+// Closed returns true if Close has been called.
+func (c *UDPConn) Closed() bool { return atomic.LoadInt32(&c.closed) != 0 }
@@ -15,10 +15,15 @@
 package tun2socks
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"net"
 	"runtime/debug"
+	"syscall"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks/config"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
@@ -34,6 +39,18 @@ type OutlineTunnel interface {
 	tunnel.OutlineTunnel
 }
 
+// HealthListener embeds the tunnel.HealthListener interface so it gets exported by gobind.
+type HealthListener interface {
+	tunnel.HealthListener
+}
+
+// SocketProtector excludes sockets from the VPN.
+type SocketProtector interface {
+	// Protect excludes a socket from the VPN, so that connections that bypass the proxy do not
+	// loop back into the tunnel.  This is a wrapper for Android's VpnService.protect().
+	Protect(socket int32) bool
+}
+
 // ConnectShadowsocksTunnel reads packets from a TUN device and routes it to a Shadowsocks proxy server.
 // Returns an OutlineTunnel instance and does *not* take ownership of the TUN file descriptor; the
 // caller is responsible for closing after OutlineTunnel disconnects.
@@ -45,20 +62,79 @@ type OutlineTunnel interface {
 // `cipher` is the encryption cipher the Shadowsocks proxy.
 // `isUDPEnabled` indicates whether the tunnel and/or network enable UDP proxying.
 //
+// The tunnel cannot connect sockets directly, so bypass rules can only proxy or block them.  See
+// ConnectShadowsocksTunnelWithBypass.
+//
 // Throws an exception if the TUN file descriptor cannot be opened, or if the tunnel fails to
 // connect.
 func ConnectShadowsocksTunnel(fd int, host string, port int, password, cipher string, isUDPEnabled bool) (OutlineTunnel, error) {
 	if port <= 0 || port > math.MaxUint16 {
 		return nil, fmt.Errorf("Invalid port number: %v", port)
 	}
+	server := shadowsocks.Server{Host: host, Port: port, Password: password, Cipher: cipher}
+	return connectShadowsocksTunnel(fd, server, isUDPEnabled, nil)
+}
+
+func connectShadowsocksTunnel(fd int, server shadowsocks.Server, isUDPEnabled bool, protector SocketProtector) (OutlineTunnel, error) {
 	tun, err := tunnel.MakeTunFile(fd)
 	if err != nil {
 		return nil, err
 	}
-	t, err := tunnel.NewOutlineTunnel(host, port, password, cipher, isUDPEnabled, tun)
+	var dialer *net.Dialer
+	var config *net.ListenConfig
+	if protector != nil {
+		control := protectControl(protector)
+		dialer, config = &net.Dialer{Control: control}, &net.ListenConfig{Control: control}
+	}
+	t, err := tunnel.NewOutlineTunnel(server, isUDPEnabled, tun, dialer, config)
 	if err != nil {
 		return nil, err
 	}
 	go tunnel.ProcessInputPackets(t, tun)
 	return t, nil
 }
+
+// Returns a socket control function that excludes the socket from the VPN.
+func protectControl(p SocketProtector) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		protected := false
+		if err := c.Control(func(fd uintptr) { protected = p.Protect(int32(fd)) }); err != nil {
+			return err
+		}
+		if !protected {
+			return fmt.Errorf("Failed to protect a %s socket", network)
+		}
+		return nil
+	}
+}
+
+// ConnectShadowsocksTunnelWithAccessKey is like ConnectShadowsocksTunnel, but takes the proxy's
+// configuration from an ss:// access key, in the SIP002 or legacy format.  The access key may
+// specify a prefix for TCP streams, and the built-in simple-obfs plugin ("obfs-local").
+//
+// Fails if the access key is malformed, or requires another plugin.
+func ConnectShadowsocksTunnelWithAccessKey(fd int, accessKey string, isUDPEnabled bool) (OutlineTunnel, error) {
+	return ConnectShadowsocksTunnelWithBypass(fd, accessKey, isUDPEnabled, nil)
+}
+
+// ConnectShadowsocksTunnelWithBypass is like ConnectShadowsocksTunnelWithAccessKey, but
+// `protector` excludes the sockets of connections that bypass the proxy from the VPN, so that
+// bypass rules can connect them directly.  `protector` may be nil.
+func ConnectShadowsocksTunnelWithBypass(fd int, accessKey string, isUDPEnabled bool, protector SocketProtector) (OutlineTunnel, error) {
+	server, err := config.ParseAccessKey(accessKey)
+	if err != nil {
+		return nil, err
+	}
+	return connectShadowsocksTunnel(fd, server, isUDPEnabled, protector)
+}
+
+// ParseOnlineConfig validates a SIP008 online config document, and returns its servers as a
+// JSON array for OutlineTunnel.SetServers.
+func ParseOnlineConfig(doc string) (string, error) {
+	servers, err := config.ParseOnlineConfig([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(servers)
+	return string(b), err
+}
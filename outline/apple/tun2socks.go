@@ -15,13 +15,17 @@
 package tun2socks
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"runtime/debug"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks/config"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
 )
 
@@ -30,6 +34,11 @@ type OutlineTunnel interface {
 	tunnel.OutlineTunnel
 }
 
+// HealthListener embeds the tunnel.HealthListener interface so it gets exported by gobind.
+type HealthListener interface {
+	tunnel.HealthListener
+}
+
 // TunWriter is an interface that allows for outputting packets to the TUN (VPN).
 type TunWriter interface {
 	io.WriteCloser
@@ -59,6 +68,9 @@ func init() {
 // `cipher` is the encryption cipher the Shadowsocks proxy.
 // `isUDPEnabled` indicates whether the tunnel and/or network enable UDP proxying.
 //
+// Connections that bypass the proxy use the extension's own sockets, which the system does not
+// route through the VPN.
+//
 // Sets an error if the tunnel fails to connect.
 func ConnectShadowsocksTunnel(tunWriter TunWriter, host string, port int, password, cipher string, isUDPEnabled bool) (OutlineTunnel, error) {
 	if tunWriter == nil {
@@ -66,5 +78,33 @@ func ConnectShadowsocksTunnel(tunWriter TunWriter, host string, port int, passwo
 	} else if port <= 0 || port > math.MaxUint16 {
 		return nil, fmt.Errorf("Invalid port number: %v", port)
 	}
-	return tunnel.NewOutlineTunnel(host, port, password, cipher, isUDPEnabled, tunWriter)
+	server := shadowsocks.Server{Host: host, Port: port, Password: password, Cipher: cipher}
+	return tunnel.NewOutlineTunnel(server, isUDPEnabled, tunWriter, &net.Dialer{}, &net.ListenConfig{})
+}
+
+// ConnectShadowsocksTunnelWithAccessKey is like ConnectShadowsocksTunnel, but takes the proxy's
+// configuration from an ss:// access key, in the SIP002 or legacy format.  The access key may
+// specify a prefix for TCP streams, and the built-in simple-obfs plugin ("obfs-local").
+//
+// Fails if the access key is malformed, or requires another plugin.
+func ConnectShadowsocksTunnelWithAccessKey(tunWriter TunWriter, accessKey string, isUDPEnabled bool) (OutlineTunnel, error) {
+	if tunWriter == nil {
+		return nil, errors.New("Must provide a TunWriter")
+	}
+	server, err := config.ParseAccessKey(accessKey)
+	if err != nil {
+		return nil, err
+	}
+	return tunnel.NewOutlineTunnel(server, isUDPEnabled, tunWriter, &net.Dialer{}, &net.ListenConfig{})
+}
+
+// ParseOnlineConfig validates a SIP008 online config document, and returns its servers as a
+// JSON array for OutlineTunnel.SetServers.
+func ParseOnlineConfig(doc string) (string, error) {
+	servers, err := config.ParseOnlineConfig([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(servers)
+	return string(b), err
 }
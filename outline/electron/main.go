@@ -15,9 +15,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -26,6 +29,9 @@ import (
 
 	oss "github.com/Jigsaw-Code/outline-go-tun2socks/outline/shadowsocks"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks/config"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	_ "github.com/eycorsican/go-tun2socks/common/log/simple" // Register a simple logger.
 	"github.com/eycorsican/go-tun2socks/core"
@@ -49,9 +55,19 @@ var args struct {
 	proxyPort         *int
 	proxyPassword     *string
 	proxyCipher       *string
+	accessKey         *string
+	execPlugins       *bool
 	logLevel          *string
 	checkConnectivity *bool
+	jsonOutput        *bool
 	dnsFallback       *bool
+	udpOverTCP        *bool
+	metricsAddr       *string
+	bypassRules       *string
+	udpNAT            *string
+	dnsUpstream       *string
+	checkURL          *string
+	checkResolver     *string
 	version           *bool
 }
 var version string // Populated at build time through `-X main.version=...`
@@ -67,9 +83,19 @@ func main() {
 	args.proxyPort = flag.Int("proxyPort", 0, "Shadowsocks proxy port number")
 	args.proxyPassword = flag.String("proxyPassword", "", "Shadowsocks proxy password")
 	args.proxyCipher = flag.String("proxyCipher", "chacha20-ietf-poly1305", "Shadowsocks proxy encryption cipher")
+	args.accessKey = flag.String("accessKey", "", "Shadowsocks access key (ss://...). Overrides the other proxy flags.")
+	args.execPlugins = flag.Bool("execPlugins", false, "Allow the access key to run the v2ray-plugin or xray-plugin executable from the PATH.")
 	args.logLevel = flag.String("logLevel", "info", "Logging level: debug|info|warn|error|none")
 	args.dnsFallback = flag.Bool("dnsFallback", false, "Enable DNS fallback over TCP (overrides the UDP handler).")
+	args.udpOverTCP = flag.Bool("udpOverTCP", false, "Relay all UDP traffic over the proxy's TCP streams, which requires server support (overrides -dnsFallback).")
+	args.metricsAddr = flag.String("metricsAddr", "", "Local address (e.g. 127.0.0.1:9091) at which to serve Prometheus metrics on /metrics. Disabled if empty.")
+	args.bypassRules = flag.String("bypassRules", "", "JSON array of split tunneling rules, e.g. '[{\"cidrs\": [\"192.168.0.0/16\"], \"action\": \"direct\"}]'. Direct destinations must be routed outside the TUN interface.")
+	args.udpNAT = flag.String("udpNAT", shadowsocks.NATFullCone, "NAT mode of UDP associations through the proxy: full-cone|symmetric")
+	args.dnsUpstream = flag.String("dnsUpstream", "", "Forward DNS queries to the -tunDNS resolvers through the proxy to this resolver: udp://host[:port], tcp://host[:port] or https://host[:port]/path. Disabled if empty.")
+	args.checkURL = flag.String("checkURL", shadowsocks.DefaultCheckURL, "HTTP URL fetched through the proxy by the TCP connectivity check")
+	args.checkResolver = flag.String("checkResolver", shadowsocks.DefaultCheckResolver, "DNS resolver (host:port) queried through the proxy by the UDP connectivity check")
 	args.checkConnectivity = flag.Bool("checkConnectivity", false, "Check the proxy TCP and UDP connectivity and exit.")
+	args.jsonOutput = flag.Bool("json", false, "With -checkConnectivity, print a JSON report of each phase of the checks.")
 	args.version = flag.Bool("version", false, "Print the version and exit.")
 
 	flag.Parse()
@@ -80,6 +106,20 @@ func main() {
 	}
 
 	setLogLevel(*args.logLevel)
+	shadowsocks.EnableExecPlugins(*args.execPlugins)
+
+	var server shadowsocks.Server // The prefix and plugin are set only by the access key.
+	if *args.accessKey != "" {
+		var err error
+		if server, err = config.ParseAccessKey(*args.accessKey); err != nil {
+			log.Errorf("Invalid access key: %v", err)
+			os.Exit(oss.IllegalConfiguration)
+		}
+		*args.proxyHost = server.Host
+		*args.proxyPort = server.Port
+		*args.proxyPassword = server.Password
+		*args.proxyCipher = server.Cipher
+	}
 
 	// Validate proxy flags
 	if *args.proxyHost == "" {
@@ -94,10 +134,27 @@ func main() {
 	} else if *args.proxyCipher == "" {
 		log.Errorf("Must provide a Shadowsocks proxy encryption cipher")
 		os.Exit(oss.IllegalConfiguration)
+	} else if *args.udpNAT != shadowsocks.NATFullCone && *args.udpNAT != shadowsocks.NATSymmetric {
+		log.Errorf("Invalid UDP NAT mode: %v", *args.udpNAT)
+		os.Exit(oss.IllegalConfiguration)
+	}
+
+	if err := oss.SetCheckTargets(*args.checkURL, *args.checkResolver); err != nil {
+		log.Errorf("Invalid connectivity check targets: %v", err)
+		os.Exit(oss.IllegalConfiguration)
 	}
 
 	if *args.checkConnectivity {
-		connErrCode, err := oss.CheckConnectivity(*args.proxyHost, *args.proxyPort, *args.proxyPassword, *args.proxyCipher)
+		if *args.jsonOutput {
+			os.Exit(printConnectivityReport())
+		}
+		var connErrCode int
+		var err error
+		if *args.accessKey != "" {
+			connErrCode, err = oss.CheckConnectivityWithAccessKey(*args.accessKey)
+		} else {
+			connErrCode, err = oss.CheckConnectivity(*args.proxyHost, *args.proxyPort, *args.proxyPassword, *args.proxyCipher)
+		}
 		log.Debugf("Connectivity checks error code: %v", connErrCode)
 		if err != nil {
 			log.Errorf("Failed to perform connectivity checks: %v", err)
@@ -105,6 +162,18 @@ func main() {
 		os.Exit(connErrCode)
 	}
 
+	router := shadowsocks.NewRouter()
+	if *args.bypassRules != "" {
+		rules, err := shadowsocks.ParseRules(*args.bypassRules)
+		if err == nil {
+			err = router.SetRules(rules)
+		}
+		if err != nil {
+			log.Errorf("Invalid bypass rules: %v", err)
+			os.Exit(oss.IllegalConfiguration)
+		}
+	}
+
 	// Open TUN device
 	dnsResolvers := strings.Split(*args.tunDNS, ",")
 	tunDevice, err := tun.OpenTunDevice(*args.tunName, *args.tunAddr, *args.tunGw, *args.tunMask, dnsResolvers, persistTun)
@@ -115,17 +184,49 @@ func main() {
 	// Output packets to TUN device
 	core.RegisterOutputFn(tunDevice.Write)
 
-	// Register TCP and UDP connection handlers
-	core.RegisterTCPConnHandler(
-		shadowsocks.NewTCPHandler(*args.proxyHost, *args.proxyPort, *args.proxyPassword, *args.proxyCipher))
-	if *args.dnsFallback {
+	// Start the proxy client, and its plugin if any.
+	server.Host, server.Port = *args.proxyHost, *args.proxyPort
+	server.Password, server.Cipher = *args.proxyPassword, *args.proxyCipher
+	client, err := shadowsocks.NewServerClient(server)
+	if err != nil {
+		log.Errorf("Failed to start the Shadowsocks client: %v", err)
+		os.Exit(oss.ShadowsocksStartFailure)
+	}
+	defer client.Close()
+
+	// Forward the queries to the TUN resolvers, if configured.
+	dns := shadowsocks.NewDNSForwarder(router)
+	if *args.dnsUpstream != "" {
+		upstream, err := shadowsocks.NewDNSUpstream(client, *args.dnsUpstream)
+		if err == nil {
+			err = dns.SetUpstream(dnsResolvers, upstream)
+		}
+		if err != nil {
+			log.Errorf("Invalid DNS upstream: %v", err)
+			os.Exit(oss.IllegalConfiguration)
+		}
+	}
+
+	// Register TCP and UDP connection handlers.  The connection table feeds the
+	// traffic metrics, the dispatchers apply the bypass rules, and the DNS
+	// forwarder intercepts queries before them.
+	flows := conntrack.NewTable()
+	tcpHandler := shadowsocks.NewClientTCPHandler(client, flows)
+	core.RegisterTCPConnHandler(dns.TCPHandler(shadowsocks.NewTCPDispatcher(tcpHandler, router, &net.Dialer{}, flows)))
+	natConfig := shadowsocks.DefaultNATConfig(udpTimeout)
+	natConfig.Mode = *args.udpNAT
+	var udpHandler core.UDPConnHandler
+	if *args.udpOverTCP {
+		log.Debugf("Registering UDP over TCP handler")
+		udpHandler = shadowsocks.NewClientUDPHandler(shadowsocks.NewUDPOverTCPClient(client), natConfig, flows)
+	} else if *args.dnsFallback {
 		// UDP connectivity not supported, fall back to DNS over TCP.
 		log.Debugf("Registering DNS fallback UDP handler")
-		core.RegisterUDPConnHandler(dnsfallback.NewUDPHandler())
+		udpHandler = dnsfallback.NewUDPHandler()
 	} else {
-		core.RegisterUDPConnHandler(
-			shadowsocks.NewUDPHandler(*args.proxyHost, *args.proxyPort, *args.proxyPassword, *args.proxyCipher, udpTimeout))
+		udpHandler = shadowsocks.NewClientUDPHandler(client, natConfig, flows)
 	}
+	core.RegisterUDPConnHandler(dns.UDPHandler(shadowsocks.NewUDPDispatcher(udpHandler, router, &net.ListenConfig{}, udpTimeout, flows)))
 
 	// Configure LWIP stack to receive input data from the TUN device
 	lwipWriter := core.NewLWIPStack()
@@ -137,6 +238,10 @@ func main() {
 		}
 	}()
 
+	if *args.metricsAddr != "" {
+		serveMetrics(*args.metricsAddr)
+	}
+
 	log.Infof("tun2socks running...")
 
 	osSignals := make(chan os.Signal, 1)
@@ -145,6 +250,48 @@ func main() {
 	log.Debugf("Received signal: %v", sig)
 }
 
+// Prints the connectivity report of the proxy to stdout, and returns its error code.
+func printConnectivityReport() int {
+	var report string
+	var err error
+	if *args.accessKey != "" {
+		report, err = oss.DiagnoseConnectivityWithAccessKey(*args.accessKey)
+	} else {
+		report, err = oss.DiagnoseConnectivity(*args.proxyHost, *args.proxyPort, *args.proxyPassword, *args.proxyCipher, "")
+	}
+	if err != nil {
+		log.Errorf("Failed to perform connectivity checks: %v", err)
+		return oss.Unexpected
+	}
+	fmt.Println(report)
+	var summary struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(report), &summary); err != nil {
+		return oss.Unexpected
+	}
+	log.Debugf("Connectivity checks error code: %v", summary.Code)
+	return summary.Code
+}
+
+// Serves the traffic metrics at http://`addr`/metrics.  Failure is not fatal,
+// because the metrics are optional.
+func serveMetrics(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Errorf("Failed to serve metrics: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	log.Infof("Serving metrics at http://%s/metrics", listener.Addr())
+}
+
 func setLogLevel(level string) {
 	switch strings.ToLower(level) {
 	case "debug":
@@ -1,12 +1,14 @@
 package shadowsocks
 
 import (
+	"encoding/json"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	oss "github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
-	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks/config"
 )
 
 // Outline error codes. Must be kept in sync with definitions in outline-client/cordova-plugin-outline/outlinePlugin.js
@@ -28,29 +30,134 @@ const (
 
 const reachabilityTimeout = 10 * time.Second
 
+var checkTargets = struct {
+	sync.Mutex
+	oss.CheckTargets
+}{CheckTargets: oss.DefaultCheckTargets()}
+
+// SetCheckTargets sets the destinations of the connectivity checks through the proxy: an http://
+// URL for TCP, and the host:port of a DNS resolver for UDP.  They default to "http://example.com"
+// and "1.1.1.1:53".
+func SetCheckTargets(url, resolver string) error {
+	targets := oss.DefaultCheckTargets()
+	targets.URL, targets.Resolver = url, resolver
+	if err := targets.Validate(); err != nil {
+		return err
+	}
+	checkTargets.Lock()
+	defer checkTargets.Unlock()
+	checkTargets.CheckTargets = targets
+	return nil
+}
+
 // CheckConnectivity determines whether the Shadowsocks proxy can relay TCP and UDP traffic under
 // the current network. Parallelizes the execution of TCP and UDP checks, selects the appropriate
 // error code to return accounting for transient network failures.
 // Returns an error if an unexpected error ocurrs.
 func CheckConnectivity(host string, port int, password, cipher string) (int, error) {
-	client, err := shadowsocks.NewClient(host, port, password, cipher)
+	return CheckConnectivityWithPrefix(host, port, password, cipher, "")
+}
+
+// CheckConnectivityWithPrefix is like CheckConnectivity, but starts the TCP streams to the proxy
+// with `prefix`, as configured by the access key.
+func CheckConnectivityWithPrefix(host string, port int, password, cipher, prefix string) (int, error) {
+	server := oss.Server{Host: host, Port: port, Password: password, Cipher: cipher, Prefix: prefix}
+	return reportCode(check(server))
+}
+
+// CheckConnectivityWithAccessKey is like CheckConnectivity, but takes the proxy's configuration
+// from an ss:// access key, including its prefix and plugin.
+func CheckConnectivityWithAccessKey(accessKey string) (int, error) {
+	server, err := config.ParseAccessKey(accessKey)
+	if err != nil {
+		return IllegalConfiguration, err
+	}
+	return reportCode(check(server))
+}
+
+// connectivityReport is a shadowsocks.ConnectivityReport with its error code.
+type connectivityReport struct {
+	// Code is the error code that CheckConnectivity returns.
+	Code int `json:"code"`
+	// Error is the error that CheckConnectivity returns, if any.
+	Error string `json:"error,omitempty"`
+	*oss.ConnectivityReport
+}
+
+// DiagnoseConnectivity is like CheckConnectivityWithPrefix, but returns a JSON report of each
+// phase of the checks, with its duration and error class, e.g.
+//
+//	{"code": 5, "host": "proxy.example", "port": 8388,
+//	 "resolve": {"ok": true, "duration_ms": 12}, "ips": ["192.0.2.1"],
+//	 "connect": [{"ip": "192.0.2.1", "ok": false, "duration_ms": 1, "error_class": "refused", ...}]}
+//
+// The phases are "resolve", "connect", "config", "tcp" and "udp".  A phase is missing if a
+// previous phase failed, except that the TCP and UDP checks run in parallel.  See
+// shadowsocks.ConnectivityReport.
+func DiagnoseConnectivity(host string, port int, password, cipher, prefix string) (string, error) {
+	server := oss.Server{Host: host, Port: port, Password: password, Cipher: cipher, Prefix: prefix}
+	return marshalReport(diagnose(server))
+}
+
+// DiagnoseConnectivityWithAccessKey is like DiagnoseConnectivity, but takes the proxy's
+// configuration from an ss:// access key.  Fails if the access key is malformed.
+func DiagnoseConnectivityWithAccessKey(accessKey string) (string, error) {
+	server, err := config.ParseAccessKey(accessKey)
 	if err != nil {
-		// TODO: Inspect error for invalid cipher error or proxy host resolution failure.
-		return Unexpected, err
+		return "", err
 	}
-	tcpChan := make(chan error)
-	// Check whether the proxy is reachable and that the client is able to authenticate to the proxy
-	go func() {
-		tcpChan <- oss.CheckTCPConnectivityWithHTTP(client, "http://example.com")
-	}()
-	// Check whether UDP is supported
-	udpErr := oss.CheckUDPConnectivityWithDNS(client, shadowsocks.NewAddr("1.1.1.1:53", "udp"))
-	if udpErr == nil {
+	return marshalReport(diagnose(server))
+}
+
+func diagnose(server oss.Server) *oss.ConnectivityReport {
+	return oss.Diagnose(server, getCheckTargets())
+}
+
+func check(server oss.Server) *oss.ConnectivityReport {
+	return oss.CheckConnectivity(server, getCheckTargets())
+}
+
+func getCheckTargets() oss.CheckTargets {
+	checkTargets.Lock()
+	defer checkTargets.Unlock()
+	return checkTargets.CheckTargets
+}
+
+func marshalReport(report *oss.ConnectivityReport) (string, error) {
+	code, err := reportCode(report)
+	r := connectivityReport{Code: code, ConnectivityReport: report}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b, err := json.Marshal(r)
+	return string(b), err
+}
+
+// Returns the error code that summarizes `report`.
+func reportCode(report *oss.ConnectivityReport) (int, error) {
+	if report.Resolve != nil && (!report.Resolve.OK || len(report.Connect) == 0 || !report.Connect[len(report.Connect)-1].OK) {
+		// The proxy's host does not resolve, or does not accept connections.
+		return Unreachable, nil
+	}
+	if !report.Config.OK {
+		return Unexpected, report.Config.Err()
+	}
+	if report.UDP.OK {
 		// The UDP connectvity check is a superset of the TCP checks. If the other tests fail,
 		// assume it's due to intermittent network conditions and declare success anyway.
 		return NoError, nil
 	}
-	tcpErr := <-tcpChan
+	if report.Auth != nil {
+		switch report.Auth.Cause {
+		case oss.AuthOK, oss.AuthTargetFailed:
+			// The proxy accepts the key, so the TCP check failed for another reason.
+			return UDPConnectivity, nil
+		case oss.AuthUnreachable:
+			return Unreachable, nil
+		}
+		return AuthenticationFailure, nil
+	}
+	tcpErr := report.TCP.Err()
 	if tcpErr == nil {
 		// The TCP connectivity checks succeeded, which means UDP is not supported.
 		return UDPConnectivity, nil
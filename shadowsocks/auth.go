@@ -0,0 +1,153 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// Ways in which the proxy ends an HTTP request through it.
+const (
+	// CloseReply is a proxy that relayed a reply.
+	CloseReply = "reply"
+	// CloseTimeout is a proxy that kept the stream open without replying.
+	CloseTimeout = "timeout"
+	// CloseFIN is a proxy that closed the stream without replying.
+	CloseFIN = "fin"
+	// CloseRST is a proxy that reset the stream without replying.
+	CloseRST = "rst"
+	// CloseError is a stream that failed otherwise, such as an unreachable proxy.
+	CloseError = "error"
+)
+
+// Causes of a failed TCP connectivity check, found by DiagnoseAuthentication.
+const (
+	// AuthOK is a check that succeeded.
+	AuthOK = "ok"
+	// AuthWrongKey is a proxy that treats the key like an invalid one, because
+	// the password or cipher is wrong.
+	AuthWrongKey = "wrong-key"
+	// AuthTargetFailed is a proxy that accepts the key, but whose connection to
+	// the check target failed or was slow.
+	AuthTargetFailed = "target-failed"
+	// AuthUnreachable is a proxy that could not be reached.
+	AuthUnreachable = "unreachable"
+	// AuthInconclusive is a proxy whose behavior does not depend on the key.
+	AuthInconclusive = "inconclusive"
+)
+
+// AuthDiagnosis is the result of DiagnoseAuthentication.
+type AuthDiagnosis struct {
+	// Cause is AuthOK, AuthWrongKey, AuthTargetFailed, AuthUnreachable or
+	// AuthInconclusive.
+	Cause string `json:"cause"`
+	// ValidKey is how the proxy ended the request with the key.
+	ValidKey string `json:"valid_key"`
+	// AltTarget is how the proxy ended the request to the alternate target with
+	// the key, if it was tried.
+	AltTarget string `json:"alt_target,omitempty"`
+	// InvalidKey is how the proxy ended the request with an invalid key, if it
+	// was tried.
+	InvalidKey string `json:"invalid_key,omitempty"`
+}
+
+// DiagnoseAuthentication finds why the proxy does not reply to an HTTP request
+// for `targetURL` through `client`.  A wrong key, the probing resistance and
+// replay defense of Outline servers, and a slow target all look alike to
+// CheckTCPConnectivityWithHTTP: the proxy does not reply.  If the proxy replies
+// to a request for `altURL`, which may be empty, the key is valid.  Otherwise,
+// if the proxy ends the stream of `invalidClient`, which has a deliberately
+// invalid key, in the same way as that of `client`, the key is wrong.
+func DiagnoseAuthentication(client, invalidClient shadowsocks.Client, targetURL, altURL string) *AuthDiagnosis {
+	return classifyAuthentication(probeHTTP(client, targetURL), client, invalidClient, targetURL, altURL)
+}
+
+// Like DiagnoseAuthentication, but `validKey` is how the proxy already ended a
+// request for `targetURL` through `client`.
+func classifyAuthentication(validKey string, client, invalidClient shadowsocks.Client, targetURL, altURL string) *AuthDiagnosis {
+	d := &AuthDiagnosis{ValidKey: validKey}
+	switch d.ValidKey {
+	case CloseReply:
+		d.Cause = AuthOK
+		return d
+	case CloseError:
+		d.Cause = AuthUnreachable
+		return d
+	}
+	// Both requests wait for the proxy, so run them in parallel.
+	altChan := make(chan string, 1)
+	if altURL != "" {
+		go func() {
+			altChan <- probeHTTP(client, altURL)
+		}()
+	}
+	d.InvalidKey = probeHTTP(invalidClient, targetURL)
+	if altURL != "" {
+		d.AltTarget = <-altChan
+	}
+	switch {
+	case d.AltTarget == CloseReply:
+		d.Cause = AuthTargetFailed
+	case d.InvalidKey == CloseReply, d.InvalidKey == CloseError:
+		// The proxy does not authenticate, or could not be reached again.
+		d.Cause = AuthInconclusive
+	case d.InvalidKey == d.ValidKey:
+		d.Cause = AuthWrongKey
+	default:
+		// The proxy rejects invalid keys differently, so it accepted the key.
+		d.Cause = AuthTargetFailed
+	}
+	return d
+}
+
+// Sends a HEAD request for `targetURL` through `client`, and returns how the
+// proxy ended the stream.
+func probeHTTP(client shadowsocks.Client, targetURL string) string {
+	req, targetAddr, err := newCheckRequest(targetURL)
+	if err != nil {
+		return CloseError
+	}
+	conn, err := client.DialTCP(nil, targetAddr)
+	if err != nil {
+		return CloseError
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Millisecond * tcpTimeoutMs))
+	if err := req.Write(conn); err != nil {
+		return closeKind(err)
+	}
+	n, err := conn.Read(make([]byte, bufferLength))
+	if n > 0 {
+		return CloseReply
+	}
+	return closeKind(err)
+}
+
+// Returns how the proxy ended a stream that failed with `err`.
+func closeKind(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return CloseError
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CloseFIN
+	case errors.Is(err, syscall.ECONNRESET):
+		return CloseRST
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseTimeout
+	case strings.HasPrefix(err.Error(), "failed to read salt"):
+		// The reader does not wrap the errors of the salt, so they can only be
+		// matched by their message.
+		if strings.HasSuffix(err.Error(), syscall.ECONNRESET.Error()) {
+			return CloseRST
+		} else if strings.HasSuffix(err.Error(), "timeout") {
+			return CloseTimeout
+		}
+	}
+	return CloseError
+}
@@ -0,0 +1,329 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Bypass actions for Rule.Action.
+const (
+	// ActionProxy sends the socket through the Shadowsocks proxy.
+	ActionProxy = "proxy"
+	// ActionDirect connects to the destination directly, outside the tunnel.
+	ActionDirect = "direct"
+	// ActionBlock rejects TCP connections with a reset, and drops UDP packets.
+	ActionBlock = "block"
+)
+
+var errBlocked = errors.New("Blocked by bypass rule")
+
+// proxyIdleTimeout closes proxied UDP associations that the proxy handler
+// leaves open, such as those of the DNS fallback handler.  It is longer than
+// the session timeouts of DefaultNATConfig, so that those apply first.
+const proxyIdleTimeout = 5 * time.Minute
+
+// Rule is a split tunneling rule, whose Action is ActionProxy, ActionDirect, or
+// ActionBlock.  The Outline tunnel does not inspect the client's data, so
+// rules cannot match SNIs.
+type Rule = rules.Rule
+
+// ParseRules parses a JSON array of Rule objects.
+func ParseRules(config string) ([]Rule, error) {
+	return rules.Parse(config)
+}
+
+// Router selects the route of each new socket from an ordered list of rules.
+// The first matching rule applies, and sockets that match no rule are proxied.
+type Router struct {
+	rules atomic.Value // *rules.Rules
+	names *rules.NameTable
+}
+
+// NewRouter returns a Router with no rules.
+func NewRouter() *Router {
+	r := &Router{names: rules.NewNameTable()}
+	r.rules.Store((*rules.Rules)(nil))
+	return r
+}
+
+// SetRules validates and replaces the rules.  The new rules apply to new
+// sockets.
+func (r *Router) SetRules(list []Rule) error {
+	for i, rule := range list {
+		if len(rule.SNIs) > 0 {
+			return fmt.Errorf("Rule %d: SNIs are not supported", i)
+		}
+	}
+	compiled, err := rules.Compile(list, ActionProxy, ActionDirect, ActionBlock)
+	if err != nil {
+		return err
+	}
+	r.rules.Store(compiled)
+	return nil
+}
+
+func (r *Router) route(protocol string, ip net.IP, port int) string {
+	rs := r.rules.Load().(*rules.Rules)
+	if rs.Len() == 0 {
+		return ActionProxy
+	}
+	conn := &rules.Conn{Protocol: protocol, IP: ip, Port: port, Domain: r.names.Lookup(ip)}
+	if action, _ := rs.Match(conn, true); action != "" {
+		return action
+	}
+	return ActionProxy
+}
+
+type tcpDispatcher struct {
+	proxy  core.TCPConnHandler
+	router *Router
+	dialer *net.Dialer
+	flows  *conntrack.Table
+}
+
+// NewTCPDispatcher returns a TCP connection handler that sends each connection
+// to `proxy`, connects it directly, or rejects it, as selected by `router`.
+// DNS responses from the proxy on port 53 are recorded, so that rules can match
+// the domain names of later sockets.
+//
+// `dialer` is used for direct connections, and must bypass the tunnel.
+// `flows` tracks the direct connections, and may be nil.
+func NewTCPDispatcher(proxy core.TCPConnHandler, router *Router, dialer *net.Dialer, flows *conntrack.Table) core.TCPConnHandler {
+	return &tcpDispatcher{proxy, router, dialer, flows}
+}
+
+func (h *tcpDispatcher) Handle(conn net.Conn, target *net.TCPAddr) error {
+	switch h.router.route("tcp", target.IP, target.Port) {
+	case ActionBlock:
+		return errBlocked
+	case ActionDirect:
+		return h.handleDirect(conn, target)
+	}
+	if tcpConn, ok := conn.(core.TCPConn); ok && target.Port == 53 {
+		conn = &dnsSnoopConn{TCPConn: tcpConn, names: h.router.names}
+	}
+	return h.proxy.Handle(conn, target)
+}
+
+// dnsSnoopConn is the core.TCPConn that the dispatcher passes to the proxy for
+// DNS over TCP.  It records the responses that the proxy writes to the client,
+// like bypassUDPConn does for DNS over UDP.
+type dnsSnoopConn struct {
+	core.TCPConn
+	names *rules.NameTable
+	buf   []byte // The bytes of an incomplete response, from its 2-byte length.
+}
+
+func (c *dnsSnoopConn) Write(b []byte) (int, error) {
+	c.record(b)
+	return c.TCPConn.Write(b)
+}
+
+// Records each complete length-prefixed response in the stream.
+func (c *dnsSnoopConn) record(b []byte) {
+	c.buf = append(c.buf, b...)
+	for len(c.buf) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < n {
+			return
+		}
+		c.names.Record(c.buf[2:n])
+		c.buf = c.buf[n:]
+	}
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+}
+
+func (h *tcpDispatcher) handleDirect(conn net.Conn, target *net.TCPAddr) error {
+	c, err := h.dialer.Dial("tcp", target.String())
+	if err != nil {
+		return err
+	}
+	directConn := c.(*net.TCPConn)
+	flow := h.flows.Add(target, func() {
+		conn.Close()
+		directConn.Close()
+	})
+	flow.SetDirect()
+	flow.SetName(h.router.names.Lookup(target.IP))
+	localConn := conn.(core.TCPConn)
+	go func() {
+		onet.Relay(onet.WrapConn(localConn, flow.UploadReader(localConn), localConn),
+			onet.WrapConn(directConn, flow.DownloadReader(directConn), directConn))
+		h.flows.Remove(flow)
+	}()
+	return nil
+}
+
+// udpAssociation is a UDP socket that is either proxied or direct.
+type udpAssociation struct {
+	proxied *bypassUDPConn // Non-nil if the association is proxied.
+	direct  net.PacketConn // Non-nil if the association is direct.
+	flow    *conntrack.Flow
+}
+
+type udpDispatcher struct {
+	sync.Mutex
+
+	proxy   core.UDPConnHandler
+	router  *Router
+	config  *net.ListenConfig
+	timeout time.Duration
+	idle    time.Duration // Idle timeout of proxied associations.
+	flows   *conntrack.Table
+	conns   map[core.UDPConn]*udpAssociation
+}
+
+// NewUDPDispatcher returns a UDP connection handler that sends each association
+// to `proxy`, sends it directly, or drops it, as selected by `router` for the
+// association's first destination.  Packets to other destinations that `router`
+// blocks are dropped.  DNS responses from the proxy are recorded, so that
+// rules can match the domain names of later sockets.  NewTCPDispatcher records
+// DNS over TCP.
+//
+// `config` is used for direct associations, and must bypass the tunnel.
+// `timeout` is the read and write timeout of direct associations.  Proxied
+// associations that are idle for proxyIdleTimeout are closed, in case `proxy`
+// never closes them.
+// `flows` tracks the direct associations, and may be nil.
+func NewUDPDispatcher(proxy core.UDPConnHandler, router *Router, config *net.ListenConfig, timeout time.Duration, flows *conntrack.Table) core.UDPConnHandler {
+	return &udpDispatcher{
+		proxy:   proxy,
+		router:  router,
+		config:  config,
+		timeout: timeout,
+		idle:    proxyIdleTimeout,
+		flows:   flows,
+		conns:   make(map[core.UDPConn]*udpAssociation, 8),
+	}
+}
+
+// bypassUDPConn is the core.UDPConn that the dispatcher passes to the proxy.  It
+// records DNS responses, and removes the association when the proxy closes it,
+// or when it is idle for proxyIdleTimeout.
+type bypassUDPConn struct {
+	core.UDPConn
+	h    *udpDispatcher
+	idle *time.Timer // Closes the association when it is idle.
+}
+
+func (c *bypassUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.idle.Reset(c.h.idle)
+	if addr.Port == 53 {
+		c.h.router.names.Record(data)
+	}
+	return c.UDPConn.WriteFrom(data, addr)
+}
+
+func (c *bypassUDPConn) Close() error {
+	c.idle.Stop()
+	c.h.Lock()
+	delete(c.h.conns, c.UDPConn)
+	c.h.Unlock()
+	return c.UDPConn.Close()
+}
+
+func (h *udpDispatcher) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	switch h.router.route("udp", target.IP, target.Port) {
+	case ActionBlock:
+		return errBlocked
+	case ActionDirect:
+		return h.connectDirect(conn, target)
+	}
+	proxied := &bypassUDPConn{UDPConn: conn, h: h}
+	proxied.idle = time.AfterFunc(h.idle, func() { proxied.Close() })
+	h.Lock()
+	h.conns[conn] = &udpAssociation{proxied: proxied}
+	h.Unlock()
+	if err := h.proxy.Connect(proxied, target); err != nil {
+		proxied.idle.Stop()
+		h.Lock()
+		delete(h.conns, conn)
+		h.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (h *udpDispatcher) connectDirect(conn core.UDPConn, target *net.UDPAddr) error {
+	directConn, err := h.config.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return err
+	}
+	flow := h.flows.Add(target, func() {
+		h.Close(conn)
+	})
+	flow.SetDirect()
+	flow.SetName(h.router.names.Lookup(target.IP))
+	h.Lock()
+	h.conns[conn] = &udpAssociation{direct: directConn, flow: flow}
+	h.Unlock()
+	go h.handleDownstreamUDP(conn, directConn, flow)
+	return nil
+}
+
+func (h *udpDispatcher) handleDownstreamUDP(conn core.UDPConn, directConn net.PacketConn, flow *conntrack.Flow) {
+	buf := core.NewBytes(core.BufSize)
+	defer func() {
+		h.Close(conn)
+		core.FreeBytes(buf)
+	}()
+	for {
+		directConn.SetDeadline(time.Now().Add(h.timeout))
+		n, addr, err := directConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err = conn.WriteFrom(buf[:n], addr.(*net.UDPAddr)); err != nil {
+			return
+		}
+		flow.AddDownload(int64(n))
+	}
+}
+
+func (h *udpDispatcher) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	a, ok := h.conns[conn]
+	h.Unlock()
+	if !ok {
+		return fmt.Errorf("connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+	if h.router.route("udp", addr.IP, addr.Port) == ActionBlock {
+		return nil
+	}
+	if a.proxied != nil {
+		a.proxied.idle.Reset(h.idle)
+		return h.proxy.ReceiveTo(a.proxied, data, addr)
+	}
+	a.direct.SetDeadline(time.Now().Add(h.timeout))
+	_, err := a.direct.WriteTo(data, addr)
+	if err == nil {
+		a.flow.AddUpload(int64(len(data)))
+	}
+	return err
+}
+
+// Close closes a direct association.  Proxied associations are closed by the
+// proxy handler.
+func (h *udpDispatcher) Close(conn core.UDPConn) {
+	conn.Close()
+	h.Lock()
+	defer h.Unlock()
+	if a, ok := h.conns[conn]; ok && a.direct != nil {
+		a.direct.Close()
+		h.flows.Remove(a.flow)
+		delete(h.conns, conn)
+	}
+}
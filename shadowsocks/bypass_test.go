@@ -0,0 +1,294 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/dnstest"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/dnsfallback"
+)
+
+func makeRouter(t *testing.T, config string) *Router {
+	rules, err := ParseRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	if err := router.SetRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+// Returns a DNS response that resolves `name` to the IPv4 address `ip`.
+func makeDNSResponse(name, ip string) []byte {
+	return dnstest.Response(name, dnstest.A(name, 300, ip))
+}
+
+func TestRouter(t *testing.T) {
+	router := makeRouter(t, `[
+		{"domains": ["blocked.test"], "action": "block"},
+		{"cidrs": ["192.168.0.0/16", "fe80::/10"], "action": "direct"},
+		{"protocol": "udp", "ports": ["5000-5999"], "action": "block"},
+		{"cidrs": ["192.0.2.0/24"], "ports": ["22"], "action": "proxy"},
+		{"cidrs": ["192.0.2.0/24"], "action": "direct"}
+	]`)
+	router.names.Record(makeDNSResponse("www.blocked.test.", "198.51.100.1"))
+	cases := []struct {
+		protocol string
+		ip       string
+		port     int
+		action   string
+	}{
+		{"tcp", "198.51.100.1", 443, ActionBlock},
+		{"tcp", "198.51.100.2", 443, ActionProxy},
+		{"tcp", "192.168.1.1", 80, ActionDirect},
+		{"udp", "fe80::1", 53, ActionDirect},
+		{"udp", "203.0.113.1", 5353, ActionBlock},
+		{"tcp", "203.0.113.1", 5353, ActionProxy},
+		{"tcp", "192.0.2.1", 22, ActionProxy},
+		{"tcp", "192.0.2.1", 23, ActionDirect},
+	}
+	for _, c := range cases {
+		if action := router.route(c.protocol, net.ParseIP(c.ip), c.port); action != c.action {
+			t.Errorf("%s %s:%d: got %s, expected %s", c.protocol, c.ip, c.port, action, c.action)
+		}
+	}
+
+	if err := router.SetRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if action := router.route("tcp", net.ParseIP("198.51.100.1"), 443); action != ActionProxy {
+		t.Errorf("Cleared rules returned %s", action)
+	}
+}
+
+func TestRouterInvalid(t *testing.T) {
+	for _, bad := range []string{
+		`[{"action": "bypass"}]`,
+		`[{"protocol": "sctp", "action": "direct"}]`,
+		`[{"cidrs": ["192.168.1.1"], "action": "direct"}]`,
+		`[{"ports": ["100-10"], "action": "direct"}]`,
+		`[{"ports": ["65536"], "action": "direct"}]`,
+		`[{"snis": ["example.com"], "action": "direct"}]`,
+	} {
+		rules, err := ParseRules(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewRouter().SetRules(rules); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+	if _, err := ParseRules(`{"action": "direct"}`); err == nil {
+		t.Error("Expected error for a non-array")
+	}
+}
+
+// fakeTCPHandler records the connections that it handles, and their targets.
+type fakeTCPHandler struct {
+	conns   []net.Conn
+	targets []*net.TCPAddr
+}
+
+func (h *fakeTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.conns = append(h.conns, conn)
+	h.targets = append(h.targets, target)
+	return nil
+}
+
+func TestTCPDispatcher(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	proxy := &fakeTCPHandler{}
+	router := makeRouter(t, `[
+		{"cidrs": ["127.0.0.1/32"], "action": "direct"},
+		{"cidrs": ["127.0.0.2/32"], "action": "block"}
+	]`)
+	h := NewTCPDispatcher(proxy, router, &net.Dialer{}, nil)
+
+	// Direct connections reach the server.
+	app, tun := net.Pipe()
+	defer app.Close()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, server.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(app, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Echo failed: %q, %v", buf, err)
+	}
+
+	if err := h.Handle(&testconn.TCPConn{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 80}); err != errBlocked {
+		t.Errorf("Expected block, got %v", err)
+	}
+
+	proxied := &net.TCPAddr{IP: net.ParseIP("127.0.0.3"), Port: 80}
+	if err := h.Handle(&testconn.TCPConn{}, proxied); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.targets) != 1 || proxy.targets[0] != proxied {
+		t.Errorf("Proxy received %v", proxy.targets)
+	}
+}
+
+func TestTCPDispatcherDNS(t *testing.T) {
+	proxy := &fakeTCPHandler{}
+	router := makeRouter(t, `[{"domains": ["tcp.test"], "action": "direct"}]`)
+	h := NewTCPDispatcher(proxy, router, &net.Dialer{}, nil)
+	app, tun := net.Pipe()
+	defer app.Close()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, &net.TCPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, app)
+
+	// Two length-prefixed responses, written in chunks that split the lengths.
+	answers := map[string]string{"a.tcp.test.": "198.51.100.1", "b.tcp.test.": "198.51.100.2"}
+	var stream []byte
+	for name, ip := range answers {
+		response := makeDNSResponse(name, ip)
+		stream = append(stream, byte(len(response)>>8), byte(len(response)))
+		stream = append(stream, response...)
+	}
+	for _, chunk := range [][]byte{stream[:1], stream[1:20], stream[20:]} {
+		if _, err := proxy.conns[0].Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ip := range answers {
+		if action := router.route("tcp", net.ParseIP(ip), 443); action != ActionDirect {
+			t.Errorf("%s: got %s, expected %s", ip, action, ActionDirect)
+		}
+	}
+}
+
+// fakeUDPHandler answers every packet with `response` from port 53.
+type fakeUDPHandler struct {
+	response []byte
+	conns    []core.UDPConn
+}
+
+func (h *fakeUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	h.conns = append(h.conns, conn)
+	return nil
+}
+
+func (h *fakeUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	_, err := conn.WriteFrom(h.response, addr)
+	return err
+}
+
+func TestUDPDispatcher(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 100)
+		n, addr, err := server.ReadFrom(buf)
+		if err == nil {
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+
+	proxy := &fakeUDPHandler{response: makeDNSResponse("local.test.", "127.0.0.1")}
+	router := makeRouter(t, `[{"domains": ["local.test"], "action": "direct"}]`)
+	h := NewUDPDispatcher(proxy, router, &net.ListenConfig{}, time.Minute, nil)
+	local := &net.UDPAddr{IP: net.ParseIP("10.0.85.2"), Port: 5000}
+
+	// Before the name is resolved, sockets are proxied.
+	dnsConn := &testconn.UDPConn{Local: local, Packets: make(chan []byte, 1)}
+	dnsServer := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53}
+	if err := h.Connect(dnsConn, dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(dnsConn, []byte("query"), dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	if response := <-dnsConn.Packets; !bytes.Equal(response, proxy.response) {
+		t.Error("Wrong DNS response")
+	}
+	// The proxy handler closes the association through the dispatcher's wrapper.
+	proxy.conns[0].Close()
+	if !dnsConn.Closed() {
+		t.Error("Wrapper did not close the connection")
+	}
+	if n := len(h.(*udpDispatcher).conns); n != 0 {
+		t.Errorf("%d associations remain after close", n)
+	}
+
+	// The DNS response routes the resolved address directly.
+	conn := &testconn.UDPConn{Local: local, Packets: make(chan []byte, 1)}
+	if err := h.Connect(conn, serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("hello"), serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case echo := <-conn.Packets:
+		if string(echo) != "hello" {
+			t.Errorf("Wrong echo: %q", echo)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No response from the server")
+	}
+	if len(proxy.conns) != 1 {
+		t.Error("Direct association was proxied")
+	}
+	h.(*udpDispatcher).Close(conn)
+	if n := len(h.(*udpDispatcher).conns); n != 0 {
+		t.Errorf("%d associations remain after close", n)
+	}
+}
+
+func TestUDPDispatcherIdleProxy(t *testing.T) {
+	router := makeRouter(t, `[]`)
+	// The fallback handler answers DNS queries, but never closes the association.
+	h := NewUDPDispatcher(dnsfallback.NewUDPHandler(), router, &net.ListenConfig{}, time.Minute, nil)
+	d := h.(*udpDispatcher)
+	d.idle = 50 * time.Millisecond
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.0.85.2"), Port: 5000}, Packets: make(chan []byte, 1)}
+	dnsServer := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53}
+	if err := h.Connect(conn, dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, make([]byte, 12), dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	<-conn.Packets
+	count := func() int {
+		d.Lock()
+		defer d.Unlock()
+		return len(d.conns)
+	}
+	for deadline := time.Now().Add(time.Second); count() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := count(); n != 0 || !conn.Closed() {
+		t.Errorf("The idle association was not closed: %d associations remain", n)
+	}
+}
@@ -0,0 +1,130 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Same delay as the outline-ss-server client, so that the target address is
+// sent along with the client's first data.
+const helloWait = 10 * time.Millisecond
+
+// ServerClient is a shadowsocks.Client for a Server.  Close stops the server's
+// plugin, if any.
+type ServerClient interface {
+	shadowsocks.Client
+	io.Closer
+}
+
+// NewServerClient returns a client for `s`.  Its TCP streams start with the
+// server's prefix, if any, and pass through the server's plugin, if any.  As in
+// SIP003, UDP packets are relayed to the server directly.
+func NewServerClient(s Server) (ServerClient, error) {
+	var plugin Plugin
+	if s.Plugin != "" {
+		var err error
+		if plugin, err = StartPlugin(s.Plugin, s.PluginOptions, s.Host, s.Port); err != nil {
+			return nil, err
+		}
+	}
+	client, err := newStreamClient(s.Host, s.Port, s.Password, s.Cipher, []byte(s.Prefix), plugin)
+	if err != nil {
+		if plugin != nil {
+			plugin.Close()
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// streamClient is a shadowsocks.Client that sets up its own TCP streams, so
+// that they can start with a prefix or pass through a plugin.  It relays UDP
+// like the standard client.
+type streamClient struct {
+	shadowsocks.Client
+	cipher    shadowaead.Cipher
+	salt      shadowsocks.SaltGenerator // Random salts if nil.
+	plugin    Plugin                    // Dials proxyAddr directly if nil.
+	proxyAddr *net.TCPAddr
+}
+
+func newStreamClient(host string, port int, password, cipher string, prefix []byte, plugin Plugin) (*streamClient, error) {
+	client, err := shadowsocks.NewClient(host, port, password, cipher)
+	if err != nil {
+		return nil, err
+	}
+	ssCipher, err := sscore.PickCipher(cipher, nil, password)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := ssCipher.(shadowaead.Cipher)
+	if !ok {
+		return nil, errors.New("Only AEAD ciphers supported")
+	}
+	if max := MaxPrefixSize(aead); len(prefix) > max {
+		return nil, fmt.Errorf("Prefix is too long: %d > %d bytes", len(prefix), max)
+	}
+	c := &streamClient{Client: client, cipher: aead, plugin: plugin}
+	if len(prefix) > 0 {
+		c.salt = prefixSaltGenerator{append([]byte(nil), prefix...)}
+	}
+	if plugin == nil {
+		proxyIP, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, errors.New("Failed to resolve proxy address")
+		}
+		c.proxyAddr = &net.TCPAddr{IP: proxyIP.IP, Port: port}
+	}
+	return c, nil
+}
+
+func (c *streamClient) dialProxy(laddr *net.TCPAddr) (onet.DuplexConn, error) {
+	if c.plugin != nil {
+		return c.plugin.DialTCP(laddr)
+	}
+	conn, err := net.DialTCP("tcp", laddr, c.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *streamClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	socksTargetAddr := socks.ParseAddr(raddr)
+	if socksTargetAddr == nil {
+		return nil, errors.New("Failed to parse target address")
+	}
+	proxyConn, err := c.dialProxy(laddr)
+	if err != nil {
+		return nil, err
+	}
+	ssw := shadowsocks.NewShadowsocksWriter(proxyConn, c.cipher)
+	if c.salt != nil {
+		ssw.SetSaltGenerator(c.salt)
+	}
+	if _, err = ssw.LazyWrite(socksTargetAddr); err != nil {
+		proxyConn.Close()
+		return nil, errors.New("Failed to write target address")
+	}
+	time.AfterFunc(helloWait, func() {
+		ssw.Flush()
+	})
+	ssr := shadowsocks.NewShadowsocksReader(proxyConn, c.cipher)
+	return onet.WrapConn(proxyConn, ssr, ssw), nil
+}
+
+func (c *streamClient) Close() error {
+	if c.plugin != nil {
+		return c.plugin.Close()
+	}
+	return nil
+}
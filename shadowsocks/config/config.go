@@ -0,0 +1,204 @@
+// Package config parses Shadowsocks access keys and online configs into
+// validated server configurations.
+//
+// Access keys are ss:// URIs in the SIP002 format, or the legacy format with
+// base64-encoded credentials and address.  Online configs are SIP008 JSON
+// documents.
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// ParseAccessKey parses an ss:// access key.
+func ParseAccessKey(key string) (shadowsocks.Server, error) {
+	var s shadowsocks.Server
+	key = strings.TrimSpace(key)
+	if !strings.HasPrefix(key, "ss://") {
+		return s, errors.New("Invalid access key: must start with ss://")
+	}
+	body := key[len("ss://"):]
+	if i := strings.IndexByte(body, '#'); i >= 0 {
+		body = body[:i] // Discard the tag.
+	}
+	if !strings.Contains(body, "@") {
+		return parseLegacyKey(body)
+	}
+	u, err := url.Parse(key)
+	if err != nil {
+		return s, fmt.Errorf("Invalid access key: %v", err)
+	}
+	if s.Cipher, s.Password, err = parseUserInfo(u.User); err != nil {
+		return s, err
+	}
+	s.Host = u.Hostname()
+	if s.Port, err = strconv.Atoi(u.Port()); err != nil {
+		return s, fmt.Errorf("Invalid port: %q", u.Port())
+	}
+	if prefix := u.Query().Get("prefix"); prefix != "" {
+		if s.Prefix, err = decodePrefix(prefix); err != nil {
+			return s, err
+		}
+	}
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		parts := strings.SplitN(plugin, ";", 2)
+		s.Plugin = parts[0]
+		if len(parts) > 1 {
+			s.PluginOptions = parts[1]
+		}
+	}
+	return s, Validate(s)
+}
+
+// Decodes the "prefix" parameter of an access key, in which each byte is
+// represented by the Unicode code point with the same value, U+0000 to U+00FF.
+func decodePrefix(encoded string) (string, error) {
+	prefix := make([]byte, 0, len(encoded))
+	for _, r := range encoded {
+		if r == utf8.RuneError || r > 0xFF {
+			return "", errors.New("Invalid access key: prefix must contain only code points U+0000 to U+00FF")
+		}
+		prefix = append(prefix, byte(r))
+	}
+	return string(prefix), nil
+}
+
+// Parses the legacy format, base64("method:password@host:port").
+func parseLegacyKey(encoded string) (shadowsocks.Server, error) {
+	var s shadowsocks.Server
+	decoded, err := decodeBase64(encoded)
+	if err != nil {
+		return s, errors.New("Invalid access key: malformed base64")
+	}
+	at := strings.LastIndexByte(decoded, '@')
+	if at < 0 {
+		return s, errors.New("Invalid access key: missing credentials")
+	}
+	credentials := strings.SplitN(decoded[:at], ":", 2)
+	if len(credentials) != 2 {
+		return s, errors.New("Invalid access key: missing password")
+	}
+	s.Cipher, s.Password = credentials[0], credentials[1]
+	host, port, err := net.SplitHostPort(decoded[at+1:])
+	if err != nil {
+		return s, fmt.Errorf("Invalid access key: %v", err)
+	}
+	s.Host = host
+	if s.Port, err = strconv.Atoi(port); err != nil {
+		return s, fmt.Errorf("Invalid port: %q", port)
+	}
+	return s, Validate(s)
+}
+
+// Returns the cipher and password from the userinfo of a SIP002 URI, which is
+// either base64url("method:password") or percent-encoded "method:password".
+func parseUserInfo(user *url.Userinfo) (cipher, password string, err error) {
+	password, ok := user.Password()
+	if ok {
+		return user.Username(), password, nil
+	}
+	decoded, err := decodeBase64(user.Username())
+	if err != nil {
+		return "", "", errors.New("Invalid access key: malformed credentials")
+	}
+	parts := strings.SplitN(decoded, ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("Invalid access key: missing password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Decodes standard or URL-safe base64, with or without padding.
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return string(b), nil
+	}
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// onlineConfig is a SIP008 document.
+type onlineConfig struct {
+	Version int `json:"version"`
+	Servers []struct {
+		Server        string `json:"server"`
+		ServerPort    int    `json:"server_port"`
+		Password      string `json:"password"`
+		Method        string `json:"method"`
+		Plugin        string `json:"plugin"`
+		PluginOptions string `json:"plugin_opts"`
+	} `json:"servers"`
+}
+
+// ParseOnlineConfig parses a SIP008 online config document.  It fails if any
+// server is invalid.
+func ParseOnlineConfig(doc []byte) ([]shadowsocks.Server, error) {
+	var config onlineConfig
+	if err := json.Unmarshal(doc, &config); err != nil {
+		return nil, fmt.Errorf("Invalid online config: %v", err)
+	}
+	if config.Version != 1 {
+		return nil, fmt.Errorf("Unsupported online config version: %d", config.Version)
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("Online config has no servers")
+	}
+	servers := make([]shadowsocks.Server, 0, len(config.Servers))
+	for i, c := range config.Servers {
+		s := shadowsocks.Server{
+			Host:          c.Server,
+			Port:          c.ServerPort,
+			Password:      c.Password,
+			Cipher:        c.Method,
+			Plugin:        c.Plugin,
+			PluginOptions: c.PluginOptions,
+		}
+		if err := Validate(s); err != nil {
+			return nil, fmt.Errorf("Server %d: %v", i, err)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// Validate checks that `s` has a host, a valid port, a password, a supported
+// AEAD cipher, and a prefix that fits in the cipher's salt.
+func Validate(s shadowsocks.Server) error {
+	if s.Host == "" {
+		return errors.New("Missing host")
+	}
+	if strings.ContainsAny(s.Host, "/?#@") || (strings.Contains(s.Host, ":") && net.ParseIP(s.Host) == nil) {
+		return fmt.Errorf("Invalid host: %s", s.Host)
+	}
+	if s.Port <= 0 || s.Port > 65535 {
+		return fmt.Errorf("Invalid port: %d", s.Port)
+	}
+	if s.Password == "" {
+		return errors.New("Missing password")
+	}
+	cipher, err := sscore.PickCipher(s.Cipher, nil, s.Password)
+	if err != nil {
+		return fmt.Errorf("Unsupported cipher: %s", s.Cipher)
+	}
+	aead, ok := cipher.(shadowaead.Cipher)
+	if !ok {
+		return fmt.Errorf("Unsupported cipher: %s", s.Cipher)
+	}
+	if max := shadowsocks.MaxPrefixSize(aead); len(s.Prefix) > max {
+		return fmt.Errorf("Prefix is too long for %s: %d > %d bytes", s.Cipher, len(s.Prefix), max)
+	}
+	return nil
+}
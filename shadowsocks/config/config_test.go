@@ -0,0 +1,145 @@
+package config
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+)
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestParseAccessKey(t *testing.T) {
+	cases := []struct {
+		name   string
+		key    string
+		server shadowsocks.Server
+	}{
+		{
+			"sip002 base64",
+			"ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388#Example%20server",
+			shadowsocks.Server{Host: "192.0.2.1", Port: 8388, Password: "secret", Cipher: "chacha20-ietf-poly1305"},
+		},
+		{
+			"sip002 padded standard base64",
+			"ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:pass:with:colons")) + "@example.com:443",
+			shadowsocks.Server{Host: "example.com", Port: 443, Password: "pass:with:colons", Cipher: "aes-256-gcm"},
+		},
+		{
+			"sip002 percent-encoded",
+			"ss://aes-128-gcm:p%40ss%2Fword@[2001:db8::1]:8388/",
+			shadowsocks.Server{Host: "2001:db8::1", Port: 8388, Password: "p@ss/word", Cipher: "aes-128-gcm"},
+		},
+		{
+			"sip002 plugin",
+			"ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388/?plugin=obfs-local%3Bobfs%3Dhttp%3Bobfs-host%3Dexample.com#tag",
+			shadowsocks.Server{Host: "192.0.2.1", Port: 8388, Password: "secret", Cipher: "chacha20-ietf-poly1305",
+				Plugin: "obfs-local", PluginOptions: "obfs=http;obfs-host=example.com"},
+		},
+		{
+			"sip002 plugin without options",
+			"ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388/?plugin=v2ray-plugin",
+			shadowsocks.Server{Host: "192.0.2.1", Port: 8388, Password: "secret", Cipher: "chacha20-ietf-poly1305",
+				Plugin: "v2ray-plugin"},
+		},
+		{
+			"sip002 prefix",
+			"ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388/?prefix=%16%03%01%C3%BF",
+			shadowsocks.Server{Host: "192.0.2.1", Port: 8388, Password: "secret", Cipher: "chacha20-ietf-poly1305",
+				Prefix: "\x16\x03\x01\xff"},
+		},
+		{
+			"legacy",
+			"ss://" + base64.StdEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:p@ss@192.0.2.1:8388")) + "#tag",
+			shadowsocks.Server{Host: "192.0.2.1", Port: 8388, Password: "p@ss", Cipher: "chacha20-ietf-poly1305"},
+		},
+	}
+	for _, c := range cases {
+		server, err := ParseAccessKey(c.key)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if server != c.server {
+			t.Errorf("%s: got %+v, expected %+v", c.name, server, c.server)
+		}
+	}
+}
+
+func TestParseAccessKeyMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		key  string
+	}{
+		{"empty", ""},
+		{"wrong scheme", "http://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388"},
+		{"bad base64", "ss://!!!@192.0.2.1:8388"},
+		{"missing password", "ss://" + b64("chacha20-ietf-poly1305") + "@192.0.2.1:8388"},
+		{"empty password", "ss://" + b64("chacha20-ietf-poly1305:") + "@192.0.2.1:8388"},
+		{"missing port", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1"},
+		{"bad port", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:http"},
+		{"port out of range", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:65536"},
+		{"missing host", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@:8388"},
+		{"stream cipher", "ss://" + b64("rc4-md5:secret") + "@192.0.2.1:8388"},
+		{"unknown cipher", "ss://" + b64("rot13:secret") + "@192.0.2.1:8388"},
+		{"prefix out of range", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388/?prefix=%C4%80"},
+		{"prefix not utf-8", "ss://" + b64("chacha20-ietf-poly1305:secret") + "@192.0.2.1:8388/?prefix=%FF"},
+		{"prefix too long", "ss://" + b64("aes-128-gcm:secret") + "@192.0.2.1:8388/?prefix=123456789"},
+		{"legacy bad base64", "ss://not-base64!"},
+		{"legacy without address", "ss://" + b64("chacha20-ietf-poly1305:secret")},
+		{"legacy without port", "ss://" + b64("chacha20-ietf-poly1305:secret@192.0.2.1")},
+	}
+	for _, c := range cases {
+		if server, err := ParseAccessKey(c.key); err == nil {
+			t.Errorf("%s: expected error, got %+v", c.name, server)
+		}
+	}
+}
+
+func TestParseOnlineConfig(t *testing.T) {
+	doc := `{
+		"version": 1,
+		"servers": [
+			{"id": "27b8a625-4f4b-4428-9f0f-8a2317db7c79", "remarks": "Server 1",
+			 "server": "example.com", "server_port": 8388, "password": "secret1", "method": "chacha20-ietf-poly1305"},
+			{"server": "192.0.2.2", "server_port": 443, "password": "secret2", "method": "aes-256-gcm",
+			 "plugin": "obfs-local", "plugin_opts": "obfs=tls"}
+		],
+		"bytes_used": 274877906944
+	}`
+	servers, err := ParseOnlineConfig([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []shadowsocks.Server{
+		{Host: "example.com", Port: 8388, Password: "secret1", Cipher: "chacha20-ietf-poly1305"},
+		{Host: "192.0.2.2", Port: 443, Password: "secret2", Cipher: "aes-256-gcm", Plugin: "obfs-local", PluginOptions: "obfs=tls"},
+	}
+	if len(servers) != len(expected) {
+		t.Fatalf("Expected %d servers, got %d", len(expected), len(servers))
+	}
+	for i := range servers {
+		if servers[i] != expected[i] {
+			t.Errorf("Server %d: got %+v, expected %+v", i, servers[i], expected[i])
+		}
+	}
+}
+
+func TestParseOnlineConfigMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+	}{
+		{"not json", `version: 1`},
+		{"wrong version", `{"version": 2, "servers": [{"server": "192.0.2.1", "server_port": 8388, "password": "s", "method": "aes-128-gcm"}]}`},
+		{"no servers", `{"version": 1, "servers": []}`},
+		{"invalid server", `{"version": 1, "servers": [{"server": "192.0.2.1", "server_port": 0, "password": "s", "method": "aes-128-gcm"}]}`},
+		{"bad cipher", `{"version": 1, "servers": [{"server": "192.0.2.1", "server_port": 8388, "password": "s", "method": "table"}]}`},
+		{"bad host", `{"version": 1, "servers": [{"server": "example.com/path", "server_port": 8388, "password": "s", "method": "aes-128-gcm"}]}`},
+	}
+	for _, c := range cases {
+		if _, err := ParseOnlineConfig([]byte(c.doc)); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
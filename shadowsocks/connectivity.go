@@ -2,8 +2,10 @@ package shadowsocks
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
@@ -17,6 +19,60 @@ const (
 	bufferLength        = 512
 )
 
+// Default targets of the connectivity checks.
+const (
+	DefaultCheckURL      = "http://example.com"
+	DefaultCheckResolver = "1.1.1.1:53"
+	DefaultCheckAltURL   = "http://captive.apple.com"
+)
+
+// CheckTargets are the destinations of the connectivity checks through the proxy.
+type CheckTargets struct {
+	// URL is fetched by the TCP check, and must be of the form
+	// http://[host](:[port])(/[path]).
+	URL string `json:"url"`
+	// Resolver is the host:port of the DNS resolver queried by the UDP check.
+	Resolver string `json:"resolver"`
+	// AltURL is fetched when the TCP check fails, to tell a failing target from
+	// a rejected key.  It has the same form as URL, and may be empty.
+	AltURL string `json:"alt_url,omitempty"`
+}
+
+// DefaultCheckTargets returns DefaultCheckURL, DefaultCheckResolver and
+// DefaultCheckAltURL.
+func DefaultCheckTargets() CheckTargets {
+	return CheckTargets{DefaultCheckURL, DefaultCheckResolver, DefaultCheckAltURL}
+}
+
+// Validate returns an error if the targets are malformed.
+func (c CheckTargets) Validate() error {
+	if err := validateCheckURL(c.URL); err != nil {
+		return err
+	}
+	if c.AltURL != "" {
+		if err := validateCheckURL(c.AltURL); err != nil {
+			return err
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+		return fmt.Errorf("Invalid connectivity check resolver: %v", err)
+	}
+	return nil
+}
+
+var errUDPTimeout = errors.New("UDP connectivity check timed out")
+
+func validateCheckURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("Connectivity check URL must be http://[host](:[port])(/[path]): %s", rawurl)
+	}
+	return nil
+}
+
 // AuthenticationError is used to signal failed authentication to the Shadowsocks proxy.
 type AuthenticationError struct {
 	error
@@ -52,7 +108,7 @@ func CheckUDPConnectivityWithDNS(client shadowsocks.Client, resolverAddr net.Add
 		}
 		return nil
 	}
-	return errors.New("UDP connectivity check timed out")
+	return errUDPTimeout
 }
 
 // CheckTCPConnectivityWithHTTP determines whether the proxy is reachable over TCP and validates the
@@ -60,14 +116,10 @@ func CheckUDPConnectivityWithDNS(client shadowsocks.Client, resolverAddr net.Add
 // be of the form: http://[host](:[port])(/[path]). Returns nil on success, error if `targetURL` is
 // invalid, AuthenticationError or ReachabilityError on connectivity failure.
 func CheckTCPConnectivityWithHTTP(client shadowsocks.Client, targetURL string) error {
-	req, err := http.NewRequest("HEAD", targetURL, nil)
+	req, targetAddr, err := newCheckRequest(targetURL)
 	if err != nil {
 		return err
 	}
-	targetAddr := req.Host
-	if !hasPort(targetAddr) {
-		targetAddr = net.JoinHostPort(targetAddr, "80")
-	}
 	conn, err := client.DialTCP(nil, targetAddr)
 	if err != nil {
 		return &ReachabilityError{err}
@@ -85,6 +137,19 @@ func CheckTCPConnectivityWithHTTP(client shadowsocks.Client, targetURL string) e
 	return nil
 }
 
+// Returns a HEAD request for `targetURL`, and the address to connect to.
+func newCheckRequest(targetURL string) (*http.Request, string, error) {
+	req, err := http.NewRequest("HEAD", targetURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	targetAddr := req.Host
+	if !hasPort(targetAddr) {
+		targetAddr = net.JoinHostPort(targetAddr, "80")
+	}
+	return req, targetAddr, nil
+}
+
 func getDNSRequest() []byte {
 	return []byte{
 		0, 0, // [0-1]   query ID
@@ -2,8 +2,11 @@ package shadowsocks
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
@@ -57,18 +60,124 @@ func TestCheckTCPConnectivityWithHTTP_FailAuthentication(t *testing.T) {
 	}
 }
 
+func TestDiagnoseAuthentication(t *testing.T) {
+	const target, alt = "http://example.com", "http://captive.apple.com"
+	cases := []struct {
+		name          string
+		client        *fakeSSClient
+		invalidClient *fakeSSClient
+		altURL        string
+		expected      AuthDiagnosis
+	}{{
+		name:          "success",
+		client:        &fakeSSClient{},
+		invalidClient: &fakeSSClient{failAuthentication: true},
+		altURL:        alt,
+		expected:      AuthDiagnosis{Cause: AuthOK, ValidKey: CloseReply},
+	}, {
+		name:          "unreachable",
+		client:        &fakeSSClient{failReachability: true},
+		invalidClient: &fakeSSClient{failReachability: true},
+		altURL:        alt,
+		expected:      AuthDiagnosis{Cause: AuthUnreachable, ValidKey: CloseError},
+	}, {
+		// Outline servers drain the streams with invalid keys until they time out.
+		name:          "wrong key, probe resistant",
+		client:        &fakeSSClient{failAuthentication: true, readErr: timeoutError{}},
+		invalidClient: &fakeSSClient{failAuthentication: true, readErr: timeoutError{}},
+		altURL:        alt,
+		expected:      AuthDiagnosis{Cause: AuthWrongKey, ValidKey: CloseTimeout, AltTarget: CloseTimeout, InvalidKey: CloseTimeout},
+	}, {
+		name:          "wrong key, reset",
+		client:        &fakeSSClient{failAuthentication: true, readErr: syscall.ECONNRESET},
+		invalidClient: &fakeSSClient{failAuthentication: true, readErr: syscall.ECONNRESET},
+		expected:      AuthDiagnosis{Cause: AuthWrongKey, ValidKey: CloseRST, InvalidKey: CloseRST},
+	}, {
+		name:          "slow target",
+		client:        &fakeSSClient{failTarget: "example.com:80", readErr: timeoutError{}},
+		invalidClient: &fakeSSClient{failAuthentication: true, readErr: timeoutError{}},
+		altURL:        alt,
+		expected:      AuthDiagnosis{Cause: AuthTargetFailed, ValidKey: CloseTimeout, AltTarget: CloseReply, InvalidKey: CloseTimeout},
+	}, {
+		// The proxy closes the stream when it fails to reach the target, but
+		// drains the streams with invalid keys.
+		name:          "target down",
+		client:        &fakeSSClient{failAuthentication: true, readErr: io.EOF},
+		invalidClient: &fakeSSClient{failAuthentication: true, readErr: timeoutError{}},
+		expected:      AuthDiagnosis{Cause: AuthTargetFailed, ValidKey: CloseFIN, InvalidKey: CloseTimeout},
+	}, {
+		name:          "no authentication",
+		client:        &fakeSSClient{failAuthentication: true, readErr: io.EOF},
+		invalidClient: &fakeSSClient{},
+		expected:      AuthDiagnosis{Cause: AuthInconclusive, ValidKey: CloseFIN, InvalidKey: CloseReply},
+	}}
+	for _, c := range cases {
+		d := DiagnoseAuthentication(c.client, c.invalidClient, target, c.altURL)
+		if *d != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, *d)
+		}
+	}
+}
+
+func TestCloseKind(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind string
+	}{
+		{io.EOF, CloseFIN},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, CloseRST},
+		{timeoutError{}, CloseTimeout},
+		{fmt.Errorf("failed to read salt: %v", &net.OpError{Op: "read", Err: syscall.ECONNRESET}), CloseRST},
+		{fmt.Errorf("failed to read salt: %v", timeoutError{}), CloseTimeout},
+		{errors.New("Fake read error"), CloseError},
+	}
+	for _, c := range cases {
+		if kind := closeKind(c.err); kind != c.kind {
+			t.Errorf("%v: expected %s, got %s", c.err, c.kind, kind)
+		}
+	}
+}
+
+func TestCheckTargetsValidate(t *testing.T) {
+	valid := []CheckTargets{
+		DefaultCheckTargets(),
+		{URL: "http://192.0.2.1:8080/generate_204", Resolver: "[2001:db8::1]:53"},
+	}
+	for _, targets := range valid {
+		if err := targets.Validate(); err != nil {
+			t.Errorf("%v: %v", targets, err)
+		}
+	}
+	invalid := []CheckTargets{
+		{URL: "https://example.com", Resolver: DefaultCheckResolver},
+		{URL: "example.com", Resolver: DefaultCheckResolver},
+		{URL: DefaultCheckURL, Resolver: "1.1.1.1"},
+	}
+	for _, targets := range invalid {
+		if err := targets.Validate(); err == nil {
+			t.Errorf("Expected error for %v", targets)
+		}
+	}
+}
+
 // Fake shadowsocks.Client that can be configured to return failing UDP and TCP connections.
 type fakeSSClient struct {
 	failReachability   bool
 	failAuthentication bool
 	failUDP            bool
+	// readErr is the error of failed reads, which shows how the proxy closes the
+	// stream.  A generic error by default.
+	readErr error
+	// failTarget fails reads from streams to this address only, if set.
+	failTarget string
 }
 
 func (c *fakeSSClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
 	if c.failReachability {
 		return nil, &net.OpError{}
 	}
-	return &fakeDuplexConn{failRead: c.failAuthentication}, nil
+	failRead := c.failAuthentication || (c.failTarget != "" && raddr == c.failTarget)
+	return &fakeDuplexConn{failRead: failRead, readErr: c.readErr}, nil
 }
 func (c *fakeSSClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
 	conn, err := net.ListenPacket("udp", "")
@@ -103,10 +212,14 @@ func (c *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 type fakeDuplexConn struct {
 	onet.DuplexConn
 	failRead bool
+	readErr  error
 }
 
 func (c *fakeDuplexConn) Read(b []byte) (int, error) {
 	if c.failRead {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
 		return 0, errors.New("Fake read error")
 	}
 	return len(b), nil
@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// Error classes of a failed phase, in addition to the classes of failed
+// connections: "dns", "timeout", "refused", "reset", "unreachable" and "other".
+const (
+	// ErrorClassConfig is an invalid server configuration, such as an unsupported
+	// cipher, or a plugin that fails to start.
+	ErrorClassConfig = "config"
+	// ErrorClassClosed is a proxy that closed or reset the stream without
+	// replying, which usually means that the password or cipher is wrong.
+	ErrorClassClosed = "closed"
+)
+
+// Timeout of each phase of Diagnose, except the connectivity checks.
+const diagnoseTimeout = 5 * time.Second
+
+// PhaseResult is the outcome of a phase of Diagnose.
+type PhaseResult struct {
+	OK         bool  `json:"ok"`
+	DurationMs int64 `json:"duration_ms"`
+	// ErrorClass summarizes the failure, such as "dns", "refused" or "closed".
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	err        error
+}
+
+// Err returns the error of a failed phase, or nil.
+func (r *PhaseResult) Err() error {
+	return r.err
+}
+
+// Returns the result of a phase that started at `start`, and failed with the
+// error class of `err`, unless it is nil.
+func newPhaseResult(start time.Time, err error) *PhaseResult {
+	r := &PhaseResult{OK: err == nil, DurationMs: int64(time.Since(start) / time.Millisecond), err: err}
+	if err != nil {
+		r.ErrorClass = errorClass(err)
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Returns the class of an error from a phase of Diagnose.
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case *AuthenticationError:
+		// The proxy was reached, so classify how it ended the stream.
+		switch closeKind(e.error) {
+		case CloseFIN, CloseRST:
+			return ErrorClassClosed
+		case CloseTimeout:
+			return "timeout"
+		}
+		err = e.error
+	case *ReachabilityError:
+		err = e.error
+	}
+	if err == errUDPTimeout {
+		return "timeout"
+	}
+	return dialErrorClass(err)
+}
+
+// ConnectAttempt is a TCP connection to one of the proxy's IP addresses.
+type ConnectAttempt struct {
+	IP string `json:"ip"`
+	PhaseResult
+}
+
+// ConnectivityReport describes the connectivity to a proxy, phase by phase.  In
+// Diagnose, a phase runs only if the previous phases succeeded, except that the
+// TCP and UDP checks run in parallel.  CheckConnectivity runs the checks first,
+// and the resolution and connection phases only if the checks fail.
+type ConnectivityReport struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Resolve is the resolution of Host.
+	Resolve *PhaseResult `json:"resolve,omitempty"`
+	// IPs are the addresses of Host.
+	IPs []string `json:"ips,omitempty"`
+	// Connect are the TCP connections to IPs, in order, until one succeeds.
+	Connect []ConnectAttempt `json:"connect,omitempty"`
+	// Config is the creation of the client, which validates the cipher and
+	// starts the plugin, if any.
+	Config *PhaseResult `json:"config,omitempty"`
+	// TCP is the HTTP request to the check URL through the proxy.
+	TCP *PhaseResult `json:"tcp,omitempty"`
+	// UDP is the DNS query to the check resolver through the proxy.
+	UDP *PhaseResult `json:"udp,omitempty"`
+	// Auth is the diagnosis of a TCP check that failed with an
+	// AuthenticationError.
+	Auth *AuthDiagnosis `json:"auth,omitempty"`
+}
+
+// Diagnose checks the connectivity to `server` step by step: it resolves the
+// server's host, connects to its IP addresses over TCP, creates a client, and
+// then checks whether the proxy can relay TCP and UDP traffic to `targets`.  If
+// the proxy does not reply over TCP, it diagnoses the authentication with an
+// invalid key, as in DiagnoseAuthentication.
+func Diagnose(server Server, targets CheckTargets) *ConnectivityReport {
+	return diagnose(server, targets, newClient)
+}
+
+// CheckConnectivity is like Diagnose, but starts with the TCP and UDP checks, so
+// that a working proxy takes no longer to check than the checks themselves.  The
+// earlier phases run only if the checks fail, to find the cause.
+func CheckConnectivity(server Server, targets CheckTargets) *ConnectivityReport {
+	return checkConnectivity(server, targets, newClient)
+}
+
+func diagnose(server Server, targets CheckTargets, newClient func(Server) (shadowsocks.Client, error)) *ConnectivityReport {
+	report := &ConnectivityReport{Host: server.Host, Port: server.Port}
+	if !report.connect(server) {
+		return report
+	}
+	client := report.check(server, targets, newClient)
+	if client == nil {
+		return report
+	}
+	defer closeClient(client)
+	report.diagnoseAuthentication(server, client, targets, newClient)
+	return report
+}
+
+func checkConnectivity(server Server, targets CheckTargets, newClient func(Server) (shadowsocks.Client, error)) *ConnectivityReport {
+	report := &ConnectivityReport{Host: server.Host, Port: server.Port}
+	client := report.check(server, targets, newClient)
+	if client != nil {
+		defer closeClient(client)
+		if report.TCP.OK || report.UDP.OK {
+			return report
+		}
+	}
+	if report.connect(server) && client != nil {
+		report.diagnoseAuthentication(server, client, targets, newClient)
+	}
+	return report
+}
+
+// Runs the resolution and connection phases.  Returns true if a connection to
+// the proxy succeeded.
+func (report *ConnectivityReport) connect(server Server) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, server.Host)
+	report.Resolve = newPhaseResult(start, err)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		report.IPs = append(report.IPs, addr.IP.String())
+	}
+
+	dialer := &net.Dialer{Timeout: diagnoseTimeout}
+	for _, ip := range report.IPs {
+		start = time.Now()
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(server.Port)))
+		report.Connect = append(report.Connect, ConnectAttempt{ip, *newPhaseResult(start, err)})
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the configuration phase and the connectivity checks.  Returns the client,
+// which the caller must close, or nil if it could not be created.
+func (report *ConnectivityReport) check(server Server, targets CheckTargets, newClient func(Server) (shadowsocks.Client, error)) shadowsocks.Client {
+	start := time.Now()
+	client, err := newClient(server)
+	report.Config = newPhaseResult(start, err)
+	if err != nil {
+		report.Config.ErrorClass = ErrorClassConfig
+		return nil
+	}
+
+	tcpChan := make(chan *PhaseResult)
+	go func() {
+		start := time.Now()
+		tcpChan <- newPhaseResult(start, CheckTCPConnectivityWithHTTP(client, targets.URL))
+	}()
+	start = time.Now()
+	report.UDP = newPhaseResult(start, CheckUDPConnectivityWithDNS(client, shadowsocks.NewAddr(targets.Resolver, "udp")))
+	report.TCP = <-tcpChan
+	return client
+}
+
+// Diagnoses the authentication of `client` to `server` if the TCP check failed
+// with an AuthenticationError, reusing the outcome of the check instead of
+// repeating it.  Leaves Auth nil if the client with an invalid key fails to start.
+func (report *ConnectivityReport) diagnoseAuthentication(server Server, client shadowsocks.Client, targets CheckTargets, newClient func(Server) (shadowsocks.Client, error)) {
+	authErr, ok := report.TCP.Err().(*AuthenticationError)
+	if !ok {
+		return
+	}
+	invalid := server
+	invalid.Password = hex.EncodeToString(randomBytes(16))
+	invalidClient, err := newClient(invalid)
+	if err != nil {
+		return
+	}
+	defer closeClient(invalidClient)
+	report.Auth = classifyAuthentication(closeKind(authErr.error), client, invalidClient, targets.URL, targets.AltURL)
+}
+
+// Stops the plugin of `client`, if any.
+func closeClient(client shadowsocks.Client) {
+	if c, ok := client.(io.Closer); ok {
+		c.Close()
+	}
+}
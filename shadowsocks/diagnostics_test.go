@@ -0,0 +1,170 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// tcpOnlyClient relays TCP through the embedded client, and fails UDP.
+type tcpOnlyClient struct {
+	shadowsocks.Client
+}
+
+func (c *tcpOnlyClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	return (&fakeSSClient{failUDP: true}).ListenUDP(laddr)
+}
+
+// Returns a client factory that always returns `client`.
+func fixedClient(client shadowsocks.Client) func(Server) (shadowsocks.Client, error) {
+	return func(Server) (shadowsocks.Client, error) { return client, nil }
+}
+
+func startAcceptingServer(t *testing.T) int {
+	port, _ := startTestServer(t, func(conn net.Conn) (io.Reader, io.Writer, bool) {
+		return conn, conn, true
+	})
+	return port
+}
+
+func TestDiagnoseSuccess(t *testing.T) {
+	server := Server{Host: "localhost", Port: startAcceptingServer(t), Password: testPassword, Cipher: testCipher}
+	report := diagnose(server, DefaultCheckTargets(), fixedClient(&fakeSSClient{}))
+	if !report.Resolve.OK || len(report.IPs) == 0 {
+		t.Fatalf("Resolution failed: %+v", report.Resolve)
+	}
+	if last := report.Connect[len(report.Connect)-1]; !last.OK {
+		t.Fatalf("Connection failed: %+v", report.Connect)
+	}
+	if !report.Config.OK || !report.TCP.OK || !report.UDP.OK {
+		t.Errorf("Unexpected failure: %+v, %+v, %+v", report.Config, report.TCP, report.UDP)
+	}
+}
+
+func TestDiagnoseRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := Server{Host: "127.0.0.1", Port: port, Password: testPassword, Cipher: testCipher}
+	report := diagnose(server, DefaultCheckTargets(), fixedClient(&fakeSSClient{}))
+	if len(report.Connect) != 1 || report.Connect[0].IP != "127.0.0.1" || report.Connect[0].ErrorClass != "refused" {
+		t.Errorf("Unexpected connection attempts: %+v", report.Connect)
+	}
+	if report.Config != nil || report.TCP != nil || report.UDP != nil {
+		t.Error("Later phases ran after the connection failed")
+	}
+}
+
+func TestDiagnoseConfig(t *testing.T) {
+	server := Server{Host: "127.0.0.1", Port: startAcceptingServer(t), Password: testPassword, Cipher: "rot13"}
+	report := diagnose(server, DefaultCheckTargets(), newClient)
+	if report.Config == nil || report.Config.OK || report.Config.ErrorClass != ErrorClassConfig {
+		t.Errorf("Expected a config error, got %+v", report.Config)
+	}
+	if report.TCP != nil || report.UDP != nil {
+		t.Error("Connectivity checks ran without a client")
+	}
+}
+
+func TestDiagnoseWrongPassword(t *testing.T) {
+	port := startAcceptingServer(t)
+	client, err := shadowsocks.NewClient("127.0.0.1", port, "wrong", testCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := Server{Host: "127.0.0.1", Port: port, Password: "wrong", Cipher: testCipher}
+	report := diagnose(server, DefaultCheckTargets(), fixedClient(&tcpOnlyClient{client}))
+	if report.TCP.OK || report.TCP.ErrorClass != ErrorClassClosed {
+		t.Errorf("Expected the proxy to close the stream, got %+v", report.TCP)
+	}
+	if _, ok := report.TCP.Err().(*AuthenticationError); !ok {
+		t.Errorf("Expected authentication error, got %v", report.TCP.Err())
+	}
+	// The invalid key is as wrong as the password.
+	if report.Auth == nil || report.Auth.Cause != AuthWrongKey {
+		t.Errorf("Expected a wrong key, got %+v", report.Auth)
+	}
+	if report.UDP.OK || report.UDP.ErrorClass != "timeout" {
+		t.Errorf("Expected UDP timeout, got %+v", report.UDP)
+	}
+}
+
+func TestCheckConnectivitySuccess(t *testing.T) {
+	// The host is never resolved, because the checks succeed.
+	server := Server{Host: "proxy.invalid", Port: 8388, Password: testPassword, Cipher: testCipher}
+	report := checkConnectivity(server, DefaultCheckTargets(), fixedClient(&fakeSSClient{}))
+	if report.Resolve != nil || report.Connect != nil {
+		t.Errorf("Diagnostic phases ran after the checks succeeded: %+v, %+v", report.Resolve, report.Connect)
+	}
+	if !report.Config.OK || !report.TCP.OK || !report.UDP.OK {
+		t.Errorf("Unexpected failure: %+v, %+v, %+v", report.Config, report.TCP, report.UDP)
+	}
+}
+
+func TestCheckConnectivityRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := Server{Host: "127.0.0.1", Port: port, Password: testPassword, Cipher: testCipher}
+	client, err := shadowsocks.NewClient("127.0.0.1", port, testPassword, testCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := checkConnectivity(server, DefaultCheckTargets(), fixedClient(&tcpOnlyClient{client}))
+	if report.TCP.OK || report.UDP.OK {
+		t.Errorf("Expected the checks to fail: %+v, %+v", report.TCP, report.UDP)
+	}
+	if len(report.Connect) != 1 || report.Connect[0].ErrorClass != "refused" {
+		t.Errorf("Unexpected connection attempts: %+v", report.Connect)
+	}
+	if report.Auth != nil {
+		t.Errorf("Diagnosed the authentication of an unreachable proxy: %+v", report.Auth)
+	}
+}
+
+func TestCheckConnectivityWrongKey(t *testing.T) {
+	server := Server{Host: "127.0.0.1", Port: startAcceptingServer(t), Password: testPassword, Cipher: testCipher}
+	client := &countingClient{fakeSSClient: fakeSSClient{failAuthentication: true, readErr: io.EOF}}
+	newClient := func(s Server) (shadowsocks.Client, error) {
+		if s.Password == testPassword {
+			return client, nil
+		}
+		return &fakeSSClient{failAuthentication: true, readErr: io.EOF}, nil
+	}
+	targets := DefaultCheckTargets()
+	targets.AltURL = ""
+	report := checkConnectivity(server, targets, newClient)
+	if report.Auth == nil || report.Auth.Cause != AuthWrongKey || report.Auth.ValidKey != CloseFIN {
+		t.Errorf("Expected a wrong key, got %+v", report.Auth)
+	}
+	// The diagnosis reuses the failed TCP check.
+	if client.dials != 1 {
+		t.Errorf("Expected 1 stream with the key, got %d", client.dials)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{&AuthenticationError{io.EOF}, ErrorClassClosed},
+		{&ReachabilityError{&net.DNSError{Err: "no such host"}}, "dns"},
+		{errUDPTimeout, "timeout"},
+		{errors.New("other"), "other"},
+	}
+	for _, c := range cases {
+		if class := errorClass(c.err); class != c.class {
+			t.Errorf("%v: expected %s, got %s", c.err, c.class, class)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// DNS upstream protocols, which are the schemes of upstream URLs.
+const (
+	// DNSOverUDP sends each query in a UDP packet through the proxy.
+	DNSOverUDP = "udp"
+	// DNSOverTCP sends each query on a TCP stream through the proxy.
+	DNSOverTCP = "tcp"
+	// DNSOverHTTPS sends each query in an HTTPS request through the proxy, as in
+	// RFC 8484.
+	DNSOverHTTPS = "https"
+)
+
+// Timeout of a query to an upstream resolver.
+const dnsTimeout = 5 * time.Second
+
+// NewDNSUpstream returns a transport that sends DNS queries through `client` to
+// the resolver at `upstream`, which is a URL of the form
+// udp://host(:port), tcp://host(:port) or https://host(:port)/path.  A bare
+// host(:port) selects UDP.  The default port is 53 for UDP and TCP, and 443 for
+// HTTPS.
+func NewDNSUpstream(client shadowsocks.Client, upstream string) (doh.Transport, error) {
+	rawurl := upstream
+	if !strings.Contains(rawurl, "://") {
+		rawurl = DNSOverUDP + "://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Missing DNS upstream host: %s", upstream)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case DNSOverUDP, DNSOverTCP:
+		if u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("Unexpected path in DNS upstream: %s", upstream)
+		}
+		if port == "" {
+			port = "53"
+		}
+	case DNSOverHTTPS:
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported DNS upstream protocol: %s", u.Scheme)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > math.MaxUint16 {
+		return nil, fmt.Errorf("Invalid DNS upstream port: %s", port)
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	switch u.Scheme {
+	case DNSOverUDP:
+		return &udpDNSUpstream{client, rawurl, shadowsocks.NewAddr(addr, "udp")}, nil
+	case DNSOverTCP:
+		return &tcpDNSUpstream{client, rawurl, addr}, nil
+	}
+	return newHTTPSDNSUpstream(client, rawurl), nil
+}
+
+type udpDNSUpstream struct {
+	client shadowsocks.Client
+	url    string
+	addr   net.Addr
+}
+
+func (u *udpDNSUpstream) Query(q []byte) ([]byte, error) {
+	if len(q) < 2 {
+		return nil, errors.New("DNS query is too short")
+	}
+	conn, err := u.client.ListenUDP(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.WriteTo(q, u.addr); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, math.MaxUint16)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && bytes.Equal(buf[:2], q[:2]) {
+			return buf[:n], nil
+		}
+		// Not a response to this query.
+	}
+}
+
+func (u *udpDNSUpstream) GetURL() string {
+	return u.url
+}
+
+type tcpDNSUpstream struct {
+	client shadowsocks.Client
+	url    string
+	addr   string
+}
+
+func (u *tcpDNSUpstream) Query(q []byte) ([]byte, error) {
+	if len(q) > math.MaxUint16 {
+		return nil, errors.New("DNS query is too long")
+	}
+	conn, err := u.client.DialTCP(nil, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	// Send the length and the query in one write, so that the proxy sends them together.
+	buf := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(buf, uint16(len(q)))
+	copy(buf[2:], q)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (u *tcpDNSUpstream) GetURL() string {
+	return u.url
+}
+
+type httpsDNSUpstream struct {
+	url    string
+	client http.Client
+}
+
+func newHTTPSDNSUpstream(client shadowsocks.Client, rawurl string) *httpsDNSUpstream {
+	u := &httpsDNSUpstream{url: rawurl}
+	u.client.Timeout = dnsTimeout
+	u.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return client.DialTCP(nil, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: dnsTimeout,
+	}
+	return u
+}
+
+func (u *httpsDNSUpstream) Query(q []byte) ([]byte, error) {
+	if len(q) < 2 {
+		return nil, errors.New("DNS query is too short")
+	}
+	// Send the query with ID 0, which makes responses cacheable, as recommended by
+	// RFC 8484, and restore the ID in the response.
+	id := q[:2]
+	q = append([]byte{0, 0}, q[2:]...)
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS upstream returned HTTP status %d", resp.StatusCode)
+	}
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, math.MaxUint16+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || len(response) > math.MaxUint16 {
+		return nil, fmt.Errorf("Invalid DNS response length: %d", len(response))
+	}
+	copy(response, id)
+	return response, nil
+}
+
+func (u *httpsDNSUpstream) GetURL() string {
+	return u.url
+}
+
+// DNSForwarder intercepts the DNS queries to the TUN device's resolver
+// addresses, and forwards them to an upstream resolver.  The upstream's
+// answers are recorded, so that bypass rules can match the domain names of
+// later sockets.
+type DNSForwarder struct {
+	mu       sync.RWMutex // Protects addrs and upstream.
+	addrs    map[string]bool
+	upstream doh.Transport
+	router   *Router
+}
+
+// NewDNSForwarder returns a DNSForwarder that does not intercept any queries
+// until SetUpstream is called.  `router` records the answers, and may be nil.
+func NewDNSForwarder(router *Router) *DNSForwarder {
+	return &DNSForwarder{router: router}
+}
+
+// SetUpstream intercepts the queries to `addrs`, which are IP addresses with an
+// optional port, 53 by default, and forwards them to `upstream`.  A nil
+// `upstream` stops the interception.  Existing sockets are not affected.
+func (f *DNSForwarder) SetUpstream(addrs []string, upstream doh.Transport) error {
+	intercepted := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, "53"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("Invalid DNS address: %s", addr)
+		}
+		intercepted[net.JoinHostPort(ip.String(), port)] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs = intercepted
+	f.upstream = upstream
+	return nil
+}
+
+// Returns the upstream for queries to `ip`:`port`, or nil if they are not
+// intercepted.
+func (f *DNSForwarder) lookup(ip net.IP, port int) doh.Transport {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.upstream == nil || !f.addrs[net.JoinHostPort(ip.String(), strconv.Itoa(port))] {
+		return nil
+	}
+	if f.router == nil {
+		return f.upstream
+	}
+	return &recordingTransport{f.upstream, f.router}
+}
+
+// recordingTransport records the answer to each query in a Router.
+type recordingTransport struct {
+	doh.Transport
+	router *Router
+}
+
+func (t *recordingTransport) Query(q []byte) ([]byte, error) {
+	response, err := t.Transport.Query(q)
+	if err == nil {
+		t.router.names.Record(response)
+	}
+	return response, err
+}
+
+// TCPHandler returns a TCP connection handler that serves the intercepted DNS
+// streams, and passes other connections to `next`.
+func (f *DNSForwarder) TCPHandler(next core.TCPConnHandler) core.TCPConnHandler {
+	return &dnsTCPHandler{next, f}
+}
+
+type dnsTCPHandler struct {
+	next core.TCPConnHandler
+	f    *DNSForwarder
+}
+
+func (h *dnsTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	if upstream := h.f.lookup(target.IP, target.Port); upstream != nil {
+		go doh.Accept(upstream, conn)
+		return nil
+	}
+	return h.next.Handle(conn, target)
+}
+
+// UDPHandler returns a UDP connection handler that answers the intercepted DNS
+// queries, and passes other sockets to `next`.
+func (f *DNSForwarder) UDPHandler(next core.UDPConnHandler) core.UDPConnHandler {
+	return &dnsUDPHandler{next: next, f: f, conns: make(map[core.UDPConn]*dnsUDPConn, 8)}
+}
+
+// dnsUDPConn is a local socket whose queries are intercepted.
+type dnsUDPConn struct {
+	upstream doh.Transport
+	pending  int // Number of queries awaiting a response.
+}
+
+type dnsUDPHandler struct {
+	next  core.UDPConnHandler
+	f     *DNSForwarder
+	mu    sync.Mutex // Protects conns.
+	conns map[core.UDPConn]*dnsUDPConn
+}
+
+func (h *dnsUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if upstream := h.f.lookup(target.IP, target.Port); upstream != nil {
+		h.mu.Lock()
+		h.conns[conn] = &dnsUDPConn{upstream: upstream}
+		h.mu.Unlock()
+		return nil
+	}
+	return h.next.Connect(conn, target)
+}
+
+func (h *dnsUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.mu.Lock()
+	c := h.conns[conn]
+	if c != nil {
+		c.pending++
+	}
+	h.mu.Unlock()
+	if c == nil {
+		return h.next.ReceiveTo(conn, data, addr)
+	}
+	q := append([]byte(nil), data...) // `data` is reused after this call returns.
+	go func() {
+		if response, err := c.upstream.Query(q); err == nil {
+			conn.WriteFrom(response, addr)
+		} else {
+			log.Warnf("DNS query to %s failed: %v", c.upstream.GetURL(), err)
+		}
+		// Close the socket once it has no pending queries.  Later queries from the
+		// same local port open a new socket.
+		h.mu.Lock()
+		c.pending--
+		done := c.pending == 0
+		if done {
+			delete(h.conns, conn)
+		}
+		h.mu.Unlock()
+		if done {
+			conn.Close()
+		}
+	}()
+	return nil
+}
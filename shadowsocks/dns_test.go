@@ -0,0 +1,255 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// directClient connects directly to the destinations, without a proxy.
+type directClient struct {
+	udpTestClient
+}
+
+func (c *directClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	conn, err := net.Dial("tcp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+func (c *directClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := c.udpTestClient.ListenUDP(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &resolvingPacketConn{conn}, nil
+}
+
+// resolvingPacketConn accepts any net.Addr, like the proxy's packet conns.
+type resolvingPacketConn struct {
+	net.PacketConn
+}
+
+func (c *resolvingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, udpAddr)
+}
+
+// Returns `response` with the ID of `query`.
+func withID(query, response []byte) []byte {
+	response = append([]byte(nil), response...)
+	copy(response, query[:2])
+	return response
+}
+
+// fixedDNSTransport answers every query with `response`.
+type fixedDNSTransport struct {
+	response []byte
+}
+
+func (t *fixedDNSTransport) Query(q []byte) ([]byte, error) { return withID(q, t.response), nil }
+func (t *fixedDNSTransport) GetURL() string                 { return "fixed" }
+
+var testQuery = []byte{0x12, 0x34, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func TestNewDNSUpstream(t *testing.T) {
+	client := &directClient{}
+	for _, upstream := range []string{"1.1.1.1", "1.1.1.1:5353", "udp://[2606:4700:4700::1111]", "tcp://dns.example:53", "https://dns.example/dns-query"} {
+		if _, err := NewDNSUpstream(client, upstream); err != nil {
+			t.Errorf("%s: %v", upstream, err)
+		}
+	}
+	for _, upstream := range []string{"", "tls://1.1.1.1", "udp://1.1.1.1:0", "tcp://1.1.1.1/path", "https:///dns-query"} {
+		if _, err := NewDNSUpstream(client, upstream); err == nil {
+			t.Errorf("Expected error for %q", upstream)
+		}
+	}
+}
+
+func TestDNSUpstreamUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	response := makeDNSResponse("a.test.", "192.0.2.1")
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// A stray response to another query is ignored.
+		server.WriteTo([]byte{0, 0, 0x80, 0}, addr)
+		server.WriteTo(withID(buf[:n], response), addr)
+	}()
+	upstream, err := NewDNSUpstream(&directClient{}, server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := upstream.Query(testQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, withID(testQuery, response)) {
+		t.Errorf("Unexpected response %v", got)
+	}
+}
+
+func TestDNSUpstreamTCP(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	response := makeDNSResponse("a.test.", "192.0.2.1")
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length [2]byte
+		io.ReadFull(conn, length[:])
+		q := make([]byte, binary.BigEndian.Uint16(length[:]))
+		io.ReadFull(conn, q)
+		binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+		conn.Write(append(length[:], withID(q, response)...))
+	}()
+	upstream, err := NewDNSUpstream(&directClient{}, "tcp://"+server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := upstream.Query(testQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, withID(testQuery, response)) {
+		t.Errorf("Unexpected response %v", got)
+	}
+}
+
+func TestDNSUpstreamHTTPS(t *testing.T) {
+	response := makeDNSResponse("a.test.", "192.0.2.1")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(q) < 2 || q[0] != 0 || q[1] != 0 {
+			w.WriteHeader(http.StatusBadRequest) // The ID must be 0.
+			return
+		}
+		w.Write(response)
+	}))
+	defer server.Close()
+	upstream := newHTTPSDNSUpstream(&directClient{}, server.URL+"/dns-query")
+	upstream.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	got, err := upstream.Query(testQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, withID(testQuery, response)) {
+		t.Errorf("Unexpected response %v", got)
+	}
+}
+
+func TestDNSForwarderUDP(t *testing.T) {
+	router := NewRouter()
+	f := NewDNSForwarder(router)
+	response := makeDNSResponse("a.test.", "192.0.2.1")
+	if err := f.SetUpstream([]string{"10.0.85.1"}, &fixedDNSTransport{response}); err != nil {
+		t.Fatal(err)
+	}
+	next := &fakeUDPHandler{}
+	h := f.UDPHandler(next)
+
+	resolver := &net.UDPAddr{IP: net.ParseIP("10.0.85.1"), Port: 53}
+	conn := makeUDPConn(5000)
+	if err := h.Connect(conn, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, testQuery, resolver); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, conn, string(withID(testQuery, response)))
+	waitFor(t, "DNS socket to close", func() bool { return conn.Closed() })
+	if name := router.names.Lookup(net.ParseIP("192.0.2.1")); name != "a.test" {
+		t.Errorf("Answer was not recorded: %q", name)
+	}
+	if len(next.conns) != 0 {
+		t.Error("Intercepted query reached the next handler")
+	}
+
+	// Other ports and resolvers are not intercepted.
+	for _, target := range []*net.UDPAddr{{IP: resolver.IP, Port: 5353}, {IP: net.ParseIP("10.0.85.2"), Port: 53}} {
+		if err := h.Connect(makeUDPConn(5001), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(next.conns) != 2 {
+		t.Errorf("Expected 2 sockets for the next handler, got %d", len(next.conns))
+	}
+
+	// The interception stops without an upstream.
+	if err := f.SetUpstream(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Connect(makeUDPConn(5002), resolver); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.conns) != 3 {
+		t.Error("Query was intercepted without an upstream")
+	}
+}
+
+func TestDNSForwarderTCP(t *testing.T) {
+	f := NewDNSForwarder(nil)
+	response := makeDNSResponse("a.test.", "192.0.2.1")
+	if err := f.SetUpstream([]string{"[fd00::1]:53"}, &fixedDNSTransport{response}); err != nil {
+		t.Fatal(err)
+	}
+	next := &fakeTCPHandler{}
+	h := f.TCPHandler(next)
+
+	app, tun := net.Pipe()
+	defer app.Close()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	go app.Write(append([]byte{0, byte(len(testQuery))}, testQuery...))
+	var length [2]byte
+	if _, err := io.ReadFull(app, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(app, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, withID(testQuery, response)) {
+		t.Errorf("Unexpected response %v", got)
+	}
+	if len(next.targets) != 0 {
+		t.Error("Intercepted stream reached the next handler")
+	}
+}
+
+func TestDNSForwarderInvalidAddress(t *testing.T) {
+	if err := NewDNSForwarder(nil).SetUpstream([]string{"dns.example"}, &fixedDNSTransport{}); err == nil {
+		t.Error("Expected error for a DNS address that is not an IP")
+	}
+}
@@ -0,0 +1,282 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// TLS record types used by the simple-obfs TLS mode.
+const (
+	tlsChangeCipherSpec = 0x14
+	tlsHandshake        = 0x16
+	tlsApplicationData  = 0x17
+	tlsMaxRecordSize    = 1 << 14
+)
+
+// obfsPlugin is a built-in implementation of the simple-obfs client, which
+// disguises the streams as HTTP websocket upgrades or TLS sessions.
+//
+// Supported options: obfs=http|tls, obfs-host=<hostname>, and obfs-uri=<path>
+// for HTTP.  The host defaults to the server's host.
+type obfsPlugin struct {
+	proxyAddr *net.TCPAddr
+	mode      string
+	host      string // TLS server name.
+	httpHost  string // HTTP Host header.
+	uri       string
+}
+
+func newObfsPlugin(options, host string, port int) (*obfsPlugin, error) {
+	opts, err := parsePluginOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	p := &obfsPlugin{mode: opts["obfs"], host: opts["obfs-host"], uri: opts["obfs-uri"]}
+	if p.mode != "http" && p.mode != "tls" {
+		return nil, fmt.Errorf("Unsupported obfs mode: %q", p.mode)
+	}
+	if p.host == "" {
+		p.host = host
+	}
+	if p.uri == "" {
+		p.uri = "/"
+	}
+	p.httpHost = p.host
+	if port != 80 {
+		p.httpHost = net.JoinHostPort(p.host, strconv.Itoa(port))
+	}
+	if p.proxyAddr, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		return nil, fmt.Errorf("Failed to resolve proxy address: %v", err)
+	}
+	return p, nil
+}
+
+func (p *obfsPlugin) DialTCP(laddr *net.TCPAddr) (onet.DuplexConn, error) {
+	conn, err := net.DialTCP("tcp", laddr, p.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.mode == "http" {
+		return &obfsHTTPConn{TCPConn: conn, host: p.httpHost, uri: p.uri}, nil
+	}
+	return &obfsTLSConn{TCPConn: conn, host: p.host}, nil
+}
+
+func (p *obfsPlugin) Close() error {
+	return nil
+}
+
+// Returns a random integer in [0, n).
+func randomInt(n int64) int64 {
+	i, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0
+	}
+	return i.Int64()
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// obfsHTTPConn sends the first data in the body of an HTTP websocket upgrade
+// request, and skips the header of the response.  The rest of the stream is
+// unchanged.
+type obfsHTTPConn struct {
+	*net.TCPConn
+	host, uri    string
+	wroteRequest bool
+	reader       io.Reader // Reads the stream after the response header.
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	if c.wroteRequest {
+		return c.TCPConn.Write(b)
+	}
+	c.wroteRequest = true
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\n", c.uri)
+	fmt.Fprintf(&req, "Host: %s\r\n", c.host)
+	fmt.Fprintf(&req, "User-Agent: curl/7.%d.%d\r\n", randomInt(51), randomInt(2))
+	fmt.Fprintf(&req, "Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&req, "Sec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(randomBytes(16)))
+	fmt.Fprintf(&req, "Content-Length: %d\r\n\r\n", len(b))
+	req.Write(b)
+	if _, err := c.TCPConn.Write(req.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		r := bufio.NewReader(c.TCPConn)
+		tp := textproto.NewReader(r)
+		status, err := tp.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasPrefix(status, "HTTP/1.1 101 ") {
+			return 0, fmt.Errorf("Unexpected obfs response: %q", status)
+		}
+		if _, err := tp.ReadMIMEHeader(); err != nil {
+			return 0, err
+		}
+		c.reader = r
+	}
+	return c.reader.Read(b)
+}
+
+// obfsTLSConn sends the first data in the session ticket of a TLS ClientHello,
+// and the rest in application data records.  It reads the payload of the
+// server's application data records, and skips its handshake.
+type obfsTLSConn struct {
+	*net.TCPConn
+	host      string // Server name.
+	writes    int
+	remaining int // Unread bytes in the current application data record.
+}
+
+var tlsCipherSuites = []byte{
+	0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+	0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+	0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+	0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+}
+
+// ec_point_formats, supported_groups, signature_algorithms, encrypt_then_mac,
+// and extended_master_secret, as sent by simple-obfs.
+var tlsOtherExtensions = []byte{
+	0x00, 0x0b, 0x00, 0x04, 0x03, 0x00, 0x01, 0x02,
+	0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18,
+	0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, 0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01,
+	0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02, 0x04, 0x03, 0x03, 0x01, 0x03, 0x02,
+	0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+	0x00, 0x16, 0x00, 0x00,
+	0x00, 0x17, 0x00, 0x00,
+}
+
+func writeUint16(buf *bytes.Buffer, n int) {
+	buf.WriteByte(byte(n >> 8))
+	buf.WriteByte(byte(n))
+}
+
+func writeTLSRecord(buf *bytes.Buffer, recordType byte, payload []byte) {
+	buf.WriteByte(recordType)
+	buf.Write([]byte{0x03, 0x03})
+	writeUint16(buf, len(payload))
+	buf.Write(payload)
+}
+
+// Returns a ClientHello record for `serverName` with `ticket` as the session
+// ticket.
+func makeClientHello(serverName string, ticket []byte) []byte {
+	var extensions bytes.Buffer
+	writeUint16(&extensions, 0x0023) // session_ticket
+	writeUint16(&extensions, len(ticket))
+	extensions.Write(ticket)
+	writeUint16(&extensions, 0x0000) // server_name
+	writeUint16(&extensions, len(serverName)+5)
+	writeUint16(&extensions, len(serverName)+3)
+	extensions.WriteByte(0) // host_name
+	writeUint16(&extensions, len(serverName))
+	extensions.WriteString(serverName)
+	extensions.Write(tlsOtherExtensions)
+
+	var hello bytes.Buffer
+	hello.Write([]byte{0x03, 0x03})
+	hello.Write(randomBytes(32))
+	hello.WriteByte(32)
+	hello.Write(randomBytes(32)) // Session ID
+	writeUint16(&hello, len(tlsCipherSuites))
+	hello.Write(tlsCipherSuites)
+	hello.Write([]byte{0x01, 0x00}) // Null compression only.
+	writeUint16(&hello, extensions.Len())
+	hello.Write(extensions.Bytes())
+
+	var record bytes.Buffer
+	record.Write([]byte{tlsHandshake, 0x03, 0x01})
+	writeUint16(&record, hello.Len()+4)
+	record.WriteByte(0x01) // client_hello
+	record.WriteByte(byte(hello.Len() >> 16))
+	writeUint16(&record, hello.Len())
+	record.Write(hello.Bytes())
+	return record.Bytes()
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	switch c.writes {
+	case 0:
+		out.Write(makeClientHello(c.host, b))
+		c.writes++
+	case 1:
+		// Complete the handshake with a ChangeCipherSpec and an "encrypted" Finished.
+		writeTLSRecord(&out, tlsChangeCipherSpec, []byte{0x01})
+		writeTLSRecord(&out, tlsHandshake, randomBytes(32))
+		c.writes++
+		fallthrough
+	default:
+		for _, record := range splitRecords(b) {
+			writeTLSRecord(&out, tlsApplicationData, record)
+		}
+	}
+	if _, err := c.TCPConn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func splitRecords(b []byte) [][]byte {
+	var records [][]byte
+	for len(b) > 0 {
+		n := len(b)
+		if n > tlsMaxRecordSize {
+			n = tlsMaxRecordSize
+		}
+		records = append(records, b[:n])
+		b = b[n:]
+	}
+	return records
+}
+
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		var header [5]byte
+		if _, err := io.ReadFull(c.TCPConn, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		switch header[0] {
+		case tlsApplicationData:
+			c.remaining = length
+		case tlsHandshake, tlsChangeCipherSpec:
+			if _, err := io.CopyN(ioutil.Discard, c.TCPConn, int64(length)); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("Unexpected TLS record type: %d", header[0])
+		}
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.TCPConn.Read(b)
+	c.remaining -= n
+	return n, err
+}
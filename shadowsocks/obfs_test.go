@@ -0,0 +1,264 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Reads a simple-obfs ClientHello, and returns its session ticket and server
+// name.
+func readClientHello(r io.Reader) (ticket []byte, serverName string, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	if header[0] != tlsHandshake {
+		return nil, "", fmt.Errorf("Unexpected record type %d", header[0])
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err = io.ReadFull(r, record); err != nil {
+		return
+	}
+	// Skip the handshake header, version, random and session ID.
+	b := record[4+2+32:]
+	b = b[1+b[0]:]
+	b = b[2+binary.BigEndian.Uint16(b):] // Cipher suites
+	b = b[1+b[0]:]                       // Compression methods
+	b = b[2:]                            // Extensions length
+	for len(b) >= 4 {
+		extType, extLen := binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:])
+		data := b[4 : 4+extLen]
+		switch extType {
+		case 0x0023:
+			ticket = data
+		case 0x0000:
+			serverName = string(data[5:])
+		}
+		b = b[4+extLen:]
+	}
+	if ticket == nil {
+		err = errors.New("Missing session ticket")
+	}
+	return
+}
+
+// Reads the payload of TLS application data records, and skips the others.
+type tlsRecordReader struct {
+	r       io.Reader
+	pending []byte
+}
+
+func (t *tlsRecordReader) Read(b []byte) (int, error) {
+	for len(t.pending) == 0 {
+		var header [5]byte
+		if _, err := io.ReadFull(t.r, header[:]); err != nil {
+			return 0, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(t.r, payload); err != nil {
+			return 0, err
+		}
+		if header[0] == tlsApplicationData {
+			t.pending = payload
+		}
+	}
+	n := copy(b, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// Writes the server side of a simple-obfs TLS session.
+type tlsServerWriter struct {
+	w          io.Writer
+	wroteHello bool
+}
+
+func (t *tlsServerWriter) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	if !t.wroteHello {
+		t.wroteHello = true
+		writeTLSRecord(&out, tlsHandshake, randomBytes(90)) // ServerHello
+		writeTLSRecord(&out, tlsChangeCipherSpec, []byte{0x01})
+		writeTLSRecord(&out, tlsHandshake, randomBytes(40)) // Finished
+	}
+	for _, record := range splitRecords(b) {
+		writeTLSRecord(&out, tlsApplicationData, record)
+	}
+	if _, err := t.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func unwrapObfsHTTP(conn net.Conn) (io.Reader, io.Writer, bool) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Header.Get("Upgrade") != "websocket" {
+		return nil, nil, false
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	return io.MultiReader(req.Body, br), conn, true
+}
+
+func unwrapObfsTLS(conn net.Conn) (io.Reader, io.Writer, bool) {
+	ticket, _, err := readClientHello(conn)
+	if err != nil {
+		return nil, nil, false
+	}
+	return io.MultiReader(bytes.NewReader(ticket), &tlsRecordReader{r: conn}), &tlsServerWriter{w: conn}, true
+}
+
+func TestServerClientWithObfs(t *testing.T) {
+	for mode, unwrap := range map[string]func(net.Conn) (io.Reader, io.Writer, bool){
+		"http": unwrapObfsHTTP,
+		"tls":  unwrapObfsTLS,
+	} {
+		port, targets := startTestServer(t, unwrap)
+		server := Server{Host: "127.0.0.1", Port: port, Password: testPassword, Cipher: testCipher,
+			Plugin: "obfs-local", PluginOptions: "obfs=" + mode + ";obfs-host=example.net"}
+		client, err := NewServerClient(server)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if err := CheckTCPConnectivityWithHTTP(client, "http://example.com"); err != nil {
+			t.Errorf("%s: connectivity check failed: %v", mode, err)
+		} else if target := <-targets; target != "example.com:80" {
+			t.Errorf("%s: unexpected target %s", mode, target)
+		}
+		client.Close()
+	}
+}
+
+// Returns both ends of a TCP connection through an obfs plugin with `options`.
+func dialObfs(t *testing.T, options string) (io.ReadWriteCloser, net.Conn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	plugin, err := newObfsPlugin(options, "127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := plugin.DialTCP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		serverConn.Close()
+	})
+	return conn, serverConn
+}
+
+func TestObfsHTTPConn(t *testing.T) {
+	conn, serverConn := dialObfs(t, "obfs=http;obfs-host=example.net;obfs-uri=/chat")
+	conn.Write([]byte("hello"))
+	conn.Write([]byte("world"))
+
+	br := bufio.NewReader(serverConn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.Path != "/chat" || req.Host != "example.net:"+fmt.Sprint(serverConn.LocalAddr().(*net.TCPAddr).Port) {
+		t.Errorf("Unexpected request for %s%s", req.Host, req.URL.Path)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "hello" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	rest := make([]byte, 5)
+	if _, err := io.ReadFull(br, rest); err != nil || string(rest) != "world" {
+		t.Errorf("Unexpected data after the request: %q, %v", rest, err)
+	}
+
+	fmt.Fprintf(serverConn, "HTTP/1.1 101 Switching Protocols\r\nServer: nginx/1.17.0\r\n\r\nreply")
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+		t.Errorf("Unexpected reply %q, %v", reply, err)
+	}
+}
+
+func TestObfsHTTPConnRejected(t *testing.T) {
+	conn, serverConn := dialObfs(t, "obfs=http")
+	conn.Write([]byte("hello"))
+	fmt.Fprintf(serverConn, "HTTP/1.1 404 Not Found\r\n\r\n")
+	if _, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Error("Expected error for a non-upgrade response")
+	}
+}
+
+func TestObfsTLSConn(t *testing.T) {
+	conn, serverConn := dialObfs(t, "obfs=tls;obfs-host=example.net")
+	conn.Write([]byte("hello"))
+	conn.Write([]byte("world"))
+
+	ticket, serverName, err := readClientHello(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ticket) != "hello" || serverName != "example.net" {
+		t.Errorf("Unexpected ClientHello with ticket %q for %s", ticket, serverName)
+	}
+	var header [5]byte
+	for _, expected := range []byte{tlsChangeCipherSpec, tlsHandshake} {
+		if _, err := io.ReadFull(serverConn, header[:]); err != nil || header[0] != expected {
+			t.Fatalf("Expected record type %d, got %d, %v", expected, header[0], err)
+		}
+		io.CopyN(ioutil.Discard, serverConn, int64(binary.BigEndian.Uint16(header[3:])))
+	}
+	rest := make([]byte, 5)
+	if _, err := io.ReadFull(&tlsRecordReader{r: serverConn}, rest); err != nil || string(rest) != "world" {
+		t.Errorf("Unexpected application data: %q, %v", rest, err)
+	}
+
+	(&tlsServerWriter{w: serverConn}).Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+		t.Errorf("Unexpected reply %q, %v", reply, err)
+	}
+}
+
+func TestStartPluginInvalid(t *testing.T) {
+	cases := []struct{ name, options string }{
+		{"obfs-local", ""},
+		{"obfs-local", "obfs=websocket"},
+		{"obfs-local", "obfs=http\\"},
+		{"no-such-plugin", ""},
+	}
+	for _, c := range cases {
+		if plugin, err := StartPlugin(c.name, c.options, "127.0.0.1", 8388); err == nil {
+			plugin.Close()
+			t.Errorf("%s %q: expected error", c.name, c.options)
+		}
+	}
+}
+
+func TestParsePluginOptions(t *testing.T) {
+	opts, err := parsePluginOptions(`obfs=http;obfs-host=a\;b\=c;fast-open;;path=/x\\y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"obfs": "http", "obfs-host": "a;b=c", "fast-open": "", "path": `/x\y`}
+	if len(opts) != len(expected) {
+		t.Errorf("Got %v, expected %v", opts, expected)
+	}
+	for k, v := range expected {
+		if opts[k] != v {
+			t.Errorf("%s: got %q, expected %q", k, opts[k], v)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// Plugin is a SIP003 transport plugin, which wraps the TCP streams to a
+// Shadowsocks server, e.g. to make them look like HTTP or TLS.
+type Plugin interface {
+	// DialTCP opens a stream to the server through the plugin.
+	DialTCP(laddr *net.TCPAddr) (onet.DuplexConn, error)
+	// Close stops the plugin, which may close its streams.
+	Close() error
+}
+
+// Names of the SIP003 plugin executables that StartPlugin may run, once
+// enabled with EnableExecPlugins.  They are looked up in the PATH.
+var execPlugins = map[string]bool{
+	"v2ray-plugin": true,
+	"xray-plugin":  true,
+}
+
+// Whether StartPlugin may run plugin executables.  Accessed atomically.
+var execPluginsEnabled int32
+
+// EnableExecPlugins sets whether StartPlugin may run the executables of SIP003
+// plugins other than the built-in ones, which is disabled by default.  The
+// plugin is named by the access key, which may be untrusted, so only a few
+// well-known plugins are allowed.
+func EnableExecPlugins(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&execPluginsEnabled, v)
+}
+
+// StartPlugin starts the plugin `name` for the server at `host`:`port`, with
+// SIP003 `options`, such as "obfs=http;obfs-host=example.com".
+//
+// The simple-obfs plugin, named "obfs-local" or "simple-obfs", is built in.
+// On Linux, macOS and Windows, "v2ray-plugin" and "xray-plugin" run the
+// executable of that name from the PATH, until Close is called, if enabled by
+// EnableExecPlugins.  Other platforms, including Android and iOS, cannot run
+// executables, so only the built-in plugins are supported.
+func StartPlugin(name, options, host string, port int) (Plugin, error) {
+	switch name {
+	case "obfs-local", "simple-obfs":
+		return newObfsPlugin(options, host, port)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("Invalid plugin name: %s", name)
+	}
+	if !execPlugins[name] {
+		return nil, fmt.Errorf("Unsupported plugin: %s", name)
+	}
+	if atomic.LoadInt32(&execPluginsEnabled) == 0 {
+		return nil, fmt.Errorf("Plugin executables are disabled: %s", name)
+	}
+	return startExecPlugin(name, options, host, port)
+}
+
+// Parses SIP003 plugin options, which are semicolon-separated key=value pairs.
+// A backslash escapes the next character.  A key without a value maps to "".
+func parsePluginOptions(options string) (map[string]string, error) {
+	opts := make(map[string]string)
+	var key, token strings.Builder
+	inValue := false
+	end := func() {
+		if inValue {
+			opts[key.String()] = token.String()
+		} else if token.Len() > 0 {
+			opts[token.String()] = ""
+		}
+		key.Reset()
+		token.Reset()
+		inValue = false
+	}
+	for i := 0; i < len(options); i++ {
+		switch b := options[i]; {
+		case b == '\\':
+			i++
+			if i == len(options) {
+				return nil, errors.New("Invalid plugin options: trailing backslash")
+			}
+			token.WriteByte(options[i])
+		case b == '=' && !inValue:
+			key.WriteString(token.String())
+			token.Reset()
+			inValue = true
+		case b == ';':
+			end()
+		default:
+			token.WriteByte(b)
+		}
+	}
+	end()
+	return opts, nil
+}
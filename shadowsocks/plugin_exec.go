@@ -0,0 +1,94 @@
+//go:build (linux && !android) || (darwin && !ios) || windows
+// +build linux,!android darwin,!ios windows
+
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+const (
+	// How long to retry connecting to a plugin that has not started listening.
+	pluginStartTimeout = 5 * time.Second
+	pluginRetryDelay   = 50 * time.Millisecond
+)
+
+// execPlugin is a SIP003 plugin executable, which listens on a local port and
+// forwards the streams to the server.
+type execPlugin struct {
+	cmd       *exec.Cmd
+	localAddr *net.TCPAddr
+	started   time.Time
+	exited    chan struct{}
+}
+
+func startExecPlugin(name, options, host string, port int) (Plugin, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported plugin: %v", err)
+	}
+	localAddr, err := freeLocalAddr()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+host,
+		"SS_REMOTE_PORT="+strconv.Itoa(port),
+		"SS_LOCAL_HOST="+localAddr.IP.String(),
+		"SS_LOCAL_PORT="+strconv.Itoa(localAddr.Port),
+		"SS_PLUGIN_OPTIONS="+options)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start plugin: %v", err)
+	}
+	p := &execPlugin{cmd: cmd, localAddr: localAddr, started: time.Now(), exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// Returns a loopback address with a port that is currently free.
+func freeLocalAddr() (*net.TCPAddr, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr), nil
+}
+
+// DialTCP connects to the plugin's local port.  `laddr` is ignored, because the
+// plugin makes the connection to the server.
+func (p *execPlugin) DialTCP(laddr *net.TCPAddr) (onet.DuplexConn, error) {
+	for {
+		conn, err := net.DialTCP("tcp", nil, p.localAddr)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-p.exited:
+			return nil, errors.New("Plugin exited")
+		default:
+		}
+		if time.Since(p.started) > pluginStartTimeout {
+			return nil, err
+		}
+		time.Sleep(pluginRetryDelay)
+	}
+}
+
+func (p *execPlugin) Close() error {
+	p.cmd.Process.Kill()
+	<-p.exited
+	return nil
+}
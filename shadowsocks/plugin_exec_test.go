@@ -0,0 +1,120 @@
+//go:build linux && !android
+// +build linux,!android
+
+package shadowsocks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHelperPlugin is not a real test.  It is run as a SIP003 plugin by
+// TestExecPlugin, and forwards the local port to the server.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("GO_TEST_HELPER_PLUGIN") != "1" {
+		t.Skip("Only run as a plugin")
+	}
+	if os.Getenv("SS_PLUGIN_OPTIONS") != "mode=test" {
+		os.Exit(1)
+	}
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() {
+			defer conn.Close()
+			server, err := net.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer server.Close()
+			go io.Copy(server, conn)
+			io.Copy(conn, server)
+		}()
+	}
+}
+
+// Writes a plugin executable named v2ray-plugin that runs TestHelperPlugin,
+// adds it to the PATH, and enables plugin executables.
+func installHelperPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		os.Setenv("PATH", path)
+		EnableExecPlugins(false)
+	})
+	script := fmt.Sprintf("#!/bin/sh\nGO_TEST_HELPER_PLUGIN=1 exec %q -test.run='^TestHelperPlugin$'\n", os.Args[0])
+	if err := ioutil.WriteFile(filepath.Join(dir, "v2ray-plugin"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	EnableExecPlugins(true)
+}
+
+func TestExecPlugin(t *testing.T) {
+	installHelperPlugin(t)
+	port, targets := startPrefixServer(t, nil)
+	server := Server{Host: "127.0.0.1", Port: port, Password: testPassword, Cipher: testCipher,
+		Plugin: "v2ray-plugin", PluginOptions: "mode=test"}
+	client, err := NewServerClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTCPConnectivityWithHTTP(client, "http://example.com"); err != nil {
+		t.Errorf("Connectivity check through the plugin failed: %v", err)
+	} else if target := <-targets; target != "example.com:80" {
+		t.Errorf("Unexpected target %s", target)
+	}
+	client.Close()
+	if _, err := client.DialTCP(nil, "example.com:80"); err == nil {
+		t.Error("Plugin still running after Close")
+	}
+}
+
+func TestExecPluginExited(t *testing.T) {
+	installHelperPlugin(t)
+	port, _ := startPrefixServer(t, nil)
+	server := Server{Host: "127.0.0.1", Port: port, Password: testPassword, Cipher: testCipher,
+		Plugin: "v2ray-plugin", PluginOptions: "mode=invalid"}
+	client, err := NewServerClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.DialTCP(nil, "example.com:80"); err == nil {
+		t.Error("Expected error from a plugin that exited")
+	}
+}
+
+func TestExecPluginRejected(t *testing.T) {
+	installHelperPlugin(t)
+	dir := filepath.Dir(os.Args[0])
+	// Only the allowed plugins run, and only from the PATH.
+	for _, name := range []string{"sh", "/bin/sh", filepath.Join(dir, "v2ray-plugin"), "./v2ray-plugin", `..\v2ray-plugin`} {
+		if p, err := StartPlugin(name, "mode=test", "127.0.0.1", 8388); err == nil {
+			p.Close()
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	EnableExecPlugins(false)
+	if p, err := StartPlugin("v2ray-plugin", "mode=test", "127.0.0.1", 8388); err == nil {
+		p.Close()
+		t.Error("Plugin executable ran while disabled")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build (!linux || android) && (!darwin || ios) && !windows
+// +build !linux android
+// +build !darwin ios
+// +build !windows
+
+package shadowsocks
+
+import "fmt"
+
+func startExecPlugin(name, options, host string, port int) (Plugin, error) {
+	return nil, fmt.Errorf("Unsupported plugin: %s", name)
+}
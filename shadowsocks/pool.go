@@ -0,0 +1,548 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// Server selection policies for Pool.
+const (
+	// PolicyFailover uses the first healthy server, in the configured order.
+	PolicyFailover = "failover"
+	// PolicyRoundRobin rotates through the healthy servers, one per connection.
+	PolicyRoundRobin = "round-robin"
+	// PolicyLatency uses the healthy server with the lowest health check latency.
+	PolicyLatency = "latency"
+)
+
+// Server is the configuration of a Shadowsocks server.
+type Server struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+	Cipher   string `json:"cipher"`
+	// Plugin is the name of a SIP003 plugin, such as "obfs-local", or empty.
+	Plugin string `json:"plugin,omitempty"`
+	// PluginOptions are the plugin's options, such as "obfs=http;obfs-host=example.com".
+	PluginOptions string `json:"plugin_opts,omitempty"`
+	// Prefix is sent at the start of each TCP stream, in place of the first
+	// bytes of the salt.  See NewClientWithPrefix.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// ParseServers parses a JSON array of Server objects.
+func ParseServers(config string) ([]Server, error) {
+	var servers []Server
+	if err := json.Unmarshal([]byte(config), &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// ServerStatus is the health of a server in a Pool.
+type ServerStatus struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Healthy bool   `json:"healthy"`
+	UDP     bool   `json:"udp"`
+	// Latency of the last successful TCP health check, or 0 if unknown.
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+type poolMember struct {
+	server Server
+	client shadowsocks.Client
+
+	mu      sync.Mutex // Protects the fields below.
+	healthy bool
+	udp     bool
+	latency time.Duration
+	refs    int  // Open connections through the member's client.
+	removed bool // True once the member has left the pool.
+	evicted bool // True once the member's connections have been closed.
+	closed  bool // True once the member's plugin has been stopped.
+	// Functions that close the flows of open connections, by connection.
+	onEvict map[*poolRef]func()
+}
+
+func (m *poolMember) status() ServerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ServerStatus{m.server.Host, m.server.Port, m.healthy, m.udp, int64(m.latency / time.Millisecond)}
+}
+
+func (m *poolMember) setHealthy(healthy bool) {
+	m.mu.Lock()
+	m.healthy = healthy
+	m.mu.Unlock()
+}
+
+// Pool is a shadowsocks.Client that distributes connections over several
+// Shadowsocks servers.  A server that fails to connect is marked unhealthy,
+// and the connection is retried on the next server, until a health check
+// finds that it has recovered.  Servers are optimistically assumed to be
+// healthy until they are checked.
+type Pool struct {
+	mu      sync.RWMutex // Protects members, removed, policy and targets.
+	members []*poolMember
+	removed []*poolMember // Removed members that may have open connections.
+	policy  string
+	targets CheckTargets
+	next    uint32 // Round-robin counter.
+
+	newClient func(Server) (shadowsocks.Client, error)
+	stop      chan struct{}
+}
+
+// NewPool returns a Pool of `servers`, using the selection `policy`.
+func NewPool(servers []Server, policy string) (*Pool, error) {
+	p := &Pool{targets: DefaultCheckTargets(), newClient: newClient}
+	if err := p.Update(servers, policy); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func newClient(s Server) (shadowsocks.Client, error) {
+	return NewServerClient(s)
+}
+
+// Stops the plugin of a member's server, if any.
+func (m *poolMember) close() {
+	m.mu.Lock()
+	closed := m.closed
+	m.closed = true
+	m.mu.Unlock()
+	if closed {
+		return
+	}
+	if c, ok := m.client.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Adds a reference for a new connection.  Returns false if the member has
+// left the pool, in which case it must not be used.
+func (m *poolMember) acquire() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removed {
+		return false
+	}
+	m.refs++
+	return true
+}
+
+// Drops a connection's reference, and stops the plugin of a removed member
+// after its last connection.
+func (m *poolMember) release(r *poolRef) {
+	m.mu.Lock()
+	delete(m.onEvict, r)
+	m.refs--
+	drained := m.removed && m.refs == 0
+	m.mu.Unlock()
+	if drained {
+		m.close()
+	}
+}
+
+// Takes the member out of the pool.  Its plugin is stopped once its open
+// connections have closed.
+func (m *poolMember) remove() {
+	m.mu.Lock()
+	m.removed = true
+	drained := m.refs == 0
+	m.mu.Unlock()
+	if drained {
+		m.close()
+	}
+}
+
+// Closes the flows of a removed member's open connections, and of any
+// connection that registers later.
+func (m *poolMember) evict() {
+	m.mu.Lock()
+	m.evicted = true
+	closers := make([]func(), 0, len(m.onEvict))
+	for _, f := range m.onEvict {
+		closers = append(closers, f)
+	}
+	m.onEvict = nil
+	m.mu.Unlock()
+	for _, f := range closers {
+		f()
+	}
+}
+
+// Returns true if the member has left the pool and has no open connections.
+func (m *poolMember) drained() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removed && m.refs == 0
+}
+
+// poolRef is a connection's reference to the member that carries it.
+type poolRef struct {
+	m          *poolMember
+	closeRead  int32
+	closeWrite int32
+	once       sync.Once
+}
+
+func (r *poolRef) release() {
+	r.once.Do(func() { r.m.release(r) })
+}
+
+// Registers `close` to close the connection's flow if its server is evicted.
+func (r *poolRef) closeOnEvict(close func()) {
+	m := r.m
+	m.mu.Lock()
+	if m.evicted {
+		m.mu.Unlock()
+		close()
+		return
+	}
+	if m.onEvict == nil {
+		m.onEvict = make(map[*poolRef]func())
+	}
+	m.onEvict[r] = close
+	m.mu.Unlock()
+}
+
+// closeOnEvict calls `close` when Pool.CloseRemoved evicts the server of
+// `conn`, or immediately if it has been evicted already.  It does nothing if
+// `conn` was not opened by a Pool.
+func closeOnEvict(conn interface{}, close func()) {
+	switch c := conn.(type) {
+	case *poolStreamConn:
+		c.ref.closeOnEvict(close)
+	case *poolPacketConn:
+		c.ref.closeOnEvict(close)
+	}
+}
+
+// Releases the reference once both directions are closed.
+func (r *poolRef) halfClose(flag *int32) {
+	atomic.StoreInt32(flag, 1)
+	if atomic.LoadInt32(&r.closeRead) != 0 && atomic.LoadInt32(&r.closeWrite) != 0 {
+		r.release()
+	}
+}
+
+// poolStreamConn is a TCP connection through a pool member.
+type poolStreamConn struct {
+	onet.DuplexConn
+	ref *poolRef
+}
+
+func (c *poolStreamConn) Close() error {
+	defer c.ref.release()
+	return c.DuplexConn.Close()
+}
+
+func (c *poolStreamConn) CloseRead() error {
+	defer c.ref.halfClose(&c.ref.closeRead)
+	return c.DuplexConn.CloseRead()
+}
+
+func (c *poolStreamConn) CloseWrite() error {
+	defer c.ref.halfClose(&c.ref.closeWrite)
+	return c.DuplexConn.CloseWrite()
+}
+
+// poolPacketConn is a UDP socket through a pool member.
+type poolPacketConn struct {
+	net.PacketConn
+	ref *poolRef
+}
+
+func (c *poolPacketConn) Close() error {
+	defer c.ref.release()
+	return c.PacketConn.Close()
+}
+
+// Update replaces the servers and policy.  Servers that remain in the pool
+// keep their health state.  Existing connections are not affected: the
+// plugin of a removed server is stopped after its last connection closes.
+func (p *Pool) Update(servers []Server, policy string) error {
+	switch policy {
+	case PolicyFailover, PolicyRoundRobin, PolicyLatency:
+	default:
+		return fmt.Errorf("Unknown policy: %s", policy)
+	}
+	if len(servers) == 0 {
+		return errors.New("Must provide at least one server")
+	}
+	p.mu.RLock()
+	old := make(map[Server]*poolMember, len(p.members))
+	for _, m := range p.members {
+		old[m.server] = m
+	}
+	p.mu.RUnlock()
+
+	members := make([]*poolMember, 0, len(servers))
+	var added []*poolMember
+	for i, s := range servers {
+		if m, ok := old[s]; ok {
+			members = append(members, m)
+			delete(old, s)
+			continue
+		}
+		client, err := p.newClient(s)
+		if err != nil {
+			for _, m := range added {
+				m.close()
+			}
+			return fmt.Errorf("Server %d: %v", i, err)
+		}
+		m := &poolMember{server: s, client: client, healthy: true, udp: true}
+		members = append(members, m)
+		added = append(added, m)
+	}
+	p.mu.Lock()
+	p.members = members
+	p.policy = policy
+	removed := p.removed[:0]
+	for _, m := range p.removed {
+		if !m.drained() {
+			removed = append(removed, m)
+		}
+	}
+	for _, m := range old {
+		removed = append(removed, m)
+	}
+	p.removed = removed
+	p.mu.Unlock()
+	for _, m := range old {
+		m.remove()
+	}
+	return nil
+}
+
+// CloseRemoved closes the flows of every connection through a server that has
+// left the pool, including connections that are still being opened.  Only the
+// flows of handlers that use the pool, such as NewClientTCPHandler, are closed.
+func (p *Pool) CloseRemoved() {
+	p.mu.Lock()
+	removed := p.removed
+	p.removed = nil
+	p.mu.Unlock()
+	for _, m := range removed {
+		m.evict()
+	}
+}
+
+// Policy returns the current selection policy.
+func (p *Pool) Policy() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.policy
+}
+
+// Returns the members in the order in which they should be tried: healthy
+// members in policy order, followed by the unhealthy members.
+func (p *Pool) candidates(udp bool) []*poolMember {
+	p.mu.RLock()
+	members := append([]*poolMember(nil), p.members...)
+	policy := p.policy
+	p.mu.RUnlock()
+
+	if policy == PolicyRoundRobin && len(members) > 1 {
+		start := int(atomic.AddUint32(&p.next, 1)-1) % len(members)
+		members = append(members[start:], members[:start]...)
+	}
+	type rank struct {
+		usable  bool
+		latency time.Duration
+	}
+	ranks := make(map[*poolMember]rank, len(members))
+	for _, m := range members {
+		m.mu.Lock()
+		r := rank{m.healthy && (!udp || m.udp), m.latency}
+		m.mu.Unlock()
+		if r.latency == 0 || policy != PolicyLatency {
+			r.latency = time.Duration(1<<63 - 1)
+		}
+		ranks[m] = r
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		ri, rj := ranks[members[i]], ranks[members[j]]
+		if ri.usable != rj.usable {
+			return ri.usable
+		}
+		return ri.latency < rj.latency
+	})
+	return members
+}
+
+// errPoolUpdated is returned if every candidate server left the pool while
+// connecting.
+var errPoolUpdated = errors.New("Servers were replaced while connecting")
+
+// DialTCP connects through the first server that accepts the connection.
+func (p *Pool) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	err := errPoolUpdated
+	for _, m := range p.candidates(false) {
+		if !m.acquire() {
+			continue
+		}
+		var conn onet.DuplexConn
+		if conn, err = m.client.DialTCP(laddr, raddr); err == nil {
+			m.setHealthy(true)
+			return &poolStreamConn{conn, &poolRef{m: m}}, nil
+		}
+		m.release(nil)
+		m.setHealthy(false)
+	}
+	return nil, err
+}
+
+// ListenUDP relays packets through the first healthy server that supports UDP.
+func (p *Pool) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	err := errPoolUpdated
+	for _, m := range p.candidates(true) {
+		if !m.acquire() {
+			continue
+		}
+		var conn net.PacketConn
+		if conn, err = m.client.ListenUDP(laddr); err == nil {
+			return &poolPacketConn{conn, &poolRef{m: m}}, nil
+		}
+		m.release(nil)
+	}
+	return nil, err
+}
+
+// CheckTargets returns the targets of the health checks.
+func (p *Pool) CheckTargets() CheckTargets {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.targets
+}
+
+// SetCheckTargets sets the targets of the health checks, which default to
+// DefaultCheckTargets.
+func (p *Pool) SetCheckTargets(targets CheckTargets) error {
+	if err := targets.Validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = targets
+	return nil
+}
+
+// CheckHealth checks the TCP and UDP connectivity of every server in parallel,
+// and updates their health and latency.
+func (p *Pool) CheckHealth() {
+	p.mu.RLock()
+	members := append([]*poolMember(nil), p.members...)
+	targets := p.targets
+	p.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, m := range members {
+		if !m.acquire() {
+			continue
+		}
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+			defer m.release(nil)
+			start := time.Now()
+			tcpErr := CheckTCPConnectivityWithHTTP(m.client, targets.URL)
+			latency := time.Since(start)
+			udpErr := CheckUDPConnectivityWithDNS(m.client, shadowsocks.NewAddr(targets.Resolver, "udp"))
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			// The UDP check is a superset of the TCP check, as in CheckConnectivity.
+			m.healthy = tcpErr == nil || udpErr == nil
+			m.udp = udpErr == nil
+			if tcpErr == nil {
+				m.latency = latency
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// StartHealthChecks runs CheckHealth every `interval`, while the pool has more
+// than one server or a server has failed, until Stop is called.
+func (p *Pool) StartHealthChecks(interval time.Duration) {
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	p.stop = stop
+	p.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if p.needsHealthChecks() {
+					p.CheckHealth()
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic health checks, and stops the servers' plugins, even
+// if they carry open connections.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	for _, m := range p.members {
+		m.close()
+	}
+	for _, m := range p.removed {
+		m.close()
+	}
+	p.removed = nil
+}
+
+// Returns true if there is a choice of servers, or a server has failed and
+// must be checked to recover.
+func (p *Pool) needsHealthChecks() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.members) > 1 {
+		return true
+	}
+	for _, m := range p.members {
+		if s := m.status(); !s.Healthy || !s.UDP {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the health of each server, in the configured order.
+func (p *Pool) Status() []ServerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	status := make([]ServerStatus, 0, len(p.members))
+	for _, m := range p.members {
+		status = append(status, m.status())
+	}
+	return status
+}
@@ -0,0 +1,271 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// countingClient is a fakeSSClient that counts its TCP dials.
+type countingClient struct {
+	fakeSSClient
+	dials  int
+	closed bool
+}
+
+func (c *countingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *countingClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	c.dials++
+	return c.fakeSSClient.DialTCP(laddr, raddr)
+}
+
+// Returns a pool of servers named by port, whose clients are taken from `clients`.
+func makePool(t *testing.T, policy string, clients ...*countingClient) *Pool {
+	p := &Pool{newClient: func(s Server) (shadowsocks.Client, error) {
+		return clients[s.Port], nil
+	}}
+	if err := p.Update(makeServers(len(clients)), policy); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func makeServers(n int) []Server {
+	servers := make([]Server, n)
+	for i := range servers {
+		servers[i] = Server{Host: "192.0.2.1", Port: i, Password: "test", Cipher: "chacha20-ietf-poly1305"}
+	}
+	return servers
+}
+
+func dials(clients ...*countingClient) []int {
+	counts := make([]int, len(clients))
+	for i, c := range clients {
+		counts[i] = c.dials
+	}
+	return counts
+}
+
+func TestPoolFailover(t *testing.T) {
+	a := &countingClient{fakeSSClient: fakeSSClient{failReachability: true}}
+	b := &countingClient{}
+	c := &countingClient{}
+	p := makePool(t, PolicyFailover, a, b, c)
+	for i := 0; i < 2; i++ {
+		if _, err := p.DialTCP(nil, "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The failed server is skipped after the first attempt.
+	if d := dials(a, b, c); d[0] != 1 || d[1] != 2 || d[2] != 0 {
+		t.Errorf("Wrong dials: %v", d)
+	}
+	if status := p.Status(); status[0].Healthy || !status[1].Healthy {
+		t.Errorf("Wrong status: %v", status)
+	}
+
+	// If every server fails, the dial fails.
+	b.failReachability = true
+	c.failReachability = true
+	if _, err := p.DialTCP(nil, "example.com:80"); err == nil {
+		t.Error("Expected dial to fail")
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	clients := []*countingClient{{}, {}, {}}
+	p := makePool(t, PolicyRoundRobin, clients...)
+	for i := 0; i < 6; i++ {
+		if _, err := p.DialTCP(nil, "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := dials(clients...); d[0] != 2 || d[1] != 2 || d[2] != 2 {
+		t.Errorf("Uneven dials: %v", d)
+	}
+}
+
+func TestPoolLatency(t *testing.T) {
+	clients := []*countingClient{{}, {}, {}}
+	p := makePool(t, PolicyLatency, clients...)
+	p.members[0].latency = 300 * time.Millisecond
+	p.members[1].latency = 100 * time.Millisecond
+	p.members[2].latency = 0 // Unknown
+	candidates := p.candidates(false)
+	if candidates[0] != p.members[1] || candidates[1] != p.members[0] || candidates[2] != p.members[2] {
+		t.Errorf("Wrong order: %v", candidates)
+	}
+}
+
+func TestPoolCheckHealth(t *testing.T) {
+	noUDP := &countingClient{fakeSSClient: fakeSSClient{failUDP: true}}
+	down := &countingClient{fakeSSClient: fakeSSClient{failReachability: true}}
+	up := &countingClient{}
+	p := makePool(t, PolicyFailover, noUDP, down, up)
+	p.CheckHealth()
+	status := p.Status()
+	if !status[0].Healthy || status[0].UDP {
+		t.Errorf("Wrong status for server without UDP: %v", status[0])
+	}
+	if status[1].Healthy || status[1].UDP {
+		t.Errorf("Wrong status for unreachable server: %v", status[1])
+	}
+	if !status[2].Healthy || !status[2].UDP {
+		t.Errorf("Wrong status for healthy server: %v", status[2])
+	}
+	if candidates := p.candidates(true); candidates[0] != p.members[2] {
+		t.Errorf("UDP should prefer server 2, got %v", candidates[0].server)
+	}
+	if candidates := p.candidates(false); candidates[0] != p.members[0] {
+		t.Errorf("TCP should prefer server 0, got %v", candidates[0].server)
+	}
+}
+
+func TestPoolUpdate(t *testing.T) {
+	clients := []*countingClient{{}, {}, {}}
+	p := makePool(t, PolicyFailover, clients...)
+	p.members[1].setHealthy(false)
+	servers := makeServers(3)
+	if err := p.Update([]Server{servers[1], servers[2]}, PolicyRoundRobin); err != nil {
+		t.Fatal(err)
+	}
+	if status := p.Status(); len(status) != 2 || status[0].Port != 1 || status[0].Healthy {
+		t.Errorf("Health state was not kept: %v", status)
+	}
+	if !clients[0].closed || clients[1].closed || clients[2].closed {
+		t.Error("Only the removed server's client should be closed")
+	}
+	if err := p.Update(servers, "random"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+	if err := p.Update(nil, PolicyFailover); err == nil {
+		t.Error("Expected error for empty pool")
+	}
+	if len(p.Status()) != 2 {
+		t.Error("Failed update changed the pool")
+	}
+	p.Stop()
+	if !clients[1].closed || !clients[2].closed {
+		t.Error("Stop should close the clients")
+	}
+}
+
+func TestPoolUpdateDrain(t *testing.T) {
+	clients := []*countingClient{{}, {}}
+	p := makePool(t, PolicyFailover, clients...)
+	tcpConn, err := p.DialTCP(nil, "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := p.ListenUDP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := makeServers(2)
+	if err := p.Update(servers[1:], PolicyFailover); err != nil {
+		t.Fatal(err)
+	}
+	if clients[0].closed {
+		t.Fatal("The plugin was stopped while connections were open")
+	}
+	// New connections avoid the removed server.
+	if _, err := p.DialTCP(nil, "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if d := dials(clients...); d[0] != 1 || d[1] != 1 {
+		t.Errorf("Wrong dials: %v", d)
+	}
+
+	tcpConn.CloseRead()
+	tcpConn.CloseWrite()
+	if clients[0].closed {
+		t.Error("The plugin was stopped while a UDP socket was open")
+	}
+	udpConn.Close()
+	if !clients[0].closed {
+		t.Error("The plugin was not stopped after the last connection closed")
+	}
+	if clients[1].closed {
+		t.Error("The current server's plugin was stopped")
+	}
+}
+
+func TestPoolCloseRemoved(t *testing.T) {
+	clients := []*countingClient{{}, {}}
+	p := makePool(t, PolicyFailover, clients...)
+	open, err := p.DialTCP(nil, "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := 0
+	closeOnEvict(open, func() { closed++ })
+	// Dialed before the update, but registered after the flows were closed.
+	late, err := p.DialTCP(nil, "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := makeServers(2)
+	if err := p.Update(servers[1:], PolicyFailover); err != nil {
+		t.Fatal(err)
+	}
+	current, err := p.DialTCP(nil, "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeOnEvict(current, func() { t.Error("Closed a flow through a current server") })
+	p.CloseRemoved()
+	if closed != 1 {
+		t.Errorf("Expected the open flow to close, got %d closes", closed)
+	}
+	closeOnEvict(late, func() { closed++ })
+	if closed != 2 {
+		t.Error("The late flow was not closed")
+	}
+}
+
+func TestPoolSingleServerRecovers(t *testing.T) {
+	client := &countingClient{fakeSSClient: fakeSSClient{failReachability: true}}
+	p := makePool(t, PolicyFailover, client)
+	if p.needsHealthChecks() {
+		t.Error("A healthy single server should not be checked")
+	}
+	if _, err := p.DialTCP(nil, "example.com:80"); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	if p.Status()[0].Healthy || !p.needsHealthChecks() {
+		t.Error("The failed server should be checked")
+	}
+	// The next successful dial clears the failure.
+	client.failReachability = false
+	if _, err := p.DialTCP(nil, "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Status()[0].Healthy || p.needsHealthChecks() {
+		t.Error("The server did not recover")
+	}
+}
+
+func TestPoolStopClosesRemoved(t *testing.T) {
+	clients := []*countingClient{{}, {}}
+	p := makePool(t, PolicyFailover, clients...)
+	if _, err := p.DialTCP(nil, "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Update(makeServers(2)[1:], PolicyFailover); err != nil {
+		t.Fatal(err)
+	}
+	if clients[0].closed {
+		t.Fatal("The draining server's plugin was stopped")
+	}
+	p.Stop()
+	if !clients[0].closed || !clients[1].closed {
+		t.Error("Stop should stop every plugin, including draining ones")
+	}
+}
@@ -0,0 +1,45 @@
+package shadowsocks
+
+import (
+	"crypto/rand"
+
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// Minimum number of random bytes that must remain in a salt after the prefix.
+const minRandomSalt = 8
+
+// MaxPrefixSize returns the length of the longest prefix that `cipher` allows,
+// which leaves enough random bytes in its salt.
+func MaxPrefixSize(cipher shadowaead.Cipher) int {
+	return cipher.SaltSize() - minRandomSalt
+}
+
+// prefixSaltGenerator generates salts that start with a fixed prefix.
+type prefixSaltGenerator struct {
+	prefix []byte
+}
+
+func (g prefixSaltGenerator) GetSalt(salt []byte) error {
+	n := copy(salt, g.prefix)
+	_, err := rand.Read(salt[n:])
+	return err
+}
+
+// NewClientWithPrefix returns a Shadowsocks client whose TCP streams start with
+// `prefix`, such as bytes that look like an HTTP request or a TLS record, to
+// disguise the stream from classifiers that inspect the first bytes.  The
+// prefix replaces the start of the random salt, so it must leave at least 8
+// random bytes in the cipher's salt.  If `prefix` is empty, the client is the
+// standard client.
+func NewClientWithPrefix(host string, port int, password, cipher string, prefix []byte) (shadowsocks.Client, error) {
+	if len(prefix) == 0 {
+		return shadowsocks.NewClient(host, port, password, cipher)
+	}
+	client, err := newStreamClient(host, port, password, cipher, prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
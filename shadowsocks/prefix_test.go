@@ -0,0 +1,111 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	testPassword = "secret"
+	testCipher   = "chacha20-ietf-poly1305"
+)
+
+// Starts a Shadowsocks server stand-in that answers any request with a fixed
+// response.  `unwrap` undoes the client's transport on each connection, and
+// returns the encrypted streams in each direction, or false to reject the
+// connection.  Returns the server's port and a channel that receives the target
+// address of each accepted stream.
+func startTestServer(t *testing.T, unwrap func(conn net.Conn) (io.Reader, io.Writer, bool)) (int, <-chan string) {
+	cipher, err := sscore.PickCipher(testCipher, nil, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead := cipher.(shadowaead.Cipher)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r, w, ok := unwrap(conn)
+				if !ok {
+					return
+				}
+				ssr := shadowsocks.NewShadowsocksReader(r, aead)
+				target, err := socks.ReadAddr(ssr)
+				if err != nil {
+					return
+				}
+				targets <- target.String()
+				ssr.Read(make([]byte, bufferLength))
+				shadowsocks.NewShadowsocksWriter(w, aead).Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, targets
+}
+
+// Starts a server stand-in that accepts only streams starting with `prefix`.
+func startPrefixServer(t *testing.T, prefix []byte) (int, <-chan string) {
+	return startTestServer(t, func(conn net.Conn) (io.Reader, io.Writer, bool) {
+		start := make([]byte, len(prefix))
+		if _, err := io.ReadFull(conn, start); err != nil || !bytes.Equal(start, prefix) {
+			return nil, nil, false
+		}
+		return io.MultiReader(bytes.NewReader(start), conn), conn, true
+	})
+}
+
+func TestClientWithPrefix(t *testing.T) {
+	prefix := []byte{0x16, 0x03, 0x01}
+	port, targets := startPrefixServer(t, prefix)
+	client, err := NewClientWithPrefix("127.0.0.1", port, testPassword, testCipher, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTCPConnectivityWithHTTP(client, "http://example.com"); err != nil {
+		t.Fatalf("Connectivity check failed: %v", err)
+	}
+	if target := <-targets; target != "example.com:80" {
+		t.Errorf("Unexpected target %s", target)
+	}
+}
+
+func TestClientWithWrongPrefix(t *testing.T) {
+	port, _ := startPrefixServer(t, []byte("GET /"))
+	for _, prefix := range [][]byte{nil, []byte("POST ")} {
+		client, err := NewClientWithPrefix("127.0.0.1", port, testPassword, testCipher, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckTCPConnectivityWithHTTP(client, "http://example.com")
+		if _, ok := err.(*AuthenticationError); !ok {
+			t.Errorf("Prefix %q: expected authentication error, got %v", prefix, err)
+		}
+	}
+}
+
+func TestClientWithPrefixTooLong(t *testing.T) {
+	// aes-128-gcm has a 16-byte salt, which leaves room for an 8-byte prefix.
+	if _, err := NewClientWithPrefix("127.0.0.1", 8388, testPassword, "aes-128-gcm", make([]byte, 8)); err != nil {
+		t.Errorf("8-byte prefix rejected: %v", err)
+	}
+	if _, err := NewClientWithPrefix("127.0.0.1", 8388, testPassword, "aes-128-gcm", make([]byte, 9)); err == nil {
+		t.Error("9-byte prefix accepted")
+	}
+}
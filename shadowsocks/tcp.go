@@ -1,8 +1,12 @@
 package shadowsocks
 
 import (
+	"errors"
 	"net"
+	"syscall"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 	"github.com/eycorsican/go-tun2socks/core"
@@ -10,6 +14,7 @@ import (
 
 type tcpHandler struct {
 	client shadowsocks.Client
+	flows  *conntrack.Table
 }
 
 // NewTCPHandler returns a Shadowsocks TCP connection handler.
@@ -18,20 +23,61 @@ type tcpHandler struct {
 // `port` is the port of the Shadowsocks proxy server.
 // `password` is password used to authenticate to the server.
 // `cipher` is the encryption cipher of the Shadowsocks proxy.
-func NewTCPHandler(host string, port int, password, cipher string) core.TCPConnHandler {
-	client, err := shadowsocks.NewClient(host, port, password, cipher)
+// `prefix` is sent at the start of each stream to the proxy, and may be empty; see NewClientWithPrefix.
+// `flows` tracks the active connections, and may be nil.
+func NewTCPHandler(host string, port int, password, cipher string, prefix []byte, flows *conntrack.Table) core.TCPConnHandler {
+	client, err := NewClientWithPrefix(host, port, password, cipher, prefix)
 	if err != nil {
 		return nil
 	}
-	return &tcpHandler{client}
+	return NewClientTCPHandler(client, flows)
+}
+
+// NewClientTCPHandler returns a TCP connection handler that connects through
+// `client`, such as a Pool.
+//
+// `flows` tracks the active connections, and may be nil.
+func NewClientTCPHandler(client shadowsocks.Client, flows *conntrack.Table) core.TCPConnHandler {
+	return &tcpHandler{client, flows}
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 	proxyConn, err := h.client.DialTCP(nil, target.String())
 	if err != nil {
+		metrics.AddDialError(dialErrorClass(err))
 		return err
 	}
+	closeFlow := func() {
+		conn.Close()
+		proxyConn.Close()
+	}
+	flow := h.flows.Add(target, closeFlow)
+	closeOnEvict(proxyConn, closeFlow)
 	// TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid this type assertion.
-	go onet.Relay(conn.(core.TCPConn), proxyConn)
+	localConn := conn.(core.TCPConn)
+	go func() {
+		onet.Relay(onet.WrapConn(localConn, flow.UploadReader(localConn), localConn),
+			onet.WrapConn(proxyConn, flow.DownloadReader(proxyConn), proxyConn))
+		h.flows.Remove(flow)
+	}()
 	return nil
 }
+
+// Classifies an error from connecting to the proxy, for metrics.
+func dialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	}
+	return "other"
+}
@@ -0,0 +1,39 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDialErrorClass(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "proxy.example"}, "dns"},
+		{&net.DNSError{Err: "timeout", Name: "proxy.example", IsTimeout: true}, "dns"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "timeout"},
+		{opError(syscall.ECONNREFUSED), "refused"},
+		{opError(syscall.ECONNRESET), "reset"},
+		{opError(syscall.EHOSTUNREACH), "unreachable"},
+		{opError(syscall.ENETUNREACH), "unreachable"},
+		{errors.New("unknown"), "other"},
+	}
+	for _, c := range cases {
+		if class := dialErrorClass(c.err); class != c.class {
+			t.Errorf("%v: %s != %s", c.err, class, c.class)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
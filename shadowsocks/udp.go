@@ -1,21 +1,116 @@
 package shadowsocks
 
 import (
+	"container/list"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
 	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
+// NAT modes for UDP associations through the proxy.
+const (
+	// NATFullCone relays each local socket through a single proxy association,
+	// which accepts packets from any remote address.
+	NATFullCone = "full-cone"
+	// NATSymmetric relays each destination of a local socket through its own
+	// proxy association, which drops packets from other remote addresses.
+	NATSymmetric = "symmetric"
+)
+
+// Default limit on the number of proxy associations.
+const defaultMaxSessions = 256
+
+// NATConfig configures the proxy associations of a UDP handler.
+type NATConfig struct {
+	// Mode is NATFullCone or NATSymmetric.
+	Mode string
+	// Timeout closes associations that are idle for this long.
+	Timeout time.Duration
+	// PortTimeouts overrides Timeout for some destination ports.  A full-cone
+	// association uses the longest timeout of its destinations.
+	PortTimeouts map[int]time.Duration
+	// MaxSessions is the maximum number of associations.  When it is reached,
+	// the least recently used association is closed.  Zero means unlimited.
+	MaxSessions int
+}
+
+// DefaultNATConfig returns a full-cone configuration with `timeout`, except
+// for a shorter timeout for DNS, and a longer one for QUIC and WebRTC, whose
+// sessions can be quiet for a while.
+func DefaultNATConfig(timeout time.Duration) NATConfig {
+	return NATConfig{
+		Mode:    NATFullCone,
+		Timeout: timeout,
+		PortTimeouts: map[int]time.Duration{
+			53:    10 * time.Second, // DNS
+			443:   2 * time.Minute,  // QUIC
+			3478:  2 * time.Minute,  // STUN and TURN
+			19302: 2 * time.Minute,  // Google STUN
+		},
+		MaxSessions: defaultMaxSessions,
+	}
+}
+
+func (c *NATConfig) timeout(port int) time.Duration {
+	if t, ok := c.PortTimeouts[port]; ok {
+		return t
+	}
+	return c.Timeout
+}
+
+// NATStats counts the proxy associations of a UDP handler.
+type NATStats struct {
+	// Active is the number of open associations.
+	Active int `json:"active"`
+	// Created is the number of associations opened.
+	Created int64 `json:"created"`
+	// Expired is the number of associations closed by their idle timeout.
+	Expired int64 `json:"expired"`
+	// Evicted is the number of associations closed to stay within MaxSessions.
+	Evicted int64 `json:"evicted"`
+	// Filtered is the number of packets from unexpected addresses that were
+	// dropped by symmetric associations, or from domain names, which the TUN
+	// device cannot deliver.
+	Filtered int64 `json:"filtered"`
+}
+
+// UDPHandler is a core.UDPConnHandler that relays UDP through a Shadowsocks
+// proxy, with NAT semantics.
+type UDPHandler interface {
+	core.UDPConnHandler
+	// Close closes a local socket and its associations.
+	Close(conn core.UDPConn)
+	// Stats returns the association counters.
+	Stats() NATStats
+}
+
+// udpSession is a UDP association forwarded through the proxy.
+type udpSession struct {
+	conn      core.UDPConn
+	dest      string // The only remote address in symmetric mode, or "".
+	proxyConn net.PacketConn
+	flow      *conntrack.Flow
+	lru       *list.Element
+	timeout   time.Duration // Protected by the handler's lock.
+}
+
 type udpHandler struct {
 	sync.Mutex
 
-	client  shadowsocks.Client
-	timeout time.Duration
-	conns   map[core.UDPConn]net.PacketConn
+	client shadowsocks.Client
+	config NATConfig
+	// Sessions of each local socket, by destination.
+	conns map[core.UDPConn]map[string]*udpSession
+	lru   *list.List // Of *udpSession, most recently used first.
+	stats NATStats
+	flows *conntrack.Table
 }
 
 // NewUDPHandler returns a Shadowsocks UDP connection handler.
@@ -25,71 +120,239 @@ type udpHandler struct {
 // `password` is password used to authenticate to the proxy.
 // `cipher` is the encryption cipher of the Shadowsocks proxy.
 // `timeout` is the UDP read and write timeout.
-func NewUDPHandler(host string, port int, password, cipher string, timeout time.Duration) core.UDPConnHandler {
+// `flows` tracks the active UDP associations, and may be nil.
+func NewUDPHandler(host string, port int, password, cipher string, timeout time.Duration, flows *conntrack.Table) core.UDPConnHandler {
 	client, err := shadowsocks.NewClient(host, port, password, cipher)
 	if err != nil {
 		return nil
 	}
+	return NewClientUDPHandler(client, DefaultNATConfig(timeout), flows)
+}
+
+// NewClientUDPHandler returns a UDP connection handler that relays packets
+// through `client`, such as a Pool.
+//
+// `config` configures the NAT mode, timeouts and limits of the associations.
+// `flows` tracks the active UDP associations, and may be nil.
+func NewClientUDPHandler(client shadowsocks.Client, config NATConfig, flows *conntrack.Table) UDPHandler {
 	return &udpHandler{
-		client:  client,
-		timeout: timeout,
-		conns:   make(map[core.UDPConn]net.PacketConn, 8),
+		client: client,
+		config: config,
+		conns:  make(map[core.UDPConn]map[string]*udpSession, 8),
+		lru:    list.New(),
+		flows:  flows,
 	}
 }
 
+// Returns the session key of `addr`.
+func (h *udpHandler) destKey(addr *net.UDPAddr) string {
+	if h.config.Mode == NATSymmetric {
+		return addr.String()
+	}
+	return ""
+}
+
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	_, err := h.session(conn, target)
+	return err
+}
+
+// Returns the session of `conn` for `addr`, and opens it if needed.  Marks the
+// session as recently used, and extends its timeout for `addr`.
+func (h *udpHandler) session(conn core.UDPConn, addr *net.UDPAddr) (*udpSession, error) {
+	dest := h.destKey(addr)
+	if s := h.touch(conn, dest, addr.Port); s != nil {
+		return s, nil
+	}
 	proxyConn, err := h.client.ListenUDP(nil)
 	if err != nil {
-		return err
+		metrics.AddDialError(dialErrorClass(err))
+		return nil, err
+	}
+	s := &udpSession{conn: conn, dest: dest, proxyConn: proxyConn, timeout: h.config.timeout(addr.Port)}
+	closeFlow := func() {
+		h.closeSession(s, false)
+	}
+	s.flow = h.flows.Add(addr, closeFlow)
+
+	h.Lock()
+	if existing := h.conns[conn][dest]; existing != nil {
+		// Opened concurrently.
+		h.lru.MoveToFront(existing.lru)
+		h.Unlock()
+		proxyConn.Close()
+		h.flows.Remove(s.flow)
+		return existing, nil
+	}
+	if h.conns[conn] == nil {
+		h.conns[conn] = make(map[string]*udpSession, 1)
+	}
+	h.conns[conn][dest] = s
+	s.lru = h.lru.PushFront(s)
+	h.stats.Created++
+	var evicted *udpSession
+	var last bool
+	if h.config.MaxSessions > 0 && h.lru.Len() > h.config.MaxSessions {
+		evicted = h.lru.Back().Value.(*udpSession)
+		_, last = h.removeLocked(evicted)
+		h.stats.Evicted++
+	}
+	h.Unlock()
+
+	if evicted != nil {
+		h.release(evicted, last)
+	}
+	closeOnEvict(proxyConn, closeFlow)
+	go h.handleDownstreamUDP(s)
+	return s, nil
+}
+
+// Marks an existing session as recently used, and extends its timeout for
+// `port`.  Returns nil if there is no session.
+func (h *udpHandler) touch(conn core.UDPConn, dest string, port int) *udpSession {
+	h.Lock()
+	defer h.Unlock()
+	s := h.conns[conn][dest]
+	if s == nil {
+		return nil
+	}
+	h.lru.MoveToFront(s.lru)
+	if t := h.config.timeout(port); t > s.timeout {
+		s.timeout = t
+	}
+	return s
+}
+
+func (h *udpHandler) sessionTimeout(s *udpSession) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return s.timeout
+}
+
+// Removes a session from the table.  Reports whether it was present, and
+// whether its local socket has no sessions left.  The caller must hold the lock.
+func (h *udpHandler) removeLocked(s *udpSession) (removed, last bool) {
+	sessions := h.conns[s.conn]
+	if sessions[s.dest] != s {
+		return false, false
+	}
+	delete(sessions, s.dest)
+	h.lru.Remove(s.lru)
+	if len(sessions) == 0 {
+		delete(h.conns, s.conn)
+		return true, true
 	}
+	return true, false
+}
+
+// Closes a session, unless it was already removed.  `expired` indicates that it
+// reached its idle timeout.
+func (h *udpHandler) closeSession(s *udpSession, expired bool) {
 	h.Lock()
-	h.conns[conn] = proxyConn
+	removed, last := h.removeLocked(s)
+	if removed && expired {
+		h.stats.Expired++
+	}
 	h.Unlock()
-	go h.handleDownstreamUDP(conn, proxyConn)
-	return nil
+	if removed {
+		h.release(s, last)
+	}
 }
 
-func (h *udpHandler) handleDownstreamUDP(conn core.UDPConn, proxyConn net.PacketConn) {
+// Closes the proxy association of a session that was removed from the table.
+// If it was the `last` session of its local socket, closes the socket too.
+func (h *udpHandler) release(s *udpSession, last bool) {
+	s.proxyConn.Close()
+	h.flows.Remove(s.flow)
+	if last {
+		s.conn.Close()
+	}
+}
+
+func (h *udpHandler) handleDownstreamUDP(s *udpSession) {
 	buf := core.NewBytes(core.BufSize)
-	defer func() {
-		h.Close(conn)
-		core.FreeBytes(buf)
-	}()
+	defer core.FreeBytes(buf)
 	for {
-		proxyConn.SetDeadline(time.Now().Add(h.timeout))
-		n, addr, err := proxyConn.ReadFrom(buf)
+		s.proxyConn.SetReadDeadline(time.Now().Add(h.sessionTimeout(s)))
+		n, addr, err := s.proxyConn.ReadFrom(buf)
 		if err != nil {
+			netErr, ok := err.(net.Error)
+			h.closeSession(s, ok && netErr.Timeout())
 			return
 		}
-		// No resolution will take place, the address sent by the proxy is a resolved IP.
-		udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
-		if err != nil {
-			return
+		udpAddr := packetSource(addr)
+		if udpAddr == nil || (s.dest != "" && udpAddr.String() != s.dest) {
+			h.Lock()
+			h.stats.Filtered++
+			h.Unlock()
+			continue
 		}
-		_, err = conn.WriteFrom(buf[:n], udpAddr)
-		if err != nil {
+		if _, err = s.conn.WriteFrom(buf[:n], udpAddr); err != nil {
+			h.closeSession(s, false)
 			return
 		}
+		s.flow.AddDownload(int64(n))
+		h.touch(s.conn, s.dest, udpAddr.Port)
 	}
 }
 
 func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
-	h.Lock()
-	proxyConn, ok := h.conns[conn]
-	h.Unlock()
-	if !ok {
+	var s *udpSession
+	if h.config.Mode == NATSymmetric {
+		// Each destination has its own association, which is opened on demand.
+		var err error
+		if s, err = h.session(conn, addr); err != nil {
+			return err
+		}
+	} else if s = h.touch(conn, "", addr.Port); s == nil {
 		return fmt.Errorf("connection %v->%v does not exist", conn.LocalAddr(), addr)
 	}
-	proxyConn.SetDeadline(time.Now().Add(h.timeout))
-	_, err := proxyConn.WriteTo(data, addr)
+	s.proxyConn.SetDeadline(time.Now().Add(h.sessionTimeout(s)))
+	_, err := s.proxyConn.WriteTo(data, addr)
+	if err == nil {
+		s.flow.AddUpload(int64(len(data)))
+	}
 	return err
 }
 
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
+	h.Lock()
+	sessions := h.conns[conn]
+	delete(h.conns, conn)
+	for _, s := range sessions {
+		h.lru.Remove(s.lru)
+	}
+	h.Unlock()
+	for _, s := range sessions {
+		s.proxyConn.Close()
+		h.flows.Remove(s.flow)
+	}
+}
+
+func (h *udpHandler) Stats() NATStats {
 	h.Lock()
 	defer h.Unlock()
-	if proxyConn, ok := h.conns[conn]; ok {
-		proxyConn.Close()
+	stats := h.stats
+	stats.Active = h.lru.Len()
+	return stats
+}
+
+// Returns the source of a packet from the proxy, without a DNS lookup, or nil
+// if it is not an IP address.  A UDP-over-TCP server may name the source by its
+// domain, but the TUN device only takes packets from IP addresses.
+func packetSource(addr net.Addr) *net.UDPAddr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr
+	}
+	host, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if ip == nil || err != nil {
+		return nil
 	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
 }
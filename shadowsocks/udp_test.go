@@ -0,0 +1,269 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// udpTestClient relays UDP directly from local sockets, and counts the open
+// sockets.
+type udpTestClient struct {
+	fakeSSClient
+	mu   sync.Mutex
+	open int
+}
+
+func (c *udpTestClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.open++
+	c.mu.Unlock()
+	return &countedPacketConn{PacketConn: conn, client: c}, nil
+}
+
+func (c *udpTestClient) openSockets() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open
+}
+
+type countedPacketConn struct {
+	net.PacketConn
+	client *udpTestClient
+	once   sync.Once
+}
+
+func (c *countedPacketConn) Close() error {
+	c.once.Do(func() {
+		c.client.mu.Lock()
+		c.client.open--
+		c.client.mu.Unlock()
+	})
+	return c.PacketConn.Close()
+}
+
+// Starts a UDP server that echoes each packet.  If `reflect` is true, it
+// replies from a different address.
+func startUDPServer(t *testing.T, reflect bool) *net.UDPAddr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyConn := conn
+	if reflect {
+		if replyConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		replyConn.Close()
+	})
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			replyConn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func makeUDPConn(port int) *testconn.UDPConn {
+	return &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.0.85.2"), Port: port}, Packets: make(chan []byte, 10)}
+}
+
+// Waits up to a second for `cond` to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Timed out waiting for %s", what)
+}
+
+func expectPacket(t *testing.T, conn *testconn.UDPConn, expected string) {
+	select {
+	case p := <-conn.Packets:
+		if string(p) != expected {
+			t.Errorf("Got %q, expected %q", p, expected)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Missing packet %q", expected)
+	}
+}
+
+func expectNoPacket(t *testing.T, conn *testconn.UDPConn) {
+	select {
+	case p := <-conn.Packets:
+		t.Errorf("Unexpected packet %q", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Checks that the handler and the client have no sessions or sockets left.
+func checkNoLeaks(t *testing.T, h UDPHandler, client *udpTestClient) {
+	waitFor(t, "sockets to close", func() bool { return client.openSockets() == 0 })
+	handler := h.(*udpHandler)
+	handler.Lock()
+	defer handler.Unlock()
+	if len(handler.conns) != 0 || handler.lru.Len() != 0 {
+		t.Errorf("Leaked %d sockets and %d sessions", len(handler.conns), handler.lru.Len())
+	}
+}
+
+func TestUDPHandlerFullCone(t *testing.T) {
+	client := &udpTestClient{}
+	h := NewClientUDPHandler(client, DefaultNATConfig(time.Minute), nil)
+	echo1, echo2, reflector := startUDPServer(t, false), startUDPServer(t, false), startUDPServer(t, true)
+	conn := makeUDPConn(5000)
+	if err := h.Connect(conn, echo1); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []*net.UDPAddr{echo1, echo2, reflector} {
+		if err := h.ReceiveTo(conn, []byte(addr.String()), addr); err != nil {
+			t.Fatal(err)
+		}
+		// Replies from any address are accepted.
+		expectPacket(t, conn, addr.String())
+	}
+	if stats := h.Stats(); stats.Created != 1 || stats.Active != 1 || stats.Filtered != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	h.Close(conn)
+	if !conn.Closed() {
+		t.Error("Local socket was not closed")
+	}
+	if stats := h.Stats(); stats.Active != 0 {
+		t.Errorf("Session is still active: %+v", stats)
+	}
+	checkNoLeaks(t, h, client)
+}
+
+func TestUDPHandlerSymmetric(t *testing.T) {
+	client := &udpTestClient{}
+	config := DefaultNATConfig(time.Minute)
+	config.Mode = NATSymmetric
+	h := NewClientUDPHandler(client, config, nil)
+	echo, reflector := startUDPServer(t, false), startUDPServer(t, true)
+	conn := makeUDPConn(5000)
+	if err := h.Connect(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("echo"), echo); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, conn, "echo")
+	// A new destination gets its own session, which drops replies from other addresses.
+	if err := h.ReceiveTo(conn, []byte("reflect"), reflector); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, conn)
+	if stats := h.Stats(); stats.Created != 2 || stats.Active != 2 || stats.Filtered != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	h.Close(conn)
+	checkNoLeaks(t, h, client)
+}
+
+func TestUDPHandlerPortTimeouts(t *testing.T) {
+	client := &udpTestClient{}
+	echo1, echo2 := startUDPServer(t, false), startUDPServer(t, false)
+	config := NATConfig{
+		Mode:         NATSymmetric,
+		Timeout:      50 * time.Millisecond,
+		PortTimeouts: map[int]time.Duration{echo2.Port: time.Minute},
+	}
+	h := NewClientUDPHandler(client, config, nil)
+	conn := makeUDPConn(5000)
+	for _, addr := range []*net.UDPAddr{echo1, echo2} {
+		if err := h.ReceiveTo(conn, []byte("ping"), addr); err != nil {
+			t.Fatal(err)
+		}
+		expectPacket(t, conn, "ping")
+	}
+	waitFor(t, "short session to expire", func() bool { return h.Stats().Expired == 1 })
+	if stats := h.Stats(); stats.Active != 1 {
+		t.Errorf("Long session should remain: %+v", stats)
+	}
+	if conn.Closed() {
+		t.Error("Local socket closed while it has a session")
+	}
+	h.Close(conn)
+	checkNoLeaks(t, h, client)
+}
+
+func TestUDPHandlerExpiry(t *testing.T) {
+	client := &udpTestClient{}
+	h := NewClientUDPHandler(client, NATConfig{Mode: NATFullCone, Timeout: 50 * time.Millisecond}, nil)
+	conn := makeUDPConn(5000)
+	if err := h.Connect(conn, startUDPServer(t, false)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "session to expire", func() bool { return h.Stats().Expired == 1 })
+	// The local socket is closed with its last session, and nothing is left behind.
+	checkNoLeaks(t, h, client)
+	if !conn.Closed() {
+		t.Error("Local socket was not closed")
+	}
+}
+
+func TestUDPHandlerEviction(t *testing.T) {
+	client := &udpTestClient{}
+	config := DefaultNATConfig(time.Minute)
+	config.MaxSessions = 2
+	h := NewClientUDPHandler(client, config, nil)
+	echo := startUDPServer(t, false)
+	conns := []*testconn.UDPConn{makeUDPConn(5000), makeUDPConn(5001), makeUDPConn(5002)}
+	for _, conn := range conns[:2] {
+		if err := h.Connect(conn, echo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Use the first socket, so that the second is the least recently used.
+	if err := h.ReceiveTo(conns[0], []byte("ping"), echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Connect(conns[2], echo); err != nil {
+		t.Fatal(err)
+	}
+	if !conns[1].Closed() || conns[0].Closed() || conns[2].Closed() {
+		t.Error("Expected only the least recently used socket to be evicted")
+	}
+	if err := h.ReceiveTo(conns[1], []byte("ping"), echo); err == nil {
+		t.Error("Evicted socket can still send")
+	}
+	if stats := h.Stats(); stats.Evicted != 1 || stats.Active != 2 || stats.Created != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	h.Close(conns[0])
+	h.Close(conns[2])
+	checkNoLeaks(t, h, client)
+}
+
+func TestPacketSource(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	if source := packetSource(udpAddr); source != udpAddr {
+		t.Errorf("Unexpected source %v", source)
+	}
+	if source := packetSource(shadowsocks.NewAddr("[2001:db8::1]:443", "udp")); source == nil || source.String() != "[2001:db8::1]:443" {
+		t.Errorf("Unexpected source %v", source)
+	}
+	// Domain names are not resolved.
+	if source := packetSource(shadowsocks.NewAddr("localhost:53", "udp")); source != nil {
+		t.Errorf("Unexpected source %v", source)
+	}
+}
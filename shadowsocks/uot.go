@@ -0,0 +1,167 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// Target of the TCP streams that carry UDP packets.  A cooperating server
+// relays the packets instead of connecting to it.
+const udpOverTCPAddr = "sp.udp-over-tcp.arpa:0"
+
+type udpOverTCPClient struct {
+	shadowsocks.Client
+}
+
+// Address families of the frames, which are numbered differently from SOCKS.
+const (
+	uotFamilyIPv4 = 0x00
+	uotFamilyIPv6 = 0x01
+	uotFamilyFQDN = 0x02
+)
+
+// NewUDPOverTCPClient returns a client that relays UDP packets over TCP
+// streams through `client`, for networks that block UDP.  Streams are not
+// shared: each association, i.e. each call to ListenUDP, opens its own stream,
+// which carries the association's packets to and from any remote address,
+// framed as [family][address][2-byte port][2-byte length][payload].  The family is 0 for
+// a 4-byte IPv4 address, 1 for a 16-byte IPv6 address, and 2 for a domain name
+// preceded by its 1-byte length.  The server must support this protocol.  The
+// framing follows version 1 of the UDP-over-TCP protocol of sing-box, but has
+// not been tested against a sing-box server.
+func NewUDPOverTCPClient(client shadowsocks.Client) shadowsocks.Client {
+	return &udpOverTCPClient{client}
+}
+
+// ListenUDP opens a new stream to the proxy for one association.  `laddr` is
+// ignored.
+func (c *udpOverTCPClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := c.Client.DialTCP(nil, udpOverTCPAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpOverTCPConn{DuplexConn: conn}, nil
+}
+
+// udpOverTCPConn is a net.PacketConn over a stream to a UDP-over-TCP server.
+type udpOverTCPConn struct {
+	onet.DuplexConn
+	wmu sync.Mutex // Keeps the frames of concurrent writes whole.
+}
+
+func (c *udpOverTCPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > math.MaxUint16 {
+		return 0, errors.New("Packet is too large")
+	}
+	frame, err := appendUOTAddr(make([]byte, 0, 1+math.MaxUint8+2+2+len(b)), addr.String())
+	if err != nil {
+		return 0, err
+	}
+	frame = append(frame, byte(len(b)>>8), byte(len(b)))
+	frame = append(frame, b...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.DuplexConn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the next packet.  Like a UDP socket, it discards the end of a
+// packet that is longer than `b`.
+func (c *udpOverTCPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	addr, err := readUOTAddr(c.DuplexConn)
+	if err != nil {
+		return 0, nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(c.DuplexConn, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n <= len(b) {
+		_, err = io.ReadFull(c.DuplexConn, b[:n])
+	} else if _, err = io.ReadFull(c.DuplexConn, b); err == nil {
+		_, err = io.CopyN(ioutil.Discard, c.DuplexConn, int64(n-len(b)))
+		n = len(b)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, shadowsocks.NewAddr(addr, "udp"), nil
+}
+
+// Appends the frame address of `hostport` to `b`.
+func appendUOTAddr(b []byte, hostport string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %s", portString)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > math.MaxUint8 {
+			return nil, fmt.Errorf("Invalid domain name: %s", host)
+		}
+		b = append(b, uotFamilyFQDN, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, uotFamilyIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, uotFamilyIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// Reads a frame address from `r`, and returns it as host:port.
+func readUOTAddr(r io.Reader) (string, error) {
+	var family [1]byte
+	if _, err := io.ReadFull(r, family[:]); err != nil {
+		return "", err
+	}
+	var host string
+	var ip net.IP
+	switch family[0] {
+	case uotFamilyIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case uotFamilyIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case uotFamilyFQDN:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("Unknown address family: %d", family[0])
+	}
+	if ip != nil {
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
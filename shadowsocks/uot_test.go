@@ -0,0 +1,92 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// pipeClient dials one end of a net.Pipe, and records the target.
+type pipeClient struct {
+	fakeSSClient
+	server net.Conn
+	target string
+}
+
+func (c *pipeClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	client, server := net.Pipe()
+	c.server, c.target = server, raddr
+	return &testconn.TCPConn{Conn: client}, nil
+}
+
+// Reads `n` bytes from `r`.
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUDPOverTCPConn(t *testing.T) {
+	client := &pipeClient{}
+	conn, err := NewUDPOverTCPClient(client).ListenUDP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if client.target != udpOverTCPAddr {
+		t.Errorf("Stream opened to %s", client.target)
+	}
+
+	// The frames are checked byte by byte, because the address families differ
+	// from SOCKS.
+	go conn.WriteTo([]byte("query"), &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53})
+	expected := []byte{0x00, 1, 1, 1, 1, 0, 53, 0, 5, 'q', 'u', 'e', 'r', 'y'}
+	if frame := readN(t, client.server, len(expected)); !bytes.Equal(frame, expected) {
+		t.Errorf("Unexpected IPv4 frame %v", frame)
+	}
+	go conn.WriteTo([]byte("stun"), shadowsocks.NewAddr("example.com:3478", "udp"))
+	expected = append([]byte{0x02, 11}, "example.com"...)
+	expected = append(expected, 0x0d, 0x96, 0, 4, 's', 't', 'u', 'n')
+	if frame := readN(t, client.server, len(expected)); !bytes.Equal(frame, expected) {
+		t.Errorf("Unexpected domain frame %v", frame)
+	}
+
+	go func() {
+		ipv6 := append([]byte{0x01}, net.ParseIP("2001:db8::1")...)
+		client.server.Write(append(ipv6, 0x01, 0xbb, 0, 10, 'x', 'x', 'x', 'x', 'x', 'x', 'x', 'x', 'x', 'x'))
+		domain := append([]byte{0x02, 11}, "example.com"...)
+		client.server.Write(append(domain, 0x0d, 0x96, 0, 4, 'n', 'e', 'x', 't'))
+		client.server.Write([]byte{0x03})
+	}()
+	// A packet that is longer than the buffer is truncated, like UDP.
+	buf := make([]byte, 4)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil || n != 4 || from.String() != "[2001:db8::1]:443" {
+		t.Errorf("Got %d bytes from %v, %v", n, from, err)
+	}
+	n, from, err = conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "next" || from.String() != "example.com:3478" {
+		t.Errorf("Got %q from %v, %v", buf[:n], from, err)
+	}
+	if _, _, err := conn.ReadFrom(buf); err == nil {
+		t.Error("Expected error for an unknown address family")
+	}
+}
+
+func TestUDPOverTCPConnTooLarge(t *testing.T) {
+	conn, err := NewUDPOverTCPClient(&pipeClient{}).ListenUDP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(make([]byte, 1<<16), &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 53}); err == nil {
+		t.Error("Expected error for a packet that does not fit in a frame")
+	}
+}
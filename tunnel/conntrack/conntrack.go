@@ -0,0 +1,233 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conntrack keeps a live table of the flows that a tunnel is
+// forwarding, so that they can be listed and closed while they are active.
+// The table also feeds the per-protocol traffic metrics.
+package conntrack
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
+)
+
+// Connection describes an active flow, as returned by Table.List.
+type Connection struct {
+	ID       int64  `json:"id"`
+	Protocol string `json:"protocol"` // "tcp" or "udp"
+	Target   string `json:"target"`   // Destination IP and port.
+	// Domain name of the target, if known.
+	Name          string `json:"name,omitempty"`
+	Start         int64  `json:"start"` // Unix time (ms) when the flow was opened.
+	UploadBytes   int64  `json:"upload"`
+	DownloadBytes int64  `json:"download"`
+	// True if the flow's first segment was split to evade SNI-based blocking.
+	Split bool `json:"split"`
+	// True if the flow bypasses the proxy.
+	Direct bool `json:"direct"`
+}
+
+// Flow is an active flow in a Table.  A nil *Flow is valid, and ignores all updates.
+type Flow struct {
+	// The counters are accessed atomically, and come first so that they are
+	// 64-bit aligned on 32-bit platforms.
+	upload   int64
+	download int64
+	split    int32
+	direct   int32
+	name     atomic.Value // string
+
+	id       int64
+	protocol string
+	target   string
+	start    time.Time
+	close    func()
+	traffic  *metrics.Traffic
+}
+
+// ID returns the flow's identifier, which is unique within its Table.
+func (f *Flow) ID() int64 {
+	return f.id
+}
+
+// AddUpload adds `n` bytes to the flow's upload count.
+func (f *Flow) AddUpload(n int64) {
+	if f != nil {
+		atomic.AddInt64(&f.upload, n)
+		f.traffic.AddUpload(n)
+	}
+}
+
+// AddDownload adds `n` bytes to the flow's download count.
+func (f *Flow) AddDownload(n int64) {
+	if f != nil {
+		atomic.AddInt64(&f.download, n)
+		f.traffic.AddDownload(n)
+	}
+}
+
+// SetSplit marks the flow as split.
+func (f *Flow) SetSplit() {
+	if f != nil {
+		atomic.StoreInt32(&f.split, 1)
+	}
+}
+
+// SetDirect marks the flow as bypassing the proxy.
+func (f *Flow) SetDirect() {
+	if f != nil {
+		atomic.StoreInt32(&f.direct, 1)
+	}
+}
+
+// SetName records the domain name of the flow's target.
+func (f *Flow) SetName(name string) {
+	if f != nil {
+		f.name.Store(name)
+	}
+}
+
+// UploadReader returns a reader that adds all the bytes read from `r` to the
+// flow's upload count.
+func (f *Flow) UploadReader(r io.Reader) io.Reader {
+	if f == nil {
+		return r
+	}
+	return &countingReader{r, f.AddUpload}
+}
+
+// DownloadReader returns a reader that adds all the bytes read from `r` to the
+// flow's download count.
+func (f *Flow) DownloadReader(r io.Reader) io.Reader {
+	if f == nil {
+		return r
+	}
+	return &countingReader{r, f.AddDownload}
+}
+
+type countingReader struct {
+	io.Reader
+	add func(int64)
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.add(int64(n))
+	}
+	return n, err
+}
+
+func (f *Flow) connection() Connection {
+	name, _ := f.name.Load().(string)
+	return Connection{
+		ID:            f.id,
+		Protocol:      f.protocol,
+		Target:        f.target,
+		Name:          name,
+		Start:         f.start.UnixNano() / int64(time.Millisecond),
+		UploadBytes:   atomic.LoadInt64(&f.upload),
+		DownloadBytes: atomic.LoadInt64(&f.download),
+		Split:         atomic.LoadInt32(&f.split) != 0,
+		Direct:        atomic.LoadInt32(&f.direct) != 0,
+	}
+}
+
+// Table holds the active flows of a tunnel.  A nil *Table is valid, and tracks nothing.
+type Table struct {
+	mu     sync.Mutex
+	nextID int64
+	flows  map[int64]*Flow
+}
+
+// NewTable returns an empty Table.
+func NewTable() *Table {
+	return &Table{flows: make(map[int64]*Flow)}
+}
+
+// Add registers a new flow to `target`, and returns it.  `close` must close the
+// flow, causing its handler to call Remove.  It may be called concurrently with
+// the handler.
+func (t *Table) Add(target net.Addr, close func()) *Flow {
+	if t == nil {
+		return nil
+	}
+	f := &Flow{
+		protocol: target.Network(),
+		target:   target.String(),
+		start:    time.Now(),
+		close:    close,
+		traffic:  metrics.ForProtocol(target.Network()),
+	}
+	f.traffic.Open()
+	t.mu.Lock()
+	t.nextID++
+	f.id = t.nextID
+	t.flows[f.id] = f
+	t.mu.Unlock()
+	return f
+}
+
+// Remove deletes `f` from the table.  It is safe to remove a flow more than once.
+func (t *Table) Remove(f *Flow) {
+	if t == nil || f == nil {
+		return
+	}
+	t.mu.Lock()
+	_, ok := t.flows[f.id]
+	delete(t.flows, f.id)
+	t.mu.Unlock()
+	if ok {
+		f.traffic.Close()
+	}
+}
+
+// List returns a snapshot of the active flows, ordered by ID.
+func (t *Table) List() []Connection {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	conns := make([]Connection, 0, len(t.flows))
+	for _, f := range t.flows {
+		conns = append(conns, f.connection())
+	}
+	t.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// Close closes the flow with the specified ID.
+func (t *Table) Close(id int64) error {
+	var f *Flow
+	if t != nil {
+		t.mu.Lock()
+		f = t.flows[id]
+		t.mu.Unlock()
+	}
+	if f == nil {
+		return fmt.Errorf("No active connection with ID %d", id)
+	}
+	f.close()
+	return nil
+}
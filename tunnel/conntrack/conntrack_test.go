@@ -0,0 +1,119 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	tcpTarget = &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 443}
+	udpTarget = &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 443}
+)
+
+func TestList(t *testing.T) {
+	table := NewTable()
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	f1 := table.Add(tcpTarget, func() {})
+	f2 := table.Add(udpTarget, func() {})
+	f1.AddUpload(100)
+	f1.AddDownload(2000)
+	f1.SetSplit()
+	f1.SetName("example.com")
+	f2.AddUpload(50)
+
+	conns := table.List()
+	if len(conns) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(conns))
+	}
+	c := conns[0]
+	if c.ID != 1 || c.Protocol != "tcp" || c.Target != "93.184.216.34:443" || c.Name != "example.com" {
+		t.Errorf("Bad TCP connection: %v", c)
+	}
+	if c.UploadBytes != 100 || c.DownloadBytes != 2000 || !c.Split {
+		t.Errorf("Bad TCP counters: %v", c)
+	}
+	if c.Start < before {
+		t.Errorf("Bad start time: %d < %d", c.Start, before)
+	}
+	c = conns[1]
+	if c.ID != 2 || c.Protocol != "udp" || c.Name != "" || c.UploadBytes != 50 || c.Split {
+		t.Errorf("Bad UDP connection: %v", c)
+	}
+
+	table.Remove(f1)
+	table.Remove(f1)
+	if conns = table.List(); len(conns) != 1 || conns[0].ID != 2 {
+		t.Errorf("Wrong connections after removal: %v", conns)
+	}
+}
+
+func TestClose(t *testing.T) {
+	table := NewTable()
+	var f *Flow
+	f = table.Add(tcpTarget, func() {
+		table.Remove(f)
+	})
+	if err := table.Close(f.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.List()) != 0 {
+		t.Error("Flow was not removed")
+	}
+	if err := table.Close(f.ID()); err == nil {
+		t.Error("Closing a missing flow should fail")
+	}
+}
+
+func TestReaders(t *testing.T) {
+	table := NewTable()
+	f := table.Add(tcpTarget, func() {})
+	data := []byte("hello")
+	if out, _ := ioutil.ReadAll(f.UploadReader(bytes.NewReader(data))); !bytes.Equal(out, data) {
+		t.Error("Upload was modified")
+	}
+	ioutil.ReadAll(f.DownloadReader(bytes.NewReader(append(data, data...))))
+	c := table.List()[0]
+	if c.UploadBytes != 5 || c.DownloadBytes != 10 {
+		t.Errorf("Wrong counts: %v", c)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var table *Table
+	f := table.Add(tcpTarget, func() {})
+	if f != nil {
+		t.Fatal("Nil table returned a flow")
+	}
+	f.AddUpload(1)
+	f.AddDownload(1)
+	f.SetSplit()
+	f.SetName("example.com")
+	r := bytes.NewReader(nil)
+	if f.UploadReader(r) != r || f.DownloadReader(r) != r {
+		t.Error("Nil flow should not wrap readers")
+	}
+	table.Remove(f)
+	if len(table.List()) != 0 {
+		t.Error("Nil table has connections")
+	}
+	if err := table.Close(1); err == nil {
+		t.Error("Nil table should fail to close")
+	}
+}
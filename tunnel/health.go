@@ -0,0 +1,138 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	oss "github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+// HealthListener is notified by the health monitor of an OutlineTunnel when the
+// proxy's connectivity changes.  Implementations must be thread-safe.
+type HealthListener interface {
+	// OnHealthChanged is called with whether the proxy is reachable, and whether
+	// the tunnel proxies UDP, after the tunnel has switched its handlers.
+	OnHealthChanged(isProxyHealthy, isUDPEnabled bool)
+}
+
+// healthMonitor probes the proxy periodically, and reports sustained changes.
+// A change is sustained once `threshold` consecutive probes agree on a failure,
+// or after a single successful probe.
+type healthMonitor struct {
+	t         *outlinetunnel
+	threshold int
+	listener  HealthListener
+	// check probes the TCP and UDP connectivity through the proxy.
+	check       func() (tcpErr, udpErr error)
+	healthy     bool
+	failures    int // Consecutive probes that could not reach the proxy.
+	udpFailures int // Consecutive probes that reached the proxy over TCP only.
+	stop        chan struct{}
+}
+
+func newHealthMonitor(t *outlinetunnel, threshold int, listener HealthListener) *healthMonitor {
+	m := &healthMonitor{t: t, threshold: threshold, listener: listener, healthy: true, stop: make(chan struct{})}
+	m.check = func() (error, error) {
+		targets := t.pool.CheckTargets()
+		tcpErr := oss.CheckTCPConnectivityWithHTTP(t.pool, targets.URL)
+		udpErr := oss.CheckUDPConnectivityWithDNS(t.pool, shadowsocks.NewAddr(targets.Resolver, "udp"))
+		return tcpErr, udpErr
+	}
+	return m
+}
+
+// Probes the proxy every `interval` until stopped.
+func (m *healthMonitor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.probe()
+		}
+	}
+}
+
+// Probes the proxy once, switches the UDP handler on a sustained change in UDP
+// support, and notifies the listener of any sustained change.
+func (m *healthMonitor) probe() {
+	tcpErr, udpErr := m.check()
+	healthy := m.healthy
+	// The UDP check is a superset of the TCP check, as in CheckConnectivity.
+	if tcpErr == nil || udpErr == nil {
+		m.failures = 0
+		healthy = true
+	} else if m.failures++; m.failures >= m.threshold {
+		healthy = false
+	}
+
+	udpChanged := false
+	switch {
+	case udpErr == nil:
+		m.udpFailures = 0
+		udpChanged = m.setUDPSupport(true)
+	case tcpErr == nil:
+		// Only count the UDP failures of a reachable proxy, so that an outage does
+		// not disable UDP once the proxy is back.
+		if m.udpFailures++; m.udpFailures >= m.threshold {
+			udpChanged = m.setUDPSupport(false)
+		}
+	}
+	if healthy == m.healthy && !udpChanged {
+		return
+	}
+	if !m.active() {
+		// Stopped during the probe, so the listener no longer expects events.
+		return
+	}
+	m.healthy = healthy
+	isUDPEnabled := m.t.udpSupport()
+	log.Infof("Proxy health changed: healthy=%v, UDP=%v", healthy, isUDPEnabled)
+	m.listener.OnHealthChanged(healthy, isUDPEnabled)
+}
+
+// Returns true if the monitor was stopped, or its tunnel disconnected.  Callers
+// must hold m.t.mu.
+func (m *healthMonitor) stoppedLocked() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return !m.t.isConnected
+	}
+}
+
+func (m *healthMonitor) active() bool {
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	return !m.stoppedLocked()
+}
+
+// Switches the tunnel's UDP handler, unless the monitor was stopped while
+// probing.  Returns whether the UDP support changed.
+func (m *healthMonitor) setUDPSupport(isUDPEnabled bool) bool {
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	if m.stoppedLocked() {
+		return false
+	}
+	return m.t.setUDPSupportLocked(isUDPEnabled)
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// fakeLWIPStack counts the times it was closed to switch the handlers.
+type fakeLWIPStack struct {
+	core.LWIPStack
+	closed int
+}
+
+func (s *fakeLWIPStack) Close() error {
+	s.closed++
+	return nil
+}
+
+type healthEvent struct {
+	healthy, udp bool
+}
+
+type fakeHealthListener struct {
+	events chan healthEvent
+}
+
+func (l *fakeHealthListener) OnHealthChanged(isProxyHealthy, isUDPEnabled bool) {
+	l.events <- healthEvent{isProxyHealthy, isUDPEnabled}
+}
+
+func makeHealthMonitor(t *testing.T, threshold int) (*healthMonitor, *fakeLWIPStack, *fakeHealthListener) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	t.Cleanup(func() { proxy.listener.Close() })
+	tun, _ := makeOutlineTunnel(t, proxy)
+	stack := &fakeLWIPStack{}
+	tun.lwipStack = stack
+	tun.isConnected = true
+	tun.isUDPEnabled = true
+	listener := &fakeHealthListener{make(chan healthEvent, 10)}
+	return newHealthMonitor(tun, threshold, listener), stack, listener
+}
+
+// Probes `m` with a check that returns `tcpErr` and `udpErr`.
+func probeWith(m *healthMonitor, tcpErr, udpErr error) {
+	m.check = func() (error, error) { return tcpErr, udpErr }
+	m.probe()
+}
+
+func expectHealthEvent(t *testing.T, l *fakeHealthListener, expected *healthEvent) {
+	select {
+	case e := <-l.events:
+		if expected == nil {
+			t.Errorf("Unexpected event %+v", e)
+		} else if e != *expected {
+			t.Errorf("Expected %+v, got %+v", *expected, e)
+		}
+	default:
+		if expected != nil {
+			t.Errorf("Missing event %+v", *expected)
+		}
+	}
+}
+
+func TestHealthMonitorUDPBlocked(t *testing.T) {
+	m, stack, l := makeHealthMonitor(t, 3)
+	blocked := errors.New("UDP blocked")
+	probeWith(m, nil, blocked)
+	probeWith(m, nil, blocked)
+	expectHealthEvent(t, l, nil)
+	if !m.t.udpSupport() || stack.closed != 0 {
+		t.Error("UDP was disabled before the threshold")
+	}
+	probeWith(m, nil, blocked)
+	expectHealthEvent(t, l, &healthEvent{true, false})
+	if m.t.udpSupport() || m.t.udp != nil || stack.closed != 1 {
+		t.Error("Expected the DNS fallback handler")
+	}
+	probeWith(m, nil, blocked)
+	expectHealthEvent(t, l, nil)
+
+	// A single success restores UDP.
+	probeWith(m, nil, nil)
+	expectHealthEvent(t, l, &healthEvent{true, true})
+	if !m.t.udpSupport() || m.t.udp == nil || stack.closed != 2 {
+		t.Error("Expected the UDP handler")
+	}
+}
+
+func TestHealthMonitorProxyDown(t *testing.T) {
+	m, stack, l := makeHealthMonitor(t, 2)
+	down := errors.New("Proxy down")
+	probeWith(m, down, down)
+	// An intermittent failure resets the count.
+	probeWith(m, nil, nil)
+	probeWith(m, down, down)
+	expectHealthEvent(t, l, nil)
+	probeWith(m, down, down)
+	expectHealthEvent(t, l, &healthEvent{false, true})
+	probeWith(m, down, down)
+	expectHealthEvent(t, l, nil)
+	probeWith(m, nil, nil)
+	expectHealthEvent(t, l, &healthEvent{true, true})
+	// An outage does not disable UDP.
+	if stack.closed != 0 {
+		t.Error("Handlers switched during the outage")
+	}
+}
+
+func TestStartHealthMonitor(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	tun, _ := makeOutlineTunnel(t, proxy)
+	listener := &fakeHealthListener{make(chan healthEvent, 10)}
+	if err := tun.StartHealthMonitor(0, 3, listener); err == nil {
+		t.Error("Expected error for an invalid interval")
+	}
+	if err := tun.StartHealthMonitor(60, 0, listener); err == nil {
+		t.Error("Expected error for an invalid threshold")
+	}
+	if err := tun.StartHealthMonitor(60, 3, nil); err == nil {
+		t.Error("Expected error without a listener")
+	}
+	if err := tun.StartHealthMonitor(60, 3, listener); err != nil {
+		t.Fatal(err)
+	}
+	first := tun.monitor
+	if err := tun.StartHealthMonitor(60, 3, listener); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.stop:
+	case <-time.After(time.Second):
+		t.Error("The previous monitor is still running")
+	}
+	tun.StopHealthMonitor()
+	if tun.monitor != nil {
+		t.Error("The monitor is still running")
+	}
+}
+
+func TestHealthMonitorStoppedDuringProbe(t *testing.T) {
+	cases := []struct {
+		name   string
+		stop   func(*outlinetunnel)
+		closes int // Expected closes of the stack.
+	}{
+		{"StopHealthMonitor", (*outlinetunnel).StopHealthMonitor, 0},
+		{"Disconnect", (*outlinetunnel).Disconnect, 1},
+	}
+	for _, c := range cases {
+		m, stack, l := makeHealthMonitor(t, 1)
+		m.t.monitor = m
+		started := make(chan struct{})
+		result := make(chan error)
+		m.check = func() (error, error) {
+			close(started)
+			return nil, <-result
+		}
+		done := make(chan struct{})
+		go func() {
+			m.probe()
+			close(done)
+		}()
+		<-started
+		c.stop(m.t)
+		result <- errors.New("UDP blocked")
+		<-done
+		expectHealthEvent(t, l, nil)
+		if stack.closed != c.closes {
+			t.Errorf("%s: the stopped monitor switched the handlers", c.name)
+		}
+	}
+}
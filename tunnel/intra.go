@@ -15,17 +15,25 @@
 package tunnel
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
 )
 
 // IntraListener receives usage statistics when a UDP or TCP socket is closed,
@@ -47,19 +55,79 @@ type IntraTunnel interface {
 	SetDNS(doh.Transport)
 	// When set to true, Intra will pre-emptively split all HTTPS connections.
 	SetAlwaysSplitHTTPS(bool)
+	// Set the policy that controls when HTTPS connections are retried with splitting.
+	// A nil policy restores the default.  The policy applies to new connections.
+	// Returns an error, and keeps the current policy, if the policy is invalid.
+	SetRetryPolicy(*split.RetryPolicy) error
+	// Set the lookup that identifies the app that owns each socket, so that
+	// socket summaries include the app's UID.  A nil lookup disables this.
+	SetOwnerLookup(intra.OwnerLookup)
+	// Set the routing rules for new TCP and UDP sockets, as a JSON array of
+	// intra.Rule objects, e.g.
+	//   [{"domains": ["example.com"], "action": "split"},
+	//    {"cidrs": ["10.0.0.0/8"], "ports": ["1-1023"], "action": "reset"}]
+	// The first matching rule applies.  An empty string removes all rules.
+	SetRoutingRules(rules string) error
 	// Enable reporting of SNIs that resulted in connection failures, using the
 	// Choir library for privacy-preserving error reports.  `file` is the path
 	// that Choir should use to store its persistent state, `suffix` is the
 	// authoritative domain to which reports will be sent, and `country` is a
-	// two-letter ISO country code for the user's current location.
+	// two-letter ISO country code for the user's current location.  This is
+	// EnableSNIReporterBackend with SNIReporterChoir.
 	EnableSNIReporter(file, suffix, country string) error
+	// Enable reporting of SNIs on which a split retry was attempted.  `backend`
+	// selects the report destination (SNIReporterChoir, SNIReporterLog, or
+	// SNIReporterHTTPS), replacing any previous reporter.  `country` is a
+	// two-letter ISO country code for the user's current location.
+	//
+	// SNIReporterChoir uses the Choir library for privacy-preserving reports.
+	// `file` is the path that Choir should use to store its persistent state,
+	// and `destination` is the authoritative domain to which reports will be sent.
+	//
+	// SNIReporterLog appends hourly counts to the JSON log at `file`.
+	// `destination` is ignored.
+	//
+	// SNIReporterHTTPS uploads batches of reports to the HTTPS URL in `destination`.
+	// `file` is ignored.
+	EnableSNIReporterBackend(backend, file, destination, country string) error
+	// When set to true, failed connections that were not retried are also
+	// reported, by the current SNI reporter and any later one.  Defaults to false.
+	SetSNIReportUnretried(bool)
+	// Disable SNI reporting.  Pending reports are delivered or logged if possible,
+	// and the reporter's file is closed.
+	DisableSNIReporter()
+	// Change the country code attached to future SNI reports.
+	UpdateSNIReporterCountry(country string) error
+	// Get the SNI reporter's pending, non-identifying state as JSON, for display
+	// to the user.  The "backend" is empty if reporting is disabled.
+	GetSNIReporterState() (string, error)
 }
 
+// SNI reporter backends for IntraTunnel.EnableSNIReporterBackend.
+const (
+	SNIReporterChoir = "choir"
+	SNIReporterLog   = "log"
+	SNIReporterHTTPS = "https"
+)
+
+const (
+	sniLogInterval   = time.Hour
+	sniHTTPSBatch    = 20
+	sniHTTPSInterval = 10 * time.Minute
+	sniHTTPSTimeout  = 30 * time.Second
+)
+
 type intratunnel struct {
 	*tunnel
-	tcp intra.TCPHandler
-	udp intra.UDPHandler
-	dns doh.Transport
+	tcp    intra.TCPHandler
+	udp    intra.UDPHandler
+	dns    doh.Transport
+	dialer *net.Dialer
+
+	reporterMu      sync.Mutex // Protects reporter, reporterBackend and unretried.
+	reporter        intra.SNIReporter
+	reporterBackend string
+	unretried       bool
 }
 
 // NewIntraTunnel creates a connected Intra session.
@@ -77,9 +145,10 @@ func NewIntraTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteClos
 		return nil, errors.New("Must provide a valid TUN writer")
 	}
 	core.RegisterOutputFn(tunWriter.Write)
-	base := &tunnel{tunWriter, core.NewLWIPStack(), true}
+	base := &tunnel{tunWriter, core.NewLWIPStack(), true, conntrack.NewTable()}
 	t := &intratunnel{
 		tunnel: base,
+		dialer: dialer,
 	}
 	if err := t.registerConnectionHandlers(fakedns, dialer, config, listener); err != nil {
 		return nil, err
@@ -92,19 +161,21 @@ func NewIntraTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteClos
 func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dialer, config *net.ListenConfig, listener IntraListener) error {
 	// RFC 5382 REQ-5 requires a timeout no shorter than 2 hours and 4 minutes.
 	timeout, _ := time.ParseDuration("2h4m")
+	// DNS answers seen by either handler name the servers of both.
+	names := rules.NewNameTable()
 
 	udpfakedns, err := net.ResolveUDPAddr("udp", fakedns)
 	if err != nil {
 		return err
 	}
-	t.udp = intra.NewUDPHandler(*udpfakedns, timeout, config, listener)
+	t.udp = intra.NewUDPHandler(*udpfakedns, timeout, config, listener, t.flows, names)
 	core.RegisterUDPConnHandler(t.udp)
 
 	tcpfakedns, err := net.ResolveTCPAddr("tcp", fakedns)
 	if err != nil {
 		return err
 	}
-	t.tcp = intra.NewTCPHandler(*tcpfakedns, dialer, listener)
+	t.tcp = intra.NewTCPHandler(*tcpfakedns, dialer, listener, t.flows, names)
 	core.RegisterTCPConnHandler(t.tcp)
 	return nil
 }
@@ -123,10 +194,123 @@ func (t *intratunnel) SetAlwaysSplitHTTPS(s bool) {
 	t.tcp.SetAlwaysSplitHTTPS(s)
 }
 
-func (t *intratunnel) EnableSNIReporter(filename, suffix, country string) error {
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+func (t *intratunnel) SetRetryPolicy(policy *split.RetryPolicy) error {
+	return t.tcp.SetRetryPolicy(policy)
+}
+
+func (t *intratunnel) SetOwnerLookup(lookup intra.OwnerLookup) {
+	t.tcp.SetOwnerLookup(lookup)
+	t.udp.SetOwnerLookup(lookup)
+}
+
+func (t *intratunnel) SetRoutingRules(config string) error {
+	var rules *intra.Rules
+	if config != "" {
+		var err error
+		if rules, err = intra.ParseRules(config); err != nil {
+			return err
+		}
+	}
+	t.tcp.SetRules(rules)
+	t.udp.SetRules(rules)
+	return nil
+}
+
+func (t *intratunnel) EnableSNIReporter(file, suffix, country string) error {
+	return t.EnableSNIReporterBackend(SNIReporterChoir, file, suffix, country)
+}
+
+func (t *intratunnel) EnableSNIReporterBackend(backend, file, destination, country string) error {
+	country = strings.ToLower(country)
+	var reporter intra.SNIReporter
+	switch backend {
+	case SNIReporterChoir:
+		f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if reporter, err = intra.NewChoirSNIReporter(f, destination, country); err != nil {
+			f.Close()
+			return err
+		}
+	case SNIReporterLog:
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		reporter = intra.NewLogSNIReporter(f, sniLogInterval, country)
+	case SNIReporterHTTPS:
+		client := &http.Client{
+			Transport: &http.Transport{DialContext: t.dialer.DialContext},
+			Timeout:   sniHTTPSTimeout,
+		}
+		var err error
+		reporter, err = intra.NewHTTPSSNIReporter(destination, country, client, sniHTTPSBatch, sniHTTPSInterval)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown SNI reporter backend: %s", backend)
 	}
-	return t.tcp.EnableSNIReporter(f, suffix, strings.ToLower(country))
+	t.setSNIReporter(backend, reporter)
+	return nil
+}
+
+func (t *intratunnel) SetSNIReportUnretried(unretried bool) {
+	t.reporterMu.Lock()
+	defer t.reporterMu.Unlock()
+	t.unretried = unretried
+	if t.reporter != nil {
+		t.reporter.SetReportUnretried(unretried)
+	}
+}
+
+// Replaces the current SNI reporter, and closes the previous one.
+func (t *intratunnel) setSNIReporter(backend string, reporter intra.SNIReporter) {
+	t.reporterMu.Lock()
+	old := t.reporter
+	if reporter != nil {
+		reporter.SetReportUnretried(t.unretried)
+	}
+	t.reporter = reporter
+	t.reporterBackend = backend
+	t.tcp.SetSNIReporter(reporter)
+	t.reporterMu.Unlock()
+	if old != nil {
+		if err := old.Close(); err != nil {
+			log.Warnf("Failed to close SNI reporter: %v", err)
+		}
+	}
+}
+
+func (t *intratunnel) DisableSNIReporter() {
+	t.setSNIReporter("", nil)
+}
+
+func (t *intratunnel) UpdateSNIReporterCountry(country string) error {
+	t.reporterMu.Lock()
+	defer t.reporterMu.Unlock()
+	if t.reporter == nil {
+		return errors.New("SNI reporter is not enabled")
+	}
+	return t.reporter.SetCountry(strings.ToLower(country))
+}
+
+func (t *intratunnel) GetSNIReporterState() (string, error) {
+	t.reporterMu.Lock()
+	state := struct {
+		Backend string `json:"backend"`
+		*intra.SNIReporterState
+	}{Backend: t.reporterBackend}
+	if t.reporter != nil {
+		state.SNIReporterState = t.reporter.State()
+	}
+	t.reporterMu.Unlock()
+	b, err := json.Marshal(state)
+	return string(b), err
+}
+
+func (t *intratunnel) Disconnect() {
+	t.DisableSNIReporter()
+	t.tunnel.Disconnect()
 }
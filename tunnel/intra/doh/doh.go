@@ -33,6 +33,7 @@ import (
 
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh/ipmap"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
 
@@ -51,6 +52,23 @@ const (
 	InternalError
 )
 
+// Returns a metric label for a query status.
+func statusName(status int) string {
+	switch status {
+	case Complete:
+		return "complete"
+	case SendFailed:
+		return "send-failed"
+	case HTTPError:
+		return "http-error"
+	case BadQuery:
+		return "bad-query"
+	case BadResponse:
+		return "bad-response"
+	}
+	return "internal-error"
+}
+
 // Summary is a summary of a DNS transaction, reported when it is complete.
 type Summary struct {
 	Latency    float64 // Response (or failure) latency in seconds
@@ -116,7 +134,7 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	confirmed := ips.Confirmed()
 	if confirmed != nil {
 		log.Debugf("Trying confirmed IP %s for addr %s", confirmed.String(), addr)
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(confirmed), nil); err == nil {
+		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(confirmed), nil, nil); err == nil {
 			log.Infof("Confirmed IP %s worked", confirmed.String())
 			return conn, nil
 		}
@@ -130,7 +148,7 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 			// Don't try this IP twice.
 			continue
 		}
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(ip), nil); err == nil {
+		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(ip), nil, nil); err == nil {
 			log.Infof("Found working IP: %s", ip.String())
 			return conn, nil
 		}
@@ -382,21 +400,22 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 	response, server, err := t.doQuery(q)
 	after := time.Now()
 
-	if t.listener != nil {
-		latency := after.Sub(before)
-		status := Complete
-		httpStatus := http.StatusOK
-		var qerr *queryError
-		if errors.As(err, &qerr) {
-			status = qerr.status
-			httpStatus = 0
-
-			var herr *httpError
-			if errors.As(qerr.err, &herr) {
-				httpStatus = herr.status
-			}
+	latency := after.Sub(before)
+	status := Complete
+	httpStatus := http.StatusOK
+	var qerr *queryError
+	if errors.As(err, &qerr) {
+		status = qerr.status
+		httpStatus = 0
+
+		var herr *httpError
+		if errors.As(qerr.err, &herr) {
+			httpStatus = herr.status
 		}
+	}
+	metrics.ObserveDoH(statusName(status), latency)
 
+	if t.listener != nil {
 		var ip string
 		if server != nil {
 			ip = server.IP.String()
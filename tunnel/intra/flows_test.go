@@ -0,0 +1,111 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+)
+
+func TestTCPFlow(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		// Echo until the tunnel closes the socket.
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	flows := conntrack.NewTable()
+	summaries := make(tcpSummaries, 1)
+	h := NewTCPHandler(net.TCPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, &net.Dialer{}, summaries, flows, nil)
+	app, tun := net.Pipe()
+	target := server.Addr().(*net.TCPAddr)
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(app, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := flows.List()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	c := conns[0]
+	if c.Protocol != "tcp" || c.Target != target.String() || c.UploadBytes != 5 || c.DownloadBytes != 5 || c.Split {
+		t.Errorf("Bad connection: %v", c)
+	}
+
+	if err := flows.Close(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-summaries:
+	case <-time.After(time.Second):
+		t.Fatal("Closing the flow did not close the socket")
+	}
+	if len(flows.List()) != 0 {
+		t.Error("Closed flow is still listed")
+	}
+}
+
+func TestUDPFlow(t *testing.T) {
+	flows := conntrack.NewTable()
+	summaries := make(udpSummaries, 1)
+	h := NewUDPHandler(net.UDPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, time.Minute, &net.ListenConfig{}, summaries, flows, nil)
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5353}}
+	target := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("hello"), target); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := flows.List()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	if c := conns[0]; c.Protocol != "udp" || c.Target != "127.0.0.1:9" || c.UploadBytes != 5 {
+		t.Errorf("Bad connection: %v", c)
+	}
+
+	if err := flows.Close(conns[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if summary := <-summaries; summary.UploadBytes != 5 {
+		t.Errorf("Wrong summary: %v", summary)
+	}
+	if len(flows.List()) != 0 {
+		t.Error("Closed flow is still listed")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
+)
+
+// snoopingTransport records the answer to each query in a NameTable.
+type snoopingTransport struct {
+	doh.Transport
+	names *rules.NameTable
+}
+
+func (t *snoopingTransport) Query(q []byte) ([]byte, error) {
+	response, err := t.Transport.Query(q)
+	if err == nil {
+		t.names.Record(response)
+	}
+	return response, err
+}
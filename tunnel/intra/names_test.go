@@ -0,0 +1,106 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/dnstest"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
+)
+
+// Returns a transport that always returns `response`.
+func fixedTransport(response []byte) *fakeTransport {
+	return newFakeTransport(func(q []byte) ([]byte, error) {
+		return response, nil
+	})
+}
+
+func TestSnoopingTransport(t *testing.T) {
+	names := rules.NewNameTable()
+	response := dnstest.Response("a.test.", dnstest.A("a.test.", 300, "10.0.0.1"))
+	transport := &snoopingTransport{fixedTransport(response), names}
+	if _, err := transport.Query([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if name := names.Lookup(net.ParseIP("10.0.0.1")); name != "a.test" {
+		t.Errorf("Answer was not recorded: %s", name)
+	}
+}
+
+func TestTCPDomain(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	names := rules.NewNameTable()
+	names.Record(dnstest.Response("local.test.", dnstest.A("local.test.", 300, "127.0.0.1")))
+	flows := conntrack.NewTable()
+	summaries := make(tcpSummaries, 1)
+	h := NewTCPHandler(net.TCPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, &net.Dialer{}, summaries, flows, names)
+	app, tun := net.Pipe()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, server.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if conns := flows.List(); len(conns) != 1 || conns[0].Name != "local.test" {
+		t.Errorf("Wrong flow name: %v", conns)
+	}
+	app.Close()
+	if summary := <-summaries; summary.Domain != "local.test" {
+		t.Errorf("Wrong domain: %s", summary.Domain)
+	}
+}
+
+func TestUDPDomain(t *testing.T) {
+	names := rules.NewNameTable()
+	summaries := make(udpSummaries, 2)
+	fakedns := net.UDPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}
+	h := NewUDPHandler(fakedns, time.Minute, &net.ListenConfig{}, summaries, nil, names)
+	response := dnstest.Response("local.test.", dnstest.A("local.test.", 300, "127.0.0.1"))
+	h.SetDNS(fixedTransport(response))
+
+	// A DNS query through the fake DNS server records the answer.
+	dnsConn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5000}}
+	if err := h.Connect(dnsConn, &fakedns); err != nil {
+		t.Fatal(err)
+	}
+	query := make([]byte, 12)
+	if err := h.ReceiveTo(dnsConn, query, &fakedns); err != nil {
+		t.Fatal(err)
+	}
+	// The DNS-only socket is closed after the response.
+	<-summaries
+
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5001}}
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	h.(*udpHandler).Close(conn)
+	if summary := <-summaries; summary.Domain != "local.test" {
+		t.Errorf("Wrong domain: %s", summary.Domain)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// IP protocol numbers for OwnerLookup.
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+// UnknownOwner is the UID reported when the owner of a socket is unknown.
+const UnknownOwner = -1
+
+// OwnerLookup identifies the app that owns a socket on the TUN device.  On
+// Android, this can be implemented with ConnectivityManager.getConnectionOwnerUid.
+type OwnerLookup interface {
+	// GetOwner returns the UID of the app whose socket has the specified local
+	// (app-side) and remote addresses, or UnknownOwner.  `protocol` is
+	// ProtocolTCP or ProtocolUDP.
+	GetOwner(protocol int32, localIP string, localPort int32, remoteIP string, remotePort int32) int32
+}
+
+// ownerBox allows atomic.Value to hold OwnerLookups of different types, or nil.
+type ownerBox struct {
+	OwnerLookup
+}
+
+// atomicOwner holds an OwnerLookup that can be replaced at any time.
+type atomicOwner struct {
+	v atomic.Value
+}
+
+func (a *atomicOwner) Store(lookup OwnerLookup) {
+	a.v.Store(ownerBox{lookup})
+}
+
+// lookup returns the UID of the owner of the socket from `local` to `remote`,
+// or UnknownOwner if there is no OwnerLookup.
+func (a *atomicOwner) lookup(protocol int32, local, remote net.Addr) int32 {
+	box, _ := a.v.Load().(ownerBox)
+	if box.OwnerLookup == nil {
+		return UnknownOwner
+	}
+	localIP, localPort, ok1 := splitAddr(local)
+	remoteIP, remotePort, ok2 := splitAddr(remote)
+	if !ok1 || !ok2 {
+		return UnknownOwner
+	}
+	return box.GetOwner(protocol, localIP, localPort, remoteIP, remotePort)
+}
+
+// Returns the IP and port of `addr`, or false if it is nil or not an IP address.
+func splitAddr(addr net.Addr) (string, int32, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.IP.String(), int32(a.Port), true
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.IP.String(), int32(a.Port), true
+		}
+	}
+	return "", 0, false
+}
+
+// procNetLookup is an OwnerLookup that reads the Linux socket tables.
+type procNetLookup struct {
+	root string // Normally "/proc/net".
+}
+
+// NewProcNetOwnerLookup returns an OwnerLookup that finds the owner of each
+// socket in /proc/net/{tcp,tcp6,udp,udp6}.  This only works on Linux, and
+// only if those tables are readable (which is not the case on Android 10+).
+func NewProcNetOwnerLookup() OwnerLookup {
+	return &procNetLookup{root: "/proc/net"}
+}
+
+func (l *procNetLookup) GetOwner(protocol int32, localIP string, localPort int32, remoteIP string, remotePort int32) int32 {
+	var table string
+	switch protocol {
+	case ProtocolTCP:
+		table = "tcp"
+	case ProtocolUDP:
+		table = "udp"
+	default:
+		return UnknownOwner
+	}
+	local, remote := net.ParseIP(localIP), net.ParseIP(remoteIP)
+	if local == nil || remote == nil {
+		return UnknownOwner
+	}
+	if local.To4() != nil {
+		// IPv4 sockets appear in the IPv4 table, or in the IPv6 table as
+		// IPv4-mapped addresses if the socket is dual-stack.
+		uid := l.search(table, procNetAddr(local.To4(), localPort), procNetAddr(remote.To4(), remotePort), protocol)
+		if uid != UnknownOwner {
+			return uid
+		}
+	}
+	return l.search(table+"6", procNetAddr(local.To16(), localPort), procNetAddr(remote.To16(), remotePort), protocol)
+}
+
+// Formats `ip` and `port` as in /proc/net: each 32-bit word of the address
+// in host (little-endian) order, followed by the port in big-endian order.
+func procNetAddr(ip net.IP, port int32) string {
+	var b strings.Builder
+	for i := 0; i+4 <= len(ip); i += 4 {
+		fmt.Fprintf(&b, "%08X", binary.LittleEndian.Uint32(ip[i:i+4]))
+	}
+	fmt.Fprintf(&b, ":%04X", port)
+	return b.String()
+}
+
+// Returns true if `addr` is an unspecified address and port, as shown for the
+// remote side of an unconnected socket.
+func unspecified(addr string) bool {
+	return strings.Trim(addr, "0:") == ""
+}
+
+// Returns true if `bound` is the wildcard address with the same port as `local`.
+func wildcard(bound, local string) bool {
+	i := strings.IndexByte(bound, ':')
+	return i >= 0 && strings.Trim(bound[:i], "0") == "" && strings.HasSuffix(local, bound[i:])
+}
+
+// Searches /proc/net/`table` for a socket from `local` to `remote`.  For UDP,
+// unconnected sockets bound to `local` (or the wildcard address) also match.
+func (l *procNetLookup) search(table, local, remote string, protocol int32) int32 {
+	f, err := os.Open(filepath.Join(l.root, table))
+	if err != nil {
+		return UnknownOwner
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header.
+	unconnected := int32(UnknownOwner)
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		exact := strings.EqualFold(fields[1], local)
+		if !exact && !(protocol == ProtocolUDP && wildcard(fields[1], local)) {
+			continue
+		}
+		uid, err := strconv.ParseInt(fields[7], 10, 32)
+		if err != nil {
+			continue
+		}
+		if exact && strings.EqualFold(fields[2], remote) {
+			return int32(uid)
+		}
+		if protocol == ProtocolUDP && unspecified(fields[2]) {
+			unconnected = int32(uid)
+		}
+	}
+	return unconnected
+}
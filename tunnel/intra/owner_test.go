@@ -0,0 +1,214 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+)
+
+// fakeLookup records each query and returns a fixed UID.
+type fakeLookup struct {
+	uid      int32
+	protocol int32
+	local    string
+	remote   string
+}
+
+func (l *fakeLookup) GetOwner(protocol int32, localIP string, localPort int32, remoteIP string, remotePort int32) int32 {
+	l.protocol = protocol
+	l.local = net.JoinHostPort(localIP, strconv.Itoa(int(localPort)))
+	l.remote = net.JoinHostPort(remoteIP, strconv.Itoa(int(remotePort)))
+	return l.uid
+}
+
+const procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+func writeProcNet(t *testing.T, dir, table, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, table), []byte(procNetHeader+contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcNetAddr(t *testing.T) {
+	if addr := procNetAddr(net.ParseIP("10.111.222.1").To4(), 443); addr != "01DE6F0A:01BB" {
+		t.Errorf("Wrong IPv4 address: %s", addr)
+	}
+	if addr := procNetAddr(net.ParseIP("10.111.222.1").To16(), 443); addr != "0000000000000000FFFF000001DE6F0A:01BB" {
+		t.Errorf("Wrong IPv4-mapped address: %s", addr)
+	}
+	if addr := procNetAddr(net.ParseIP("2001:db8::1"), 80); addr != "B80D0120000000000000000001000000:0050" {
+		t.Errorf("Wrong IPv6 address: %s", addr)
+	}
+}
+
+func TestProcNetLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "procnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 10.111.222.1:40000 -> 93.184.216.34:443, owned by UID 10123.
+	writeProcNet(t, dir, "tcp",
+		"   0: 01DE6F0A:9C40 22D8B85D:01BB 01 00000000:00000000 00:00000000 00000000 10123        0 1234 1 0000000000000000 20 4 30 10 -1\n"+
+			"   1: 01DE6F0A:9C41 22D8B85D:01BB 01 00000000:00000000 00:00000000 00000000 10456        0 1235 1 0000000000000000 20 4 30 10 -1\n")
+	// A dual-stack socket: 10.111.222.1:40002 -> 93.184.216.34:443, owned by UID 10789.
+	writeProcNet(t, dir, "tcp6",
+		"   0: 0000000000000000FFFF000001DE6F0A:9C42 0000000000000000FFFF000022D8B85D:01BB 01 00000000:00000000 00:00000000 00000000 10789        0 1236 1 0000000000000000 20 4 30 10 -1\n")
+	// An unconnected UDP socket bound to the wildcard address on port 5353.
+	writeProcNet(t, dir, "udp",
+		"   0: 00000000:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000 10321        0 1237 2 0000000000000000 0\n")
+
+	l := &procNetLookup{root: dir}
+	cases := []struct {
+		protocol   int32
+		local      string
+		localPort  int32
+		remote     string
+		remotePort int32
+		uid        int32
+	}{
+		{ProtocolTCP, "10.111.222.1", 40000, "93.184.216.34", 443, 10123},
+		{ProtocolTCP, "10.111.222.1", 40001, "93.184.216.34", 443, 10456},
+		{ProtocolTCP, "10.111.222.1", 40002, "93.184.216.34", 443, 10789},
+		{ProtocolTCP, "10.111.222.1", 40000, "93.184.216.34", 80, UnknownOwner},
+		{ProtocolUDP, "10.111.222.1", 5353, "224.0.0.251", 5353, 10321},
+		{ProtocolUDP, "10.111.222.1", 5354, "224.0.0.251", 5353, UnknownOwner},
+		{ProtocolTCP, "not an IP", 1, "93.184.216.34", 443, UnknownOwner},
+		{1, "10.111.222.1", 40000, "93.184.216.34", 443, UnknownOwner},
+	}
+	for _, c := range cases {
+		if uid := l.GetOwner(c.protocol, c.local, c.localPort, c.remote, c.remotePort); uid != c.uid {
+			t.Errorf("%d %s:%d -> %s:%d: UID %d != %d", c.protocol, c.local, c.localPort, c.remote, c.remotePort, uid, c.uid)
+		}
+	}
+}
+
+func TestProcNetMissing(t *testing.T) {
+	l := &procNetLookup{root: "/nonexistent"}
+	if uid := l.GetOwner(ProtocolTCP, "10.0.0.1", 1, "10.0.0.2", 2); uid != UnknownOwner {
+		t.Errorf("Expected unknown owner, got %d", uid)
+	}
+}
+
+func TestAtomicOwner(t *testing.T) {
+	var a atomicOwner
+	local := &net.TCPAddr{IP: net.ParseIP("10.111.222.1"), Port: 40000}
+	remote := &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 443}
+	if uid := a.lookup(ProtocolTCP, local, remote); uid != UnknownOwner {
+		t.Errorf("Unset lookup returned %d", uid)
+	}
+	l := &fakeLookup{uid: 10123}
+	a.Store(l)
+	if uid := a.lookup(ProtocolTCP, local, remote); uid != 10123 {
+		t.Errorf("Wrong UID %d", uid)
+	}
+	if l.local != "10.111.222.1:40000" || l.remote != "93.184.216.34:443" {
+		t.Errorf("Wrong addresses %s -> %s", l.local, l.remote)
+	}
+	var nilAddr *net.UDPAddr
+	if uid := a.lookup(ProtocolUDP, nilAddr, remote); uid != UnknownOwner {
+		t.Errorf("Nil address returned %d", uid)
+	}
+	a.Store(nil)
+	if uid := a.lookup(ProtocolTCP, local, remote); uid != UnknownOwner {
+		t.Errorf("Cleared lookup returned %d", uid)
+	}
+}
+
+type tcpSummaries chan *TCPSocketSummary
+
+func (c tcpSummaries) OnTCPSocketClosed(s *TCPSocketSummary) { c <- s }
+
+func TestTCPOwner(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	summaries := make(tcpSummaries, 1)
+	h := NewTCPHandler(net.TCPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, &net.Dialer{}, summaries, nil, nil)
+	l := &fakeLookup{uid: 10123}
+	h.SetOwnerLookup(l)
+
+	app, tun := net.Pipe()
+	local := &net.TCPAddr{IP: net.ParseIP("10.111.222.1"), Port: 40000}
+	target := server.Addr().(*net.TCPAddr)
+	if err := h.Handle(&testconn.TCPConn{Conn: tun, Local: local}, target); err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+
+	summary := <-summaries
+	if summary.UID != 10123 {
+		t.Errorf("Wrong UID %d", summary.UID)
+	}
+	if l.protocol != ProtocolTCP || l.local != local.String() || l.remote != target.String() {
+		t.Errorf("Wrong lookup: %d %s -> %s", l.protocol, l.local, l.remote)
+	}
+}
+
+type udpSummaries chan *UDPSocketSummary
+
+func (c udpSummaries) OnUDPSocketClosed(s *UDPSocketSummary) { c <- s }
+
+func TestUDPOwner(t *testing.T) {
+	summaries := make(udpSummaries, 1)
+	h := NewUDPHandler(net.UDPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, time.Minute, &net.ListenConfig{}, summaries, nil, nil)
+	l := &fakeLookup{uid: 10321}
+	h.SetOwnerLookup(l)
+
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5353}}
+	target := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	h.(*udpHandler).Close(conn)
+
+	summary := <-summaries
+	if summary.UID != 10321 {
+		t.Errorf("Wrong UID %d", summary.UID)
+	}
+	if l.protocol != ProtocolUDP || l.local != "10.111.222.1:5353" || l.remote != "127.0.0.1:9" {
+		t.Errorf("Wrong lookup: %d %s -> %s", l.protocol, l.local, l.remote)
+	}
+}
+
+func TestUDPNoOwner(t *testing.T) {
+	summaries := make(udpSummaries, 1)
+	h := NewUDPHandler(net.UDPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, time.Minute, &net.ListenConfig{}, summaries, nil, nil)
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5353}}
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	h.(*udpHandler).Close(conn)
+	if summary := <-summaries; summary.UID != UnknownOwner {
+		t.Errorf("Expected unknown owner, got %d", summary.UID)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quic extracts the TLS SNI from the first packet of a QUIC connection.
+// QUIC Initial packets are encrypted, but the keys are derived only from
+// values visible on the wire, so any observer (including censors) can read them.
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/Jigsaw-Code/getsni"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	version1       = 0x00000001
+	versionDraft29 = 0xff00001d
+)
+
+// Initial salts from RFC 9001, Section 5.2 and draft-ietf-quic-tls-29.
+var (
+	saltV1      = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	saltDraft29 = []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99}
+)
+
+// Frame types that may appear in a client's Initial packet.
+const (
+	framePadding = 0x00
+	framePing    = 0x01
+	frameAck     = 0x02
+	frameAckECN  = 0x03
+	frameCrypto  = 0x06
+)
+
+// A ClientHello must fit in a TLS record, so it can't exceed this size.
+const maxHello = 1<<16 - 1
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446, Section 7.1,
+// with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	hkdf.Expand(sha256.New, secret, b.BytesOrPanic()).Read(out)
+	return out
+}
+
+// clientInitialKeys returns the AEAD key, IV, and header protection key that
+// protect a client's Initial packets for the connection ID `dcid`.
+func clientInitialKeys(salt, dcid []byte) (key, iv, hp []byte) {
+	initial := hkdf.Extract(sha256.New, dcid, salt)
+	client := hkdfExpandLabel(initial, "client in", sha256.Size)
+	return hkdfExpandLabel(client, "quic key", 16),
+		hkdfExpandLabel(client, "quic iv", 12),
+		hkdfExpandLabel(client, "quic hp", 16)
+}
+
+func readVarint(s *cryptobyte.String, out *uint64) bool {
+	var first uint8
+	if !s.ReadUint8(&first) {
+		return false
+	}
+	n := 1 << (first >> 6)
+	v := uint64(first & 0x3f)
+	for i := 1; i < n; i++ {
+		var b uint8
+		if !s.ReadUint8(&b) {
+			return false
+		}
+		v = v<<8 | uint64(b)
+	}
+	*out = v
+	return true
+}
+
+// decrypt removes header protection from a client Initial packet and returns
+// its plaintext payload.
+func decrypt(packet []byte) ([]byte, error) {
+	s := cryptobyte.String(packet)
+	var first uint8
+	var version uint32
+	var dcid, scid cryptobyte.String
+	var token []byte
+	var tokenLen, length uint64
+	if !s.ReadUint8(&first) || !s.ReadUint32(&version) {
+		return nil, errors.New("Short header")
+	}
+	if first&0x80 == 0 {
+		return nil, errors.New("Not a long header packet")
+	}
+	if (first>>4)&0x03 != 0 {
+		return nil, errors.New("Not an Initial packet")
+	}
+	var salt []byte
+	switch version {
+	case version1:
+		salt = saltV1
+	case versionDraft29:
+		salt = saltDraft29
+	default:
+		return nil, errors.New("Unsupported QUIC version")
+	}
+	if !s.ReadUint8LengthPrefixed(&dcid) || !s.ReadUint8LengthPrefixed(&scid) ||
+		!readVarint(&s, &tokenLen) || !s.ReadBytes(&token, int(tokenLen)) ||
+		!readVarint(&s, &length) {
+		return nil, errors.New("Bad long header")
+	}
+	pnOffset := len(packet) - len(s)
+	if length < 20 || uint64(len(s)) < length {
+		return nil, errors.New("Truncated packet")
+	}
+
+	key, iv, hp := clientInitialKeys(salt, dcid)
+	hpCipher, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	// Work on a copy so that the caller's buffer is not modified.
+	p := append([]byte{}, packet[:pnOffset+int(length)]...)
+	mask := make([]byte, aes.BlockSize)
+	hpCipher.Encrypt(mask, p[pnOffset+4:pnOffset+4+aes.BlockSize])
+	p[0] ^= mask[0] & 0x0f
+	pnLen := int(p[0]&0x03) + 1
+	for i := 0; i < pnLen; i++ {
+		p[pnOffset+i] ^= mask[1+i]
+	}
+	var pn uint64
+	for _, b := range p[pnOffset : pnOffset+pnLen] {
+		pn = pn<<8 | uint64(b)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	var pnBytes [8]byte
+	binary.BigEndian.PutUint64(pnBytes[:], pn)
+	for i := range pnBytes {
+		nonce[len(nonce)-8+i] ^= pnBytes[i]
+	}
+	header := p[:pnOffset+pnLen]
+	return aead.Open(nil, nonce, p[pnOffset+pnLen:], header)
+}
+
+// cryptoData reassembles the contiguous prefix of the CRYPTO stream from the
+// frames in `payload`.
+func cryptoData(payload []byte) ([]byte, error) {
+	s := cryptobyte.String(payload)
+	var data []byte
+	for !s.Empty() {
+		var frameType uint64
+		if !readVarint(&s, &frameType) {
+			return nil, errors.New("Bad frame type")
+		}
+		switch frameType {
+		case framePadding, framePing:
+		case frameAck, frameAckECN:
+			var largest, delay, count, first, gap, ackLen uint64
+			if !readVarint(&s, &largest) || !readVarint(&s, &delay) ||
+				!readVarint(&s, &count) || !readVarint(&s, &first) {
+				return nil, errors.New("Bad ACK frame")
+			}
+			for i := uint64(0); i < count; i++ {
+				if !readVarint(&s, &gap) || !readVarint(&s, &ackLen) {
+					return nil, errors.New("Bad ACK range")
+				}
+			}
+			if frameType == frameAckECN {
+				var ect0, ect1, ce uint64
+				if !readVarint(&s, &ect0) || !readVarint(&s, &ect1) || !readVarint(&s, &ce) {
+					return nil, errors.New("Bad ECN counts")
+				}
+			}
+		case frameCrypto:
+			var offset, length uint64
+			var chunk []byte
+			if !readVarint(&s, &offset) || !readVarint(&s, &length) ||
+				!s.ReadBytes(&chunk, int(length)) {
+				return nil, errors.New("Bad CRYPTO frame")
+			}
+			end := offset + length
+			if end > maxHello {
+				return nil, errors.New("CRYPTO frame out of range")
+			}
+			if end > uint64(len(data)) {
+				data = append(data, make([]byte, end-uint64(len(data)))...)
+			}
+			copy(data[offset:], chunk)
+		default:
+			// Any other frame ends the search.  The frames processed so far may
+			// still contain the whole ClientHello.
+			return data, nil
+		}
+	}
+	return data, nil
+}
+
+// GetSNI accepts a UDP payload containing a client's QUIC Initial packet and
+// returns the server name from the TLS ClientHello, or an error if the server
+// name was not found.  Only the first packet in the datagram is examined, and the
+// ClientHello must fit within that packet.
+func GetSNI(packet []byte) (string, error) {
+	payload, err := decrypt(packet)
+	if err != nil {
+		return "", err
+	}
+	hello, err := cryptoData(payload)
+	if err != nil {
+		return "", err
+	}
+	if len(hello) == 0 {
+		return "", errors.New("No CRYPTO data")
+	}
+	// getsni expects a TLS record, so add a record header around the handshake message.
+	record := make([]byte, 5, 5+len(hello))
+	record[0] = 0x16 // Handshake
+	record[1], record[2] = 0x03, 0x01
+	binary.BigEndian.PutUint16(record[3:], uint16(len(hello)))
+	return getsni.GetSNI(append(record, hello...))
+}
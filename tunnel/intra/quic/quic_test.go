@@ -0,0 +1,167 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// Test vectors from RFC 9001, Appendix A.1.
+func TestClientInitialKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := clientInitialKeys(saltV1, dcid)
+	check := func(name string, got []byte, want string) {
+		if hex.EncodeToString(got) != want {
+			t.Errorf("Wrong %s: %x != %s", name, got, want)
+		}
+	}
+	check("key", key, "1f369613dd76d5467730efcbe3b1a22d")
+	check("iv", iv, "fa044b2f42a3fd3b46fb255c")
+	check("hp", hp, "9f50449e04a0e810283a1e9933adedd2")
+}
+
+// Returns the handshake message (without record header) of a real ClientHello.
+func makeHello(t *testing.T, sni string) []byte {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: sni}).Handshake()
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	return buf[5:n]
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Constructs a protected client Initial packet containing `frames`.
+func makeInitial(t *testing.T, version uint32, salt, frames []byte) []byte {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pn := []byte{0, 0, 0, 2}
+	packet := []byte{0xc3, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	packet = append(packet, byte(len(dcid)))
+	packet = append(packet, dcid...)
+	packet = append(packet, 0) // Empty SCID
+	packet = append(packet, 0) // Empty token
+	packet = appendVarint(packet, uint64(len(pn)+len(frames)+16))
+	pnOffset := len(packet)
+	packet = append(packet, pn...)
+
+	key, iv, hp := clientInitialKeys(salt, dcid)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := append([]byte{}, iv...)
+	nonce[len(nonce)-1] ^= pn[3]
+	packet = aead.Seal(packet, nonce, frames, packet)
+
+	hpCipher, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	hpCipher.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := range pn {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{frameCrypto}
+	frame = appendVarint(frame, uint64(offset))
+	frame = appendVarint(frame, uint64(len(data)))
+	return append(frame, data...)
+}
+
+func TestGetSNI(t *testing.T) {
+	hello := makeHello(t, "www.example.test")
+	frames := append(cryptoFrame(0, hello), make([]byte, 100)...) // Padding
+	packet := makeInitial(t, version1, saltV1, frames)
+	orig := append([]byte{}, packet...)
+	sni, err := GetSNI(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "www.example.test" {
+		t.Errorf("Wrong SNI: %s", sni)
+	}
+	if !bytes.Equal(packet, orig) {
+		t.Error("Input was modified")
+	}
+}
+
+func TestGetSNIDraft29(t *testing.T) {
+	hello := makeHello(t, "draft.example.test")
+	packet := makeInitial(t, versionDraft29, saltDraft29, cryptoFrame(0, hello))
+	sni, err := GetSNI(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "draft.example.test" {
+		t.Errorf("Wrong SNI: %s", sni)
+	}
+}
+
+func TestGetSNIReordered(t *testing.T) {
+	hello := makeHello(t, "www.example.test")
+	half := len(hello) / 2
+	frames := append([]byte{framePing}, cryptoFrame(half, hello[half:])...)
+	frames = append(frames, cryptoFrame(0, hello[:half])...)
+	packet := makeInitial(t, version1, saltV1, frames)
+	sni, err := GetSNI(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "www.example.test" {
+		t.Errorf("Wrong SNI: %s", sni)
+	}
+}
+
+func TestGetSNITruncatedHello(t *testing.T) {
+	hello := makeHello(t, "www.example.test")
+	packet := makeInitial(t, version1, saltV1, cryptoFrame(0, hello[:len(hello)/2]))
+	if _, err := GetSNI(packet); err == nil {
+		t.Error("Expected failure for incomplete ClientHello")
+	}
+}
+
+func TestGetSNIWrongKeys(t *testing.T) {
+	hello := makeHello(t, "www.example.test")
+	packet := makeInitial(t, version1, saltDraft29, cryptoFrame(0, hello))
+	if _, err := GetSNI(packet); err == nil {
+		t.Error("Expected decryption failure")
+	}
+}
+
+func TestGetSNINotQUIC(t *testing.T) {
+	for _, packet := range [][]byte{
+		nil,
+		{0x40, 1, 2, 3},                // Short header
+		{0xc0, 0, 0, 0, 1},             // Truncated
+		{0xe0, 0, 0, 0, 1, 0, 0, 0, 0}, // Handshake packet
+		{0xc0, 0x0a, 0x0a, 0x0a, 0x0a}, // Unknown version
+	} {
+		if _, err := GetSNI(packet); err == nil {
+			t.Errorf("Expected failure for %x", packet)
+		}
+	}
+}
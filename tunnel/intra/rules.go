@@ -0,0 +1,129 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
+)
+
+// Routing actions for Rule.Action.
+const (
+	// ActionDirect connects to the destination without splitting.
+	ActionDirect = "direct"
+	// ActionSplit splits the first segment of every TCP connection.
+	ActionSplit = "split"
+	// ActionRetry retries TCP connections with splitting if they fail, as
+	// normally happens on port 443.
+	ActionRetry = "retry"
+	// ActionReset rejects TCP connections with a reset, and drops UDP associations.
+	ActionReset = "reset"
+	// ActionBlackhole accepts connections and silently discards their data.
+	ActionBlackhole = "blackhole"
+)
+
+// Rule is a routing rule, whose Action is ActionDirect, ActionSplit,
+// ActionRetry, ActionReset, or ActionBlackhole.
+type Rule = rules.Rule
+
+// Rules is an ordered list of routing rules.  The first matching rule applies.
+// Sockets that match no rule use Intra's default behavior.  A nil *Rules has
+// no rules.
+type Rules = rules.Rules
+
+// ParseRules parses a JSON array of Rule objects.
+func ParseRules(config string) (*Rules, error) {
+	list, err := rules.Parse(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewRules(list)
+}
+
+// NewRules validates and compiles `list`.
+func NewRules(list []Rule) (*Rules, error) {
+	return rules.Compile(list, ActionDirect, ActionSplit, ActionRetry, ActionReset, ActionBlackhole)
+}
+
+// atomicRules holds Rules that can be replaced at any time.
+type atomicRules struct {
+	v atomic.Value
+}
+
+func (a *atomicRules) Store(rules *Rules) {
+	a.v.Store(rules)
+}
+
+func (a *atomicRules) Load() *Rules {
+	rules, _ := a.v.Load().(*Rules)
+	return rules
+}
+
+// helloPeek reads the beginning of a TCP stream, up to the end of the first
+// TLS record, so that the SNI can be inspected before connecting.  It then
+// replays those bytes as an io.Reader.
+type helloPeek struct {
+	done chan struct{} // Closed when the read is complete.
+	data []byte
+}
+
+// Maximum size of a TLS record, including the header.
+const maxRecordSize = 5 + 16384 + 256
+
+func peekHello(r io.Reader) *helloPeek {
+	p := &helloPeek{done: make(chan struct{})}
+	go p.read(r)
+	return p
+}
+
+// Reads until the first record is complete, the stream is found not to be TLS,
+// or helloTimeout expires.  Empty reads do not end the peek.
+func (p *helloPeek) read(r io.Reader) {
+	defer close(p.done)
+	buf := make([]byte, maxRecordSize)
+	n := 0
+	deadline := time.Now().Add(helloTimeout)
+	for n < len(buf) && time.Now().Before(deadline) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+		if n == 0 {
+			continue
+		}
+		if buf[0] != recordTypeHandshake {
+			break
+		}
+		if n >= 5 && n >= 5+(int(buf[3])<<8|int(buf[4])) {
+			break
+		}
+	}
+	p.data = buf[:n]
+}
+
+// Read returns the peeked bytes, and then io.EOF.
+func (p *helloPeek) Read(b []byte) (int, error) {
+	<-p.done
+	if len(p.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	return n, nil
+}
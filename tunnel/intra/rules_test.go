@@ -0,0 +1,288 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/getsni"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
+)
+
+const testRules = `[
+	{"protocol": "udp", "ports": ["443"], "snis": ["quic.test"], "action": "blackhole"},
+	{"domains": ["blocked.test"], "action": "reset"},
+	{"cidrs": ["10.0.0.0/8", "2001:db8::/32"], "ports": ["22", "8000-8999"], "action": "direct"},
+	{"protocol": "tcp", "snis": ["Split.Test."], "action": "split"},
+	{"cidrs": ["192.0.2.0/24"], "action": "blackhole"}
+]`
+
+func TestParseRules(t *testing.T) {
+	rs, err := ParseRules(testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 5 {
+		t.Fatalf("Wrong number of rules: %d", rs.Len())
+	}
+
+	for _, bad := range []string{
+		`{"action": "direct"}`,
+		`[{"action": "proxy"}]`,
+		`[{"protocol": "icmp", "action": "direct"}]`,
+		`[{"cidrs": ["10.0.0.1"], "action": "direct"}]`,
+		`[{"ports": ["100-10"], "action": "direct"}]`,
+		`[{"ports": ["70000"], "action": "direct"}]`,
+		`[{"ports": ["http"], "action": "direct"}]`,
+	} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("Expected error for %s", bad)
+		}
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	rs, err := ParseRules(testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		info    rules.Conn
+		action  string
+		needSNI bool
+		sni     string
+		final   string
+	}{
+		{"domain", rules.Conn{Protocol: "tcp", IP: net.ParseIP("93.184.216.34"), Port: 443, Domain: "www.blocked.test"}, ActionReset, false, "", ""},
+		{"parent domain", rules.Conn{Protocol: "tcp", IP: net.ParseIP("93.184.216.34"), Port: 443, Domain: "notblocked.test"}, "", true, "", ""},
+		{"cidr and port", rules.Conn{Protocol: "tcp", IP: net.ParseIP("10.1.2.3"), Port: 8080}, ActionDirect, false, "", ""},
+		{"cidr ipv6", rules.Conn{Protocol: "udp", IP: net.ParseIP("2001:db8::1"), Port: 22}, ActionDirect, false, "", ""},
+		{"port outside range", rules.Conn{Protocol: "udp", IP: net.ParseIP("10.1.2.3"), Port: 9000}, "", false, "", ""},
+		{"tcp sni", rules.Conn{Protocol: "tcp", IP: net.ParseIP("198.51.100.1"), Port: 443}, "", true, "a.split.test", ActionSplit},
+		{"tcp no sni", rules.Conn{Protocol: "tcp", IP: net.ParseIP("192.0.2.1"), Port: 443}, "", true, "", ActionBlackhole},
+		{"udp sni", rules.Conn{Protocol: "udp", IP: net.ParseIP("198.51.100.1"), Port: 443}, "", true, "quic.test", ActionBlackhole},
+		{"udp other sni", rules.Conn{Protocol: "udp", IP: net.ParseIP("198.51.100.1"), Port: 443}, "", true, "split.test", ""},
+		{"udp other port", rules.Conn{Protocol: "udp", IP: net.ParseIP("192.0.2.1"), Port: 53}, ActionBlackhole, false, "", ""},
+	}
+	for _, c := range cases {
+		action, needSNI := rs.Match(&c.info, false)
+		if action != c.action || needSNI != c.needSNI {
+			t.Errorf("%s: got (%q, %v), expected (%q, %v)", c.name, action, needSNI, c.action, c.needSNI)
+		}
+		if needSNI {
+			c.info.SNI = c.sni
+			if action, _ := rs.Match(&c.info, true); action != c.final {
+				t.Errorf("%s: got %q with SNI, expected %q", c.name, action, c.final)
+			}
+		}
+	}
+
+	var none *Rules
+	if action, needSNI := none.Match(&cases[0].info, false); action != "" || needSNI {
+		t.Errorf("Nil rules matched: %q %v", action, needSNI)
+	}
+}
+
+func TestHelloPeek(t *testing.T) {
+	hello := record(recordTypeHandshake, bytes.Repeat([]byte{1}, 600)...)
+	stream := append(append([]byte{}, hello...), record(recordTypeApplication, make([]byte, 300)...)...)
+	// Deliver the record in small pieces.
+	r, w := net.Pipe()
+	go func() {
+		for i := 0; i < len(stream); i += 100 {
+			end := i + 100
+			if end > len(stream) {
+				end = len(stream)
+			}
+			w.Write(stream[i:end])
+		}
+		w.Close()
+	}()
+	p := peekHello(r)
+	<-p.done
+	// The peek stops after the chunk that completes the record.
+	if !bytes.HasPrefix(p.data, hello) || len(p.data) >= len(stream) {
+		t.Errorf("Peeked %d bytes, expected the %d-byte record", len(p.data), len(hello))
+	}
+	replayed, _ := ioutil.ReadAll(p)
+	rest, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(append(replayed, rest...), stream) {
+		t.Error("Stream was not replayed correctly")
+	}
+}
+
+func TestHelloPeekNotTLS(t *testing.T) {
+	r, w := net.Pipe()
+	go w.Write([]byte("GET / HTTP/1.1\r\n"))
+	p := peekHello(r)
+	<-p.done
+	if string(p.data) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("Wrong data: %q", p.data)
+	}
+}
+
+// slowReader returns `empty` empty reads before reading from the embedded reader.
+type slowReader struct {
+	io.Reader
+	empty int
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.empty > 0 {
+		r.empty--
+		return 0, nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestHelloPeekLate(t *testing.T) {
+	hello := record(recordTypeHandshake, bytes.Repeat([]byte{1}, 100)...)
+	p := peekHello(&slowReader{bytes.NewReader(hello), 3})
+	<-p.done
+	if !bytes.Equal(p.data, hello) {
+		t.Errorf("Peeked %d bytes, expected the %d-byte record", len(p.data), len(hello))
+	}
+}
+
+// Starts a server that sends the first bytes it receives on `received`.
+func startFirstBytesServer(t *testing.T) (net.Listener, chan []byte) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, maxRecordSize)
+		n, _ := conn.Read(buf)
+		received <- buf[:n]
+		conn.Close()
+	}()
+	return server, received
+}
+
+func newRulesTCPHandler(t *testing.T, config string) (TCPHandler, tcpSummaries) {
+	rules, err := ParseRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := make(tcpSummaries, 1)
+	h := NewTCPHandler(net.TCPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, &net.Dialer{}, summaries, nil, nil)
+	h.SetRules(rules)
+	return h, summaries
+}
+
+func TestTCPRuleReset(t *testing.T) {
+	h, _ := newRulesTCPHandler(t, `[{"ports": ["1-65535"], "action": "reset"}]`)
+	_, tun := net.Pipe()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}); err != errRejected {
+		t.Errorf("Expected rejection, got %v", err)
+	}
+}
+
+func TestTCPRuleBlackhole(t *testing.T) {
+	h, _ := newRulesTCPHandler(t, `[{"cidrs": ["127.0.0.0/8"], "action": "blackhole"}]`)
+	app, tun := net.Pipe()
+	// No server is listening, so a dial would fail.
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Write([]byte("discarded")); err != nil {
+		t.Errorf("Write to blackhole failed: %v", err)
+	}
+	app.Close()
+}
+
+func TestTCPRuleSNI(t *testing.T) {
+	server, received := startFirstBytesServer(t)
+	defer server.Close()
+	h, _ := newRulesTCPHandler(t, `[{"snis": ["blocked.test"], "action": "reset"}]`)
+	target := server.Addr().(*net.TCPAddr)
+
+	// A blocked SNI resets the connection.
+	app, tun := net.Pipe()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, target); err != nil {
+		t.Fatal(err)
+	}
+	handshake := make(chan error, 1)
+	go func() {
+		handshake <- tls.Client(app, &tls.Config{ServerName: "www.blocked.test"}).Handshake()
+	}()
+	if err := <-handshake; err == nil {
+		t.Error("Handshake with blocked SNI succeeded")
+	}
+
+	// Other SNIs reach the server, including the ClientHello that was inspected.
+	app, tun = net.Pipe()
+	defer app.Close()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, target); err != nil {
+		t.Fatal(err)
+	}
+	go tls.Client(app, &tls.Config{ServerName: "allowed.test"}).Handshake()
+	select {
+	case hello := <-received:
+		if sni, err := getsni.GetSNI(hello); err != nil || sni != "allowed.test" {
+			t.Errorf("Server received the wrong ClientHello: %q, %v", sni, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server did not receive the ClientHello")
+	}
+}
+
+func TestUDPRules(t *testing.T) {
+	rules, err := ParseRules(`[
+		{"cidrs": ["127.0.0.2/32"], "action": "reset"},
+		{"cidrs": ["127.0.0.3/32"], "action": "blackhole"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := make(udpSummaries, 2)
+	h := NewUDPHandler(net.UDPAddr{IP: net.ParseIP("10.111.222.3"), Port: 53}, time.Minute, &net.ListenConfig{}, summaries, nil, nil)
+	h.SetRules(rules)
+	local := &net.UDPAddr{IP: net.ParseIP("10.111.222.1"), Port: 5353}
+
+	if err := h.Connect(&testconn.UDPConn{Local: local}, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9}); err != errRejected {
+		t.Errorf("Expected rejection, got %v", err)
+	}
+
+	conn := &testconn.UDPConn{Local: local}
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	// Packets to the blackholed destination are dropped.
+	if err := h.ReceiveTo(conn, []byte("dropped"), &net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	// Packets to a rejected destination close the association.
+	if err := h.ReceiveTo(conn, []byte("rejected"), &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9}); err != errRejected {
+		t.Errorf("Expected rejection, got %v", err)
+	}
+	if summary := <-summaries; summary.UploadBytes != 0 {
+		t.Errorf("Dropped packets were sent: %v", summary)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// sniBatch is the body of each POST to the collector.
+type sniBatch struct {
+	Country string      `json:"country"`
+	Reports []SNIReport `json:"reports"`
+}
+
+// httpsSNIReporter is an SNIReporter that uploads batches of reports to an
+// HTTPS collector.
+type httpsSNIReporter struct {
+	reportFilter
+	url       string
+	client    *http.Client
+	batchSize int
+	interval  time.Duration
+
+	mu      sync.Mutex // Protects the fields below.
+	country string
+	pending []SNIReport
+	timer   *time.Timer // Non-nil if a flush is scheduled.
+	closed  bool
+}
+
+// NewHTTPSSNIReporter returns an SNIReporter that POSTs reports as JSON to
+// `collector`, which must be an HTTPS URL.  Reports are uploaded in batches of
+// `batchSize`, or `interval` after the first report in a batch, whichever comes
+// first.  `country` is the two-letter ISO country code of the user's location.
+func NewHTTPSSNIReporter(collector, country string, client *http.Client, batchSize int, interval time.Duration) (SNIReporter, error) {
+	parsed, err := url.Parse(collector)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" {
+		return nil, errors.New("Collector must use HTTPS")
+	}
+	if batchSize < 1 {
+		return nil, errors.New("Batch size must be positive")
+	}
+	return &httpsSNIReporter{
+		url:       collector,
+		country:   country,
+		client:    client,
+		batchSize: batchSize,
+		interval:  interval,
+	}, nil
+}
+
+// SetDNS is a no-op because uploads use the HTTP client's resolver.
+func (r *httpsSNIReporter) SetDNS(dns doh.Transport) {}
+
+// Report adds `summary` to the current batch, and uploads the batch if it is full.
+func (r *httpsSNIReporter) Report(summary TCPSocketSummary) {
+	report, ok := r.newReport(summary)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.pending = append(r.pending, report)
+	if len(r.pending) < r.batchSize {
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.interval, r.flush)
+		}
+		r.mu.Unlock()
+		return
+	}
+	batch := r.takeLocked()
+	r.mu.Unlock()
+	go r.upload(batch)
+}
+
+// Returns the pending reports and cancels the scheduled flush.  Must be
+// called with r.mu held.
+func (r *httpsSNIReporter) takeLocked() sniBatch {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	batch := sniBatch{Country: r.country, Reports: r.pending}
+	r.pending = nil
+	return batch
+}
+
+func (r *httpsSNIReporter) flush() {
+	r.mu.Lock()
+	batch := r.takeLocked()
+	r.mu.Unlock()
+	if len(batch.Reports) > 0 {
+		r.upload(batch)
+	}
+}
+
+// SetCountry uploads the current batch, so that each batch has one country.
+func (r *httpsSNIReporter) SetCountry(country string) error {
+	r.mu.Lock()
+	batch := r.takeLocked()
+	r.country = country
+	r.mu.Unlock()
+	if len(batch.Reports) > 0 {
+		go r.upload(batch)
+	}
+	return nil
+}
+
+// State returns the reports in the current batch.
+func (r *httpsSNIReporter) State() *SNIReporterState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[SNIReport]int)
+	for _, report := range r.pending {
+		counts[report]++
+	}
+	return &SNIReporterState{
+		Country:     r.country,
+		Destination: r.url,
+		Unretried:   r.reportUnretried(),
+		Pending:     sortCounts(counts),
+	}
+}
+
+// Close uploads the current batch in the background, and ignores later reports.
+func (r *httpsSNIReporter) Close() error {
+	r.mu.Lock()
+	batch := r.takeLocked()
+	r.closed = true
+	r.mu.Unlock()
+	if len(batch.Reports) > 0 {
+		go r.upload(batch)
+	}
+	return nil
+}
+
+// Uploads `batch`.  Failed batches are dropped.
+func (r *httpsSNIReporter) upload(batch sniBatch) {
+	if err := r.send(batch); err != nil {
+		log.Infof("Failed to deliver %d SNI reports: %v", len(batch.Reports), err)
+	}
+}
+
+func (r *httpsSNIReporter) send(batch sniBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
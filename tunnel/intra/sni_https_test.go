@@ -0,0 +1,194 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Starts a collector that forwards each batch it receives to the returned channel.
+func startCollector(t *testing.T, status int) (*httptest.Server, chan sniBatch) {
+	batches := make(chan sniBatch, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Bad request: %s %s", req.Method, req.Header.Get("Content-Type"))
+		}
+		var batch sniBatch
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+		batches <- batch
+	}))
+	return server, batches
+}
+
+func receiveBatch(t *testing.T, batches chan sniBatch) sniBatch {
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for batch")
+	}
+	return sniBatch{}
+}
+
+func TestHTTPSBatchSize(t *testing.T) {
+	server, batches := startCollector(t, http.StatusNoContent)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("a.test", 100, false))
+	select {
+	case <-batches:
+		t.Fatal("Batch was sent before it was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.Report(makeSummary("b.test", 0, true))
+
+	batch := receiveBatch(t, batches)
+	if batch.Country != country {
+		t.Errorf("Wrong country: %s", batch.Country)
+	}
+	if len(batch.Reports) != 2 {
+		t.Fatalf("Wrong batch: %v", batch.Reports)
+	}
+	if batch.Reports[0] != (SNIReport{"a.test", "success", "closed", "split", OutcomeSuccess, "fixed", "none"}) {
+		t.Errorf("Wrong report: %v", batch.Reports[0])
+	}
+	if batch.Reports[1] != (SNIReport{"b.test", "failed", "timeout", "split", OutcomeFIN, "unfixed", "none"}) {
+		t.Errorf("Wrong report: %v", batch.Reports[1])
+	}
+}
+
+func TestHTTPSInterval(t *testing.T) {
+	server, batches := startCollector(t, http.StatusOK)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 100, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("a.test", 100, false))
+	batch := receiveBatch(t, batches)
+	if len(batch.Reports) != 1 || batch.Reports[0].SNI != "a.test" {
+		t.Errorf("Wrong batch: %v", batch.Reports)
+	}
+}
+
+func TestHTTPSServerError(t *testing.T) {
+	server, batches := startCollector(t, http.StatusInternalServerError)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := sniBatch{country, []SNIReport{{"a.test", "success", "closed", "split", OutcomeSuccess, "fixed", "none"}}}
+	if err := r.(*httpsSNIReporter).send(batch); err == nil {
+		t.Error("Expected an error for HTTP 500")
+	}
+	receiveBatch(t, batches)
+}
+
+func TestHTTPSNoSplit(t *testing.T) {
+	server, batches := startCollector(t, http.StatusOK)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := makeSummary("a.test", 100, false)
+	summary.Retry.Retries = 0
+	r.Report(summary)
+	select {
+	case batch := <-batches:
+		t.Errorf("Unexpected batch: %v", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHTTPSBadCollector(t *testing.T) {
+	for _, collector := range []string{"http://collector.test/", "://", ""} {
+		if _, err := NewHTTPSSNIReporter(collector, country, http.DefaultClient, 1, time.Hour); err == nil {
+			t.Errorf("Expected an error for %q", collector)
+		}
+	}
+	if _, err := NewHTTPSSNIReporter("https://collector.test/", country, http.DefaultClient, 0, time.Hour); err == nil {
+		t.Error("Expected an error for batch size 0")
+	}
+}
+
+func TestHTTPSState(t *testing.T) {
+	r, err := NewHTTPSSNIReporter("https://collector.test/", country, http.DefaultClient, 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("a.test", 100, false))
+	r.Report(makeSummary("b.test", 0, true))
+	r.Report(makeSummary("b.test", 0, true))
+	state := r.State()
+	if state.Country != country || state.Destination != "https://collector.test/" || state.Unretried {
+		t.Errorf("Bad state: %v", state)
+	}
+	if len(state.Pending) != 2 || state.Pending[0].SNI != "b.test" || state.Pending[0].Count != 2 {
+		t.Errorf("Bad pending reports: %v", state.Pending)
+	}
+}
+
+func TestHTTPSSetCountry(t *testing.T) {
+	server, batches := startCollector(t, http.StatusOK)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("a.test", 100, false))
+	if err := r.SetCountry("yy"); err != nil {
+		t.Fatal(err)
+	}
+	// The pending batch is uploaded with the old country.
+	batch := receiveBatch(t, batches)
+	if batch.Country != country || len(batch.Reports) != 1 {
+		t.Errorf("Bad batch: %v", batch)
+	}
+	if state := r.State(); state.Country != "yy" || len(state.Pending) != 0 {
+		t.Errorf("Bad state: %v", state)
+	}
+}
+
+func TestHTTPSClose(t *testing.T) {
+	server, batches := startCollector(t, http.StatusOK)
+	defer server.Close()
+	r, err := NewHTTPSSNIReporter(server.URL, country, server.Client(), 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("a.test", 100, false))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if batch := receiveBatch(t, batches); len(batch.Reports) != 1 {
+		t.Errorf("Bad batch: %v", batch)
+	}
+	r.Report(makeSummary("b.test", 100, false))
+	if len(r.State().Pending) != 0 {
+		t.Error("Report was accepted after Close")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// sniLogEntry is one line of the JSON log.
+type sniLogEntry struct {
+	Start   int64            `json:"start"` // Unix time in seconds
+	End     int64            `json:"end"`
+	Country string           `json:"country"`
+	Counts  []SNIReportCount `json:"counts"`
+}
+
+// logSNIReporter is an SNIReporter that aggregates reports locally, and
+// appends one JSON line of counts to a log for each interval.
+type logSNIReporter struct {
+	reportFilter
+	mu       sync.Mutex // Protects all fields.
+	w        io.Writer
+	interval time.Duration
+	country  string
+	start    time.Time
+	counts   map[SNIReport]int
+	timer    *time.Timer // Non-nil if a flush is scheduled.
+}
+
+// NewLogSNIReporter returns an SNIReporter that writes aggregated counts to
+// `w` as newline-delimited JSON.  Counts are written `interval` after the first
+// report in each interval, and when Flush is called.  `country` is the
+// two-letter ISO country code of the user's location.
+func NewLogSNIReporter(w io.Writer, interval time.Duration, country string) SNIReporter {
+	return &logSNIReporter{
+		w:        w,
+		interval: interval,
+		country:  country,
+		counts:   make(map[SNIReport]int),
+	}
+}
+
+// SetDNS is a no-op because this reporter doesn't use the network.
+func (r *logSNIReporter) SetDNS(dns doh.Transport) {}
+
+// Report adds `summary` to the counts for the current interval.
+func (r *logSNIReporter) Report(summary TCPSocketSummary) {
+	report, ok := r.newReport(summary)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return // Closed
+	}
+	if r.timer == nil {
+		r.start = time.Now()
+		r.timer = time.AfterFunc(r.interval, r.Flush)
+	}
+	r.counts[report]++
+}
+
+// Flush writes the counts for the current interval, if any, and starts a new interval.
+func (r *logSNIReporter) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+}
+
+func (r *logSNIReporter) flushLocked() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if len(r.counts) == 0 || r.w == nil {
+		return
+	}
+	entry := sniLogEntry{
+		Start:   r.start.Unix(),
+		End:     time.Now().Unix(),
+		Country: r.country,
+		Counts:  sortCounts(r.counts),
+	}
+	r.counts = make(map[SNIReport]int)
+	if err := json.NewEncoder(r.w).Encode(entry); err != nil {
+		log.Warnf("Failed to write SNI log: %v", err)
+	}
+}
+
+// SetCountry ends the current interval, so that each log entry has one country.
+func (r *logSNIReporter) SetCountry(country string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+	r.country = country
+	return nil
+}
+
+// State returns the counts for the current interval.
+func (r *logSNIReporter) State() *SNIReporterState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &SNIReporterState{
+		Country:   r.country,
+		Unretried: r.reportUnretried(),
+		Pending:   sortCounts(r.counts),
+	}
+}
+
+// Close flushes the log, and closes the writer if it is an io.Closer.
+func (r *logSNIReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+	w := r.w
+	r.w = nil
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+)
+
+func makeSummary(sni string, download int64, timeout bool) TCPSocketSummary {
+	return TCPSocketSummary{
+		DownloadBytes: download,
+		UploadBytes:   500,
+		Retry: &split.RetryStats{
+			Timeout:   timeout,
+			Split:     40,
+			Retries:   1,
+			SNI:       sni,
+			Technique: split.SplitRandom,
+		},
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func parseLog(t *testing.T, s string) []sniLogEntry {
+	var entries []sniLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry sniLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogAggregation(t *testing.T) {
+	var buf syncBuffer
+	r := NewLogSNIReporter(&buf, time.Hour, country).(*logSNIReporter)
+	r.Report(makeSummary("a.test", 100, false))
+	r.Report(makeSummary("b.test", 0, true))
+	r.Report(makeSummary("a.test", 200, false))
+	if buf.String() != "" {
+		t.Fatal("Log was written before the interval ended")
+	}
+	r.Flush()
+
+	entries := parseLog(t, buf.String())
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	counts := entries[0].Counts
+	expected := []SNIReportCount{
+		{SNIReport{"a.test", "success", "closed", "split", OutcomeSuccess, "fixed", "none"}, 2},
+		{SNIReport{"b.test", "failed", "timeout", "split", OutcomeFIN, "unfixed", "none"}, 1},
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("Wrong counts: %v", counts)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Errorf("Count %d: %v != %v", i, counts[i], expected[i])
+		}
+	}
+	if entries[0].Start > entries[0].End {
+		t.Errorf("Bad interval: %d > %d", entries[0].Start, entries[0].End)
+	}
+
+	// An empty interval writes nothing.
+	r.Flush()
+	if len(parseLog(t, buf.String())) != 1 {
+		t.Error("Empty interval was logged")
+	}
+}
+
+func TestLogInterval(t *testing.T) {
+	var buf syncBuffer
+	r := NewLogSNIReporter(&buf, 10*time.Millisecond, country)
+	r.Report(makeSummary("a.test", 100, false))
+	time.Sleep(100 * time.Millisecond)
+	r.Report(makeSummary("b.test", 100, false))
+	time.Sleep(100 * time.Millisecond)
+
+	entries := parseLog(t, buf.String())
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Counts[0].SNI != "a.test" || entries[1].Counts[0].SNI != "b.test" {
+		t.Errorf("Wrong entries: %v", entries)
+	}
+}
+
+func TestLogNoSplit(t *testing.T) {
+	var buf syncBuffer
+	r := NewLogSNIReporter(&buf, time.Hour, country).(*logSNIReporter)
+	summary := makeSummary("a.test", 100, false)
+	summary.Retry.Retries = 0
+	r.Report(summary)
+	r.Flush()
+	if buf.String() != "" {
+		t.Errorf("Unexpected log: %s", buf.String())
+	}
+}
+
+// closeRecorder is a syncBuffer that records whether it was closed.
+type closeRecorder struct {
+	syncBuffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLogState(t *testing.T) {
+	var buf syncBuffer
+	r := NewLogSNIReporter(&buf, time.Hour, country)
+	r.SetReportUnretried(true)
+	r.Report(makeSummary("a.test", 100, false))
+	r.Report(makeSummary("a.test", 100, false))
+	state := r.State()
+	if state.Country != country || !state.Unretried || state.Destination != "" {
+		t.Errorf("Bad state: %v", state)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].SNI != "a.test" || state.Pending[0].Count != 2 {
+		t.Errorf("Bad pending reports: %v", state.Pending)
+	}
+}
+
+func TestLogSetCountry(t *testing.T) {
+	var buf syncBuffer
+	r := NewLogSNIReporter(&buf, time.Hour, country).(*logSNIReporter)
+	r.Report(makeSummary("a.test", 100, false))
+	if err := r.SetCountry("yy"); err != nil {
+		t.Fatal(err)
+	}
+	r.Report(makeSummary("b.test", 100, false))
+	r.Flush()
+
+	entries := parseLog(t, buf.String())
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Country != country || entries[0].Counts[0].SNI != "a.test" {
+		t.Errorf("Bad first entry: %v", entries[0])
+	}
+	if entries[1].Country != "yy" || entries[1].Counts[0].SNI != "b.test" {
+		t.Errorf("Bad second entry: %v", entries[1])
+	}
+}
+
+func TestLogClose(t *testing.T) {
+	var w closeRecorder
+	r := NewLogSNIReporter(&w, time.Hour, country)
+	r.Report(makeSummary("a.test", 100, false))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.closed {
+		t.Error("Writer was not closed")
+	}
+	if len(parseLog(t, w.String())) != 1 {
+		t.Error("Pending counts were not flushed on close")
+	}
+	// Reports after Close are ignored.
+	r.Report(makeSummary("b.test", 100, false))
+	if len(r.State().Pending) != 0 {
+		t.Error("Report was accepted after Close")
+	}
+}
@@ -15,12 +15,16 @@
 package intra
 
 import (
+	"errors"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jigsaw-Code/choir"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
 
@@ -28,21 +32,160 @@ import (
 // k-anonymity goals.  See the Choir documentation for more info.
 const bins = 32
 
-// Number of values in each report.  The two values are
-// * success/failure
-// * timeout/close
-const values = 2
+// Number of values in each report.  The six values are
+// * success/failed
+// * the cause of the last retry: timeout/closed, or none if there was no retry
+// * the evasion technique used by the last retry (see split.TechniqueName)
+// * the outcome of the connection (see OutcomeSuccess, etc.)
+// * whether the retry fixed the connection: fixed/unfixed/none
+// * ech if the SNI is the public name of an Encrypted Client Hello, or none
+const values = 6
 
 // Burst duration.  Only one report will be sent in each interval
 // to avoid correlated reports.
 const burst = 10 * time.Second
 
-// tcpSNIReporter is a thread-safe wrapper around choir.Reporter
+// SNIReporter is a backend for reports about TCP sockets on which a split
+// retry was attempted.  Implementations must be thread-safe.
+type SNIReporter interface {
+	// SetDNS changes the DNS transport, for backends that report via DNS.
+	SetDNS(doh.Transport)
+	// SetReportUnretried controls whether failed sockets that were not retried
+	// are also reported (default: false).
+	SetReportUnretried(bool)
+	// SetCountry changes the two-letter ISO country code for future reports.
+	SetCountry(string) error
+	// Report queues a report about `summary`, if it is eligible.
+	Report(TCPSocketSummary)
+	// State returns a snapshot of the reporter's pending, non-identifying state.
+	State() *SNIReporterState
+	// Close delivers or discards pending reports, and releases any files.
+	// Reports are ignored after Close.
+	io.Closer
+}
+
+// SNIReporterState describes a reporter, for display to the user.  It excludes
+// anything that could identify the user across reports, such as Choir's salt.
+type SNIReporterState struct {
+	Country string `json:"country"`
+	// Destination is the Choir suffix or the collector URL, if applicable.
+	Destination string `json:"destination,omitempty"`
+	Unretried   bool   `json:"unretried"`
+	// Reports that have been queued but not yet delivered or logged.
+	Pending []SNIReportCount `json:"pending"`
+}
+
+// SNIReport is the content of a report, shared by all backends.
+type SNIReport struct {
+	SNI       string `json:"sni"`
+	Result    string `json:"result"`    // "success" or "failed"
+	Response  string `json:"response"`  // "timeout", "closed", or "none"
+	Technique string `json:"technique"` // See split.TechniqueName.
+	Outcome   string `json:"outcome"`   // See OutcomeSuccess, etc.
+	Retry     string `json:"retry"`     // "fixed", "unfixed", or "none"
+	// "ech" if the ClientHello offered Encrypted Client Hello, or "none".  With ECH,
+	// the SNI is the outer (public) name, not the name of the destination.
+	ECH string `json:"ech"`
+}
+
+// newSNIReport returns the report for `summary`, or false if there is nothing
+// to report.  Sockets that were not retried are only reported if `unretried`
+// is true and the socket failed.
+func newSNIReport(summary TCPSocketSummary, unretried bool) (SNIReport, bool) {
+	if summary.Retry == nil {
+		return SNIReport{}, false
+	}
+	outcome := summary.Outcome
+	if outcome == "" {
+		// Not classified, so infer the outcome from the byte count.
+		outcome = tlsOutcome(summary.DownloadBytes, nil, &recordScanner{}, &recordScanner{})
+	}
+	success := outcome == OutcomeSuccess
+	retried := summary.Retry.Retries > 0
+	if !retried && (!unretried || success) {
+		return SNIReport{}, false
+	}
+	r := SNIReport{
+		SNI:       summary.Retry.SNI,
+		Result:    "failed",
+		Response:  "none",
+		Technique: split.TechniqueName(summary.Retry.Technique),
+		Outcome:   outcome,
+		Retry:     "none",
+		ECH:       "none",
+	}
+	if summary.Retry.ECH {
+		r.ECH = "ech"
+	}
+	if success {
+		r.Result = "success"
+	}
+	if retried {
+		r.Response = "closed"
+		if summary.Retry.Timeout {
+			r.Response = "timeout"
+		}
+		r.Retry = "unfixed"
+		if success {
+			r.Retry = "fixed"
+		}
+	}
+	return r, true
+}
+
+// SNIReportCount is the number of identical reports.
+type SNIReportCount struct {
+	SNIReport
+	Count int `json:"count"`
+}
+
+// Converts a map of report counts into a slice, in order of decreasing count.
+func sortCounts(counts map[SNIReport]int) []SNIReportCount {
+	sorted := make([]SNIReportCount, 0, len(counts))
+	for report, count := range counts {
+		sorted = append(sorted, SNIReportCount{report, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Count > sorted[j].Count ||
+			(sorted[i].Count == sorted[j].Count && sorted[i].SNI < sorted[j].SNI)
+	})
+	return sorted
+}
+
+// reportFilter implements SetReportUnretried for each backend.
+type reportFilter struct {
+	unretried int32 // 1 if failed sockets without a retry are reported.
+}
+
+func (f *reportFilter) SetReportUnretried(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&f.unretried, v)
+}
+
+func (f *reportFilter) reportUnretried() bool {
+	return atomic.LoadInt32(&f.unretried) == 1
+}
+
+func (f *reportFilter) newReport(summary TCPSocketSummary) (SNIReport, bool) {
+	return newSNIReport(summary, f.reportUnretried())
+}
+
+// tcpSNIReporter is an SNIReporter that wraps choir.Reporter, and sends
+// reports as DNS queries.
 type tcpSNIReporter struct {
-	mu     sync.RWMutex // Protects dns, suffix, and r.
-	dns    doh.Transport
-	suffix string
-	r      choir.Reporter
+	reportFilter
+	mu      sync.RWMutex // Protects all fields below.
+	dns     doh.Transport
+	file    io.ReadWriter
+	suffix  string
+	country string
+	r       choir.Reporter
+	// Reports passed to Choir since the last upload.  Choir sends one report from
+	// each burst, and discards the rest.
+	pending map[SNIReport]int
 }
 
 // SetDNS changes the DNS transport used for uploading reports.
@@ -54,10 +197,11 @@ func (r *tcpSNIReporter) SetDNS(dns doh.Transport) {
 
 // Send implements choir.ReportSender.
 func (r *tcpSNIReporter) Send(report choir.Report) error {
-	r.mu.RLock()
+	r.mu.Lock()
 	suffix := r.suffix
 	dns := r.dns
-	r.mu.RUnlock()
+	r.pending = nil
+	r.mu.Unlock()
 	q, err := choir.FormatQuery(report, suffix)
 	if err != nil {
 		log.Warnf("Failed to construct query for Choir: %v", err)
@@ -73,17 +217,82 @@ func (r *tcpSNIReporter) Send(report choir.Report) error {
 // `file` is the Choir salt file (persistent and initially empty).
 // `suffix` is the domain to which reports will be sent.
 // `country` is the two-letter ISO country code of the user's location.
-func (r *tcpSNIReporter) Configure(file io.ReadWriter, suffix, country string) (err error) {
+func (r *tcpSNIReporter) Configure(file io.ReadWriter, suffix, country string) error {
 	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.configureLocked(file, suffix, country)
+}
+
+func (r *tcpSNIReporter) configureLocked(file io.ReadWriter, suffix, country string) error {
+	reporter, err := choir.NewReporter(file, bins, values, country, burst, r)
+	if err != nil {
+		return err
+	}
+	r.file = file
 	r.suffix = suffix
-	r.r, err = choir.NewReporter(file, bins, values, country, burst, r)
-	r.mu.Unlock()
-	return
+	r.country = country
+	r.r = reporter
+	return nil
+}
+
+// SetCountry reinitializes the reporter for a new country.  This requires
+// rereading the salt, so the salt file must implement io.Seeker.
+func (r *tcpSNIReporter) SetCountry(country string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.r == nil {
+		return errors.New("Reporter is not configured")
+	}
+	seeker, ok := r.file.(io.Seeker)
+	if !ok {
+		return errors.New("Salt file is not seekable")
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return r.configureLocked(r.file, r.suffix, country)
+}
+
+// State returns the configuration and the reports in the current burst.
+func (r *tcpSNIReporter) State() *SNIReporterState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &SNIReporterState{
+		Country:     r.country,
+		Destination: r.suffix,
+		Unretried:   r.reportUnretried(),
+		Pending:     sortCounts(r.pending),
+	}
+}
+
+// Close disables the reporter and closes the salt file, if it is an io.Closer.
+func (r *tcpSNIReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file := r.file
+	r.r = nil
+	r.file = nil
+	r.pending = nil
+	if closer, ok := file.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewChoirSNIReporter returns an SNIReporter that sends privacy-preserving
+// reports using Choir.  The arguments are as in tcpSNIReporter.Configure.
+func NewChoirSNIReporter(file io.ReadWriter, suffix, country string) (SNIReporter, error) {
+	r := &tcpSNIReporter{}
+	if err := r.Configure(file, suffix, country); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // Report converts `summary` into a Choir report and queues it for delivery.
 func (r *tcpSNIReporter) Report(summary TCPSocketSummary) {
-	if summary.Retry.Split == 0 {
+	report, ok := r.newReport(summary)
+	if !ok {
 		return // Nothing to report
 	}
 
@@ -94,23 +303,22 @@ func (r *tcpSNIReporter) Report(summary TCPSocketSummary) {
 	if reporter == nil {
 		return // Reports are disabled
 	}
-	result := "failed"
-	if summary.DownloadBytes > 0 {
-		result = "success"
+	var choirValues []choir.Value
+	for _, v := range []string{report.Result, report.Response, report.Technique, report.Outcome, report.Retry, report.ECH} {
+		value, err := choir.NewValue(v)
+		if err != nil {
+			log.Fatalf("Bad value %s: %v", v, err)
+		}
+		choirValues = append(choirValues, value)
 	}
-	response := "closed"
-	if summary.Retry.Timeout {
-		response = "timeout"
-	}
-	resultValue, err := choir.NewValue(result)
-	if err != nil {
-		log.Fatalf("Bad result %s: %v", result, err)
-	}
-	responseValue, err := choir.NewValue(response)
-	if err != nil {
-		log.Fatalf("Bad response %s: %v", response, err)
-	}
-	if err := reporter.Report(summary.Retry.SNI, resultValue, responseValue); err != nil {
+	if err := reporter.Report(report.SNI, choirValues...); err != nil {
 		log.Warnf("Choir report failed: %v", err)
+		return
+	}
+	r.mu.Lock()
+	if r.pending == nil {
+		r.pending = make(map[SNIReport]int)
 	}
+	r.pending[report]++
+	r.mu.Unlock()
 }
@@ -17,6 +17,9 @@ package intra
 import (
 	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -77,10 +80,13 @@ func TestSuccessClosed(t *testing.T) {
 		DownloadBytes: 10000, // >0 indicates success
 		UploadBytes:   5000,
 		Retry: &split.RetryStats{
-			Timeout: false,              // Socket was explicitly closed
-			Split:   48,                 // >0 indicates a split was attempted
-			SNI:     "user.domain.test", // SNI of the socket
+			Timeout:   false,              // Socket was explicitly closed
+			Split:     48,                 // >0 indicates a split was attempted
+			Retries:   1,                  // >0 indicates a retry occurred
+			SNI:       "user.domain.test", // SNI of the socket
+			Technique: split.SplitSNI,     // Evasion technique of the last retry
 		},
+		Outcome: OutcomeSuccess,
 	}
 	name := runSuccessTest(t, summary)
 	labels := strings.Split(name, ".")
@@ -90,12 +96,24 @@ func TestSuccessClosed(t *testing.T) {
 	if labels[1] != "closed" {
 		t.Errorf("Bad name %s, %s != closed", name, labels[1])
 	}
-	// labels[2] is the bin, which is random.
-	if labels[3] != "zz" {
-		t.Errorf("Bad name %s, %s != zz", name, labels[1])
+	if labels[2] != "splitsni" {
+		t.Errorf("Bad name %s, %s != splitsni", name, labels[2])
+	}
+	if labels[3] != "success" {
+		t.Errorf("Bad name %s, %s != success", name, labels[3])
+	}
+	if labels[4] != "fixed" {
+		t.Errorf("Bad name %s, %s != fixed", name, labels[4])
+	}
+	if labels[5] != "none" {
+		t.Errorf("Bad name %s, %s != none", name, labels[5])
 	}
-	// labels[4] is the date, which is not controlled by the code under test.
-	remainder := strings.Join(labels[5:], ".")
+	// labels[6] is the bin, which is random.
+	if labels[7] != "zz" {
+		t.Errorf("Bad name %s, %s != zz", name, labels[7])
+	}
+	// labels[8] is the date, which is not controlled by the code under test.
+	remainder := strings.Join(labels[9:], ".")
 	expected := summary.Retry.SNI + "." + suffix + "."
 	if remainder != expected {
 		t.Errorf("Bad name %s, %s != %s", name, remainder, expected)
@@ -109,6 +127,7 @@ func TestTimeout(t *testing.T) {
 		Retry: &split.RetryStats{
 			Timeout: true,               // Socket timed out
 			Split:   54,                 // >0 indicates a split was attempted
+			Retries: 1,                  // >0 indicates a retry occurred
 			SNI:     "user.domain.test", // SNI of the socket
 		},
 	}
@@ -119,6 +138,24 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestECH(t *testing.T) {
+	summary := TCPSocketSummary{
+		DownloadBytes: 10000,
+		UploadBytes:   5000,
+		Retry: &split.RetryStats{
+			Retries: 1,
+			SNI:     "public.domain.test", // Outer SNI of the ECH ClientHello
+			ECH:     true,
+		},
+		Outcome: OutcomeSuccess,
+	}
+	name := runSuccessTest(t, summary)
+	labels := strings.Split(name, ".")
+	if labels[5] != "ech" {
+		t.Errorf("Bad name %s, %s != ech", name, labels[5])
+	}
+}
+
 func TestFail(t *testing.T) {
 	summary := TCPSocketSummary{
 		DownloadBytes: 0, // 0 indicates failure
@@ -126,6 +163,7 @@ func TestFail(t *testing.T) {
 		Retry: &split.RetryStats{
 			Timeout: true,               // Socket timed out
 			Split:   36,                 // >0 indicates a split was attempted
+			Retries: 1,                  // >0 indicates a retry occurred
 			SNI:     "user.domain.test", // SNI of the socket
 		},
 	}
@@ -134,6 +172,83 @@ func TestFail(t *testing.T) {
 	if labels[0] != "failed" {
 		t.Errorf("Bad name %s, %s != failed", name, labels[0])
 	}
+	// The outcome is inferred from the byte count if it was not classified.
+	if labels[3] != OutcomeFIN {
+		t.Errorf("Bad name %s, %s != %s", name, labels[3], OutcomeFIN)
+	}
+	if labels[4] != "unfixed" {
+		t.Errorf("Bad name %s, %s != unfixed", name, labels[4])
+	}
+}
+
+func TestResetAfterHello(t *testing.T) {
+	summary := TCPSocketSummary{
+		DownloadBytes: 1500, // The ServerHello was received before the reset.
+		UploadBytes:   500,
+		Retry: &split.RetryStats{
+			Split:     36,
+			Retries:   1,
+			SNI:       "user.domain.test",
+			Technique: split.FragmentRecord,
+		},
+		Outcome: OutcomeResetAfterHello,
+	}
+	name := runSuccessTest(t, summary)
+	labels := strings.Split(name, ".")
+	if labels[0] != "failed" {
+		t.Errorf("Bad name %s, %s != failed", name, labels[0])
+	}
+	if labels[2] != "fragment" {
+		t.Errorf("Bad name %s, %s != fragment", name, labels[2])
+	}
+	if labels[3] != OutcomeResetAfterHello {
+		t.Errorf("Bad name %s, %s != %s", name, labels[3], OutcomeResetAfterHello)
+	}
+	if labels[4] != "unfixed" {
+		t.Errorf("Bad name %s, %s != unfixed", name, labels[4])
+	}
+}
+
+func TestFailedRedial(t *testing.T) {
+	summary := TCPSocketSummary{
+		UploadBytes: 500,
+		Retry: &split.RetryStats{
+			Timeout: true,
+			Retries: 1, // The retry's connection failed, so nothing was split.
+			SNI:     "user.domain.test",
+		},
+	}
+	name := runSuccessTest(t, summary)
+	labels := strings.Split(name, ".")
+	if labels[0] != "failed" || labels[1] != "timeout" {
+		t.Errorf("Bad name %s", name)
+	}
+	if labels[4] != "unfixed" {
+		t.Errorf("Bad name %s, %s != unfixed", name, labels[4])
+	}
+}
+
+func TestUnretriedFailure(t *testing.T) {
+	r := tcpSNIReporter{}
+	var stubFile bytes.Buffer
+	r.Configure(&stubFile, suffix, country)
+	r.SetReportUnretried(true)
+	summary := TCPSocketSummary{
+		UploadBytes: 500,
+		Retry: &split.RetryStats{
+			Retries: 0, // No retry
+			SNI:     "user.domain.test",
+		},
+		Outcome: OutcomeCertificate,
+	}
+	name := sendReport(t, &r, summary, make([]byte, 100), nil)
+	labels := strings.Split(name, ".")
+	expected := []string{"failed", "none", "none", OutcomeCertificate, "none", "none"}
+	for i, label := range expected {
+		if labels[i] != label {
+			t.Errorf("Bad name %s, %s != %s", name, labels[i], label)
+		}
+	}
 }
 
 func TestError(t *testing.T) {
@@ -146,6 +261,7 @@ func TestError(t *testing.T) {
 		Retry: &split.RetryStats{
 			Timeout: true,
 			Split:   36,
+			Retries: 1,
 			SNI:     "user.domain.test",
 		},
 	}
@@ -162,7 +278,7 @@ func TestNoSplit(t *testing.T) {
 		UploadBytes:   500,
 		Retry: &split.RetryStats{
 			Timeout: true,
-			Split:   0,
+			Retries: 0,
 			SNI:     "user.domain.test",
 		},
 	}
@@ -174,6 +290,26 @@ func TestNoSplit(t *testing.T) {
 	r.Report(summary)
 }
 
+func TestUnretriedSuccess(t *testing.T) {
+	r := tcpSNIReporter{}
+	var stubFile bytes.Buffer
+	r.Configure(&stubFile, suffix, country)
+	r.SetReportUnretried(true)
+	summary := TCPSocketSummary{
+		DownloadBytes: 5000,
+		Retry: &split.RetryStats{
+			SNI: "user.domain.test",
+		},
+		Outcome: OutcomeSuccess,
+	}
+	dns := newFakeTransport(func(q []byte) ([]byte, error) {
+		t.Error("Successful sockets without a retry should not be reported")
+		return nil, errors.New("Unreachable")
+	})
+	r.SetDNS(dns)
+	r.Report(summary)
+}
+
 func TestUnconfigured(t *testing.T) {
 	r := tcpSNIReporter{}
 	summary := TCPSocketSummary{
@@ -182,6 +318,7 @@ func TestUnconfigured(t *testing.T) {
 		Retry: &split.RetryStats{
 			Timeout: true,
 			Split:   45,
+			Retries: 1,
 			SNI:     "user.domain.test",
 		},
 	}
@@ -201,9 +338,103 @@ func TestNoDNS(t *testing.T) {
 		Retry: &split.RetryStats{
 			Timeout: true,
 			Split:   45,
+			Retries: 1,
 			SNI:     "user.domain.test",
 		},
 	}
 	// Verify that this doesn't panic.
 	r.Report(summary)
 }
+
+func TestChoirBackend(t *testing.T) {
+	var stubFile bytes.Buffer
+	r, err := NewChoirSNIReporter(&stubFile, suffix, country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := TCPSocketSummary{
+		DownloadBytes: 5000,
+		Retry: &split.RetryStats{
+			Split:   45,
+			Retries: 1,
+			SNI:     "user.domain.test",
+		},
+	}
+	name := sendReport(t, r.(*tcpSNIReporter), summary, make([]byte, 100), nil)
+	if !strings.HasSuffix(name, summary.Retry.SNI+"."+suffix+".") {
+		t.Errorf("Bad name %s", name)
+	}
+}
+
+func TestChoirState(t *testing.T) {
+	var stubFile bytes.Buffer
+	r, err := NewChoirSNIReporter(&stubFile, suffix, country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetDNS(newFakeTransport(func(q []byte) ([]byte, error) {
+		return make([]byte, 100), nil
+	}))
+	summary := TCPSocketSummary{
+		DownloadBytes: 5000,
+		Retry: &split.RetryStats{
+			Split:   45,
+			Retries: 1,
+			SNI:     "user.domain.test",
+		},
+	}
+	r.Report(summary)
+	state := r.State()
+	if state.Country != country || state.Destination != suffix {
+		t.Errorf("Bad state: %v", state)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].SNI != "user.domain.test" || state.Pending[0].Count != 1 {
+		t.Errorf("Bad pending reports: %v", state.Pending)
+	}
+}
+
+func TestChoirSetCountry(t *testing.T) {
+	f, err := ioutil.TempFile("", "choir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	r, err := NewChoirSNIReporter(f, suffix, country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetCountry("yy"); err != nil {
+		t.Fatal(err)
+	}
+	if r.State().Country != "yy" {
+		t.Errorf("Country was not updated")
+	}
+	if err := r.SetCountry("bad"); err == nil {
+		t.Error("Expected an error for an invalid country")
+	}
+	// The salt file is reread, not extended.
+	if info, _ := f.Stat(); info.Size() != 16 {
+		t.Errorf("Unexpected salt file size %d", info.Size())
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err == nil {
+		t.Error("Salt file was not closed")
+	}
+	if err := r.SetCountry("zz"); err == nil {
+		t.Error("Expected an error after Close")
+	}
+}
+
+func TestChoirSetCountryNotSeekable(t *testing.T) {
+	var stubFile struct{ io.ReadWriter }
+	stubFile.ReadWriter = &bytes.Buffer{}
+	r, err := NewChoirSNIReporter(stubFile, suffix, country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetCountry("yy"); err == nil {
+		t.Error("Expected an error for a file that can't be reread")
+	}
+}
@@ -29,19 +29,26 @@ type DuplexConn interface {
 
 type splitter struct {
 	*net.TCPConn
-	used bool // Initially false.  Becomes true after the first write.
+	technique int16
+	used      bool // Initially false.  Becomes true after the first write.
 }
 
 // DialWithSplit returns a TCP connection that always splits the initial upstream segment.
 // Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 func DialWithSplit(d *net.Dialer, addr *net.TCPAddr) (DuplexConn, error) {
+	return DialWithTechnique(d, addr, SplitRandom)
+}
+
+// DialWithTechnique is like DialWithSplit, but applies the specified evasion
+// technique to the initial upstream segment.
+func DialWithTechnique(d *net.Dialer, addr *net.TCPAddr, technique int16) (DuplexConn, error) {
 	conn, err := d.Dial(addr.Network(), addr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return &splitter{TCPConn: conn.(*net.TCPConn)}, nil
+	return &splitter{TCPConn: conn.(*net.TCPConn), technique: technique}, nil
 }
 
 // Write-related functions
@@ -54,13 +61,11 @@ func (s *splitter) Write(b []byte) (int, error) {
 
 	// Setting `used` to true ensures that this code only runs once per socket.
 	s.used = true
-	b1, b2 := splitHello(b)
-	n1, err := conn.Write(b1)
-	if err != nil {
-		return n1, err
+	if err := writeSegments(conn, applyTechnique(s.technique, b)); err != nil {
+		// The technique may have changed the bytes, so a partial count is meaningless.
+		return 0, err
 	}
-	n2, err := conn.Write(b2)
-	return n1 + n2, err
+	return len(b), nil
 }
 
 func (s *splitter) ReadFrom(reader io.Reader) (bytes int64, err error) {
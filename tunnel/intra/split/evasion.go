@@ -0,0 +1,112 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Evasion techniques that a retry can apply to the initial upstream segment.
+// The values are stable, so they are safe to persist and report.
+//
+// Every technique must deliver exactly the bytes that the application wrote, as
+// seen by the TLS layer.  This rules out techniques that modify the ClientHello
+// itself (e.g. adding a padding extension), because the server would then compute
+// a different handshake transcript and the handshake would fail.
+const (
+	// NoTechnique indicates that no retry occurred.
+	NoTechnique int16 = iota
+	// SplitRandom splits the first segment at a random offset of 32-64 bytes.
+	SplitRandom
+	// SplitSNI splits the first segment in the middle of the TLS SNI.
+	SplitSNI
+	// FragmentRecord splits the ClientHello across two TLS records, in the middle
+	// of the SNI if possible, and sends each record in a separate segment.
+	FragmentRecord
+)
+
+// DefaultTechniques is the order in which retries apply evasion techniques.
+var DefaultTechniques = []int16{SplitRandom, SplitSNI, FragmentRecord}
+
+// TechniqueName returns a short lower-case name for `technique`.
+func TechniqueName(technique int16) string {
+	switch technique {
+	case NoTechnique:
+		return "none"
+	case SplitRandom:
+		return "split"
+	case SplitSNI:
+		return "splitsni"
+	case FragmentRecord:
+		return "fragment"
+	}
+	return "unknown"
+}
+
+// ParseTechniques parses a comma-separated list of technique names, as returned
+// by TechniqueName, e.g. "split,splitsni".  An empty string yields an empty list.
+func ParseTechniques(names string) ([]int16, error) {
+	var techniques []int16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		technique := NoTechnique
+		for _, t := range DefaultTechniques {
+			if TechniqueName(t) == name {
+				technique = t
+			}
+		}
+		if technique == NoTechnique {
+			return nil, fmt.Errorf("Unknown technique: %s", name)
+		}
+		techniques = append(techniques, technique)
+	}
+	return techniques, nil
+}
+
+// Returns the offset of the middle of the SNI in `hello`, or zero if there is no SNI.
+func sniMiddle(hello []byte) int {
+	info, err := parseHello(hello)
+	if err != nil || info.sni == "" {
+		return 0
+	}
+	return info.sniOffset + len(info.sni)/2
+}
+
+// applyTechnique returns the segments that should be written in place of `hello`.
+// If `technique` is not applicable to `hello`, it falls back to SplitRandom.
+func applyTechnique(technique int16, hello []byte) [][]byte {
+	switch technique {
+	case SplitSNI:
+		if s := sniMiddle(hello); s > 0 {
+			return [][]byte{hello[:s], hello[s:]}
+		}
+	case FragmentRecord:
+		// Offset of the split within the record payload, after the 5-byte header.
+		at := sniMiddle(hello) - 5
+		if at <= 0 {
+			first, _ := splitHello(hello)
+			at = len(first) - 5
+		}
+		if first, second, err := fragmentRecord(hello, at); err == nil {
+			return [][]byte{first, second}
+		}
+	}
+	first, second := splitHello(hello)
+	return [][]byte{first, second}
+}
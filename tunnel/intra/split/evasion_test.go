@@ -0,0 +1,188 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSNI(t *testing.T) {
+	hello := makeClientHello("www.example.test", false)
+	segments := applyTechnique(SplitSNI, hello)
+	if len(segments) != 2 {
+		t.Fatalf("Wrong number of segments: %d", len(segments))
+	}
+	if !bytes.Equal(append(segments[0], segments[1]...), hello) {
+		t.Error("Segments don't match the hello")
+	}
+	if !bytes.HasSuffix(segments[0], []byte("www.exam")) {
+		t.Errorf("Split is not in the SNI: %q", segments[0])
+	}
+}
+
+func TestSplitSNIFallback(t *testing.T) {
+	data := makeBuffer()
+	segments := applyTechnique(SplitSNI, data)
+	if len(segments[0]) < 32 || len(segments[0]) > 64 {
+		t.Errorf("Unexpected fallback split: %d", len(segments[0]))
+	}
+	if !bytes.Equal(append(segments[0], segments[1]...), data) {
+		t.Error("Segments don't match the input")
+	}
+}
+
+// Reassembles the payloads of all TLS records in `b`.
+func recordPayloads(t *testing.T, b []byte) []byte {
+	var payload []byte
+	for len(b) > 0 {
+		if len(b) < 5 {
+			t.Fatal("Truncated record header")
+		}
+		length := int(b[3])<<8 | int(b[4])
+		payload = append(payload, b[5:5+length]...)
+		b = b[5+length:]
+	}
+	return payload
+}
+
+func TestFragmentRecord(t *testing.T) {
+	hello := makeClientHello("www.example.test", false)
+	segments := applyTechnique(FragmentRecord, hello)
+	if len(segments) != 2 {
+		t.Fatalf("Wrong number of segments: %d", len(segments))
+	}
+	if bytes.Contains(segments[0], []byte("www.example.test")) ||
+		bytes.Contains(segments[1], []byte("www.example.test")) {
+		t.Error("SNI should be fragmented")
+	}
+	if _, err := parseHello(segments[0]); err == nil {
+		t.Error("First record should not contain a complete ClientHello")
+	}
+	original := recordPayloads(t, hello)
+	fragmented := recordPayloads(t, append(segments[0], segments[1]...))
+	if !bytes.Equal(original, fragmented) {
+		t.Error("Fragmented payload doesn't match")
+	}
+}
+
+func TestFragmentRecordTrailingData(t *testing.T) {
+	hello := append(makeClientHello("www.example.test", false), makeClientHello("x.test", false)...)
+	segments := applyTechnique(FragmentRecord, hello)
+	original := recordPayloads(t, hello)
+	fragmented := recordPayloads(t, append(segments[0], segments[1]...))
+	if !bytes.Equal(original, fragmented) {
+		t.Error("Fragmented payload doesn't match")
+	}
+}
+
+func TestTechniqueName(t *testing.T) {
+	for _, technique := range append([]int16{NoTechnique}, DefaultTechniques...) {
+		name := TechniqueName(technique)
+		if name == "unknown" || strings.ToLower(name) != name {
+			t.Errorf("Bad name for %d: %s", technique, name)
+		}
+	}
+}
+
+func TestParseTechniques(t *testing.T) {
+	techniques, err := ParseTechniques(" fragment, split ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(techniques) != 2 || techniques[0] != FragmentRecord || techniques[1] != SplitRandom {
+		t.Errorf("Wrong techniques: %v", techniques)
+	}
+	if techniques, err := ParseTechniques(""); err != nil || len(techniques) != 0 {
+		t.Errorf("Empty list: %v, %v", techniques, err)
+	}
+	for _, names := range []string{"split,bogus", "none"} {
+		if _, err := ParseTechniques(names); err == nil {
+			t.Errorf("Expected an error for %q", names)
+		}
+	}
+}
+
+func makeCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.test"},
+		DNSNames:     []string{"www.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Applies an evasion technique to the first write.
+type techniqueConn struct {
+	net.Conn
+	technique int16
+	used      bool
+}
+
+func (c *techniqueConn) Write(b []byte) (int, error) {
+	if c.used {
+		return c.Conn.Write(b)
+	}
+	c.used = true
+	for _, segment := range applyTechnique(c.technique, b) {
+		if _, err := c.Conn.Write(segment); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Verifies that each technique is transparent to a real TLS server.
+func TestTechniquesHandshake(t *testing.T) {
+	cert := makeCertificate(t)
+	roots := x509.NewCertPool()
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots.AddCert(parsed)
+	for _, technique := range DefaultTechniques {
+		client, server := net.Pipe()
+		go func() {
+			conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+		conn := tls.Client(&techniqueConn{Conn: client, technique: technique},
+			&tls.Config{ServerName: "www.example.test", RootCAs: roots})
+		if err := conn.Handshake(); err != nil {
+			t.Errorf("%s: handshake failed: %v", TechniqueName(technique), err)
+		}
+		conn.Close()
+	}
+}
@@ -15,66 +15,120 @@
 package main
 
 import (
-	"crypto/tls"
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-
-	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+	"strings"
+	"time"
 )
 
+// Reads one domain per line from `path`, ignoring blank lines and # comments.
+func readDomains(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// Splits a comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-sni=SNI] destination\n", os.Args[0])
-		fmt.Fprintln(flag.CommandLine.Output(), "This tool attempts a TLS connection to the "+
-			"destination (port 443), with and without splitting.  If the SNI is specified, it "+
-			"overrides the destination, which can be an IP address.")
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] domain...\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "This tool attempts a TLS connection to each "+
+			"domain with several strategies (direct, split, retry, fragment), and reports "+
+			"the outcome, timing, and error class of each attempt.")
 		flag.PrintDefaults()
 	}
 
-	sni := flag.String("sni", "", "Server name override")
+	domainFile := flag.String("domains", "", "File containing one domain per line")
+	strategies := flag.String("strategies", strings.Join(allStrategies, ","), "Comma-separated list of strategies")
+	resolvers := flag.String("resolvers", "", "Comma-separated list of DNS resolvers (host:port), tried in order.  Default: system resolver")
+	addr := flag.String("addr", "", "Connect to this host:port instead of resolving each domain")
+	port := flag.Int("port", 443, "Destination port")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout for each DNS lookup and handshake")
+	format := flag.String("format", "json", "Output format: json|csv")
+	output := flag.String("o", "", "Output file.  Default: stdout")
 	flag.Parse()
-	destination := flag.Arg(0)
-	if destination == "" {
+
+	domains := flag.Args()
+	if *domainFile != "" {
+		fromFile, err := readDomains(*domainFile)
+		if err != nil {
+			log.Fatalf("Couldn't read domains: %v", err)
+		}
+		domains = append(domains, fromFile...)
+	}
+	if len(domains) == 0 {
 		flag.Usage()
-		return
+		os.Exit(2)
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(destination, "443"))
-	if err != nil {
-		log.Fatalf("Couldn't resolve destination: %v", err)
+	// Check every flag before probing, and before creating the output file.
+	c := &config{
+		strategies: splitList(*strategies),
+		resolvers:  splitList(*resolvers),
+		port:       *port,
+		timeout:    *timeout,
+		dialer:     &net.Dialer{Timeout: *timeout},
 	}
-
-	if *sni == "" {
-		*sni = destination
+	if len(c.strategies) == 0 {
+		log.Fatal("No strategies")
 	}
-	tlsConfig := &tls.Config{ServerName: *sni}
-
-	log.Println("Trying direct connection")
-	conn, err := net.DialTCP(addr.Network(), nil, addr)
-	if err != nil {
-		log.Fatalf("Could not establish a TCP connection: %v", err)
+	for _, strategy := range c.strategies {
+		if !validStrategy(strategy) {
+			log.Fatalf("Unknown strategy: %s", strategy)
+		}
 	}
-	tlsConn := tls.Client(conn, tlsConfig)
-	err = tlsConn.Handshake()
-	if err != nil {
-		log.Printf("Direct TLS handshake failed: %v", err)
-	} else {
-		log.Printf("Direct TLS succeeded")
+	for _, resolver := range c.resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			log.Fatalf("Invalid resolver %s: %v", resolver, err)
+		}
+	}
+	if *addr != "" {
+		var err error
+		if c.addr, err = net.ResolveTCPAddr("tcp", *addr); err != nil {
+			log.Fatalf("Invalid address %s: %v", *addr, err)
+		}
+	}
+	if *port <= 0 || *port > 65535 {
+		log.Fatalf("Invalid port: %d", *port)
+	}
+	if *timeout <= 0 {
+		log.Fatalf("Invalid timeout: %v", *timeout)
+	}
+	if !validFormat(*format) {
+		log.Fatalf("Unknown format: %s", *format)
 	}
 
-	log.Println("Trying split connection")
-	splitConn, err := split.DialWithSplit(&net.Dialer{}, addr)
+	out, err := openOutput(*output)
 	if err != nil {
-		log.Fatalf("Could not establish a splitting socket: %v", err)
+		log.Fatalf("Couldn't open output: %v", err)
 	}
-	tlsConn2 := tls.Client(splitConn, tlsConfig)
-	err = tlsConn2.Handshake()
-	if err != nil {
-		log.Printf("Split TLS handshake failed: %v", err)
-	} else {
-		log.Printf("Split TLS succeeded")
+	defer out.Close()
+	if err := writeReport(out, *format, c.probe(domains)); err != nil {
+		log.Fatalf("Couldn't write report: %v", err)
 	}
 }
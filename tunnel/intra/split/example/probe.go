@@ -0,0 +1,295 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+)
+
+// Connection strategies.
+const (
+	strategyDirect   = "direct"   // Plain TCP connection.
+	strategySplit    = "split"    // Always split the first segment.
+	strategyRetry    = "retry"    // After a failure, retry with each evasion technique in turn.
+	strategyFragment = "fragment" // Always fragment the ClientHello into two TLS records.
+)
+
+var allStrategies = []string{strategyDirect, strategySplit, strategyRetry, strategyFragment}
+
+func validStrategy(strategy string) bool {
+	for _, s := range allStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// Error classes.  These are coarse enough to compare across networks.
+const (
+	errorNone        = ""
+	errorDNS         = "dns"
+	errorTimeout     = "timeout"
+	errorReset       = "reset"
+	errorRefused     = "refused"
+	errorClosed      = "closed"
+	errorAlert       = "tls-alert"
+	errorCertificate = "certificate"
+	errorOther       = "other"
+)
+
+// Result is the outcome of one strategy for one domain.
+type Result struct {
+	Domain      string `json:"domain"`
+	Strategy    string `json:"strategy"`
+	Resolver    string `json:"resolver,omitempty"` // Resolver that answered, if any.
+	IP          string `json:"ip,omitempty"`
+	Success     bool   `json:"success"`
+	ErrorClass  string `json:"error_class,omitempty"`
+	Error       string `json:"error,omitempty"`
+	DNSMs       int64  `json:"dns_ms"`
+	ConnectMs   int64  `json:"connect_ms"`
+	HandshakeMs int64  `json:"handshake_ms"`
+	Retries     int16  `json:"retries"`             // Only for the retry strategy.
+	Technique   string `json:"technique,omitempty"` // Only for the retry strategy.
+}
+
+// config controls a probe.
+type config struct {
+	strategies []string
+	resolvers  []string // "host:port" of each DNS resolver, or empty for the system default.
+	port       int
+	// If non-nil, connect to this address instead of resolving each domain.
+	addr    *net.TCPAddr
+	timeout time.Duration
+	roots   *x509.CertPool // Trusted roots, or nil for the system default.
+	dialer  *net.Dialer
+}
+
+func makeResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolves `domain` using each resolver in order, and returns the first answer.
+func (c *config) resolve(domain string) (ip net.IP, resolver string, err error) {
+	if len(c.resolvers) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		var ips []net.IPAddr
+		if ips, err = net.DefaultResolver.LookupIPAddr(ctx, domain); err != nil {
+			return
+		}
+		return ips[0].IP, "system", nil
+	}
+	for _, resolver = range c.resolvers {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		var ips []net.IPAddr
+		ips, err = makeResolver(resolver).LookupIPAddr(ctx, domain)
+		cancel()
+		if err == nil {
+			return ips[0].IP, resolver, nil
+		}
+	}
+	return nil, "", err
+}
+
+// Returns the address to connect to for `domain`, and records the DNS lookup
+// in `r`.
+func (c *config) target(domain string, r *Result) (*net.TCPAddr, error) {
+	if c.addr != nil {
+		return c.addr, nil
+	}
+	start := time.Now()
+	ip, resolver, err := c.resolve(domain)
+	r.DNSMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return nil, err
+	}
+	r.Resolver = resolver
+	return &net.TCPAddr{IP: ip, Port: c.port}, nil
+}
+
+func (c *config) dial(strategy string, addr *net.TCPAddr) (net.Conn, *split.RetryStats, error) {
+	switch strategy {
+	case strategyDirect:
+		conn, err := c.dialer.Dial(addr.Network(), addr.String())
+		return conn, nil, err
+	case strategySplit:
+		conn, err := split.DialWithSplit(c.dialer, addr)
+		return conn, nil, err
+	case strategyRetry:
+		var stats split.RetryStats
+		conn, err := split.DialWithSplitRetry(c.dialer, addr, nil, &stats)
+		return conn, &stats, err
+	case strategyFragment:
+		conn, err := split.DialWithTechnique(c.dialer, addr, split.FragmentRecord)
+		return conn, nil, err
+	}
+	return nil, nil, fmt.Errorf("Unknown strategy: %s", strategy)
+}
+
+// classify returns the error class of `err`.
+func classify(err error) string {
+	if err == nil {
+		return errorNone
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return errorDNS
+	case errors.Is(err, syscall.ECONNRESET):
+		return errorReset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorRefused
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorClosed
+	case strings.HasPrefix(err.Error(), "remote error: tls:"):
+		// crypto/tls reports alerts from the server with this prefix.
+		return errorAlert
+	case errors.As(err, &hostnameErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr):
+		return errorCertificate
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorTimeout
+	}
+	return errorOther
+}
+
+// Records `err` as the outcome of `r`.
+func failed(r Result, err error) Result {
+	r.ErrorClass = classify(err)
+	r.Error = err.Error()
+	return r
+}
+
+// probeStrategy attempts a TLS handshake with `r.Domain` at `addr` using
+// `r.Strategy`.  `r` holds the results of the DNS lookup.
+func (c *config) probeStrategy(r Result, addr *net.TCPAddr) Result {
+	domain, strategy := r.Domain, r.Strategy
+	fail := func(err error) Result {
+		return failed(r, err)
+	}
+	start := time.Now()
+	conn, stats, err := c.dial(strategy, addr)
+	r.ConnectMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: domain, RootCAs: c.roots})
+	start = time.Now()
+	err = tlsConn.Handshake()
+	r.HandshakeMs = time.Since(start).Milliseconds()
+	if stats != nil {
+		r.Retries = stats.Retries
+		r.Technique = split.TechniqueName(stats.Technique)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	r.Success = true
+	return r
+}
+
+// probe runs every configured strategy against each domain.  Each domain is
+// resolved once, so that every strategy connects to the same IP address.
+func (c *config) probe(domains []string) []Result {
+	var results []Result
+	for _, domain := range domains {
+		lookup := Result{Domain: domain}
+		addr, err := c.target(domain, &lookup)
+		if err == nil {
+			lookup.IP = addr.IP.String()
+		}
+		for _, strategy := range c.strategies {
+			r := lookup
+			r.Strategy = strategy
+			if err != nil {
+				results = append(results, failed(r, err))
+			} else {
+				results = append(results, c.probeStrategy(r, addr))
+			}
+		}
+	}
+	return results
+}
+
+func writeJSON(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+func writeCSV(w io.Writer, results []Result) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"domain", "strategy", "resolver", "ip", "success", "error_class", "error",
+		"dns_ms", "connect_ms", "handshake_ms", "retries", "technique"})
+	for _, r := range results {
+		out.Write([]string{r.Domain, r.Strategy, r.Resolver, r.IP, strconv.FormatBool(r.Success),
+			r.ErrorClass, r.Error, strconv.FormatInt(r.DNSMs, 10), strconv.FormatInt(r.ConnectMs, 10),
+			strconv.FormatInt(r.HandshakeMs, 10), strconv.Itoa(int(r.Retries)), r.Technique})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func validFormat(format string) bool {
+	return format == "json" || format == "csv"
+}
+
+// writeReport writes `results` to `w` in the specified format ("json" or "csv").
+func writeReport(w io.Writer, format string, results []Result) error {
+	switch format {
+	case "json":
+		return writeJSON(w, results)
+	case "csv":
+		return writeCSV(w, results)
+	}
+	return fmt.Errorf("Unknown format: %s", format)
+}
+
+// openOutput returns the writer for `path`, or stdout if `path` is empty.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/getsni"
+)
+
+const (
+	allowed = "allowed.test"
+	blocked = "blocked.test"
+)
+
+// Starts a TLS server for `allowed` and `blocked` that completes each handshake
+// and then closes the connection.
+func startServer(t *testing.T) (net.Listener, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: allowed},
+		DNSNames:     []string{allowed, blocked},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return l, roots
+}
+
+// Starts a stand-in for a censoring middlebox.  It reassembles the first TLS
+// record, and resets the connection if the record contains a ClientHello for
+// `blocked`.  Otherwise, it relays traffic to `server`.
+func startMiddlebox(t *testing.T, server net.Addr) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *net.TCPConn) {
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					conn.Close()
+					return
+				}
+				payload := make([]byte, int(header[3])<<8|int(header[4]))
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					conn.Close()
+					return
+				}
+				record := append(header, payload...)
+				if sni, _ := getsni.GetSNI(record); sni == blocked {
+					conn.SetLinger(0) // Send RST
+					conn.Close()
+					return
+				}
+				upstream, err := net.Dial("tcp", server.String())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				upstream.Write(record)
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+				conn.Close()
+			}(conn.(*net.TCPConn))
+		}
+	}()
+	return l
+}
+
+func makeTestConfig(t *testing.T) (*config, func()) {
+	server, roots := startServer(t)
+	middlebox := startMiddlebox(t, server.Addr())
+	c := &config{
+		strategies: allStrategies,
+		addr:       middlebox.Addr().(*net.TCPAddr),
+		timeout:    5 * time.Second,
+		roots:      roots,
+		dialer:     &net.Dialer{},
+	}
+	return c, func() {
+		middlebox.Close()
+		server.Close()
+	}
+}
+
+func findResult(t *testing.T, results []Result, domain, strategy string) Result {
+	for _, r := range results {
+		if r.Domain == domain && r.Strategy == strategy {
+			return r
+		}
+	}
+	t.Fatalf("No result for %s/%s", domain, strategy)
+	return Result{}
+}
+
+func TestProbeAllowed(t *testing.T) {
+	c, done := makeTestConfig(t)
+	defer done()
+	results := c.probe([]string{allowed})
+	if len(results) != len(allStrategies) {
+		t.Fatalf("Wrong number of results: %d", len(results))
+	}
+	for _, r := range results {
+		if !r.Success {
+			t.Errorf("%s failed: %s", r.Strategy, r.Error)
+		}
+	}
+	if r := findResult(t, results, allowed, strategyRetry); r.Retries != 0 {
+		t.Errorf("Unexpected retries: %d", r.Retries)
+	}
+}
+
+func TestProbeBlocked(t *testing.T) {
+	c, done := makeTestConfig(t)
+	defer done()
+	results := c.probe([]string{blocked})
+
+	// The middlebox reassembles the first record, so TCP splitting doesn't help.
+	for _, strategy := range []string{strategyDirect, strategySplit} {
+		r := findResult(t, results, blocked, strategy)
+		if r.Success {
+			t.Errorf("%s should have failed", strategy)
+		}
+		if r.ErrorClass != errorReset {
+			t.Errorf("%s: expected %s, got %s (%s)", strategy, errorReset, r.ErrorClass, r.Error)
+		}
+	}
+	if r := findResult(t, results, blocked, strategyFragment); !r.Success {
+		t.Errorf("Fragment failed: %s", r.Error)
+	}
+	// The retry strategy should work through the techniques until fragmentation succeeds.
+	r := findResult(t, results, blocked, strategyRetry)
+	if !r.Success {
+		t.Errorf("Retry failed: %s", r.Error)
+	}
+	if r.Technique != "fragment" || r.Retries != 3 {
+		t.Errorf("Unexpected retry result: %d retries, technique %s", r.Retries, r.Technique)
+	}
+}
+
+func TestProbeDNSFailure(t *testing.T) {
+	c := &config{
+		strategies: []string{strategyDirect, strategySplit},
+		resolvers:  []string{"127.0.0.1:1"}, // Nothing listens on port 1.
+		port:       443,
+		timeout:    time.Second,
+		dialer:     &net.Dialer{},
+	}
+	results := c.probe([]string{"unresolvable.test"})
+	if len(results) != 2 {
+		t.Fatalf("Expected a result for each strategy, got %v", results)
+	}
+	for _, r := range results {
+		if r.Success || r.ErrorClass != errorDNS {
+			t.Errorf("Expected DNS failure, got %v", r)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cases := map[error]string{
+		nil:                                errorNone,
+		io.EOF:                             errorClosed,
+		&net.DNSError{Err: "no such host"}: errorDNS,
+		x509.UnknownAuthorityError{}:       errorCertificate,
+		errors.New("remote error: tls: handshake failure"): errorAlert,
+		errors.New("something else"):                       errorOther,
+	}
+	for err, class := range cases {
+		if got := classify(err); got != class {
+			t.Errorf("classify(%v) = %s, expected %s", err, got, class)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	results := []Result{
+		{Domain: allowed, Strategy: strategyDirect, Success: true, HandshakeMs: 12},
+		{Domain: blocked, Strategy: strategyRetry, ErrorClass: errorReset, Retries: 3, Technique: "fragment"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeReport(&buf, "json", results); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []Result
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[1] != results[1] {
+		t.Errorf("JSON round trip failed: %v", decoded)
+	}
+
+	buf.Reset()
+	if err := writeReport(&buf, "csv", results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "domain" || rows[2][5] != errorReset {
+		t.Errorf("Bad CSV: %v", rows)
+	}
+
+	if err := writeReport(&buf, "xml", results); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
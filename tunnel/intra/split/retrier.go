@@ -15,27 +15,98 @@
 package split
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
 	"time"
-
-	"github.com/Jigsaw-Code/getsni"
 )
 
 type RetryStats struct {
-	SNI     string // TLS SNI observed, if present.
-	Bytes   int32  // Number of bytes uploaded before the retry.
-	Chunks  int16  // Number of writes before the retry.
-	Split   int16  // Number of bytes in the first retried segment.
-	Timeout bool   // True if the retry was caused by a timeout.
+	// TLS SNI observed, if present.  If ECH is true, this is the outer (public) name,
+	// because the inner name is encrypted.  The SNI is cleared if a second ClientHello
+	// names a different server, so that an incorrect name is never reported.
+	SNI        string
+	ECH        bool  // True if the ClientHello offered Encrypted Client Hello.
+	HelloRetry bool  // True if the server sent a HelloRetryRequest.
+	Bytes      int32 // Number of bytes uploaded before the retry.
+	Chunks     int16 // Number of writes before the retry.
+	Split      int16 // Number of bytes in the first segment of the last retry.
+	Timeout    bool  // True if the last retry was caused by a timeout.
+	Retries    int16 // Number of retries that occurred.
+	// Evasion technique applied by the last retry, or NoTechnique if there was no
+	// retry.  If the connection received any data, this technique worked.
+	Technique int16
+}
+
+// RetryPolicy controls when DialWithSplitRetry retries a connection.
+type RetryPolicy struct {
+	// Minimum time to wait for a reply before retrying (ms).
+	BaseTimeoutMs int32
+	// The TCP handshake time is multiplied by this value and added to the base timeout.
+	RTTMultiplier float64
+	// Maximum number of retries for each connection.  Zero disables retry.
+	MaxRetries int16
+	// Retry if the socket is reset or closed before any reply is received.
+	RetryOnReset bool
+	// Retry if no reply is received before the timeout.  If false, the system's
+	// default TCP timeout (typically 2-3 minutes) applies.
+	RetryOnTimeout bool
+	// Evasion techniques to apply, in order, as a comma-separated list of names
+	// (see TechniqueName), e.g. "split,splitsni".  If there are more retries than
+	// techniques, the list repeats.  If empty, DefaultTechniques is used.
+	Techniques string
+}
+
+// DefaultRetryPolicy returns the policy used when none is specified: one retry
+// for each of the DefaultTechniques, in order, on either a reset or a timeout.
+// Each retry can add up to another timeout to the time to connect, so a server
+// that is unreachable for reasons other than SNI filtering takes several timeouts
+// to fail.
+func DefaultRetryPolicy() *RetryPolicy {
+	// These values were chosen to have a <1% false positive rate based on test data.
+	// False positives trigger an unnecessary retry, which can make connections slower, so they are
+	// worth avoiding.  However, overly long timeouts make retry slower and less useful.
+	return &RetryPolicy{
+		BaseTimeoutMs:  1200,
+		RTTMultiplier:  2,
+		MaxRetries:     int16(len(DefaultTechniques)),
+		RetryOnReset:   true,
+		RetryOnTimeout: true,
+	}
+}
+
+// Validate returns an error if the policy's Techniques can't be parsed.
+func (p *RetryPolicy) Validate() error {
+	_, err := p.techniques()
+	return err
+}
+
+// Returns the parsed Techniques, or DefaultTechniques if there are none.
+func (p *RetryPolicy) techniques() ([]int16, error) {
+	techniques, err := ParseTechniques(p.Techniques)
+	if err != nil {
+		return nil, err
+	}
+	if len(techniques) == 0 {
+		techniques = DefaultTechniques
+	}
+	return techniques, nil
+}
+
+// Given timestamps immediately before and after a successful socket connection
+// (i.e. the time the SYN was sent and the time the SYNACK was received), this
+// function returns the timeout for replies to a hello sent on this socket.
+func (p *RetryPolicy) timeout(before, after time.Time) time.Duration {
+	rtt := after.Sub(before)
+	return time.Duration(p.BaseTimeoutMs)*time.Millisecond + time.Duration(p.RTTMultiplier*float64(rtt))
 }
 
 // retrier implements the DuplexConn interface.
 type retrier struct {
-	// mutex is a lock that guards `conn`, `hello`, and `retryCompleteFlag`.
+	// mutex is a lock that guards `conn`, `hello`, `hrr`, `hello2`, and `retryCompleteFlag`.
 	// These fields must not be modified except under this lock.
 	// After retryCompletedFlag is closed, these values will not be modified
 	// again so locking is no longer required for reads.
@@ -50,12 +121,22 @@ type retrier struct {
 	// they can be re-applied in the event of a retry.
 	readDeadline  time.Time
 	writeDeadline time.Time
+	// policy determines when a retry is attempted.
+	policy RetryPolicy
+	// techniques is the parsed policy.Techniques.
+	techniques []int16
 	// Time to wait between the first write and the first read before triggering a
 	// retry.
 	timeout time.Duration
 	// hello is the contents written before the first read.  It is initially empty,
 	// and is cleared when the first byte is received.
 	hello []byte
+	// If the first response is a TLS HelloRetryRequest, the retry window is extended
+	// to cover the second ClientHello.  `hrr` holds the bytes received before the
+	// second ClientHello, and `hello2` holds the second ClientHello.  Both are
+	// cleared when retry is complete.
+	hrr    []byte
+	hello2 []byte
 	// Flag indicating when retry is finished or unnecessary.
 	retryCompleteFlag chan struct{}
 	// Flags indicating whether the caller has called CloseRead and CloseWrite.
@@ -95,29 +176,23 @@ func (r *retrier) retryCompleted() bool {
 	return closed(r.retryCompleteFlag)
 }
 
-// Given timestamps immediately before and after a successful socket connection
-// (i.e. the time the SYN was sent and the time the SYNACK was received), this
-// function returns a reasonable timeout for replies to a hello sent on this socket.
-func timeout(before, after time.Time) time.Duration {
-	// These values were chosen to have a <1% false positive rate based on test data.
-	// False positives trigger an unnecessary retry, which can make connections slower, so they are
-	// worth avoiding.  However, overly long timeouts make retry slower and less useful.
-	rtt := after.Sub(before)
-	return 1200*time.Millisecond + 2*rtt
-}
-
-// DefaultTimeout is the value that will cause DialWithSplitRetry to use the system's
-// default TCP timeout (typically 2-3 minutes).
-const DefaultTimeout time.Duration = 0
-
 // DialWithSplitRetry returns a TCP connection that transparently retries by
 // splitting the initial upstream segment if the socket closes without receiving a
 // reply.  Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 // `dialer` will be used to establish the connection.
 // `addr` is the destination.
+// `policy` controls retry behavior.  If it is nil, DefaultRetryPolicy() is used.
 // If `stats` is non-nil, it will be populated with retry-related information.
-func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats) (DuplexConn, error) {
+func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, policy *RetryPolicy, stats *RetryStats) (DuplexConn, error) {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	techniques, err := policy.techniques()
+	if err != nil {
+		return nil, err
+	}
+
 	before := time.Now()
 	conn, err := dialer.Dial(addr.Network(), addr.String())
 	if err != nil {
@@ -135,7 +210,9 @@ func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats
 		dialer:            dialer,
 		addr:              addr,
 		conn:              conn.(*net.TCPConn),
-		timeout:           timeout(before, after),
+		policy:            *policy,
+		techniques:        techniques,
+		timeout:           policy.timeout(before, after),
 		retryCompleteFlag: make(chan struct{}),
 		readCloseFlag:     make(chan struct{}),
 		writeCloseFlag:    make(chan struct{}),
@@ -155,36 +232,80 @@ func (r *retrier) Read(buf []byte) (n int, err error) {
 	if !r.retryCompleted() {
 		r.mutex.Lock()
 		if err != nil {
-			var neterr net.Error
-			if errors.As(err, &neterr) {
-				r.stats.Timeout = neterr.Timeout()
+			// Read failed.  Retry as many times as the policy allows.
+			for err != nil && r.shouldRetry(err) {
+				n, err = r.retry(buf)
 			}
-			// Read failed.  Retry.
-			n, err = r.retry(buf)
+		} else if r.awaitingHello2(buf[:n]) {
+			// The server asked for a second ClientHello, so the retry window stays open.
+			r.hrr = append(r.hrr, buf[:n]...)
+			// The next write will set a new deadline.
+			r.conn.SetReadDeadline(time.Time{})
+			r.mutex.Unlock()
+			return
 		}
 		close(r.retryCompleteFlag)
 		// Unset read deadline.
 		r.conn.SetReadDeadline(time.Time{})
 		r.hello = nil
+		r.hrr = nil
+		r.hello2 = nil
 		r.mutex.Unlock()
 	}
 	return
 }
 
+// Returns true if the policy permits another retry after `err`.  Must be called
+// under the lock.
+func (r *retrier) shouldRetry(err error) bool {
+	if r.stats.Retries >= r.policy.MaxRetries {
+		return false
+	}
+	var neterr net.Error
+	timeout := errors.As(err, &neterr) && neterr.Timeout()
+	if timeout && !r.policy.RetryOnTimeout || !timeout && !r.policy.RetryOnReset {
+		return false
+	}
+	r.stats.Timeout = timeout
+	return true
+}
+
+// Returns true if `response` is part of a HelloRetryRequest flight that arrived
+// before the second ClientHello.  Must be called under the lock.
+func (r *retrier) awaitingHello2(response []byte) bool {
+	if len(r.hello2) > 0 {
+		// The second ClientHello has been sent, so this is the real response.
+		return false
+	}
+	if len(r.hrr) > 0 {
+		// Additional bytes after the HelloRetryRequest (e.g. ChangeCipherSpec).
+		return true
+	}
+	if isHelloRetryRequest(response) {
+		r.stats.HelloRetry = true
+		return true
+	}
+	return false
+}
+
 func (r *retrier) retry(buf []byte) (n int, err error) {
+	r.stats.Retries++
 	r.conn.Close()
 	var newConn net.Conn
 	if newConn, err = r.dialer.Dial(r.addr.Network(), r.addr.String()); err != nil {
 		return
 	}
 	r.conn = newConn.(*net.TCPConn)
-	first, second := splitHello(r.hello)
-	r.stats.Split = int16(len(first))
-	if _, err = r.conn.Write(first); err != nil {
+	r.stats.Technique = r.techniques[int(r.stats.Retries-1)%len(r.techniques)]
+	segments := applyTechnique(r.stats.Technique, r.hello)
+	r.stats.Split = int16(len(segments[0]))
+	if err = writeSegments(r.conn, segments); err != nil {
 		return
 	}
-	if _, err = r.conn.Write(second); err != nil {
-		return
+	if len(r.hrr) > 0 {
+		if err = r.replayHelloRetry(); err != nil {
+			return
+		}
 	}
 	// While we were creating the new socket, the caller might have called CloseRead
 	// or CloseWrite on the old socket.  Copy that state to the new socket.
@@ -199,9 +320,68 @@ func (r *retrier) retry(buf []byte) (n int, err error) {
 	// The caller might have set read or write deadlines before the retry.
 	r.conn.SetReadDeadline(r.readDeadline)
 	r.conn.SetWriteDeadline(r.writeDeadline)
+	if r.policy.RetryOnTimeout && r.stats.Retries < r.policy.MaxRetries {
+		// Another retry is possible, so the reply must arrive within the timeout.
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
 	return r.conn.Read(buf)
 }
 
+// Reads the server's response to the first ClientHello on the new socket, which
+// the caller has already received, and sends the second ClientHello.
+//
+// The new HelloRetryRequest must select the same cipher suite and group as the
+// original, because the second ClientHello depends on them.  Its cookie may differ,
+// e.g. if it is bound to the connection.  The second ClientHello can't be rebuilt
+// with the new cookie, because the client's handshake transcript already includes
+// the original HelloRetryRequest, so it is replayed with the original cookie.  A
+// server that uses stateless cookies (RFC 8446, Section 4.2.2) accepts it, and any
+// other server rejects it with an alert, failing the connection as it would
+// have failed without the retry.
+func (r *retrier) replayHelloRetry() error {
+	// The original response took less than the timeout.
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	original, err := parseHelloRetryRequest(r.hrr)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, recordHeaderLength)
+	if _, err := io.ReadFull(r.conn, header); err != nil {
+		return err
+	}
+	response := make([]byte, recordLength(header))
+	copy(response, header)
+	if _, err := io.ReadFull(r.conn, response[len(header):]); err != nil {
+		return err
+	}
+	// Any records that followed the original HelloRetryRequest (e.g. ChangeCipherSpec).
+	trailer := r.hrr[recordLength(r.hrr):]
+	if len(trailer) > 0 {
+		rest := make([]byte, len(trailer))
+		if _, err := io.ReadFull(r.conn, rest); err != nil {
+			return err
+		}
+		response = append(response, rest...)
+	}
+	if replayed, err := parseHelloRetryRequest(response); err != nil || *replayed != *original ||
+		!bytes.HasSuffix(response, trailer) {
+		// The caller has already processed the original response, so the new
+		// connection is unusable.
+		return errors.New("HelloRetryRequest changed on retry")
+	}
+	return writeSegments(r.conn, applyTechnique(r.stats.Technique, r.hello2))
+}
+
+// Writes each segment in a separate call, so that it is sent in a separate packet.
+func writeSegments(conn *net.TCPConn, segments [][]byte) error {
+	for _, segment := range segments {
+		if _, err := conn.Write(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *retrier) CloseRead() error {
 	if !r.readClosed() {
 		close(r.readCloseFlag)
@@ -242,16 +422,29 @@ func (r *retrier) Write(b []byte) (int, error) {
 		if !r.retryCompleted() {
 			n, err = r.conn.Write(b)
 			attempted = true
-			r.hello = append(r.hello, b[:n]...)
-
-			r.stats.Chunks++
-			r.stats.Bytes = int32(len(r.hello))
-			if r.stats.SNI == "" {
-				r.stats.SNI, _ = getsni.GetSNI(r.hello)
+			if len(r.hrr) == 0 {
+				r.hello = append(r.hello, b[:n]...)
+				r.stats.Chunks++
+				r.stats.Bytes = int32(len(r.hello))
+				if info, err := parseHello(r.hello); err == nil {
+					r.stats.SNI = info.sni
+					r.stats.ECH = info.ech
+				}
+			} else {
+				r.hello2 = append(r.hello2, b[:n]...)
+				r.stats.Chunks++
+				r.stats.Bytes = int32(len(r.hello) + len(r.hello2))
+				if info, err := parseHello(r.hello2); err == nil && info.sni != r.stats.SNI {
+					// RFC 8446 requires the second ClientHello to match the first.
+					// Don't guess which name is correct.
+					r.stats.SNI = ""
+				}
 			}
 
-			// We require a response or another write within the specified timeout.
-			r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+			if r.policy.RetryOnTimeout {
+				// We require a response or another write within the specified timeout.
+				r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+			}
 		}
 		r.mutex.Unlock()
 		if attempted {
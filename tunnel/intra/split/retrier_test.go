@@ -16,6 +16,7 @@ package split
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"testing"
@@ -32,6 +33,10 @@ type setup struct {
 }
 
 func makeSetup(t *testing.T) *setup {
+	return makeSetupWithPolicy(t, nil)
+}
+
+func makeSetupWithPolicy(t *testing.T, policy *RetryPolicy) *setup {
 	addr, err := net.ResolveTCPAddr("tcp", ":0")
 	if err != nil {
 		t.Error(err)
@@ -46,7 +51,7 @@ func makeSetup(t *testing.T) *setup {
 		t.Error("Server isn't TCP?")
 	}
 	var stats RetryStats
-	clientSide, err := DialWithSplitRetry(&net.Dialer{}, serverAddr, &stats)
+	clientSide, err := DialWithSplitRetry(&net.Dialer{}, serverAddr, policy, &stats)
 	if err != nil {
 		t.Error(err)
 	}
@@ -196,6 +201,9 @@ func (s *setup) checkStats(bytes int32, chunks int16, timeout bool) {
 	if r.Split < 32 || r.Split > 64 {
 		s.t.Errorf("Unexpected split: %d", r.Split)
 	}
+	if r.Retries != 1 {
+		s.t.Errorf("Expected 1 retry, got %d", r.Retries)
+	}
 }
 
 func TestNormalConnection(t *testing.T) {
@@ -305,3 +313,284 @@ func TestIdle(t *testing.T) {
 	s.close()
 	s.checkNoSplit()
 }
+
+// Writes `b` to `w` and reads the same number of bytes from `r`.
+func transfer(t *testing.T, w io.Writer, r io.Reader, b []byte) {
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(b))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, b) {
+		t.Fatal("Wrong contents")
+	}
+}
+
+// Runs a HelloRetryRequest flight, after which the server closes the socket.
+// On the replacement socket, the server responds to the first hello with `hrr2`.
+// The original HelloRetryRequest selects X25519 and carries the cookie "cookie".
+func runHelloRetry(t *testing.T, hello1, hello2, hrr2 []byte) (*setup, chan error) {
+	s := makeSetup(t)
+	hrr := makeHelloRetryRequest(0x001d, "cookie")
+	transfer(t, s.clientSide, s.serverSide, hello1)
+	transfer(t, s.serverSide, s.clientSide, hrr)
+	if !s.stats.HelloRetry {
+		t.Error("HelloRetryRequest not detected")
+	}
+	transfer(t, s.clientSide, s.serverSide, hello2)
+	s.serverSide.Close()
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(s.clientSide, buf)
+		if err == nil && string(buf) != "reply" {
+			err = errors.New("Wrong reply")
+		}
+		done <- err
+	}()
+
+	var err error
+	s.serverSide, err = s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(hello1))
+	if _, err := io.ReadFull(s.serverSide, buf); err != nil || !bytes.Equal(buf, hello1) {
+		t.Errorf("First hello replay failed: %v", err)
+	}
+	s.serverSide.Write(hrr2)
+	return s, done
+}
+
+func TestHelloRetryRetry(t *testing.T) {
+	hello := makeClientHello("www.example.test", false)
+	s, done := runHelloRetry(t, hello, hello, makeHelloRetryRequest(0x001d, "cookie"))
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(s.serverSide, buf); err != nil || !bytes.Equal(buf, hello) {
+		t.Errorf("Second hello replay failed: %v", err)
+	}
+	s.serverSide.Write([]byte("reply"))
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	s.close()
+	s.checkStats(int32(2*len(hello)), 2, false)
+	if s.stats.SNI != "www.example.test" {
+		t.Errorf("Wrong SNI: %s", s.stats.SNI)
+	}
+}
+
+func TestHelloRetryChanged(t *testing.T) {
+	hello := makeClientHello("www.example.test", false)
+	for _, hrr2 := range [][]byte{makeServerHello(false), makeHelloRetryRequest(0x0017, "cookie")} {
+		s, done := runHelloRetry(t, hello, hello, hrr2)
+		if err := <-done; err == nil {
+			t.Error("Retry should fail if the server's response changes")
+		}
+		s.close()
+	}
+}
+
+func TestHelloRetryCookieChanged(t *testing.T) {
+	hello1 := makeClientHello("www.example.test", false)
+	// The second hello echoes the original cookie.
+	hello2 := append(makeClientHello("www.example.test", false), []byte("cookie")...)
+	s, done := runHelloRetry(t, hello1, hello2, makeHelloRetryRequest(0x001d, "a longer cookie"))
+	buf := make([]byte, len(hello2))
+	if _, err := io.ReadFull(s.serverSide, buf); err != nil || !bytes.Equal(buf, hello2) {
+		t.Errorf("Second hello replay failed: %v", err)
+	}
+	s.serverSide.Write([]byte("reply"))
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	s.close()
+}
+
+func TestHelloRetrySNIMismatch(t *testing.T) {
+	hello1 := makeClientHello("www.example.test", false)
+	hello2 := makeClientHello("www.other.test", false)
+	s, done := runHelloRetry(t, hello1, hello2, makeHelloRetryRequest(0x001d, "cookie"))
+	buf := make([]byte, len(hello2))
+	io.ReadFull(s.serverSide, buf)
+	s.serverSide.Write([]byte("reply"))
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	s.close()
+	if s.stats.SNI != "" {
+		t.Errorf("SNI should be cleared, got %s", s.stats.SNI)
+	}
+}
+
+func TestECHStats(t *testing.T) {
+	s := makeSetup(t)
+	transfer(t, s.clientSide, s.serverSide, makeClientHello("public.example.test", true))
+	s.sendDown()
+	s.close()
+	if !s.stats.ECH || s.stats.SNI != "public.example.test" {
+		t.Errorf("Wrong stats: %v", s.stats)
+	}
+}
+
+func TestMultipleRetries(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = 3
+	s := makeSetupWithPolicy(t, policy)
+	s.sendUp()
+	s.serverSide.Close()
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, BUFSIZE)
+		_, err := io.ReadFull(s.clientSide, buf)
+		done <- err
+	}()
+	// The first two retries also fail.  The third succeeds.
+	for i := 0; i < 3; i++ {
+		conn, err := s.server.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, BUFSIZE)
+		io.ReadFull(conn, buf)
+		if i < 2 {
+			conn.Close()
+		} else {
+			conn.Write(buf)
+			defer conn.Close()
+		}
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	s.close()
+	if s.stats.Retries != 3 {
+		t.Errorf("Expected 3 retries, got %d", s.stats.Retries)
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = 2
+	s := makeSetupWithPolicy(t, policy)
+	s.sendUp()
+	s.serverSide.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := s.clientSide.Read(make([]byte, 1))
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := s.server.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadFull(conn, make([]byte, BUFSIZE))
+		conn.Close()
+	}
+	if err := <-done; err == nil {
+		t.Error("Read should fail after the last retry")
+	}
+	s.close()
+	if s.stats.Retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", s.stats.Retries)
+	}
+}
+
+func TestNoRetryOnReset(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.RetryOnReset = false
+	s := makeSetupWithPolicy(t, policy)
+	s.sendUp()
+	s.serverSide.Close()
+	n, err := s.clientSide.Read(make([]byte, 1))
+	if n > 0 || err == nil {
+		t.Error("Expected read to fail")
+	}
+	s.close()
+	s.checkNoSplit()
+}
+
+func TestNoRetryOnTimeout(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.BaseTimeoutMs = 100
+	policy.RetryOnTimeout = false
+	s := makeSetupWithPolicy(t, policy)
+	s.sendUp()
+	// Wait for longer than the timeout.  No retry should occur.
+	time.Sleep(300 * time.Millisecond)
+	s.sendDown()
+	s.close()
+	s.checkNoSplit()
+}
+
+func TestZeroRetries(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = 0
+	s := makeSetupWithPolicy(t, policy)
+	s.sendUp()
+	s.serverSide.Close()
+	n, err := s.clientSide.Read(make([]byte, 1))
+	if n > 0 || err == nil {
+		t.Error("Expected read to fail")
+	}
+	s.close()
+	s.checkNoSplit()
+}
+
+func TestPolicyTimeout(t *testing.T) {
+	p := &RetryPolicy{BaseTimeoutMs: 500, RTTMultiplier: 1.5}
+	before := time.Now()
+	after := before.Add(100 * time.Millisecond)
+	if timeout := p.timeout(before, after); timeout != 650*time.Millisecond {
+		t.Errorf("Wrong timeout: %v", timeout)
+	}
+}
+
+func TestTechniqueSequence(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.Techniques = "split,splitsni"
+	policy.MaxRetries = 2
+	s := makeSetupWithPolicy(t, policy)
+	hello := makeClientHello("www.example.test", false)
+	transfer(t, s.clientSide, s.serverSide, hello)
+	s.serverSide.Close()
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(s.clientSide, buf)
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := s.server.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(hello))
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, hello) {
+			t.Errorf("Replay %d failed: %v", i, err)
+		}
+		if i == 0 {
+			conn.Close()
+		} else {
+			conn.Write([]byte("reply"))
+			defer conn.Close()
+		}
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	s.close()
+	if s.stats.Technique != SplitSNI {
+		t.Errorf("Expected %s, got %s", TechniqueName(SplitSNI), TechniqueName(s.stats.Technique))
+	}
+	if int(s.stats.Split) != sniMiddle(hello) {
+		t.Errorf("Split %d is not in the SNI", s.stats.Split)
+	}
+}
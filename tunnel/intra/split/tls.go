@@ -0,0 +1,213 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	handshakeTypeServerHello = 2
+	extensionServerName      = 0
+	extensionCookie          = 44
+	extensionKeyShare        = 51
+	// Encrypted Client Hello, draft-ietf-tls-esni-13 and later.
+	extensionECH = 0xfe0d
+	// Length of the TLSPlaintext header: type, version, and length.
+	recordHeaderLength = 5
+)
+
+// A ServerHello with this random value is a HelloRetryRequest (RFC 8446, Section 4.1.3).
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// helloInfo holds the fields of a ClientHello that are visible to the network.
+type helloInfo struct {
+	// sni is the cleartext server name.  If ech is true, this is the outer
+	// (public) name, and the inner name is encrypted.
+	sni       string
+	sniOffset int  // Offset of the SNI in the input, or zero if there is no SNI.
+	ech       bool // True if the ClientHello has an ECH extension.
+}
+
+// helloRetryInfo holds the parameters that a HelloRetryRequest selects for the
+// second ClientHello.  The cookie is omitted, because it can differ between
+// connections without changing the second ClientHello that the server accepts.
+type helloRetryInfo struct {
+	cipherSuite uint16
+	group       uint16 // Selected key share group, or zero if there is none.
+}
+
+// Returns the length of the first TLS record in `b`, including the header,
+// or zero if `b` does not contain a complete header.
+func recordLength(b []byte) int {
+	if len(b) < recordHeaderLength {
+		return 0
+	}
+	return recordHeaderLength + int(binary.BigEndian.Uint16(b[3:recordHeaderLength]))
+}
+
+// Reads the handshake message from the first TLS record in `b`.
+func readHandshake(b []byte, msgType uint8) (cryptobyte.String, error) {
+	record := cryptobyte.String(b)
+	var contentType uint8
+	var fragment cryptobyte.String
+	// Skip uint16 ProtocolVersion
+	if !record.ReadUint8(&contentType) || contentType != recordTypeHandshake ||
+		!record.Skip(2) || !record.ReadUint16LengthPrefixed(&fragment) {
+		return nil, errors.New("Bad TLSPlaintext")
+	}
+	var t uint8
+	var msg cryptobyte.String
+	if !fragment.ReadUint8(&t) || t != msgType || !fragment.ReadUint24LengthPrefixed(&msg) {
+		return nil, errors.New("Bad handshake message")
+	}
+	return msg, nil
+}
+
+// parseHello accepts the beginning of a TLS connection and returns information
+// about the ClientHello, or an error if it could not be parsed.
+func parseHello(b []byte) (*helloInfo, error) {
+	s, err := readHandshake(b, handshakeTypeClientHello)
+	if err != nil {
+		return nil, err
+	}
+	// Skip uint16 version and 32 byte random.
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.Skip(2+32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.New("Bad ClientHello")
+	}
+	info := &helloInfo{}
+	if s.Empty() {
+		// No extensions
+		return info, nil
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("Bad extensions")
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, errors.New("Bad extension")
+		}
+		switch extension {
+		case extensionServerName:
+			// RFC 6066, Section 3
+			var nameList cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&nameList) {
+				return nil, errors.New("Bad namelist")
+			}
+			for !nameList.Empty() {
+				var nameType uint8
+				var serverName cryptobyte.String
+				if !nameList.ReadUint8(&nameType) || !nameList.ReadUint16LengthPrefixed(&serverName) {
+					return nil, errors.New("Bad SNI")
+				}
+				if nameType == 0 && info.sni == "" {
+					info.sni = string(serverName)
+					// cryptobyte.String slices share capacity with `b`.
+					info.sniOffset = cap(b) - cap(serverName)
+				}
+			}
+		case extensionECH:
+			info.ech = true
+		}
+	}
+	return info, nil
+}
+
+// parseHelloRetryRequest returns the parameters of the HelloRetryRequest at the
+// start of `b`, or an error if `b` does not start with a HelloRetryRequest.
+func parseHelloRetryRequest(b []byte) (*helloRetryInfo, error) {
+	s, err := readHandshake(b, handshakeTypeServerHello)
+	if err != nil {
+		return nil, err
+	}
+	info := &helloRetryInfo{}
+	var random []byte
+	var sessionID, extensions cryptobyte.String
+	// Skip uint16 legacy_version and uint8 legacy_compression_method.
+	if !s.Skip(2) || !s.ReadBytes(&random, len(helloRetryRandom)) ||
+		!bytes.Equal(random, helloRetryRandom) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16(&info.cipherSuite) || !s.Skip(1) {
+		return nil, errors.New("Bad HelloRetryRequest")
+	}
+	if s.Empty() {
+		// No extensions
+		return info, nil
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("Bad extensions")
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, errors.New("Bad extension")
+		}
+		// RFC 8446, Section 4.2.8: the HelloRetryRequest's key_share holds only
+		// the selected group.
+		if extension == extensionKeyShare && !extData.ReadUint16(&info.group) {
+			return nil, errors.New("Bad key share")
+		}
+	}
+	return info, nil
+}
+
+// isHelloRetryRequest returns true if `b` starts with a TLS HelloRetryRequest.
+func isHelloRetryRequest(b []byte) bool {
+	_, err := parseHelloRetryRequest(b)
+	return err == nil
+}
+
+// fragmentRecord splits the first TLS record in `b` into two records, at offset
+// `at` in the record's payload.  Any bytes after the first record are appended to
+// the second record.  The fragmented records are equivalent to the original at
+// the TLS layer, but not to a middlebox that only inspects the first record.
+func fragmentRecord(b []byte, at int) ([]byte, []byte, error) {
+	record := cryptobyte.String(b)
+	var contentType uint8
+	var version uint16
+	var payload []byte
+	var length uint16
+	if !record.ReadUint8(&contentType) || !record.ReadUint16(&version) ||
+		!record.ReadUint16(&length) || !record.ReadBytes(&payload, int(length)) {
+		return nil, nil, errors.New("Bad TLSPlaintext")
+	}
+	if at <= 0 || at >= len(payload) {
+		return nil, nil, errors.New("Fragment boundary out of range")
+	}
+	makeRecord := func(fragment []byte) []byte {
+		var builder cryptobyte.Builder
+		builder.AddUint8(contentType)
+		builder.AddUint16(version)
+		builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(fragment)
+		})
+		return builder.BytesOrPanic()
+	}
+	return makeRecord(payload[:at]), append(makeRecord(payload[at:]), record...), nil
+}
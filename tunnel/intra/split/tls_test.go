@@ -0,0 +1,184 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Wraps a handshake message in a TLS record.
+func makeRecord(msgType uint8, body func(b *cryptobyte.Builder)) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(recordTypeHandshake)
+	b.AddUint16(0x0301)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(msgType)
+		b.AddUint24LengthPrefixed(body)
+	})
+	return b.BytesOrPanic()
+}
+
+// Returns a minimal ClientHello with the specified SNI and an optional ECH extension.
+func makeClientHello(sni string, ech bool) []byte {
+	return makeRecord(handshakeTypeClientHello, func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(make([]byte, 32)) // Random
+		b.AddUint8(0)                // Session ID
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x1301)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if ech {
+				b.AddUint16(extensionECH)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0) // Outer
+					b.AddBytes(make([]byte, 40))
+				})
+			}
+			b.AddUint16(extensionServerName)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(sni))
+					})
+				})
+			})
+		})
+	})
+}
+
+// Returns a ServerHello, which is a HelloRetryRequest if `hrr` is true.
+func makeServerHello(hrr bool) []byte {
+	return makeRecord(handshakeTypeServerHello, func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		if hrr {
+			b.AddBytes(helloRetryRandom)
+		} else {
+			b.AddBytes(make([]byte, 32))
+		}
+		b.AddUint8(0)
+		b.AddUint16(0x1301)
+		b.AddUint8(0)
+	})
+}
+
+// Returns a HelloRetryRequest that selects `group` and carries `cookie`.
+func makeHelloRetryRequest(group uint16, cookie string) []byte {
+	return makeRecord(handshakeTypeServerHello, func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(helloRetryRandom)
+		b.AddUint8(0)
+		b.AddUint16(0x1301)
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(43) // supported_versions
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0304)
+			})
+			b.AddUint16(extensionKeyShare)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(group)
+			})
+			b.AddUint16(extensionCookie)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte(cookie))
+				})
+			})
+		})
+	})
+}
+
+func TestParseHello(t *testing.T) {
+	info, err := parseHello(makeClientHello("www.example.test", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.sni != "www.example.test" || info.ech {
+		t.Errorf("Wrong info: %v", info)
+	}
+}
+
+func TestParseHelloECH(t *testing.T) {
+	info, err := parseHello(makeClientHello("public.example.test", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.sni != "public.example.test" || !info.ech {
+		t.Errorf("Wrong info: %v", info)
+	}
+}
+
+func TestParseRealHello(t *testing.T) {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "real.example.test"}).Handshake()
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	info, err := parseHello(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.sni != "real.example.test" {
+		t.Errorf("Wrong SNI: %s", info.sni)
+	}
+}
+
+func TestParseTruncatedHello(t *testing.T) {
+	hello := makeClientHello("www.example.test", false)
+	if _, err := parseHello(hello[:len(hello)-1]); err == nil {
+		t.Error("Expected failure")
+	}
+}
+
+func TestIsHelloRetryRequest(t *testing.T) {
+	if !isHelloRetryRequest(makeServerHello(true)) {
+		t.Error("HelloRetryRequest not detected")
+	}
+	if isHelloRetryRequest(makeServerHello(false)) {
+		t.Error("ServerHello is not a HelloRetryRequest")
+	}
+	if isHelloRetryRequest(makeClientHello("www.example.test", false)) {
+		t.Error("ClientHello is not a HelloRetryRequest")
+	}
+	if isHelloRetryRequest(makeServerHello(true)[:20]) {
+		t.Error("Truncated message should not be detected")
+	}
+}
+
+func TestParseHelloRetryRequest(t *testing.T) {
+	info, err := parseHelloRetryRequest(makeHelloRetryRequest(0x001d, "cookie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.cipherSuite != 0x1301 || info.group != 0x001d {
+		t.Errorf("Wrong info: %v", info)
+	}
+	hrr := makeHelloRetryRequest(0x001d, "cookie")
+	if _, err := parseHelloRetryRequest(hrr[:len(hrr)-1]); err == nil {
+		t.Error("Expected failure")
+	}
+}
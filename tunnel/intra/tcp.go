@@ -17,15 +17,23 @@
 package intra
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Jigsaw-Code/getsni"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/split"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
 )
 
 // TCPHandler is a core TCP handler that also supports DOH and splitting control.
@@ -33,17 +41,37 @@ type TCPHandler interface {
 	core.TCPConnHandler
 	SetDNS(doh.Transport)
 	SetAlwaysSplitHTTPS(bool)
-	EnableSNIReporter(file io.ReadWriter, suffix, country string) error
+	SetRetryPolicy(*split.RetryPolicy) error
+	// SetSNIReporter sets the backend for reports about retried sockets.
+	// A nil reporter disables reports.
+	SetSNIReporter(SNIReporter)
+	// SetOwnerLookup sets the function used to identify the app that owns each
+	// socket.  A nil lookup disables identification.
+	SetOwnerLookup(OwnerLookup)
+	// SetRules sets the routing rules for new sockets.  Nil rules restore the
+	// default behavior.
+	SetRules(*Rules)
 }
 
+// Time to wait for a ClientHello when the routing rules depend on the SNI.
+const helloTimeout = 3 * time.Second
+
+var errRejected = errors.New("Rejected by routing rule")
+
 type tcpHandler struct {
 	TCPHandler
 	fakedns          net.TCPAddr
 	dns              doh.Atomic
 	alwaysSplitHTTPS bool
+	retryPolicy      atomic.Value // *split.RetryPolicy
 	dialer           *net.Dialer
 	listener         TCPListener
-	sniReporter      tcpSNIReporter
+	flows            *conntrack.Table
+	names            *rules.NameTable
+	reporterMu       sync.RWMutex // Protects sniReporter.
+	sniReporter      SNIReporter
+	owner            atomicOwner
+	rules            atomicRules
 }
 
 // TCPSocketSummary provides information about each TCP socket, reported when it is closed.
@@ -53,8 +81,15 @@ type TCPSocketSummary struct {
 	Duration      int32 // Duration in seconds.
 	ServerPort    int16 // The server port.  All values except 80, 443, and 0 are set to -1.
 	Synack        int32 // TCP handshake latency (ms)
-	// Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
+	// Retry is non-nil if retry was possible.  Retry.Retries is non-zero if a retry occurred.
 	Retry *split.RetryStats
+	// Outcome classifies the result of a TLS connection on port 443 (see
+	// OutcomeSuccess, etc.).  It is empty for other ports.
+	Outcome string
+	UID     int32 // UID of the app that opened the socket, or UnknownOwner.
+	// Domain name that resolved to the server's IP address, from DNS queries
+	// through the tunnel, or empty if unknown.
+	Domain string
 }
 
 // TCPListener is notified when a socket closes.
@@ -66,41 +101,103 @@ type TCPListener interface {
 // Connections to `fakedns` are redirected to DOH.
 // All other traffic is forwarded using `dialer`.
 // `listener` is provided with a summary of each socket when it is closed.
-func NewTCPHandler(fakedns net.TCPAddr, dialer *net.Dialer, listener TCPListener) TCPHandler {
-	return &tcpHandler{
+// `flows` tracks the active sockets, and may be nil.
+// `names` records DNS answers and names each socket's server, and may be nil.
+func NewTCPHandler(fakedns net.TCPAddr, dialer *net.Dialer, listener TCPListener, flows *conntrack.Table, names *rules.NameTable) TCPHandler {
+	h := &tcpHandler{
 		fakedns:  fakedns,
 		dialer:   dialer,
 		listener: listener,
+		flows:    flows,
+		names:    names,
 	}
+	h.retryPolicy.Store(split.DefaultRetryPolicy())
+	return h
 }
 
 // TODO: Propagate TCP RST using local.Abort(), on appropriate errors.
-func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64) {
-	bytes, _ := remote.ReadFrom(local)
+func (h *tcpHandler) handleUpload(local core.TCPConn, upstream io.Reader, remote split.DuplexConn, upload chan int64) {
+	bytes, _ := remote.ReadFrom(upstream)
 	local.CloseRead()
 	remote.CloseWrite()
 	upload <- bytes
 }
 
-func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn) (bytes int64, err error) {
-	bytes, err = io.Copy(local, remote)
+func (h *tcpHandler) handleDownload(local core.TCPConn, downstream io.Reader, remote split.DuplexConn) (bytes int64, err error) {
+	bytes, err = io.Copy(local, downstream)
 	local.CloseWrite()
 	remote.CloseRead()
 	return
 }
 
-func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, summary *TCPSocketSummary) {
-	localtcp := local.(core.TCPConn)
+// retryObserver marks a flow as split once a split retry has occurred.  It
+// must wrap the retrier's download stream, because the retrier only updates
+// the retry count while reading.  The SNI names the flow if `named` is false.
+type retryObserver struct {
+	io.Reader
+	flow  *conntrack.Flow
+	stats *split.RetryStats
+	named bool
+	done  bool
+}
+
+func (r *retryObserver) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if !r.done && r.stats.Retries > 0 {
+		// The retry is complete, so the SNI is no longer being modified.
+		r.done = true
+		r.flow.SetSplit()
+		if !r.named && r.stats.SNI != "" {
+			r.flow.SetName(r.stats.SNI)
+		}
+	}
+	return n, err
+}
+
+func (h *tcpHandler) forward(localtcp core.TCPConn, remote split.DuplexConn, summary *TCPSocketSummary, flow *conntrack.Flow, first io.Reader) {
+	var upstream io.Reader = localtcp
+	if first != nil {
+		upstream = io.MultiReader(first, localtcp)
+	}
+	var downstream io.Reader = remote
+	var client, server *recordScanner
+	if summary.ServerPort == 443 {
+		client, server = &recordScanner{}, &recordScanner{}
+		upstream = &scanningReader{upstream, client}
+		downstream = &scanningReader{remote, server}
+	}
+	upstream = flow.UploadReader(upstream)
+	downstream = flow.DownloadReader(downstream)
+	if summary.Retry != nil {
+		downstream = &retryObserver{Reader: downstream, flow: flow, stats: summary.Retry, named: summary.Domain != ""}
+	}
 	upload := make(chan int64)
 	start := time.Now()
-	go h.handleUpload(localtcp, remote, upload)
-	download, _ := h.handleDownload(localtcp, remote)
+	go h.handleUpload(localtcp, upstream, remote, upload)
+	download, err := h.handleDownload(localtcp, downstream, remote)
 	summary.DownloadBytes = download
 	summary.UploadBytes = <-upload
 	summary.Duration = int32(time.Since(start).Seconds())
+	h.flows.Remove(flow)
+	if server != nil {
+		summary.Outcome = tlsOutcome(download, err, client, server)
+	}
+	if summary.Retry != nil && summary.Retry.Retries > 0 {
+		outcome := summary.Outcome
+		if outcome == "" {
+			// Only connections to port 443 are classified.
+			outcome = "unknown"
+		}
+		metrics.AddSplitRetry(outcome)
+	}
 	h.listener.OnTCPSocketClosed(summary)
 	if summary.Retry != nil {
-		h.sniReporter.Report(*summary)
+		h.reporterMu.RLock()
+		reporter := h.sniReporter
+		h.reporterMu.RUnlock()
+		if reporter != nil {
+			reporter.Report(*summary)
+		}
 	}
 }
 
@@ -125,23 +222,70 @@ func filteredPort(addr net.Addr) int16 {
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 	// DNS override
 	if target.IP.Equal(h.fakedns.IP) && target.Port == h.fakedns.Port {
-		dns := h.dns.Load()
+		var dns doh.Transport = h.dns.Load()
+		if h.names != nil {
+			dns = &snoopingTransport{dns, h.names}
+		}
 		go doh.Accept(dns, conn)
 		return nil
 	}
 	var summary TCPSocketSummary
 	summary.ServerPort = filteredPort(target)
+	summary.UID = h.owner.lookup(ProtocolTCP, conn.LocalAddr(), target)
+	summary.Domain = h.names.Lookup(target.IP)
+	info := &rules.Conn{Protocol: "tcp", IP: target.IP, Port: target.Port, Domain: summary.Domain}
+	rs := h.rules.Load()
+	action, needSNI := rs.Match(info, false)
+	if needSNI {
+		// The client can't send data until this function returns.
+		go h.handleWithSNI(conn.(core.TCPConn), target, &summary, rs, info)
+		return nil
+	}
+	return h.apply(conn.(core.TCPConn), target, &summary, action, nil)
+}
+
+// Waits for the client's first data, and then applies the rule that matches
+// its SNI.  If the client doesn't send anything promptly, the socket is
+// routed as if it had no SNI.
+func (h *tcpHandler) handleWithSNI(conn core.TCPConn, target *net.TCPAddr, summary *TCPSocketSummary, rs *Rules, info *rules.Conn) {
+	peek := peekHello(conn)
+	timer := time.NewTimer(helloTimeout)
+	select {
+	case <-peek.done:
+		info.SNI, _ = getsni.GetSNI(peek.data)
+		timer.Stop()
+	case <-timer.C:
+		// The client is waiting for the server to speak first.
+	}
+	action, _ := rs.Match(info, true)
+	if err := h.apply(conn, target, summary, action, peek); err != nil {
+		log.Infof("TCP connection to %s failed: %v", target, err)
+		conn.Abort()
+	}
+}
+
+// Applies a routing action to a new socket.  `first` replays any data that was
+// already read from `conn`, and may be nil.  If this function returns an
+// error, the caller must reset `conn`.
+func (h *tcpHandler) apply(conn core.TCPConn, target *net.TCPAddr, summary *TCPSocketSummary, action string, first io.Reader) error {
+	switch action {
+	case ActionReset:
+		return errRejected
+	case ActionBlackhole:
+		go blackhole(conn)
+		return nil
+	}
 	start := time.Now()
 	var c split.DuplexConn
 	var err error
+	splitAll := action == ActionSplit || action == "" && summary.ServerPort == 443 && h.alwaysSplitHTTPS
 	// TODO: Cancel dialing if c is closed.
-	if summary.ServerPort == 443 {
-		if h.alwaysSplitHTTPS {
-			c, err = split.DialWithSplit(h.dialer, target)
-		} else {
-			summary.Retry = &split.RetryStats{}
-			c, err = split.DialWithSplitRetry(h.dialer, target, summary.Retry)
-		}
+	if splitAll {
+		c, err = split.DialWithSplit(h.dialer, target)
+	} else if action == ActionRetry || action == "" && summary.ServerPort == 443 {
+		summary.Retry = &split.RetryStats{}
+		policy := h.retryPolicy.Load().(*split.RetryPolicy)
+		c, err = split.DialWithSplitRetry(h.dialer, target, policy, summary.Retry)
 	} else {
 		var generic net.Conn
 		generic, err = h.dialer.Dial(target.Network(), target.String())
@@ -153,20 +297,66 @@ func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 		return err
 	}
 	summary.Synack = int32(time.Since(start).Seconds() * 1000)
-	go h.forward(conn, c, &summary)
+	flow := h.flows.Add(target, func() {
+		conn.Close()
+		c.Close()
+	})
+	if summary.Domain != "" {
+		flow.SetName(summary.Domain)
+	}
+	if splitAll {
+		flow.SetSplit()
+	}
+	go h.forward(conn, c, summary, flow, first)
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
 
+// Discards all data from `conn` until the client closes it.
+func blackhole(conn core.TCPConn) {
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+}
+
 func (h *tcpHandler) SetDNS(dns doh.Transport) {
 	h.dns.Store(dns)
-	h.sniReporter.SetDNS(dns)
+	h.reporterMu.RLock()
+	if h.sniReporter != nil {
+		h.sniReporter.SetDNS(dns)
+	}
+	h.reporterMu.RUnlock()
 }
 
 func (h *tcpHandler) SetAlwaysSplitHTTPS(s bool) {
 	h.alwaysSplitHTTPS = s
 }
 
-func (h *tcpHandler) EnableSNIReporter(file io.ReadWriter, suffix, country string) error {
-	return h.sniReporter.Configure(file, suffix, country)
+// SetRetryPolicy changes the retry policy for new connections.  A nil policy
+// restores the default.  An invalid policy is rejected, leaving the current one.
+func (h *tcpHandler) SetRetryPolicy(policy *split.RetryPolicy) error {
+	if policy == nil {
+		policy = split.DefaultRetryPolicy()
+	}
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	h.retryPolicy.Store(policy)
+	return nil
+}
+
+func (h *tcpHandler) SetRules(rules *Rules) {
+	h.rules.Store(rules)
+}
+
+func (h *tcpHandler) SetOwnerLookup(lookup OwnerLookup) {
+	h.owner.Store(lookup)
+}
+
+func (h *tcpHandler) SetSNIReporter(reporter SNIReporter) {
+	h.reporterMu.Lock()
+	defer h.reporterMu.Unlock()
+	if reporter != nil {
+		reporter.SetDNS(h.dns.Load())
+	}
+	h.sniReporter = reporter
 }
@@ -0,0 +1,185 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Outcomes of a TLS connection, as reported in TCPSocketSummary.Outcome.
+const (
+	// OutcomeSuccess indicates that data was received without a detected failure.
+	OutcomeSuccess = "success"
+	// OutcomeResetBeforeHello indicates a TCP reset before any response.
+	OutcomeResetBeforeHello = "reset-before-hello"
+	// OutcomeResetAfterHello indicates a TCP reset after the ServerHello.
+	OutcomeResetAfterHello = "reset-after-hello"
+	// OutcomeAlert indicates that the server (or a middlebox) sent a cleartext TLS alert.
+	OutcomeAlert = "alert"
+	// OutcomeCertificate indicates that the client rejected the server's
+	// certificate.  This is only visible in TLS 1.2, where the client's alert is
+	// not encrypted.
+	OutcomeCertificate = "certificate"
+	// OutcomeFIN indicates that the server closed the socket cleanly without
+	// sending any data.
+	OutcomeFIN = "fin"
+	// OutcomeTimeout indicates that no data was received before a timeout.
+	OutcomeTimeout = "timeout"
+	// OutcomeError indicates any other failure with no data received.
+	OutcomeError = "error"
+)
+
+const (
+	recordTypeAlert          = 21
+	recordTypeHandshake      = 22
+	recordTypeApplication    = 23
+	handshakeTypeServerHello = 2
+	// Stop scanning after this many records.  Plaintext alerts and handshake
+	// messages only appear at the start of a connection.
+	maxScannedRecords = 8
+)
+
+// Certificate-related alert descriptions (RFC 8446, Section 6.2).
+var certificateAlerts = map[byte]bool{
+	42: true, // bad_certificate
+	43: true, // unsupported_certificate
+	44: true, // certificate_revoked
+	45: true, // certificate_expired
+	46: true, // certificate_unknown
+	48: true, // unknown_ca
+}
+
+// recordScanner observes one direction of a TLS stream, and notes the first
+// handshake message type and the first cleartext alert.  It stops inspecting
+// data once encrypted application data begins.
+type recordScanner struct {
+	header    []byte // Partial header of the current record.
+	body      []byte // First two bytes of the current record's body.
+	remaining int    // Bytes remaining in the current record's body.
+	records   int    // Number of records whose headers have been read.
+	done      bool
+
+	firstHandshake byte // Type of the first handshake message, or 0.
+	alert          bool // True if a cleartext alert was observed.
+	alertCode      byte // Description of the first alert.
+}
+
+// scan processes the next bytes of the stream.
+func (s *recordScanner) scan(b []byte) {
+	for len(b) > 0 && !s.done {
+		if len(s.header) < 5 {
+			n := min(5-len(s.header), len(b))
+			s.header = append(s.header, b[:n]...)
+			b = b[n:]
+			if len(s.header) < 5 {
+				return
+			}
+			contentType := s.header[0]
+			if contentType < 20 || contentType >= recordTypeApplication {
+				// Encrypted data, or not TLS.
+				s.done = true
+				return
+			}
+			s.records++
+			s.remaining = int(s.header[3])<<8 | int(s.header[4])
+			s.body = s.body[:0]
+		}
+		n := min(s.remaining, len(b))
+		if len(s.body) < 2 {
+			s.body = append(s.body, b[:min(n, 2-len(s.body))]...)
+		}
+		s.remaining -= n
+		b = b[n:]
+		s.observe()
+		if s.remaining == 0 {
+			s.header = s.header[:0]
+			if s.records >= maxScannedRecords {
+				s.done = true
+			}
+		}
+	}
+}
+
+// Records the contents of the current record, once enough of it is available.
+func (s *recordScanner) observe() {
+	switch s.header[0] {
+	case recordTypeHandshake:
+		if s.firstHandshake == 0 && len(s.body) >= 1 {
+			s.firstHandshake = s.body[0]
+		}
+	case recordTypeAlert:
+		if len(s.body) >= 2 {
+			s.alert = true
+			s.alertCode = s.body[1]
+			s.done = true
+		}
+	}
+}
+
+func (s *recordScanner) serverHello() bool {
+	return s.firstHandshake == handshakeTypeServerHello
+}
+
+func (s *recordScanner) certificateAlert() bool {
+	return s.alert && certificateAlerts[s.alertCode]
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// scanningReader passes each read through a recordScanner.
+type scanningReader struct {
+	io.Reader
+	s *recordScanner
+}
+
+func (r *scanningReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if !r.s.done {
+		r.s.scan(b[:n])
+	}
+	return n, err
+}
+
+// tlsOutcome classifies a TLS connection that downloaded `download` bytes and
+// ended with `err`, given scanners for the `client` and `server` streams.
+func tlsOutcome(download int64, err error, client, server *recordScanner) string {
+	var neterr net.Error
+	switch {
+	case server.alert:
+		return OutcomeAlert
+	case client.certificateAlert():
+		return OutcomeCertificate
+	case errors.Is(err, syscall.ECONNRESET):
+		if server.serverHello() {
+			return OutcomeResetAfterHello
+		}
+		return OutcomeResetBeforeHello
+	case download > 0:
+		return OutcomeSuccess
+	case err == nil:
+		return OutcomeFIN
+	case errors.As(err, &neterr) && neterr.Timeout():
+		return OutcomeTimeout
+	}
+	return OutcomeError
+}
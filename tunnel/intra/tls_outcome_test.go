@@ -0,0 +1,145 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func record(contentType byte, body ...byte) []byte {
+	return append([]byte{contentType, 3, 3, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	clientHello  = record(recordTypeHandshake, 1, 0, 0, 4, 3, 3, 0, 0)
+	serverHello  = record(recordTypeHandshake, handshakeTypeServerHello, 0, 0, 2, 3, 3)
+	changeCipher = record(20, 1)
+	appData      = record(recordTypeApplication, 0xaa, 0xbb, 0xcc)
+	unknownCA    = record(recordTypeAlert, 2, 48)
+	handshakeErr = record(recordTypeAlert, 2, 40)
+)
+
+// Scans `stream` one byte at a time, to exercise reassembly.
+func scanBytewise(stream []byte) *recordScanner {
+	s := &recordScanner{}
+	for i := range stream {
+		s.scan(stream[i : i+1])
+	}
+	return s
+}
+
+func TestScannerServerHello(t *testing.T) {
+	stream := concat(serverHello, changeCipher, appData)
+	for _, s := range []*recordScanner{scanBytewise(stream), {}} {
+		s.scan(stream)
+		if !s.serverHello() {
+			t.Error("Missed ServerHello")
+		}
+		if s.alert {
+			t.Error("Unexpected alert")
+		}
+		if !s.done {
+			t.Error("Scanner should stop at application data")
+		}
+	}
+}
+
+func TestScannerAlert(t *testing.T) {
+	s := scanBytewise(concat(clientHello, unknownCA))
+	if !s.alert || s.alertCode != 48 || !s.certificateAlert() {
+		t.Errorf("Missed certificate alert: %v", s)
+	}
+	s = scanBytewise(handshakeErr)
+	if !s.alert || s.certificateAlert() {
+		t.Errorf("Wrong alert: %v", s)
+	}
+}
+
+func TestScannerEncryptedAlert(t *testing.T) {
+	// Alerts after application data begins are encrypted, and must be ignored.
+	s := &recordScanner{}
+	s.scan(concat(clientHello, appData, unknownCA))
+	if s.alert {
+		t.Error("Alert after application data should be ignored")
+	}
+}
+
+func TestScannerNotTLS(t *testing.T) {
+	s := &recordScanner{}
+	s.scan([]byte("GET / HTTP/1.1\r\n"))
+	if !s.done || s.serverHello() || s.alert {
+		t.Errorf("Bad state for non-TLS stream: %v", s)
+	}
+}
+
+func TestScanningReader(t *testing.T) {
+	stream := concat(serverHello, appData)
+	s := &recordScanner{}
+	out, err := ioutil.ReadAll(&scanningReader{bytes.NewReader(stream), s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, stream) {
+		t.Error("Stream was modified")
+	}
+	if !s.serverHello() {
+		t.Error("Missed ServerHello")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTLSOutcome(t *testing.T) {
+	reset := &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	cases := []struct {
+		name     string
+		download int64
+		err      error
+		client   []byte
+		server   []byte
+		expected string
+	}{
+		{"success", 500, nil, concat(clientHello, appData), concat(serverHello, appData), OutcomeSuccess},
+		{"reset before hello", 0, reset, clientHello, nil, OutcomeResetBeforeHello},
+		{"reset after hello", int64(len(serverHello)), reset, clientHello, serverHello, OutcomeResetAfterHello},
+		{"server alert", int64(len(handshakeErr)), nil, clientHello, handshakeErr, OutcomeAlert},
+		{"certificate", 500, nil, concat(clientHello, unknownCA), serverHello, OutcomeCertificate},
+		{"fin", 0, nil, clientHello, nil, OutcomeFIN},
+		{"timeout", 0, timeoutError{}, clientHello, nil, OutcomeTimeout},
+		{"error", 0, errors.New("unknown"), clientHello, nil, OutcomeError},
+	}
+	for _, c := range cases {
+		client, server := &recordScanner{}, &recordScanner{}
+		client.scan(c.client)
+		server.scan(c.server)
+		if outcome := tlsOutcome(c.download, c.err, client, server); outcome != c.expected {
+			t.Errorf("%s: %s != %s", c.name, outcome, c.expected)
+		}
+	}
+}
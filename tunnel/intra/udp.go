@@ -22,19 +22,35 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/intra/quic"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/rules"
 )
 
-// UDPSocketSummary describes a non-DNS UDP association, reported when it is discarded.
+// UDPSocketSummary describes a UDP association, reported when it is discarded.
 type UDPSocketSummary struct {
-	UploadBytes   int64 // Amount uploaded (bytes)
-	DownloadBytes int64 // Amount downloaded (bytes)
+	UploadBytes   int64 // Non-DNS amount uploaded (bytes)
+	DownloadBytes int64 // Non-DNS amount downloaded (bytes)
 	Duration      int32 // How long the socket was open (seconds)
+	ServerPort    int16 // The first server port.  All values except 80, 443, and 0 are set to -1.
+	// Time from the first non-DNS upload to the first non-DNS download (ms), or -1 if
+	// no reply was received.
+	FirstPacketLatency int32
+	DNSQueries         int32  // Number of queries redirected to DOH.
+	DNSUploadBytes     int64  // Total size of DNS queries (bytes)
+	DNSDownloadBytes   int64  // Total size of DNS responses (bytes)
+	SNI                string // QUIC SNI observed, if present.
+	UID                int32  // UID of the app that opened the socket, or UnknownOwner.
+	// Domain name that resolved to the first server's IP address, from DNS
+	// queries through the tunnel, or empty if unknown.
+	Domain string
 }
 
 // UDPListener is notified when a non-DNS UDP association is discarded.
@@ -42,21 +58,108 @@ type UDPListener interface {
 	OnUDPSocketClosed(*UDPSocketSummary)
 }
 
+// Number of initial upload packets to inspect for a QUIC SNI.
+const sniPackets = 3
+
 type tracker struct {
-	conn     *net.UDPConn
-	start    time.Time
-	upload   int64 // Non-DNS upload bytes
-	download int64 // Non-DNS download bytes
+	conn   *net.UDPConn
+	start  time.Time
+	port   int16
+	uid    int32
+	domain string
+	flow   *conntrack.Flow
+	// mu protects the non-DNS counters below, because uploads are recorded on the
+	// lwIP thread, and downloads on the socket's reader goroutine.
+	mu              sync.Mutex
+	upload          int64 // Non-DNS upload bytes
+	download        int64 // Non-DNS download bytes
+	uploadPackets   int32
+	downloadPackets int32
+	firstUpload     time.Time
+	latency         int32 // First packet latency (ms), or -1 if not yet known.
+	sni             string
+	// The routing action for packets to target, once routed is true.
+	target *net.UDPAddr
+	action string
+	routed bool
+	// DNS counters are updated concurrently by DoH goroutines, so they are accessed
+	// atomically.
+	dnsQueries  int32
+	dnsUpload   int64
+	dnsDownload int64
 }
 
-func makeTracker(conn *net.UDPConn) *tracker {
-	return &tracker{conn, time.Now(), 0, 0}
+func makeTracker(conn *net.UDPConn, target *net.UDPAddr, uid int32, domain string, flow *conntrack.Flow) *tracker {
+	if domain != "" {
+		flow.SetName(domain)
+	}
+	return &tracker{conn: conn, start: time.Now(), port: filteredPort(target), uid: uid, domain: domain, latency: -1, flow: flow, target: target}
+}
+
+// Records an outgoing non-DNS packet.
+func (t *tracker) onUpload(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.uploadPackets == 0 {
+		t.firstUpload = time.Now()
+	}
+	if t.sni == "" && t.port == 443 && t.uploadPackets < sniPackets {
+		t.sni, _ = quic.GetSNI(data)
+		if t.sni != "" && t.domain == "" {
+			t.flow.SetName(t.sni)
+		}
+	}
+	t.uploadPackets++
+	t.upload += int64(len(data))
+	t.flow.AddUpload(int64(len(data)))
+}
+
+// Records an incoming non-DNS packet.
+func (t *tracker) onDownload(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.downloadPackets == 0 && t.uploadPackets > 0 {
+		t.latency = int32(time.Since(t.firstUpload).Seconds() * 1000)
+	}
+	t.downloadPackets++
+	t.download += int64(n)
+	t.flow.AddDownload(int64(n))
+}
+
+// Returns whether the socket has carried no non-DNS traffic.
+func (t *tracker) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.upload == 0 && t.download == 0
+}
+
+func (t *tracker) summary() *UDPSocketSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &UDPSocketSummary{
+		UploadBytes:        t.upload,
+		DownloadBytes:      t.download,
+		Duration:           int32(time.Since(t.start).Seconds()),
+		ServerPort:         t.port,
+		FirstPacketLatency: t.latency,
+		DNSQueries:         atomic.LoadInt32(&t.dnsQueries),
+		DNSUploadBytes:     atomic.LoadInt64(&t.dnsUpload),
+		DNSDownloadBytes:   atomic.LoadInt64(&t.dnsDownload),
+		SNI:                t.sni,
+		UID:                t.uid,
+		Domain:             t.domain,
+	}
 }
 
 // UDPHandler adds DOH support to the base UDPConnHandler interface.
 type UDPHandler interface {
 	core.UDPConnHandler
 	SetDNS(dns doh.Transport)
+	// SetOwnerLookup sets the function used to identify the app that owns each
+	// socket.  A nil lookup disables identification.
+	SetOwnerLookup(OwnerLookup)
+	// SetRules sets the routing rules.  Nil rules restore the default behavior.
+	SetRules(*Rules)
 }
 
 type udpHandler struct {
@@ -69,6 +172,10 @@ type udpHandler struct {
 	dns      doh.Transport
 	config   *net.ListenConfig
 	listener UDPListener
+	flows    *conntrack.Table
+	names    *rules.NameTable
+	owner    atomicOwner
+	rules    atomicRules
 }
 
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
@@ -77,13 +184,17 @@ type udpHandler struct {
 // `timeout` controls the effective NAT mapping lifetime.
 // `config` is used to bind new external UDP ports.
 // `listener` receives a summary about each UDP binding when it expires.
-func NewUDPHandler(fakedns net.UDPAddr, timeout time.Duration, config *net.ListenConfig, listener UDPListener) UDPHandler {
+// `flows` tracks the active UDP bindings, and may be nil.
+// `names` records DNS answers and names each binding's server, and may be nil.
+func NewUDPHandler(fakedns net.UDPAddr, timeout time.Duration, config *net.ListenConfig, listener UDPListener, flows *conntrack.Table, names *rules.NameTable) UDPHandler {
 	return &udpHandler{
 		timeout:  timeout,
 		udpConns: make(map[core.UDPConn]*tracker, 8),
 		fakedns:  fakedns,
 		config:   config,
 		listener: listener,
+		flows:    flows,
+		names:    names,
 	}
 }
 
@@ -103,7 +214,7 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 		}
 
 		udpaddr := addr.(*net.UDPAddr)
-		t.download += int64(n)
+		t.onDownload(n)
 		_, err = conn.WriteFrom(buf[:n], udpaddr)
 		if err != nil {
 			log.Warnf("failed to write UDP data to TUN")
@@ -113,13 +224,24 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	domain := h.names.Lookup(target.IP)
+	if !h.isFakeDNS(target) {
+		info := &rules.Conn{Protocol: "udp", IP: target.IP, Port: target.Port, Domain: domain}
+		if action, needSNI := h.rules.Load().Match(info, false); !needSNI && action == ActionReset {
+			return errRejected
+		}
+	}
 	bindAddr := &net.UDPAddr{IP: nil, Port: 0}
 	pc, err := h.config.ListenPacket(context.TODO(), bindAddr.Network(), bindAddr.String())
 	if err != nil {
 		log.Errorf("failed to bind udp address")
 		return err
 	}
-	t := makeTracker(pc.(*net.UDPConn))
+	uid := h.owner.lookup(ProtocolUDP, conn.LocalAddr(), target)
+	flow := h.flows.Add(target, func() {
+		h.Close(conn)
+	})
+	t := makeTracker(pc.(*net.UDPConn), target, uid, domain, flow)
 	h.Lock()
 	h.udpConns[conn] = t
 	h.Unlock()
@@ -129,18 +251,18 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 }
 
 func (h *udpHandler) doDoh(dns doh.Transport, t *tracker, conn core.UDPConn, data []byte) {
+	atomic.AddInt32(&t.dnsQueries, 1)
+	atomic.AddInt64(&t.dnsUpload, int64(len(data)))
 	resp, err := dns.Query(data)
 	if err == nil {
+		atomic.AddInt64(&t.dnsDownload, int64(len(resp)))
+		h.names.Record(resp)
 		_, err = conn.WriteFrom(resp, &h.fakedns)
 	}
 	if err != nil {
 		log.Warnf("DoH query failed: %v", err)
 	}
-	// Note: Reading t.upload and t.download on this thread, while they are written on
-	// other threads, is theoretically a race condition.  In practice, this race is
-	// impossible on 64-bit platforms, likely impossible on 32-bit platforms, and
-	// low-impact if it occurs (a mixed-use socket might be closed early).
-	if t.upload == 0 && t.download == 0 {
+	if t.idle() {
 		// conn was only used for this DNS query, so it's unlikely to be used again.
 		h.Close(conn)
 	}
@@ -159,12 +281,19 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	// Update deadline.
 	t.conn.SetDeadline(time.Now().Add(h.timeout))
 
-	if addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port {
+	if h.isFakeDNS(addr) {
 		dataCopy := append([]byte{}, data...)
 		go h.doDoh(dns, t, conn, dataCopy)
 		return nil
 	}
-	t.upload += int64(len(data))
+	switch h.route(t, data, addr) {
+	case ActionReset:
+		h.Close(conn)
+		return errRejected
+	case ActionBlackhole:
+		return nil
+	}
+	t.onUpload(data)
 	_, err := t.conn.WriteTo(data, addr)
 	if err != nil {
 		log.Warnf("failed to forward UDP payload")
@@ -173,6 +302,32 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	return nil
 }
 
+func (h *udpHandler) isFakeDNS(addr *net.UDPAddr) bool {
+	return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
+}
+
+// Returns the routing action for a packet containing `data` to `addr`.  The
+// action for the association's first destination is computed only once, using
+// the QUIC SNI of its first packet if the rules require it.
+func (h *udpHandler) route(t *tracker, data []byte, addr *net.UDPAddr) string {
+	first := addr.IP.Equal(t.target.IP) && addr.Port == t.target.Port
+	if first && t.routed {
+		return t.action
+	}
+	rs := h.rules.Load()
+	info := &rules.Conn{Protocol: "udp", IP: addr.IP, Port: addr.Port, Domain: h.names.Lookup(addr.IP)}
+	action, needSNI := rs.Match(info, false)
+	if needSNI {
+		info.SNI, _ = quic.GetSNI(data)
+		action, _ = rs.Match(info, true)
+	}
+	if first {
+		t.action = action
+		t.routed = true
+	}
+	return action
+}
+
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
 
@@ -182,12 +337,20 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 	if t, ok := h.udpConns[conn]; ok {
 		t.conn.Close()
 		// TODO: Cancel any outstanding DoH queries.
-		duration := int32(time.Since(t.start).Seconds())
-		h.listener.OnUDPSocketClosed(&UDPSocketSummary{t.upload, t.download, duration})
+		h.listener.OnUDPSocketClosed(t.summary())
+		h.flows.Remove(t.flow)
 		delete(h.udpConns, conn)
 	}
 }
 
+func (h *udpHandler) SetRules(rules *Rules) {
+	h.rules.Store(rules)
+}
+
+func (h *udpHandler) SetOwnerLookup(lookup OwnerLookup) {
+	h.owner.Store(lookup)
+}
+
 func (h *udpHandler) SetDNS(dns doh.Transport) {
 	h.Lock()
 	h.dns = dns
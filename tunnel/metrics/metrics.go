@@ -0,0 +1,141 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics aggregates traffic statistics for all tunnels in the process,
+// and exports them in the Prometheus text format.
+//
+// Like the tun2socks core, whose handlers are global, the metrics are global:
+// counters accumulate across tunnels for the lifetime of the process.
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+const namespace = "tun2socks"
+
+var (
+	// A private registry, so that embedding apps' own metrics are unaffected.
+	registry = prometheus.NewRegistry()
+
+	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes forwarded, by protocol and direction.",
+	}, []string{"protocol", "direction"})
+	activeSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Active TCP connections and UDP associations, by protocol.",
+	}, []string{"protocol"})
+	dohLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "doh_latency_seconds",
+		Help:      "DNS-over-HTTPS query latency, by status.",
+		Buckets:   []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"status"})
+	splitRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "split_retries_total",
+		Help:      "TCP connections that were retried with splitting, by TLS outcome.",
+	}, []string{"outcome"})
+	dialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadowsocks_dial_errors_total",
+		Help:      "Failures to connect through the Shadowsocks proxy, by error class.",
+	}, []string{"class"})
+)
+
+func init() {
+	registry.MustRegister(bytesTotal, activeSessions, dohLatency, splitRetries, dialErrors)
+}
+
+// Traffic holds the metrics for one transport protocol.
+type Traffic struct {
+	upload   prometheus.Counter
+	download prometheus.Counter
+	sessions prometheus.Gauge
+}
+
+// ForProtocol returns the metrics for `protocol` ("tcp" or "udp").
+func ForProtocol(protocol string) *Traffic {
+	return &Traffic{
+		upload:   bytesTotal.WithLabelValues(protocol, "upload"),
+		download: bytesTotal.WithLabelValues(protocol, "download"),
+		sessions: activeSessions.WithLabelValues(protocol),
+	}
+}
+
+// AddUpload counts `n` bytes sent to the network.
+func (t *Traffic) AddUpload(n int64) {
+	t.upload.Add(float64(n))
+}
+
+// AddDownload counts `n` bytes received from the network.
+func (t *Traffic) AddDownload(n int64) {
+	t.download.Add(float64(n))
+}
+
+// Open counts a new session.
+func (t *Traffic) Open() {
+	t.sessions.Inc()
+}
+
+// Close counts the end of a session.
+func (t *Traffic) Close() {
+	t.sessions.Dec()
+}
+
+// ObserveDoH records the latency of a DNS-over-HTTPS query that ended with `status`.
+func ObserveDoH(status string, latency time.Duration) {
+	dohLatency.WithLabelValues(status).Observe(latency.Seconds())
+}
+
+// AddSplitRetry counts a split retry whose connection ended with `outcome`,
+// which is "unknown" if the connection's TLS outcome was not classified.
+func AddSplitRetry(outcome string) {
+	splitRetries.WithLabelValues(outcome).Inc()
+}
+
+// AddDialError counts a failure to connect through the Shadowsocks proxy.
+func AddDialError(class string) {
+	dialErrors.WithLabelValues(class).Inc()
+}
+
+// Handler returns an HTTP handler that serves the metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Snapshot returns the current value of all metrics in the Prometheus text format.
+func Snapshot() (string, error) {
+	families, err := registry.Gather()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTraffic(t *testing.T) {
+	tcp := ForProtocol("tcp")
+	before := testutil.ToFloat64(bytesTotal.WithLabelValues("tcp", "upload"))
+	tcp.Open()
+	tcp.AddUpload(100)
+	tcp.AddDownload(2000)
+	if v := testutil.ToFloat64(bytesTotal.WithLabelValues("tcp", "upload")); v != before+100 {
+		t.Errorf("Wrong upload count: %v", v)
+	}
+	if v := testutil.ToFloat64(activeSessions.WithLabelValues("tcp")); v != 1 {
+		t.Errorf("Wrong session count: %v", v)
+	}
+	tcp.Close()
+	if v := testutil.ToFloat64(activeSessions.WithLabelValues("tcp")); v != 0 {
+		t.Errorf("Session was not closed: %v", v)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ForProtocol("udp").AddDownload(10)
+	ObserveDoH("complete", 30*time.Millisecond)
+	AddSplitRetry("success")
+	AddDialError("timeout")
+	snapshot, err := Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`tun2socks_bytes_total{direction="download",protocol="udp"}`,
+		`tun2socks_doh_latency_seconds_bucket{status="complete",le="0.05"} 1`,
+		`tun2socks_split_retries_total{outcome="success"} 1`,
+		`tun2socks_shadowsocks_dial_errors_total{class="timeout"} 1`,
+	} {
+		if !strings.Contains(snapshot, line) {
+			t.Errorf("Missing %s in snapshot:\n%s", line, snapshot)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	AddDialError("refused")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), `tun2socks_shadowsocks_dial_errors_total{class="refused"}`) {
+		t.Errorf("Missing metric in response:\n%s", body)
+	}
+}
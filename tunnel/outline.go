@@ -15,85 +15,365 @@
 package tunnel
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/core"
 	"github.com/eycorsican/go-tun2socks/proxy/dnsfallback"
 
 	oss "github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
 	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 )
 
+const (
+	udpTimeout          = 30 * time.Second
+	healthCheckInterval = 5 * time.Minute
+)
+
 // OutlineTunnel represents a tunnel from a TUN device to a server.
 type OutlineTunnel interface {
 	Tunnel
 
 	// UpdateUDPSupport determines if UDP is supported following a network connectivity change.
-	// Sets the tunnel's UDP connection handler accordingly, falling back to DNS over TCP if UDP is not supported.
+	// Sets the tunnel's UDP connection handler accordingly, falling back to UDP over TCP if enabled,
+	// or else to DNS over TCP, if UDP is not supported.
 	// Returns whether UDP proxying is supported in the new network.
 	UpdateUDPSupport() bool
+
+	// SetUDPOverTCP sets whether to relay all UDP traffic over the proxy's TCP streams when the
+	// network does not support UDP, so that protocols like QUIC and VoIP keep working.  Each UDP
+	// association uses its own stream.  Otherwise, only DNS queries are relayed over TCP.  The servers must support the UDP-over-TCP protocol;
+	// see shadowsocks.NewUDPOverTCPClient.
+	SetUDPOverTCP(enabled bool)
+
+	// SetUDPNATMode sets the NAT mode of UDP associations through the proxy: "full-cone" (the
+	// default), which accepts replies from any address, or "symmetric", which uses a separate
+	// association for each destination and drops packets from other addresses.  Changing the
+	// mode closes existing connections if UDP is relayed through the proxy.
+	SetUDPNATMode(mode string) error
+
+	// SetDNSUpstream intercepts DNS queries over UDP and TCP to the TUN device's resolvers at
+	// `dnsAddrs`, a comma-separated list of IP addresses with an optional port (53 by default),
+	// and forwards them through the proxy to `upstream`, which is one of
+	//   udp://1.1.1.1:53, tcp://1.1.1.1:53, or https://cloudflare-dns.com/dns-query
+	// An empty `upstream` stops the interception, so that DNS goes wherever the system sends
+	// it.  On networks that block UDP, the upstream should use TCP or HTTPS.
+	SetDNSUpstream(dnsAddrs, upstream string) error
+
+	// SetCheckTargets sets the destinations of the connectivity and health checks through the
+	// proxy: an http:// URL for TCP, and the host:port of a DNS resolver for UDP.  They default
+	// to shadowsocks.DefaultCheckURL and shadowsocks.DefaultCheckResolver.
+	SetCheckTargets(url, resolver string) error
+
+	// SetBypassRules sets the split tunneling rules for new TCP and UDP sockets,
+	// as a JSON array of shadowsocks.Rule objects, e.g.
+	//   [{"cidrs": ["10.0.0.0/8", "192.168.0.0/16"], "action": "direct"},
+	//    {"domains": ["example.com"], "protocol": "tcp", "action": "block"}]
+	// The first matching rule applies, and other sockets are proxied.  An empty
+	// string removes all rules.  Fails for "direct" rules if the tunnel has no
+	// dialer for sockets that bypass the proxy.
+	SetBypassRules(rules string) error
+
+	// SetServers replaces the pool of Shadowsocks servers without reconnecting the
+	// TUN device.  `servers` is a JSON array of shadowsocks.Server objects, e.g.
+	//   [{"host": "192.0.2.1", "port": 8388, "password": "secret", "cipher": "chacha20-ietf-poly1305"}]
+	// `policy` selects the server for each connection: shadowsocks.PolicyFailover,
+	// PolicyRoundRobin, or PolicyLatency.  Servers that are already in the pool
+	// keep their health state.  Existing connections are not affected.
+	SetServers(servers, policy string) error
+
+	// UpdateProxy replaces the tunnel's Shadowsocks servers with the proxy at
+	// `host`:`port`, without reconnecting the TUN device.  New flows use the new
+	// proxy.  If `drain` is true, existing flows continue through the previous
+	// proxy until they end.  Otherwise, they are closed.  Flows that bypass the
+	// proxy are not affected.
+	UpdateProxy(host string, port int, password, cipher string, drain bool) error
+
+	// GetServerStatus returns the health of each server in the pool, as a JSON
+	// array of shadowsocks.ServerStatus objects.
+	GetServerStatus() (string, error)
+
+	// StartHealthMonitor probes the TCP and UDP connectivity through the proxy every
+	// `intervalSecs` seconds, to the targets of SetCheckTargets.  Like UpdateUDPSupport, it
+	// switches the UDP handler once `threshold` consecutive probes find that UDP is blocked,
+	// and switches back as soon as a probe succeeds.  `listener` is notified when the proxy
+	// becomes unreachable for `threshold` consecutive probes, when it recovers, and when UDP
+	// support changes.  Replaces any running monitor.
+	StartHealthMonitor(intervalSecs, threshold int, listener HealthListener) error
+
+	// StopHealthMonitor stops the health monitor, if it is running.
+	StopHealthMonitor()
+
+	// GetUDPStats returns the counters of the UDP associations through the proxy,
+	// as a JSON shadowsocks.NATStats object.  The counters restart when the UDP
+	// handler changes, and are zero while UDP falls back to DNS over TCP.
+	GetUDPStats() (string, error)
 }
 
 type outlinetunnel struct {
 	*tunnel
-	host         string
-	port         int
-	password     string
-	cipher       string
-	isUDPEnabled bool // Whether the tunnel supports proxying UDP.
+	pool         *oss.Pool
+	mu           sync.Mutex     // Protects isConnected, isUDPEnabled, udpOverTCP, udpNAT, udp and monitor.
+	isUDPEnabled bool           // Whether the tunnel supports proxying UDP.
+	udpOverTCP   bool           // Whether to relay UDP over TCP when UDP is not supported.
+	udpNAT       string         // The NAT mode of UDP associations through the proxy.
+	udp          oss.UDPHandler // The proxy UDP handler, or nil for DNS over TCP.
+	router       *oss.Router
+	dns          *oss.DNSForwarder
+	dialer       *net.Dialer
+	config       *net.ListenConfig
+	monitor      *healthMonitor // The running health monitor, or nil.
 }
 
 // NewOutlineTunnel connects a tunnel to a Shadowsocks proxy server and returns an `OutlineTunnel`.
+// More servers can be added with SetServers.
 //
-// `host` is the IP or domain of the Shadowsocks proxy.
-// `port` is the port of the Shadowsocks proxy.
-// `password` is the password of the Shadowsocks proxy.
-// `cipher` is the encryption cipher used by the Shadowsocks proxy.
+// `server` is the configuration of the Shadowsocks proxy.
 // `isUDPEnabled` indicates if the Shadowsocks proxy and the network support proxying UDP traffic.
 // `tunWriter` is used to output packets back to the TUN device.
-func NewOutlineTunnel(host string, port int, password, cipher string, isUDPEnabled bool, tunWriter io.WriteCloser) (OutlineTunnel, error) {
+// `dialer` and `config` are used for sockets that bypass the proxy, which must not be routed
+// through the TUN device.  If they are nil, bypass rules cannot connect directly.
+func NewOutlineTunnel(server oss.Server, isUDPEnabled bool, tunWriter io.WriteCloser, dialer *net.Dialer, config *net.ListenConfig) (OutlineTunnel, error) {
 	if tunWriter == nil {
 		return nil, errors.New("Must provide a TUN writer")
 	}
-	_, err := shadowsocks.NewClient(host, port, password, cipher)
+	pool, err := oss.NewPool([]oss.Server{server}, oss.PolicyFailover)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid Shadowsocks proxy parameters: %v", err.Error())
 	}
 	core.RegisterOutputFn(func(data []byte) (int, error) {
 		return tunWriter.Write(data)
 	})
-	base := &tunnel{tunWriter, core.NewLWIPStack(), true}
-	t := &outlinetunnel{base, host, port, password, cipher, isUDPEnabled}
+	base := &tunnel{tunWriter, core.NewLWIPStack(), true, conntrack.NewTable()}
+	router := oss.NewRouter()
+	t := &outlinetunnel{tunnel: base, pool: pool, isUDPEnabled: isUDPEnabled, udpNAT: oss.NATFullCone, router: router, dns: oss.NewDNSForwarder(router), dialer: dialer, config: config}
 	t.registerConnectionHandlers()
+	pool.StartHealthChecks(healthCheckInterval)
 	return t, nil
 }
 
 func (t *outlinetunnel) UpdateUDPSupport() bool {
-	client, err := shadowsocks.NewClient(t.host, t.port, t.password, t.cipher)
-	if err != nil {
+	resolver := shadowsocks.NewAddr(t.pool.CheckTargets().Resolver, "udp")
+	isUDPEnabled := oss.CheckUDPConnectivityWithDNS(t.pool, resolver) == nil
+	t.setUDPSupport(isUDPEnabled)
+	return isUDPEnabled
+}
+
+// Sets whether the tunnel proxies UDP, and switches the handlers accordingly.
+// Returns whether the UDP support changed.
+func (t *outlinetunnel) setUDPSupport(isUDPEnabled bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.setUDPSupportLocked(isUDPEnabled)
+}
+
+// Like setUDPSupport, but callers must hold t.mu.  Does nothing once the tunnel
+// is disconnected, because the handlers are global and may belong to a newer
+// tunnel.
+func (t *outlinetunnel) setUDPSupportLocked(isUDPEnabled bool) bool {
+	if !t.isConnected || t.isUDPEnabled == isUDPEnabled {
 		return false
 	}
-	isUDPEnabled := oss.CheckUDPConnectivityWithDNS(client, shadowsocks.NewAddr("1.1.1.1:53", "udp")) == nil
-	if t.isUDPEnabled != isUDPEnabled {
-		t.isUDPEnabled = isUDPEnabled
+	t.isUDPEnabled = isUDPEnabled
+	t.lwipStack.Close() // Close existing connections to avoid using the previous handlers.
+	t.registerConnectionHandlers()
+	return true
+}
+
+func (t *outlinetunnel) udpSupport() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isUDPEnabled
+}
+
+func (t *outlinetunnel) SetUDPOverTCP(enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.udpOverTCP == enabled {
+		return
+	}
+	t.udpOverTCP = enabled
+	if !t.isUDPEnabled {
 		t.lwipStack.Close() // Close existing connections to avoid using the previous handlers.
 		t.registerConnectionHandlers()
 	}
-	return isUDPEnabled
 }
 
-// Registers UDP and TCP Shadowsocks connection handlers to the tunnel's host and port.
-// Registers a DNS/TCP fallback UDP handler when UDP is disabled.
+func (t *outlinetunnel) SetUDPNATMode(mode string) error {
+	if mode != oss.NATFullCone && mode != oss.NATSymmetric {
+		return fmt.Errorf("Invalid UDP NAT mode: %s", mode)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.udpNAT == mode {
+		return nil
+	}
+	t.udpNAT = mode
+	if t.udp != nil {
+		t.lwipStack.Close() // Close existing connections to avoid using the previous handlers.
+		t.registerConnectionHandlers()
+	}
+	return nil
+}
+
+func (t *outlinetunnel) SetDNSUpstream(dnsAddrs, upstream string) error {
+	if upstream == "" {
+		return t.dns.SetUpstream(nil, nil)
+	}
+	transport, err := oss.NewDNSUpstream(t.pool, upstream)
+	if err != nil {
+		return err
+	}
+	var addrs []string
+	for _, addr := range strings.Split(dnsAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return errors.New("Must provide the DNS addresses to intercept")
+	}
+	return t.dns.SetUpstream(addrs, transport)
+}
+
+func (t *outlinetunnel) SetCheckTargets(url, resolver string) error {
+	targets := oss.DefaultCheckTargets()
+	targets.URL, targets.Resolver = url, resolver
+	return t.pool.SetCheckTargets(targets)
+}
+
+func (t *outlinetunnel) SetBypassRules(config string) error {
+	var rules []oss.Rule
+	if config != "" {
+		var err error
+		if rules, err = oss.ParseRules(config); err != nil {
+			return err
+		}
+	}
+	if t.dialer == nil || t.config == nil {
+		for i, rule := range rules {
+			if rule.Action == oss.ActionDirect {
+				return fmt.Errorf("Rule %d: Direct connections are not supported by this tunnel", i)
+			}
+		}
+	}
+	return t.router.SetRules(rules)
+}
+
+func (t *outlinetunnel) SetServers(config, policy string) error {
+	servers, err := oss.ParseServers(config)
+	if err != nil {
+		return err
+	}
+	if err := t.pool.Update(servers, policy); err != nil {
+		return err
+	}
+	if len(servers) > 1 {
+		go t.pool.CheckHealth()
+	}
+	return nil
+}
+
+func (t *outlinetunnel) UpdateProxy(host string, port int, password, cipher string, drain bool) error {
+	if port <= 0 || port > math.MaxUint16 {
+		return fmt.Errorf("Invalid port number: %v", port)
+	}
+	server := oss.Server{Host: host, Port: port, Password: password, Cipher: cipher}
+	if err := t.pool.Update([]oss.Server{server}, t.pool.Policy()); err != nil {
+		return fmt.Errorf("Invalid Shadowsocks proxy parameters: %v", err)
+	}
+	if !drain {
+		// Closes the flows through the previous servers, including flows that were
+		// being opened during the update.
+		t.pool.CloseRemoved()
+	}
+	return nil
+}
+
+func (t *outlinetunnel) GetServerStatus() (string, error) {
+	b, err := json.Marshal(t.pool.Status())
+	return string(b), err
+}
+
+func (t *outlinetunnel) StartHealthMonitor(intervalSecs, threshold int, listener HealthListener) error {
+	if intervalSecs <= 0 {
+		return fmt.Errorf("Invalid health monitor interval: %v", intervalSecs)
+	}
+	if threshold <= 0 {
+		return fmt.Errorf("Invalid health monitor threshold: %v", threshold)
+	}
+	if listener == nil {
+		return errors.New("Must provide a health listener")
+	}
+	m := newHealthMonitor(t, threshold, listener)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.monitor != nil {
+		close(t.monitor.stop)
+	}
+	t.monitor = m
+	go m.run(time.Duration(intervalSecs) * time.Second)
+	return nil
+}
+
+func (t *outlinetunnel) StopHealthMonitor() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.monitor != nil {
+		close(t.monitor.stop)
+		t.monitor = nil
+	}
+}
+
+func (t *outlinetunnel) GetUDPStats() (string, error) {
+	var stats oss.NATStats
+	t.mu.Lock()
+	udp := t.udp
+	t.mu.Unlock()
+	if udp != nil {
+		stats = udp.Stats()
+	}
+	b, err := json.Marshal(stats)
+	return string(b), err
+}
+
+func (t *outlinetunnel) Disconnect() {
+	t.StopHealthMonitor()
+	t.pool.Stop()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tunnel.Disconnect()
+}
+
+// Registers UDP and TCP Shadowsocks connection handlers to the tunnel's server pool.
+// When UDP is disabled, registers a UDP/TCP handler if enabled, or else a DNS/TCP
+// fallback UDP handler.  The handlers are wrapped in dispatchers that apply the
+// bypass rules, after the DNS forwarder intercepts queries to the TUN resolvers.
+// Callers must hold t.mu once the tunnel is running.
 func (t *outlinetunnel) registerConnectionHandlers() {
+	natConfig := oss.DefaultNATConfig(udpTimeout)
+	natConfig.Mode = t.udpNAT
 	var udpHandler core.UDPConnHandler
-	if t.isUDPEnabled {
-		udpHandler = oss.NewUDPHandler(t.host, t.port, t.password, t.cipher, 30*time.Second)
-	} else {
+	switch {
+	case t.isUDPEnabled:
+		t.udp = oss.NewClientUDPHandler(t.pool, natConfig, t.flows)
+		udpHandler = t.udp
+	case t.udpOverTCP:
+		t.udp = oss.NewClientUDPHandler(oss.NewUDPOverTCPClient(t.pool), natConfig, t.flows)
+		udpHandler = t.udp
+	default:
+		t.udp = nil
 		udpHandler = dnsfallback.NewUDPHandler()
 	}
-	core.RegisterTCPConnHandler(oss.NewTCPHandler(t.host, t.port, t.password, t.cipher))
-	core.RegisterUDPConnHandler(udpHandler)
+	tcpHandler := oss.NewClientTCPHandler(t.pool, t.flows)
+	core.RegisterTCPConnHandler(t.dns.TCPHandler(oss.NewTCPDispatcher(tcpHandler, t.router, t.dialer, t.flows)))
+	core.RegisterUDPConnHandler(t.dns.UDPHandler(oss.NewUDPDispatcher(udpHandler, t.router, t.config, udpTimeout, t.flows)))
 }
@@ -0,0 +1,377 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/testconn"
+	oss "github.com/Jigsaw-Code/outline-go-tun2socks/shadowsocks"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+const testCipher = "chacha20-ietf-poly1305"
+
+// fakeProxy is an in-process Shadowsocks TCP server.  It replies to each
+// connection with its name, and then echoes the client's data.  It relays the
+// packets of UDP-over-TCP streams.
+type fakeProxy struct {
+	listener net.Listener
+	name     string
+	password string
+}
+
+func startFakeProxy(t *testing.T, name, password string) *fakeProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := sscore.PickCipher(testCipher, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{listener, name, password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn, cipher.(shadowaead.Cipher))
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) handle(conn net.Conn, cipher shadowaead.Cipher) {
+	defer conn.Close()
+	r := shadowsocks.NewShadowsocksReader(conn, cipher)
+	w := shadowsocks.NewShadowsocksWriter(conn, cipher)
+	target, err := socks.ReadAddr(r)
+	if err != nil {
+		return
+	}
+	if target.String() == "sp.udp-over-tcp.arpa:0" {
+		relayUDP(r, w)
+		return
+	}
+	if _, err := w.Write([]byte(p.name)); err != nil {
+		return
+	}
+	io.Copy(w, r)
+}
+
+func (p *fakeProxy) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Relays packets from a UDP-over-TCP stream, framed as
+// [family][address][2-byte port][2-byte length][payload], to IPv4 addresses.
+func relayUDP(r io.Reader, w io.Writer) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpAddr := addr.(*net.UDPAddr)
+			frame := append([]byte{0}, udpAddr.IP.To4()...) // IPv4 family
+			frame = append(frame, byte(udpAddr.Port>>8), byte(udpAddr.Port), byte(n>>8), byte(n))
+			if _, err := w.Write(append(frame, buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		var header [1 + net.IPv4len + 2 + 2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 0 {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[7:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		ip := net.IP(header[1:5])
+		conn.WriteTo(payload, &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(header[5:7]))})
+	}
+}
+
+// Opens a flow through `h`, and returns the app's end after checking that the
+// flow goes through the proxy named `name`.
+func openFlow(t *testing.T, h core.TCPConnHandler, name string) net.Conn {
+	app, tun := net.Pipe()
+	if err := h.Handle(&testconn.TCPConn{Conn: tun}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, app, name, "hello")
+	return app
+}
+
+// Writes `data` to `app` and checks that the reply is `prefix` + `data`.
+func checkEcho(t *testing.T, app net.Conn, prefix, data string) {
+	if _, err := app.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(prefix)+len(data))
+	if _, err := io.ReadFull(app, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != prefix+data {
+		t.Errorf("Expected %q, got %q", prefix+data, buf)
+	}
+}
+
+func makeOutlineTunnel(t *testing.T, proxy *fakeProxy) (*outlinetunnel, core.TCPConnHandler) {
+	pool, err := oss.NewPool([]oss.Server{{Host: "127.0.0.1", Port: proxy.port(), Password: proxy.password, Cipher: testCipher}}, oss.PolicyFailover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flows := conntrack.NewTable()
+	router := oss.NewRouter()
+	tun := &outlinetunnel{tunnel: &tunnel{flows: flows}, pool: pool, udpNAT: oss.NATFullCone, router: router, dns: oss.NewDNSForwarder(router)}
+	return tun, oss.NewClientTCPHandler(pool, flows)
+}
+
+func TestUpdateProxyDrain(t *testing.T) {
+	a := startFakeProxy(t, "a", "secret-a")
+	defer a.listener.Close()
+	b := startFakeProxy(t, "b", "secret-b")
+	defer b.listener.Close()
+	tun, h := makeOutlineTunnel(t, a)
+
+	oldFlow := openFlow(t, h, "a")
+	defer oldFlow.Close()
+	if err := tun.UpdateProxy("127.0.0.1", b.port(), b.password, testCipher, true); err != nil {
+		t.Fatal(err)
+	}
+	newFlow := openFlow(t, h, "b")
+	defer newFlow.Close()
+	// The existing flow still works through the previous proxy.
+	checkEcho(t, oldFlow, "", "more")
+	if n := len(tun.flows.List()); n != 2 {
+		t.Errorf("Expected 2 flows, got %d", n)
+	}
+}
+
+func TestUpdateProxyClose(t *testing.T) {
+	a := startFakeProxy(t, "a", "secret-a")
+	defer a.listener.Close()
+	b := startFakeProxy(t, "b", "secret-b")
+	defer b.listener.Close()
+	tun, h := makeOutlineTunnel(t, a)
+
+	oldFlow := openFlow(t, h, "a")
+	defer oldFlow.Close()
+	direct := tun.flows.Add(&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 80}, func() {
+		t.Error("Direct flow was closed")
+	})
+	direct.SetDirect()
+
+	if err := tun.UpdateProxy("127.0.0.1", b.port(), b.password, testCipher, false); err != nil {
+		t.Fatal(err)
+	}
+	oldFlow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := oldFlow.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the old flow to be closed, got %v", err)
+	}
+	newFlow := openFlow(t, h, "b")
+	defer newFlow.Close()
+	conns := tun.flows.List()
+	if len(conns) != 2 || conns[0].ID != direct.ID() {
+		t.Errorf("Wrong flows after update: %v", conns)
+	}
+}
+
+func TestUpdateProxyInvalid(t *testing.T) {
+	a := startFakeProxy(t, "a", "secret-a")
+	defer a.listener.Close()
+	tun, h := makeOutlineTunnel(t, a)
+	if err := tun.UpdateProxy("127.0.0.1", 0, "secret", testCipher, false); err == nil {
+		t.Error("Expected error for invalid port")
+	}
+	if err := tun.UpdateProxy("127.0.0.1", a.port(), "secret", "rot13", false); err == nil {
+		t.Error("Expected error for invalid cipher")
+	}
+	// The tunnel still uses the original proxy.
+	flow := openFlow(t, h, "a")
+	flow.Close()
+}
+
+// Starts a UDP server that echoes each packet.
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	echo := startUDPEcho(t)
+	tun, _ := makeOutlineTunnel(t, proxy)
+	tun.udpOverTCP = true
+	tun.registerConnectionHandlers()
+	if tun.udp == nil {
+		t.Fatal("UDP-over-TCP handler was not registered")
+	}
+
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.0.85.2"), Port: 5000}, Packets: make(chan []byte, 1)}
+	if err := tun.udp.Connect(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	defer tun.udp.Close(conn)
+	for _, packet := range []string{"ping", "pong"} {
+		if err := tun.udp.ReceiveTo(conn, []byte(packet), echo); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case reply := <-conn.Packets:
+			if string(reply) != packet {
+				t.Errorf("Expected %q, got %q", packet, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No reply to %q", packet)
+		}
+	}
+	statsJSON, err := tun.GetUDPStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats oss.NATStats
+	if err := json.Unmarshal([]byte(statsJSON), &stats); err != nil || stats.Active != 1 {
+		t.Errorf("Unexpected stats %s, %v", statsJSON, err)
+	}
+
+	tun.udpOverTCP = false
+	tun.registerConnectionHandlers()
+	if tun.udp != nil {
+		t.Error("Expected the DNS fallback handler")
+	}
+}
+
+func TestSetDNSUpstream(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	tun, _ := makeOutlineTunnel(t, proxy)
+	if err := tun.SetDNSUpstream("10.0.85.1, 10.0.85.2:5353", "https://dns.example/dns-query"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.SetDNSUpstream("", "tcp://1.1.1.1"); err == nil {
+		t.Error("Expected error without DNS addresses")
+	}
+	if err := tun.SetDNSUpstream("10.0.85.1", "tls://1.1.1.1"); err == nil {
+		t.Error("Expected error for an unsupported upstream")
+	}
+	if err := tun.SetDNSUpstream("", ""); err != nil {
+		t.Errorf("Failed to stop the interception: %v", err)
+	}
+}
+
+func TestSetCheckTargets(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	tun, _ := makeOutlineTunnel(t, proxy)
+	if err := tun.SetCheckTargets("http://192.0.2.1/generate_204", "9.9.9.9:53"); err != nil {
+		t.Fatal(err)
+	}
+	if targets := tun.pool.CheckTargets(); targets.URL != "http://192.0.2.1/generate_204" || targets.Resolver != "9.9.9.9:53" {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+	if err := tun.SetCheckTargets("ftp://example.com", "9.9.9.9:53"); err == nil {
+		t.Error("Expected error for a non-HTTP URL")
+	}
+}
+
+func TestSetBypassRulesWithoutDialer(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	tun, _ := makeOutlineTunnel(t, proxy)
+	if err := tun.SetBypassRules(`[{"cidrs": ["10.0.0.0/8"], "action": "direct"}]`); err == nil {
+		t.Error("Expected error for a direct rule without a dialer")
+	}
+	if err := tun.SetBypassRules(`[{"domains": ["example.com"], "action": "block"}]`); err != nil {
+		t.Error(err)
+	}
+	tun.dialer, tun.config = &net.Dialer{}, &net.ListenConfig{}
+	if err := tun.SetBypassRules(`[{"cidrs": ["10.0.0.0/8"], "action": "direct"}]`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetUDPNATMode(t *testing.T) {
+	proxy := startFakeProxy(t, "a", "secret-a")
+	defer proxy.listener.Close()
+	tun, _ := makeOutlineTunnel(t, proxy)
+	stack := &fakeLWIPStack{}
+	tun.lwipStack = stack
+	tun.isUDPEnabled = true
+	tun.registerConnectionHandlers()
+
+	if err := tun.SetUDPNATMode("restricted"); err == nil {
+		t.Error("Expected error for an invalid mode")
+	}
+	if err := tun.SetUDPNATMode(oss.NATSymmetric); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.SetUDPNATMode(oss.NATSymmetric); err != nil {
+		t.Fatal(err)
+	}
+	if stack.closed != 1 {
+		t.Errorf("Expected 1 close of the stack, got %d", stack.closed)
+	}
+
+	// Each destination gets its own association.
+	conn := &testconn.UDPConn{Local: &net.UDPAddr{IP: net.ParseIP("10.0.85.2"), Port: 5000}}
+	defer tun.udp.Close(conn)
+	for _, port := range []int{9, 10} {
+		if err := tun.udp.ReceiveTo(conn, []byte("ping"), &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := tun.udp.Stats(); stats.Active != 2 {
+		t.Errorf("Expected 2 associations, got %+v", stats)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Apps and operating systems often cache DNS answers for longer than their
+	// TTL, so names are retained for at least this long.
+	minNameTTL = time.Minute
+	// Maximum number of addresses in a NameTable.
+	maxNames = 4096
+)
+
+type nameEntry struct {
+	name   string
+	expiry time.Time
+}
+
+// NameTable maps IP addresses to the domain names that resolved to them, as
+// observed in DNS responses that pass through the tunnel.  Each mapping
+// expires with the TTL of its DNS record.  A nil *NameTable is valid, and
+// records nothing.
+type NameTable struct {
+	mu      sync.Mutex
+	entries map[string]nameEntry // Keyed by IP address.
+	now     func() time.Time
+}
+
+// NewNameTable returns an empty NameTable.
+func NewNameTable() *NameTable {
+	return &NameTable{entries: make(map[string]nameEntry), now: time.Now}
+}
+
+// Record adds the A and AAAA answers in a DNS `response` to the table.  All
+// answers are attributed to the name in the question, so the original name is
+// used even if it is an alias (CNAME) for another name.
+func (t *NameTable) Record(response []byte) {
+	if t == nil {
+		return
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(response); err != nil {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	now := t.now()
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		var ip net.IP
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		if ttl < minNameTTL {
+			ttl = minNameTTL
+		}
+		t.add(ip, nameEntry{name, now.Add(ttl)}, now)
+	}
+}
+
+func (t *NameTable) add(ip net.IP, entry nameEntry, now time.Time) {
+	key := ip.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[key]; !ok && len(t.entries) >= maxNames {
+		t.evict(now)
+	}
+	t.entries[key] = entry
+}
+
+// Removes expired entries, or an arbitrary entry if none have expired.  Must
+// be called under the lock.
+func (t *NameTable) evict(now time.Time) {
+	for key, entry := range t.entries {
+		if now.After(entry.expiry) {
+			delete(t.entries, key)
+		}
+	}
+	if len(t.entries) < maxNames {
+		return
+	}
+	for key := range t.entries {
+		delete(t.entries, key)
+		return
+	}
+}
+
+// Lookup returns the most recent name that resolved to `ip`, or "" if the
+// address has not been seen, or its DNS record has expired.
+func (t *NameTable) Lookup(ip net.IP) string {
+	if t == nil || ip == nil {
+		return ""
+	}
+	key := ip.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok {
+		return ""
+	}
+	if t.now().After(entry.expiry) {
+		delete(t.entries, key)
+		return ""
+	}
+	return entry.name
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/dnstest"
+)
+
+// Returns a NameTable whose clock can be advanced by the test.
+func makeNameTable() (*NameTable, *time.Time) {
+	now := time.Now()
+	names := NewNameTable()
+	names.now = func() time.Time { return now }
+	return names, &now
+}
+
+func TestNameRecord(t *testing.T) {
+	names, _ := makeNameTable()
+	names.Record(dnstest.Response("WWW.Example.com.",
+		dnstest.CNAME("www.example.com.", 300, "cdn.example.net."),
+		dnstest.A("cdn.example.net.", 300, "93.184.216.34"),
+		dnstest.AAAA("cdn.example.net.", 300, "2606:2800:220:1::248")))
+	if name := names.Lookup(net.ParseIP("93.184.216.34")); name != "www.example.com" {
+		t.Errorf("Wrong name for IPv4 address: %s", name)
+	}
+	if name := names.Lookup(net.ParseIP("2606:2800:220:1::248")); name != "www.example.com" {
+		t.Errorf("Wrong name for IPv6 address: %s", name)
+	}
+	if name := names.Lookup(net.ParseIP("10.0.0.1")); name != "" {
+		t.Errorf("Unexpected name for unknown address: %s", name)
+	}
+}
+
+func TestNameExpiry(t *testing.T) {
+	names, now := makeNameTable()
+	names.Record(dnstest.Response("short.test.", dnstest.A("short.test.", 1, "10.0.0.1")))
+	names.Record(dnstest.Response("long.test.", dnstest.A("long.test.", 3600, "10.0.0.2")))
+
+	// Short TTLs are extended to the minimum.
+	*now = now.Add(minNameTTL / 2)
+	if name := names.Lookup(net.ParseIP("10.0.0.1")); name != "short.test" {
+		t.Errorf("Name expired before the minimum TTL: %s", name)
+	}
+	*now = now.Add(minNameTTL)
+	if name := names.Lookup(net.ParseIP("10.0.0.1")); name != "" {
+		t.Errorf("Name did not expire: %s", name)
+	}
+	if name := names.Lookup(net.ParseIP("10.0.0.2")); name != "long.test" {
+		t.Errorf("Name expired early: %s", name)
+	}
+	*now = now.Add(time.Hour)
+	if name := names.Lookup(net.ParseIP("10.0.0.2")); name != "" {
+		t.Errorf("Name did not expire: %s", name)
+	}
+}
+
+func TestNameLimit(t *testing.T) {
+	names, now := makeNameTable()
+	names.Record(dnstest.Response("old.test.", dnstest.A("old.test.", 0, "10.0.0.1")))
+	*now = now.Add(2 * minNameTTL)
+	for i := 0; i < maxNames; i++ {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i))
+		names.add(ip, nameEntry{"new.test", now.Add(time.Hour)}, *now)
+	}
+	if len(names.entries) != maxNames {
+		t.Errorf("Expected %d entries, got %d", maxNames, len(names.entries))
+	}
+	if _, ok := names.entries["10.0.0.1"]; ok {
+		t.Error("Expired entry was not evicted")
+	}
+	names.Record(dnstest.Response("extra.test.", dnstest.A("extra.test.", 300, "10.0.0.3")))
+	if len(names.entries) != maxNames {
+		t.Errorf("Table grew beyond the limit: %d", len(names.entries))
+	}
+	if name := names.Lookup(net.ParseIP("10.0.0.3")); name != "extra.test" {
+		t.Errorf("Newest entry is missing: %s", name)
+	}
+}
+
+func TestNameInvalid(t *testing.T) {
+	names, _ := makeNameTable()
+	names.Record([]byte{1, 2, 3})
+	names.Record(nil)
+	if len(names.entries) != 0 {
+		t.Error("Invalid response was recorded")
+	}
+	var nilTable *NameTable
+	nilTable.Record(dnstest.Response("a.test.", dnstest.A("a.test.", 300, "10.0.0.1")))
+	if name := nilTable.Lookup(net.ParseIP("10.0.0.1")); name != "" {
+		t.Errorf("Nil table returned %s", name)
+	}
+}
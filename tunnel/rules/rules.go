@@ -0,0 +1,245 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules matches sockets against ordered lists of routing rules, and
+// names their destinations from the DNS responses that pass through a tunnel.
+// Each tunnel defines its own rule actions.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule is a routing rule.  A socket matches the rule if it satisfies every
+// condition that the rule specifies, and matches a condition if it matches any
+// of the condition's values.  Empty conditions match everything.
+type Rule struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol,omitempty"`
+	// CIDRs are destination networks, such as "10.0.0.0/8" or "2001:db8::/32".
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Ports are destination ports, such as "443", or inclusive ranges, such as "8000-8999".
+	Ports []string `json:"ports,omitempty"`
+	// Domains are matched against the name that resolved to the destination
+	// address, from DNS responses that passed through the tunnel.  A domain also
+	// matches its subdomains.
+	Domains []string `json:"domains,omitempty"`
+	// SNIs are matched against the server name in a TLS ClientHello or QUIC
+	// Initial packet, like Domains.  Matching an SNI requires waiting for the
+	// client's first data before connecting to the destination.
+	SNIs []string `json:"snis,omitempty"`
+	// Action is one of the actions of the tunnel that applies the rule.
+	Action string `json:"action"`
+}
+
+type portRange struct {
+	min, max int
+}
+
+type compiledRule struct {
+	protocol string
+	nets     []*net.IPNet
+	ports    []portRange
+	domains  []string
+	snis     []string
+	action   string
+}
+
+// Rules is an ordered list of compiled rules.  The first matching rule
+// applies.  A nil *Rules has no rules.
+type Rules struct {
+	rules []compiledRule
+}
+
+// Parse parses a JSON array of Rule objects.
+func Parse(config string) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(config), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Compile validates and compiles `rules`, whose actions must be in `actions`.
+func Compile(rules []Rule, actions ...string) (*Rules, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		c, err := compileRule(rule, actions)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return &Rules{compiled}, nil
+}
+
+func compileRule(rule Rule, actions []string) (compiledRule, error) {
+	c := compiledRule{protocol: rule.Protocol, action: rule.Action}
+	switch rule.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return c, fmt.Errorf("Unknown protocol: %s", rule.Protocol)
+	}
+	known := false
+	for _, action := range actions {
+		if rule.Action == action {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return c, fmt.Errorf("Unknown action: %s", rule.Action)
+	}
+	for _, cidr := range rule.CIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return c, err
+		}
+		c.nets = append(c.nets, n)
+	}
+	for _, ports := range rule.Ports {
+		r, err := parsePortRange(ports)
+		if err != nil {
+			return c, err
+		}
+		c.ports = append(c.ports, r)
+	}
+	c.domains = normalizeNames(rule.Domains)
+	c.snis = normalizeNames(rule.SNIs)
+	return c, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	var r portRange
+	min, max := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		min, max = s[:i], s[i+1:]
+	}
+	var err1, err2 error
+	r.min, err1 = strconv.Atoi(strings.TrimSpace(min))
+	r.max, err2 = strconv.Atoi(strings.TrimSpace(max))
+	if err1 != nil || err2 != nil || r.min < 0 || r.max > 65535 || r.min > r.max {
+		return r, fmt.Errorf("Bad port range: %s", s)
+	}
+	return r, nil
+}
+
+// Returns `name` in lower case, without leading or trailing dots.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+func normalizeNames(names []string) []string {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		normalized = append(normalized, normalizeName(name))
+	}
+	return normalized
+}
+
+// Returns true if `name` is one of `domains`, or a subdomain of one of them.
+func matchName(domains []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn describes a socket for rule matching.
+type Conn struct {
+	Protocol string // "tcp" or "udp"
+	IP       net.IP
+	Port     int
+	Domain   string // The name that resolved to IP, or empty if unknown.
+	SNI      string // The server name in the client's first data, if known.
+}
+
+// Returns true if `c` matches every condition except the SNI.
+func (r *compiledRule) matchAddress(c *Conn) bool {
+	if r.protocol != "" && r.protocol != c.Protocol {
+		return false
+	}
+	if len(r.nets) > 0 {
+		found := false
+		for _, n := range r.nets {
+			if n.Contains(c.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		found := false
+		for _, p := range r.ports {
+			if c.Port >= p.min && c.Port <= p.max {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(r.domains) == 0 || matchName(r.domains, c.Domain)
+}
+
+// Match returns the action of the first rule that matches `c`, or "" if no
+// rule matches.  If `sniKnown` is false and the result depends on the SNI, it
+// returns needSNI = true instead.  c.Domain and c.SNI are normalized like the
+// rules' names, so they may have any case and a trailing dot.
+func (rs *Rules) Match(c *Conn, sniKnown bool) (action string, needSNI bool) {
+	if rs == nil {
+		return "", false
+	}
+	normalized := *c
+	normalized.Domain = normalizeName(c.Domain)
+	normalized.SNI = normalizeName(c.SNI)
+	c = &normalized
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.matchAddress(c) {
+			continue
+		}
+		if len(r.snis) > 0 {
+			if !sniKnown {
+				return "", true
+			}
+			if !matchName(r.snis, c.SNI) {
+				continue
+			}
+		}
+		return r.action, false
+	}
+	return "", false
+}
+
+// Len returns the number of rules.
+func (rs *Rules) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	list, err := Parse(`[
+		{"cidrs": ["10.0.0.0/8"], "ports": ["22", " 8000 - 8999 "], "action": "a"},
+		{"domains": ["Example.COM."], "snis": ["Split.Test."], "action": "b"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := Compile(list, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 2 {
+		t.Fatalf("Wrong number of rules: %d", rs.Len())
+	}
+	if r := rs.rules[0].ports; len(r) != 2 || r[1] != (portRange{8000, 8999}) {
+		t.Errorf("Wrong ports: %v", r)
+	}
+	if r := rs.rules[1]; r.domains[0] != "example.com" || r.snis[0] != "split.test" {
+		t.Errorf("Names were not normalized: %v, %v", r.domains, r.snis)
+	}
+
+	for _, bad := range []Rule{
+		{Action: "c"},
+		{Protocol: "icmp", Action: "a"},
+		{CIDRs: []string{"10.0.0.1"}, Action: "a"},
+		{Ports: []string{"100-10"}, Action: "a"},
+		{Ports: []string{"70000"}, Action: "a"},
+		{Ports: []string{"http"}, Action: "a"},
+	} {
+		if _, err := Compile([]Rule{bad}, "a", "b"); err == nil {
+			t.Errorf("Expected error for %+v", bad)
+		}
+	}
+	if _, err := Parse(`{"action": "a"}`); err == nil {
+		t.Error("Expected error for a non-array")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rs, err := Compile([]Rule{
+		{Domains: []string{"blocked.test"}, Action: "block"},
+		{Protocol: "udp", CIDRs: []string{"192.0.2.0/24"}, SNIs: []string{"quic.test"}, Action: "sni"},
+		{CIDRs: []string{"192.0.2.0/24", "2001:db8::/32"}, Ports: []string{"8000-8999"}, Action: "direct"},
+	}, "block", "sni", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		conn    Conn
+		action  string
+		needSNI bool
+	}{
+		{Conn{Protocol: "tcp", IP: net.ParseIP("198.51.100.1"), Port: 443, Domain: "www.blocked.test"}, "block", false},
+		{Conn{Protocol: "tcp", IP: net.ParseIP("198.51.100.1"), Port: 443, Domain: "WWW.Blocked.Test."}, "block", false},
+		{Conn{Protocol: "tcp", IP: net.ParseIP("198.51.100.1"), Port: 443, Domain: "notblocked.test"}, "", false},
+		{Conn{Protocol: "tcp", IP: net.ParseIP("2001:db8::1"), Port: 8080}, "direct", false},
+		{Conn{Protocol: "tcp", IP: net.ParseIP("2001:db8::1"), Port: 9000}, "", false},
+		{Conn{Protocol: "udp", IP: net.ParseIP("192.0.2.1"), Port: 8080}, "", true},
+	}
+	for _, c := range cases {
+		if action, needSNI := rs.Match(&c.conn, false); action != c.action || needSNI != c.needSNI {
+			t.Errorf("%+v: got (%q, %v), expected (%q, %v)", c.conn, action, needSNI, c.action, c.needSNI)
+		}
+	}
+
+	conn := cases[5].conn
+	for _, sni := range []string{"quic.test", "QUIC.test."} {
+		conn.SNI = sni
+		if action, _ := rs.Match(&conn, true); action != "sni" {
+			t.Errorf("%s: expected the SNI rule, got %q", sni, action)
+		}
+	}
+	if conn.SNI != "QUIC.test." {
+		t.Errorf("Match modified the SNI: %s", conn.SNI)
+	}
+	conn.SNI = ""
+	if action, _ := rs.Match(&conn, true); action != "direct" {
+		t.Errorf("Expected the next rule without an SNI, got %q", action)
+	}
+
+	var none *Rules
+	if action, needSNI := none.Match(&conn, false); action != "" || needSNI || none.Len() != 0 {
+		t.Errorf("Nil rules matched: %q %v", action, needSNI)
+	}
+}
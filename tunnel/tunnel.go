@@ -15,10 +15,14 @@
 package tunnel
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 
 	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/conntrack"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel/metrics"
 )
 
 // Tunnel represents a session on a TUN device.
@@ -29,12 +33,21 @@ type Tunnel interface {
 	Disconnect()
 	// Write writes input data to the TUN interface.
 	Write(data []byte) (int, error)
+	// ListConnections returns the tunnel's active TCP and UDP flows as a JSON
+	// array of conntrack.Connection objects, ordered by ID.
+	ListConnections() (string, error)
+	// CloseConnection closes the active flow with the specified ID.
+	CloseConnection(id int64) error
+	// GetMetrics returns a snapshot of the traffic metrics in the Prometheus text
+	// format.  The metrics are aggregated over all tunnels in the process.
+	GetMetrics() (string, error)
 }
 
 type tunnel struct {
 	tunWriter   io.WriteCloser
 	lwipStack   core.LWIPStack
 	isConnected bool
+	flows       *conntrack.Table
 }
 
 func (t *tunnel) IsConnected() bool {
@@ -55,3 +68,16 @@ func (t *tunnel) Write(data []byte) (int, error) {
 	}
 	return t.lwipStack.Write(data)
 }
+
+func (t *tunnel) ListConnections() (string, error) {
+	b, err := json.Marshal(t.flows.List())
+	return string(b), err
+}
+
+func (t *tunnel) CloseConnection(id int64) error {
+	return t.flows.Close(id)
+}
+
+func (t *tunnel) GetMetrics() (string, error) {
+	return metrics.Snapshot()
+}